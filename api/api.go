@@ -0,0 +1,426 @@
+/********************************************************************************************************************
+ * name: api
+ * description: REST/JSON API of the customer status, the warnings and suspensions of a day and the csv imports,
+ *              authorized by bearer tokens and described by openapi.json
+ ********************************************************************************************************************/
+package api
+
+import (
+	"crypto/subtle"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tobkle/fp/exporter"
+	"github.com/tobkle/fp/importer"
+	"github.com/tobkle/fp/rules"
+	"github.com/tobkle/fp/store"
+)
+
+// Prefix is the path all endpoints of the API start with
+const Prefix = "/api/v1/"
+
+// UploadNote follows the name of an uploaded file in the imports ledger, it was sent to the API and isn't kept
+const UploadNote = " (uploaded to the API)"
+
+// maxUpload is the size in bytes of the largest csv file an import accepts
+const maxUpload = 64 << 20
+
+//go:embed openapi.json
+var openAPI []byte
+
+// statusRank orders the states of the payments of a customer, the customer has the highest one
+var statusRank = map[string]int{
+	store.StateRecovered:  1,
+	store.StateWrittenOff: 2,
+	store.StateActive:     3,
+	store.StateWarned:     4,
+	store.StateSuspended:  5,
+}
+
+// Server answers the requests of the API with the data of a Store
+type Server struct {
+	Store store.Store
+	// Tokens are the bearer tokens accepted in the Authorization header
+	Tokens []string
+	// Importer returns the importer of an uploaded file, with the column mappings and limits of fp serve
+	Importer func(db store.Store) *importer.Importer
+	// Now is the current time, warnings and suspensions default to its date
+	Now func() time.Time
+	// imports run one at a time
+	imports sync.Mutex
+	mux     *http.ServeMux
+}
+
+// New returns a Server of s accepting tokens, the empty ones are ignored
+func New(s store.Store, tokens []string) *Server {
+	srv := &Server{Store: s, Now: time.Now, mux: http.NewServeMux()}
+	for _, token := range tokens {
+		if token = strings.TrimSpace(token); token != "" {
+			srv.Tokens = append(srv.Tokens, token)
+		}
+	}
+	srv.Importer = func(db store.Store) *importer.Importer {
+		return importer.New(db, nil)
+	}
+	srv.mux.HandleFunc(Prefix+"openapi.json", srv.openAPI)
+	srv.mux.HandleFunc(Prefix+"customers/", srv.authorized(srv.statusOf(store.KeyCustomerID, "customers/")))
+	srv.mux.HandleFunc(Prefix+"accounts/", srv.authorized(srv.statusOf(store.KeyAccountNumber, "accounts/")))
+	srv.mux.HandleFunc(Prefix+"zen-users/", srv.authorized(srv.statusOf(store.KeyZenUserID, "zen-users/")))
+	srv.mux.HandleFunc(Prefix+"warnings", srv.authorized(srv.exports(rules.StateBuckets.Warn)))
+	srv.mux.HandleFunc(Prefix+"suspensions", srv.authorized(srv.exports(rules.StateBuckets.Suspend)))
+	srv.mux.HandleFunc(Prefix+"imports/", srv.authorized(srv.importFile))
+	srv.mux.HandleFunc(Prefix, func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusNotFound, "no endpoint %s, see %sopenapi.json", r.URL.Path, Prefix)
+	})
+	return srv
+}
+
+// ServeHTTP answers the requests of the endpoints below Prefix
+func (srv *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	srv.mux.ServeHTTP(w, r)
+}
+
+// CustomerStatus is the answer of the status endpoints
+type CustomerStatus struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+	// Status is the highest state of the payments: suspended, warned, active, written-off or recovered
+	Status      string          `json:"status"`
+	Suspended   bool            `json:"suspended"`
+	Warned      bool            `json:"warned"`
+	CustomerIDs []string        `json:"customers_ids"`
+	Accounts    []string        `json:"account_numbers"`
+	Payments    []PaymentStatus `json:"payments"`
+}
+
+// PaymentStatus is a payment of a CustomerStatus
+type PaymentStatus struct {
+	PaymentID     string `json:"payments_id"`
+	CustomerID    string `json:"customers_id"`
+	Mandate       string `json:"mandate"`
+	AccountNumber string `json:"account_number"`
+	ZenUserID     string `json:"zen_user_id"`
+	FailureCount  int    `json:"failure_count"`
+	State         string `json:"state"`
+	StateSince    string `json:"state_since"`
+	PreviousState string `json:"previous_state"`
+	Bucket        string `json:"bucket"`
+	BucketDate    string `json:"bucket_date"`
+}
+
+// BucketDocuments are the payments and, on customer level, the customers put into a bucket on a date
+type BucketDocuments struct {
+	Bucket    string                      `json:"bucket"`
+	Payments  []exporter.PaymentDocument  `json:"payments"`
+	Customers []exporter.CustomerDocument `json:"customers"`
+}
+
+// ImportResult is the answer of an import
+type ImportResult struct {
+	Source      string      `json:"source"`
+	FileName    string      `json:"file_name"`
+	ImportID    int64       `json:"import_id"`
+	DuplicateOf int64       `json:"duplicate_of,omitempty"`
+	Inserted    int         `json:"inserted"`
+	Updated     int         `json:"updated"`
+	Skipped     int         `json:"skipped"`
+	Disappeared int         `json:"disappeared"`
+	Rejected    []Rejection `json:"rejected"`
+}
+
+// Rejection is a row of an import which could not be imported
+type Rejection struct {
+	Line   int    `json:"line"`
+	ID     string `json:"id"`
+	Reason string `json:"reason"`
+}
+
+// authorized calls next for requests with one of the tokens as bearer token
+func (srv *Server) authorized(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimSpace(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+		if srv.known(token) {
+			next(w, r)
+			return
+		}
+		w.Header().Set("WWW-Authenticate", `Bearer realm="fp"`)
+		writeError(w, http.StatusUnauthorized, "missing or unknown bearer token")
+	}
+}
+
+// Protect calls next for requests with one of the tokens as bearer token or as password of the basic
+// authentication a browser asks for, with any user name, e.g. for the dashboard served next to the API
+func (srv *Server) Protect(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimSpace(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+		if _, password, ok := r.BasicAuth(); ok {
+			token = password
+		}
+		if srv.known(token) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("WWW-Authenticate", `Basic realm="fp", charset="UTF-8"`)
+		http.Error(w, "enter one of the API tokens as password", http.StatusUnauthorized)
+	})
+}
+
+// known tells if token is one of the tokens
+func (srv *Server) known(token string) bool {
+	for _, t := range srv.Tokens {
+		if token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// openAPI answers the description of the API, without token
+func (srv *Server) openAPI(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, http.MethodGet) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPI)
+}
+
+// statusOf answers GET <Prefix><path><value>/status with the status of the customer of value
+func (srv *Server) statusOf(key string, path string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !allow(w, r, http.MethodGet) {
+			return
+		}
+		value := strings.TrimPrefix(r.URL.Path, Prefix+path)
+		if !strings.HasSuffix(value, "/status") || strings.TrimSuffix(value, "/status") == "" {
+			writeError(w, http.StatusNotFound, "no endpoint %s, use %s%s{%s}/status", r.URL.Path, Prefix, path, key)
+			return
+		}
+		value = strings.TrimSuffix(value, "/status")
+		payments, err := srv.Store.PaymentStatuses(key, value)
+		if err != nil {
+			srv.fail(w, err)
+			return
+		}
+		if len(payments) == 0 {
+			writeError(w, http.StatusNotFound, "no failed payments of %s %s", key, value)
+			return
+		}
+		writeJSON(w, http.StatusOK, customerStatus(key, value, payments))
+	}
+}
+
+// customerStatus sums up the payments of a customer
+func customerStatus(key string, value string, payments []store.PaymentStatus) CustomerStatus {
+	status := CustomerStatus{Key: key, Value: value, CustomerIDs: []string{}, Accounts: []string{}}
+	for _, p := range payments {
+		state := p.State
+		if state == "" {
+			// imported, but not evaluated yet
+			state = store.StateActive
+		}
+		if statusRank[state] > statusRank[status.Status] {
+			status.Status = state
+		}
+		status.CustomerIDs = appendNew(status.CustomerIDs, p.CustomerID)
+		status.Accounts = appendNew(status.Accounts, p.AccountNumber)
+		status.Payments = append(status.Payments, PaymentStatus{PaymentID: p.PaymentID, CustomerID: p.CustomerID,
+			Mandate: p.Mandate, AccountNumber: p.AccountNumber, ZenUserID: p.ZenUserID, FailureCount: p.FailureCount,
+			State: state, StateSince: p.StateSince, PreviousState: p.PreviousState, Bucket: p.Bucket,
+			BucketDate: p.BucketDate})
+	}
+	status.Suspended = status.Status == store.StateSuspended
+	status.Warned = status.Status == store.StateWarned
+	return status
+}
+
+// exports answers GET with the payments and customers put into one of buckets on ?date, today by default, as the
+// documents of the json export files
+func (srv *Server) exports(buckets []string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !allow(w, r, http.MethodGet) {
+			return
+		}
+		date := r.URL.Query().Get("date")
+		if date == "" {
+			date = srv.Now().Format(store.ISODate)
+		}
+		if _, err := time.Parse(store.ISODate, date); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid date %q, use YYYY-MM-DD", date)
+			return
+		}
+		lists := make([]BucketDocuments, 0, len(buckets))
+		for _, bucket := range buckets {
+			list := BucketDocuments{Bucket: bucket, Payments: []exporter.PaymentDocument{},
+				Customers: []exporter.CustomerDocument{}}
+			payments, err := srv.Store.ActionExports(bucket, date)
+			if err != nil {
+				srv.fail(w, err)
+				return
+			}
+			for _, row := range payments {
+				list.Payments = append(list.Payments, exporter.PaymentJSONDocument(row))
+			}
+			customers, err := srv.Store.CustomerActionExports(bucket, date)
+			if err != nil {
+				srv.fail(w, err)
+				return
+			}
+			for _, row := range customers {
+				list.Customers = append(list.Customers, exporter.CustomerJSONDocument(row))
+			}
+			lists = append(lists, list)
+		}
+		writeJSON(w, http.StatusOK, lists)
+	}
+}
+
+// importFile answers POST <Prefix>imports/{payments|accounts|crm}?as_of=YYYY-MM-DD with the result of importing
+// the csv file of the body, sent as is or as the part "file" of a multipart form
+func (srv *Server) importFile(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, http.MethodPost) {
+		return
+	}
+	source := strings.TrimPrefix(r.URL.Path, Prefix+"imports/")
+	if source != importer.SourcePayments && source != importer.SourceAccounts && source != importer.SourceCRM {
+		writeError(w, http.StatusNotFound, "cannot import %q, use %simports/payments, accounts or crm", source, Prefix)
+		return
+	}
+	asOf := r.URL.Query().Get("as_of")
+	if asOf == "" {
+		asOf = srv.Now().Format(store.ISODate)
+	}
+	if _, err := time.Parse(store.ISODate, asOf); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid as_of %q, use YYYY-MM-DD", asOf)
+		return
+	}
+
+	fileName, content, err := upload(w, r, source+"-"+asOf+".csv")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+	defer content.Close()
+	dir, err := os.MkdirTemp("", "fp-import-")
+	if err != nil {
+		srv.fail(w, err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, fileName)
+	if err = saveFile(path, content); err != nil {
+		writeError(w, http.StatusBadRequest, "reading the uploaded file failed: %s", err)
+		return
+	}
+
+	srv.imports.Lock()
+	defer srv.imports.Unlock()
+	imp := srv.Importer(srv.Store)
+	imp.SnapshotDate = asOf
+	imp.Name = fileName + UploadNote
+	var result importer.Result
+	switch source {
+	case importer.SourcePayments:
+		result, err = imp.ImportPayments(path)
+	case importer.SourceAccounts:
+		result, err = imp.ImportAccounts(path)
+	case importer.SourceCRM:
+		result, err = imp.ImportCRM(path)
+	}
+	answer := ImportResult{Source: source, FileName: fileName, ImportID: result.ImportID, DuplicateOf: result.DuplicateOf,
+		Inserted: result.Inserted, Updated: result.Updated, Skipped: result.Skipped, Disappeared: result.Disappeared,
+		Rejected: []Rejection{}}
+	for _, rejection := range imp.Rejected {
+		answer.Rejected = append(answer.Rejected, Rejection{Line: rejection.Line, ID: rejection.ID, Reason: rejection.Reason})
+	}
+	if err != nil {
+		log.Printf("ERROR: api: import of %s %s failed: %s", source, fileName, err)
+		writeJSON(w, http.StatusUnprocessableEntity, map[string]interface{}{
+			"error": fmt.Sprintf("import of %s failed, nothing was imported: %s", fileName, err), "result": answer})
+		return
+	}
+	writeJSON(w, http.StatusOK, answer)
+}
+
+// upload returns the name and content of the uploaded file, the part "file" of a multipart form or the body
+func upload(w http.ResponseWriter, r *http.Request, defaultName string) (string, io.ReadCloser, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxUpload)
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "multipart/form-data" {
+		return defaultName, r.Body, nil
+	}
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		return "", nil, fmt.Errorf("no csv file in the form field \"file\": %w", err)
+	}
+	name := filepath.Base(header.Filename)
+	if name == "." || name == string(filepath.Separator) {
+		name = defaultName
+	}
+	return name, file, nil
+}
+
+// saveFile writes content to path
+func saveFile(path string, content io.Reader) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(f, content); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// fail logs err and answers with status 500
+func (srv *Server) fail(w http.ResponseWriter, err error) {
+	log.Printf("ERROR: api: %s", err)
+	writeError(w, http.StatusInternalServerError, "reading the database failed, see the log of fp serve")
+}
+
+// allow answers requests of another method with status 405 and tells if the request has the method
+func allow(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method || (method == http.MethodGet && r.Method == http.MethodHead) {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	writeError(w, http.StatusMethodNotAllowed, "use %s for %s", method, r.URL.Path)
+	return false
+}
+
+// writeJSON answers with status and v as json
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// writeError answers with status and {"error": message}
+func writeError(w http.ResponseWriter, status int, format string, args ...interface{}) {
+	writeJSON(w, status, map[string]string{"error": fmt.Sprintf(format, args...)})
+}
+
+// appendNew appends value if it isn't empty and not in values yet
+func appendNew(values []string, value string) []string {
+	if value == "" {
+		return values
+	}
+	for _, v := range values {
+		if v == value {
+			return values
+		}
+	}
+	return append(values, value)
+}
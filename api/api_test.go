@@ -0,0 +1,294 @@
+package api
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tobkle/fp/importer"
+	"github.com/tobkle/fp/store"
+)
+
+// testServer returns a Server of a new database accepting the tokens t1 and t2, customer CU1 has the payment PM1
+// warned on 2020-01-01 and the payment PM2 failed once, its current date is 2020-01-02
+func testServer(t *testing.T) *Server {
+	t.Helper()
+	s, err := store.Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	if _, err = s.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range []store.FailedPaymentEvent{
+		{ID: "EV1", PaymentID: "PM1", CreatedAt: "2020-01-01T10:00:00.000Z"},
+		{ID: "EV2", PaymentID: "PM2", CreatedAt: "2020-01-01T11:00:00.000Z"},
+	} {
+		e.Action, e.AmountMinor, e.Currency, e.CustomerID, e.MandateID = "failed", 1250, "GBP", "CU1", "MD1"
+		if err = s.InsertFailedPaymentEvent(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	buckets := store.StateBuckets{Warn: []string{"warn"}, Suspend: []string{"suspend-small"}}
+	_, err = s.RecordActions([]store.PaymentAction{{PaymentID: "PM1", Bucket: "warn", Rule: "warn", Timestamp: "2020-01-01",
+		Count: 1, CustomerID: "CU1"}}, buckets, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.UpdatePaymentStates(buckets, "2020-01-01"); err != nil {
+		t.Fatal(err)
+	}
+	srv := New(s, []string{"t1", " t2 ", ""})
+	srv.Importer = func(db store.Store) *importer.Importer {
+		imp := importer.New(db, nil)
+		imp.Log = io.Discard
+		return imp
+	}
+	srv.Now = func() time.Time { return time.Date(2020, 1, 2, 12, 0, 0, 0, time.Local) }
+	return srv
+}
+
+func TestNew(t *testing.T) {
+	srv := New(nil, []string{"t1", " t2 ", "", " "})
+	if strings.Join(srv.Tokens, ",") != "t1,t2" {
+		t.Errorf("Tokens = %q, want t1 and t2", srv.Tokens)
+	}
+}
+
+func TestAuthorized(t *testing.T) {
+	tests := []struct {
+		name          string
+		authorization string
+		status        int
+	}{
+		{"no header", "", http.StatusUnauthorized},
+		{"unknown token", "Bearer t3", http.StatusUnauthorized},
+		{"empty token", "Bearer ", http.StatusUnauthorized},
+		{"token without scheme", "t1", http.StatusOK},
+		{"first token", "Bearer t1", http.StatusOK},
+		{"trimmed token", "Bearer t2", http.StatusOK},
+		{"prefix of a token", "Bearer t", http.StatusUnauthorized},
+		{"basic authentication", "Basic dXNlcjp0MQ==", http.StatusUnauthorized},
+	}
+	srv := testServer(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, Prefix+"customers/CU1/status", nil)
+			if tt.authorization != "" {
+				r.Header.Set("Authorization", tt.authorization)
+			}
+			w := httptest.NewRecorder()
+			srv.ServeHTTP(w, r)
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.status == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+				t.Errorf("WWW-Authenticate header missing")
+			}
+		})
+	}
+
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest(http.MethodGet, Prefix+"openapi.json", nil))
+	if w.Code != http.StatusOK || !json.Valid(w.Body.Bytes()) {
+		t.Errorf("openapi.json without token = %d, want 200 and json", w.Code)
+	}
+}
+
+func TestProtect(t *testing.T) {
+	tests := []struct {
+		name     string
+		user     string
+		password string
+		bearer   string
+		status   int
+	}{
+		{"nothing", "", "", "", http.StatusUnauthorized},
+		{"token as password", "operator", "t2", "", http.StatusOK},
+		{"any user name", "", "t1", "", http.StatusOK},
+		{"unknown password", "operator", "t3", "", http.StatusUnauthorized},
+		{"token as user name", "t1", "", "", http.StatusUnauthorized},
+		{"bearer token", "", "", "t1", http.StatusOK},
+		{"unknown bearer token", "", "", "t3", http.StatusUnauthorized},
+	}
+	srv := New(nil, []string{"t1", "t2"})
+	pages := srv.Protect(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "dashboard")
+	}))
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.user != "" || tt.password != "" {
+				r.SetBasicAuth(tt.user, tt.password)
+			}
+			if tt.bearer != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.bearer)
+			}
+			w := httptest.NewRecorder()
+			pages.ServeHTTP(w, r)
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.status == http.StatusOK && w.Body.String() != "dashboard" {
+				t.Errorf("body = %q, want the dashboard", w.Body)
+			}
+			if tt.status == http.StatusUnauthorized && !strings.HasPrefix(w.Header().Get("WWW-Authenticate"), "Basic ") {
+				t.Errorf("WWW-Authenticate = %q, want Basic for the browser to ask", w.Header().Get("WWW-Authenticate"))
+			}
+		})
+	}
+}
+
+func TestCustomerStatus(t *testing.T) {
+	tests := []struct {
+		name      string
+		states    []string
+		want      string
+		suspended bool
+		warned    bool
+	}{
+		{"not evaluated yet", []string{""}, store.StateActive, false, false},
+		{"recovered", []string{store.StateRecovered}, store.StateRecovered, false, false},
+		{"written off before recovered", []string{store.StateRecovered, store.StateWrittenOff}, store.StateWrittenOff, false, false},
+		{"active before written off", []string{store.StateWrittenOff, store.StateActive}, store.StateActive, false, false},
+		{"warned before active", []string{store.StateActive, store.StateWarned, store.StateRecovered}, store.StateWarned, false, true},
+		{"suspended first", []string{store.StateWarned, store.StateSuspended, ""}, store.StateSuspended, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var payments []store.PaymentStatus
+			for i, state := range tt.states {
+				payments = append(payments, store.PaymentStatus{PaymentID: "PM" + string(rune('1'+i)), CustomerID: "CU1",
+					AccountNumber: "A001", State: state})
+			}
+			got := customerStatus(store.KeyCustomerID, "CU1", payments)
+			if got.Status != tt.want || got.Suspended != tt.suspended || got.Warned != tt.warned {
+				t.Errorf("customerStatus() = %s suspended %v warned %v, want %s suspended %v warned %v",
+					got.Status, got.Suspended, got.Warned, tt.want, tt.suspended, tt.warned)
+			}
+			if len(got.Payments) != len(tt.states) || len(got.CustomerIDs) != 1 || len(got.Accounts) != 1 {
+				t.Errorf("customerStatus() = %+v, want %d payments of one customer and account", got, len(tt.states))
+			}
+		})
+	}
+}
+
+func TestStatusOf(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		status int
+		want   string
+	}{
+		{"customer", http.MethodGet, "customers/CU1/status", http.StatusOK, store.StateWarned},
+		{"unknown customer", http.MethodGet, "customers/CU9/status", http.StatusNotFound, ""},
+		{"without status", http.MethodGet, "customers/CU1", http.StatusNotFound, ""},
+		{"without customer", http.MethodGet, "customers/status", http.StatusNotFound, ""},
+		{"read only", http.MethodPost, "customers/CU1/status", http.StatusMethodNotAllowed, ""},
+		{"unknown endpoint", http.MethodGet, "unknown", http.StatusNotFound, ""},
+	}
+	srv := testServer(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, Prefix+tt.path, nil)
+			r.Header.Set("Authorization", "Bearer t1")
+			w := httptest.NewRecorder()
+			srv.ServeHTTP(w, r)
+			if w.Code != tt.status {
+				t.Fatalf("%s %s = %d, want %d: %s", tt.method, tt.path, w.Code, tt.status, w.Body)
+			}
+			if tt.want == "" {
+				return
+			}
+			var status CustomerStatus
+			if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+				t.Fatal(err)
+			}
+			if status.Status != tt.want || len(status.Payments) != 2 {
+				t.Errorf("%s = %+v, want %s with 2 payments", tt.path, status, tt.want)
+			}
+		})
+	}
+}
+
+func TestExports(t *testing.T) {
+	tests := []struct {
+		query  string
+		status int
+		want   int
+	}{
+		{"?date=2020-01-01", http.StatusOK, 1},
+		{"", http.StatusOK, 0},
+		{"?date=2020-1-1", http.StatusBadRequest, 0},
+	}
+	srv := testServer(t)
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, Prefix+"warnings"+tt.query, nil)
+		r.Header.Set("Authorization", "Bearer t1")
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, r)
+		if w.Code != tt.status {
+			t.Fatalf("warnings%s = %d, want %d: %s", tt.query, w.Code, tt.status, w.Body)
+		}
+		if tt.status != http.StatusOK {
+			continue
+		}
+		var lists []BucketDocuments
+		if err := json.Unmarshal(w.Body.Bytes(), &lists); err != nil {
+			t.Fatal(err)
+		}
+		payments := 0
+		for _, list := range lists {
+			payments += len(list.Payments)
+		}
+		if payments != tt.want {
+			t.Errorf("warnings%s = %d payments, want %d", tt.query, payments, tt.want)
+		}
+	}
+}
+
+func TestImportFile(t *testing.T) {
+	header := "id,created_at,resource_type,action,payments.id,payments.charge_date,payments.amount,payments.currency,customers.id,payments.links.mandate\n"
+	tests := []struct {
+		name     string
+		path     string
+		body     string
+		status   int
+		inserted int
+	}{
+		{"payments", "imports/payments", header + "EV3,2020-01-02T10:00:00Z,payments,failed,PM3,2020-01-02,12.50,GBP,CU2,MD2\n", http.StatusOK, 1},
+		{"missing columns", "imports/payments", "id,created_at\nEV4,2020-01-02T10:00:00Z\n", http.StatusUnprocessableEntity, 0},
+		{"unknown source", "imports/unknown", header, http.StatusNotFound, 0},
+		{"invalid as_of", "imports/accounts?as_of=yesterday", header, http.StatusBadRequest, 0},
+	}
+	srv := testServer(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, Prefix+tt.path, strings.NewReader(tt.body))
+			r.Header.Set("Authorization", "Bearer t1")
+			r.Header.Set("Content-Type", "text/csv")
+			w := httptest.NewRecorder()
+			srv.ServeHTTP(w, r)
+			if w.Code != tt.status {
+				t.Fatalf("POST %s = %d, want %d: %s", tt.path, w.Code, tt.status, w.Body)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			var result ImportResult
+			if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+				t.Fatal(err)
+			}
+			if result.Inserted != tt.inserted || result.ImportID == 0 || result.FileName != "payments-2020-01-02.csv" {
+				t.Errorf("POST %s = %+v, want %d inserted into payments-2020-01-02.csv", tt.path, result, tt.inserted)
+			}
+		})
+	}
+}
@@ -0,0 +1,203 @@
+/********************************************************************************************************************
+ * name: config
+ * description: YAML config file with the parameters of fp and named profiles overriding them
+ ********************************************************************************************************************/
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// keys of the config file which aren't parameters
+const (
+	KeyDataDir  = "data_dir"
+	KeyProfile  = "profile"
+	KeyProfiles = "profiles"
+)
+
+// FileName is the config file looked for in the working directory and next to the executable
+const FileName = "fp.yaml"
+
+// File is a config file: parameters by their name on the command line, e.g. db or count-warn, a data directory
+// and profiles with parameters replacing them, e.g. per business unit or currency
+//
+//	data_dir: /srv/fp
+//	profile: uk
+//	count-warn: 3
+//	profiles:
+//	  uk:
+//	    db: fp-uk.sqlite3
+//	  de:
+//	    data_dir: /srv/fp/de
+//	    amount: 25
+type File struct {
+	// Name is the path of the file
+	Name string
+	// DataDir is the directory of the files without a path, relative to the directory of the file
+	DataDir string
+	// Profile is used if none is selected
+	Profile    string
+	Parameters map[string]string
+	Profiles   map[string]Profile
+}
+
+// Profile are the parameters replacing those of the file
+type Profile struct {
+	DataDir    string
+	Parameters map[string]string
+}
+
+// Settings are the parameters of a profile, by name, with the profile and the file they come from
+type Settings struct {
+	File    string
+	Profile string
+	DataDir string
+	// Parameters are the values by parameter name
+	Parameters map[string]string
+	// Sources tells where a parameter is set: "config" or "profile <name>"
+	Sources map[string]string
+}
+
+// Load reads a config file
+func Load(fileName string) (*File, error) {
+	content, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	var values map[string]interface{}
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	if err = decoder.Decode(&values); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("%s: %w", fileName, err)
+	}
+
+	f := &File{Name: fileName, Profiles: map[string]Profile{}}
+	if f.DataDir, f.Parameters, err = parameters(values); err != nil {
+		return nil, fmt.Errorf("%s: %w", fileName, err)
+	}
+	if profile, ok := values[KeyProfile]; ok {
+		f.Profile = fmt.Sprint(profile)
+	}
+	if profiles, ok := values[KeyProfiles]; ok {
+		byName, ok := profiles.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s: profiles must map profile names to parameters", fileName)
+		}
+		for name, p := range byName {
+			values, ok := p.(map[string]interface{})
+			if !ok && p != nil {
+				return nil, fmt.Errorf("%s: profile %s must map parameter names to values", fileName, name)
+			}
+			var profile Profile
+			if profile.DataDir, profile.Parameters, err = parameters(values); err != nil {
+				return nil, fmt.Errorf("%s: profile %s: %w", fileName, name, err)
+			}
+			f.Profiles[name] = profile
+		}
+	}
+	if f.Profile != "" {
+		if _, ok := f.Profiles[f.Profile]; !ok {
+			return nil, fmt.Errorf("%s: unknown profile %q", fileName, f.Profile)
+		}
+	}
+	return f, nil
+}
+
+// parameters splits values into the data directory and the parameters, without the profiles
+func parameters(values map[string]interface{}) (string, map[string]string, error) {
+	dataDir, params := "", map[string]string{}
+	for name, value := range values {
+		switch name {
+		case KeyProfile, KeyProfiles:
+			continue
+		case KeyDataDir:
+			dataDir = fmt.Sprint(value)
+			continue
+		}
+		switch value.(type) {
+		case map[string]interface{}, []interface{}:
+			return "", nil, fmt.Errorf("%s: must be a single value", name)
+		case nil:
+			params[name] = ""
+		default:
+			params[name] = fmt.Sprint(value)
+		}
+	}
+	return dataDir, params, nil
+}
+
+// Check fails on the parameters of the file and its profiles which known doesn't list, e.g. misspelled ones
+func (f *File) Check(known map[string]bool) error {
+	check := func(params map[string]string, where string) error {
+		names := make([]string, 0, len(params))
+		for name := range params {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if known[name] {
+				continue
+			}
+			if hyphenated := strings.ReplaceAll(name, "_", "-"); known[hyphenated] {
+				return fmt.Errorf("%s%s: unknown parameter %s, did you mean %s", f.Name, where, name, hyphenated)
+			}
+			return fmt.Errorf("%s%s: unknown parameter %s, use the name of a command line parameter, %s, %s or %s",
+				f.Name, where, name, KeyDataDir, KeyProfile, KeyProfiles)
+		}
+		return nil
+	}
+	if err := check(f.Parameters, ""); err != nil {
+		return err
+	}
+	for _, name := range f.ProfileNames() {
+		if err := check(f.Profiles[name].Parameters, ": profile "+name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Resolve returns the parameters of profile, the default profile of the file if empty
+func (f *File) Resolve(profile string) (*Settings, error) {
+	if profile == "" {
+		profile = f.Profile
+	}
+	s := &Settings{File: f.Name, Profile: profile, DataDir: f.DataDir, Parameters: map[string]string{}, Sources: map[string]string{}}
+	for name, value := range f.Parameters {
+		s.Parameters[name], s.Sources[name] = value, "config"
+	}
+	if profile != "" {
+		p, ok := f.Profiles[profile]
+		if !ok {
+			return nil, fmt.Errorf("unknown profile %q, the profiles of %s are %v", profile, f.Name, f.ProfileNames())
+		}
+		if p.DataDir != "" {
+			s.DataDir = p.DataDir
+		}
+		for name, value := range p.Parameters {
+			s.Parameters[name], s.Sources[name] = value, "profile "+profile
+		}
+	}
+	if s.DataDir != "" && !filepath.IsAbs(s.DataDir) {
+		s.DataDir = filepath.Join(filepath.Dir(f.Name), s.DataDir)
+	}
+	return s, nil
+}
+
+// ProfileNames lists the profiles in alphabetical order
+func (f *File) ProfileNames() []string {
+	names := make([]string, 0, len(f.Profiles))
+	for name := range f.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,38 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+	known := map[string]bool{"count-warn": true, "amount": true, "db": true}
+	tests := []struct {
+		content string
+		wantErr string
+	}{
+		{"data_dir: /srv/fp\nprofile: uk\ncount-warn: 3\nprofiles:\n  uk:\n    data_dir: uk\n    amount: 20\n", ""},
+		{"count_warn: 7\n", "unknown parameter count_warn, did you mean count-warn"},
+		{"count-warn: 3\nprofiles:\n  de:\n    amout: 25\n", "profile de: unknown parameter amout"},
+		{"datadir: /srv/fp\n", "unknown parameter datadir"},
+	}
+	for _, test := range tests {
+		fileName := filepath.Join(t.TempDir(), FileName)
+		if err := os.WriteFile(fileName, []byte(test.content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		f, err := Load(fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = f.Check(known)
+		switch {
+		case test.wantErr == "" && err != nil:
+			t.Errorf("Check() of %q = %v, want no error", test.content, err)
+		case test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)):
+			t.Errorf("Check() of %q = %v, want %q", test.content, err, test.wantErr)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+/********************************************************************************************************************
+ * name: charts
+ * description: the payment timeline and the bar charts of the daily trends, drawn as inline svg
+ ********************************************************************************************************************/
+package dashboard
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tobkle/fp/rules"
+	"github.com/tobkle/fp/store"
+)
+
+// size of the charts in svg units, the bars share the width
+const (
+	chartWidth  = 900
+	chartHeight = 160
+)
+
+// TimelineEntry is an event of the payment provider or an entry of the dunning history of a payment
+type TimelineEntry struct {
+	// Time is the created_at of an event or the date of the run of a dunning action
+	Time string
+	// Dunning tells an entry of the dunning history from an event
+	Dunning bool
+	Action  string
+	Detail  string
+	Event   store.FailedPaymentEvent
+	History store.DunningAction
+}
+
+// Chart is a bar chart of one value per day
+type Chart struct {
+	Title  string
+	Class  string
+	Width  int
+	Height int
+	Max    int
+	Total  int
+	Bars   []Bar
+}
+
+// Bar is the value of one day, X, Y, Width and Height in svg units
+type Bar struct {
+	Date   string
+	Value  int
+	X      float64
+	Y      float64
+	Width  float64
+	Height float64
+}
+
+// timeline merges the events and the dunning history of a payment in time order, a dunning action after the
+// events of the day of its run
+func timeline(events []store.FailedPaymentEvent, history []store.DunningAction) []TimelineEntry {
+	var entries []TimelineEntry
+	for _, e := range events {
+		detail := strings.TrimSpace(e.DetailsCause + " " + e.DetailsReasonCode)
+		if e.DetailsDescription != "" {
+			detail += ": " + e.DetailsDescription
+		}
+		entries = append(entries, TimelineEntry{Time: e.CreatedAt, Action: e.Action, Detail: detail, Event: e})
+	}
+	for _, h := range history {
+		detail := h.Rule
+		if h.Reason != "" {
+			detail = strings.TrimSpace(detail + " " + h.Reason)
+		}
+		if h.Level == store.HistoryCustomer {
+			detail = strings.TrimSpace("customer " + h.CustomerKey + " " + detail)
+		}
+		entries = append(entries, TimelineEntry{Time: h.Date, Dunning: true, Action: h.Action, Detail: detail, History: h})
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return sortTime(entries[i]) < sortTime(entries[j])
+	})
+	return entries
+}
+
+// sortTime puts the dunning actions of a day after its events
+func sortTime(entry TimelineEntry) string {
+	if entry.Dunning {
+		return entry.Time + "~"
+	}
+	return entry.Time
+}
+
+// fillDays returns a day of trend for every date from from to to, with zeros for the days without activity
+func fillDays(trend []store.TrendDay, from time.Time, to time.Time) []store.TrendDay {
+	byDate := map[string]store.TrendDay{}
+	for _, day := range trend {
+		byDate[day.Date] = day
+	}
+	var days []store.TrendDay
+	last := to.Format(store.ISODate)
+	for d := from; d.Format(store.ISODate) <= last; d = d.AddDate(0, 0, 1) {
+		date := d.Format(store.ISODate)
+		day, ok := byDate[date]
+		if !ok {
+			day = store.TrendDay{Date: date, Actions: map[string]int{}}
+		}
+		days = append(days, day)
+	}
+	return days
+}
+
+// actionNames are the buckets and states of the dunning actions of the trend, the buckets in their export order
+func actionNames(trend []store.TrendDay) []string {
+	seen := map[string]bool{}
+	for _, day := range trend {
+		for action, count := range day.Actions {
+			if count > 0 {
+				seen[action] = true
+			}
+		}
+	}
+	var names []string
+	for _, bucket := range rules.Buckets {
+		if seen[string(bucket)] {
+			names = append(names, string(bucket))
+			delete(seen, string(bucket))
+		}
+	}
+	var others []string
+	for action := range seen {
+		others = append(others, action)
+	}
+	sort.Strings(others)
+	return append(names, others...)
+}
+
+// charts draws the failed requests, failing and recovered payments and each action of the trend per day
+func charts(trend []store.TrendDay) []Chart {
+	charts := []Chart{
+		chart("Failed payment requests", "failures", trend, func(d store.TrendDay) int { return d.Failures }),
+		chart("Payments with failed requests", "payments", trend, func(d store.TrendDay) int { return d.Payments }),
+		chart("Recovered payments", "recovered", trend, func(d store.TrendDay) int { return d.Recovered }),
+	}
+	for _, action := range actionNames(trend) {
+		action := action
+		charts = append(charts, chart("Payments put into "+action, "action", trend, func(d store.TrendDay) int {
+			return d.Actions[action]
+		}))
+	}
+	return charts
+}
+
+// chart draws the value of each day as a bar scaled to the largest value
+func chart(title string, class string, trend []store.TrendDay, value func(store.TrendDay) int) Chart {
+	c := Chart{Title: title, Class: class, Width: chartWidth, Height: chartHeight}
+	for _, day := range trend {
+		v := value(day)
+		c.Total += v
+		if v > c.Max {
+			c.Max = v
+		}
+	}
+	if len(trend) == 0 {
+		return c
+	}
+	step := float64(chartWidth) / float64(len(trend))
+	for i, day := range trend {
+		v := value(day)
+		bar := Bar{Date: day.Date, Value: v, X: float64(i) * step, Width: step * 0.8}
+		if c.Max > 0 {
+			bar.Height = float64(chartHeight) * float64(v) / float64(c.Max)
+		}
+		bar.Y = float64(chartHeight) - bar.Height
+		c.Bars = append(c.Bars, bar)
+	}
+	return c
+}
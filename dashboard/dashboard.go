@@ -0,0 +1,233 @@
+/********************************************************************************************************************
+ * name: dashboard
+ * description: local web dashboard of the failed-payments database, the lists of a day, customer search,
+ *              payment timelines and trend charts, read only
+ ********************************************************************************************************************/
+package dashboard
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tobkle/fp/rules"
+	"github.com/tobkle/fp/store"
+)
+
+//go:embed templates/*.html
+var templateFiles embed.FS
+
+// pages are the templates of the pages, each is executed within layout.html
+var pages = []string{"lists", "customers", "customer", "payment", "trends"}
+
+// maxHits is the number of customers a search shows
+const maxHits = 200
+
+// Server serves the dashboard pages from a Store, it never changes the database
+type Server struct {
+	Store store.Store
+	// Days are shown in the trend charts, 90 by default
+	Days int
+	// Now is the current time, the lists show its date unless another one is chosen
+	Now       func() time.Time
+	templates map[string]*template.Template
+	mux       *http.ServeMux
+}
+
+// New parses the embedded templates and returns a Server of s showing 90 days of trends
+func New(s store.Store) (*Server, error) {
+	srv := &Server{Store: s, Days: 90, Now: time.Now, templates: map[string]*template.Template{}, mux: http.NewServeMux()}
+	funcs := template.FuncMap{
+		"amount": store.FormatAmount,
+		"date":   date,
+		"join":   strings.Join,
+	}
+	for _, page := range pages {
+		t, err := template.New(page).Funcs(funcs).ParseFS(templateFiles, "templates/layout.html", "templates/"+page+".html")
+		if err != nil {
+			return nil, fmt.Errorf("dashboard template %s: %w", page, err)
+		}
+		srv.templates[page] = t
+	}
+	srv.mux.HandleFunc("/", srv.lists)
+	srv.mux.HandleFunc("/customers", srv.customers)
+	srv.mux.HandleFunc("/customers/", srv.customer)
+	srv.mux.HandleFunc("/payments/", srv.payment)
+	srv.mux.HandleFunc("/trends", srv.trends)
+	return srv, nil
+}
+
+// ServeHTTP answers GET and HEAD requests of the pages
+func (srv *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "the dashboard is read only", http.StatusMethodNotAllowed)
+		return
+	}
+	srv.mux.ServeHTTP(w, r)
+}
+
+// BucketList are the payments and customers put into a bucket on the date of the lists page
+type BucketList struct {
+	Bucket    string
+	Payments  []store.ExportRow
+	Customers []store.CustomerExportRow
+}
+
+// lists shows the payments and customers of every bucket and the payments to reinstate of ?date, today by default
+func (srv *Server) lists(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	day := r.URL.Query().Get("date")
+	if day == "" {
+		day = srv.Now().Format(store.ISODate)
+	}
+	if _, err := time.Parse(store.ISODate, day); err != nil {
+		http.Error(w, fmt.Sprintf("invalid date %q, use YYYY-MM-DD", day), http.StatusBadRequest)
+		return
+	}
+	var lists []BucketList
+	for _, bucket := range rules.Buckets {
+		if bucket == rules.BucketIgnore {
+			continue
+		}
+		list := BucketList{Bucket: string(bucket)}
+		var err error
+		if list.Payments, err = srv.Store.ActionExports(list.Bucket, day); err != nil {
+			srv.fail(w, err)
+			return
+		}
+		if list.Customers, err = srv.Store.CustomerActionExports(list.Bucket, day); err != nil {
+			srv.fail(w, err)
+			return
+		}
+		lists = append(lists, list)
+	}
+	reinstate, err := srv.Store.ReinstateExports(day)
+	if err != nil {
+		srv.fail(w, err)
+		return
+	}
+	lists = append(lists, BucketList{Bucket: "reinstate", Payments: reinstate})
+	srv.render(w, "lists", map[string]interface{}{"Title": "Lists of " + day, "Date": day, "Lists": lists})
+}
+
+// customers searches the customers by ?q, its id, lead id, name, mandate, account number or CRM name
+func (srv *Server) customers(w http.ResponseWriter, r *http.Request) {
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	var hits []store.CustomerHit
+	if query != "" {
+		var err error
+		if hits, err = srv.Store.SearchCustomers(query, maxHits); err != nil {
+			srv.fail(w, err)
+			return
+		}
+	}
+	srv.render(w, "customers", map[string]interface{}{"Title": "Customers", "Query": query, "Hits": hits,
+		"Limited": len(hits) == maxHits})
+}
+
+// customer shows the payments and the dunning history of /customers/<customers_id>
+func (srv *Server) customer(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/customers/")
+	payments, err := srv.Store.CustomerPayments(id)
+	if err != nil {
+		srv.fail(w, err)
+		return
+	}
+	if len(payments) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	history, err := srv.Store.History(id)
+	if err != nil {
+		srv.fail(w, err)
+		return
+	}
+	srv.render(w, "customer", map[string]interface{}{"Title": "Customer " + id, "Customer": payments[0],
+		"Payments": payments, "History": history})
+}
+
+// payment shows the events of /payments/<payments_id> and its dunning history as one timeline
+func (srv *Server) payment(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/payments/")
+	events, err := srv.Store.PaymentEvents(id)
+	if err != nil {
+		srv.fail(w, err)
+		return
+	}
+	if len(events) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	history, err := srv.Store.History(id)
+	if err != nil {
+		srv.fail(w, err)
+		return
+	}
+	failures := 0
+	for _, e := range events {
+		if e.Action == "failed" {
+			failures++
+		}
+	}
+	srv.render(w, "payment", map[string]interface{}{"Title": "Payment " + id, "Payment": events[len(events)-1],
+		"Failures": failures, "Timeline": timeline(events, history)})
+}
+
+// trends shows the charts of the failures, recoveries and actions per day of the last ?days, Server.Days by default
+func (srv *Server) trends(w http.ResponseWriter, r *http.Request) {
+	days := srv.Days
+	if value := r.URL.Query().Get("days"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			http.Error(w, fmt.Sprintf("invalid days %q, use a positive number", value), http.StatusBadRequest)
+			return
+		}
+		days = n
+	}
+	to := srv.Now()
+	from := to.AddDate(0, 0, 1-days)
+	trend, err := srv.Store.Trend(from.Format(store.ISODate))
+	if err != nil {
+		srv.fail(w, err)
+		return
+	}
+	trend = fillDays(trend, from, to)
+	srv.render(w, "trends", map[string]interface{}{"Title": "Trends", "Days": days, "Charts": charts(trend),
+		"Trend": trend, "Buckets": actionNames(trend)})
+}
+
+// render executes the template of page within the layout, buffered to answer errors with status 500
+func (srv *Server) render(w http.ResponseWriter, page string, data map[string]interface{}) {
+	data["Page"] = page
+	var b bytes.Buffer
+	if err := srv.templates[page].ExecuteTemplate(&b, "layout", data); err != nil {
+		srv.fail(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(b.Bytes())
+}
+
+// fail logs err and answers with status 500
+func (srv *Server) fail(w http.ResponseWriter, err error) {
+	log.Printf("ERROR: dashboard: %s", err)
+	http.Error(w, "the dashboard failed to read the database, see the log of fp serve", http.StatusInternalServerError)
+}
+
+// date returns the date of an ISO timestamp
+func date(timestamp string) string {
+	if len(timestamp) > 10 {
+		return timestamp[:10]
+	}
+	return timestamp
+}
@@ -0,0 +1,143 @@
+package dashboard
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tobkle/fp/store"
+)
+
+// testServer returns a Server of a new database with payment PM1 of customer CU1, failed on 2020-01-01 and
+// warned the same day, its current date is 2020-01-02
+func testServer(t *testing.T) *Server {
+	t.Helper()
+	s, err := store.Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	if _, err = s.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	err = s.InsertFailedPaymentEvent(store.FailedPaymentEvent{ID: "EV1", CreatedAt: "2020-01-01T10:00:00.000Z",
+		Action: "failed", DetailsCause: "insufficient_funds", PaymentID: "PM1", AmountMinor: 1250, Currency: "GBP",
+		CustomerID: "CU1", CustomerGivenName: "Alice", CustomerFamilyName: "Smith"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.RecordActions([]store.PaymentAction{{PaymentID: "PM1", Bucket: "warn", Rule: "warn", Timestamp: "2020-01-01",
+		Count: 1, CustomerID: "CU1"}}, store.StateBuckets{Warn: []string{"warn"}}, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, err := New(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Now = func() time.Time { return time.Date(2020, 1, 2, 12, 0, 0, 0, time.Local) }
+	return srv
+}
+
+func TestServeHTTP(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		target string
+		status int
+		want   string
+	}{
+		{"lists of today", http.MethodGet, "/", http.StatusOK, "Lists of 2020-01-02"},
+		{"lists of a day", http.MethodGet, "/?date=2020-01-01", http.StatusOK, "PM1"},
+		{"invalid date", http.MethodGet, "/?date=01.01.2020", http.StatusBadRequest, "invalid date"},
+		{"unknown page", http.MethodGet, "/unknown", http.StatusNotFound, ""},
+		{"search", http.MethodGet, "/customers?q=smith", http.StatusOK, "CU1"},
+		{"search without hits", http.MethodGet, "/customers?q=nobody", http.StatusOK, ""},
+		{"customer", http.MethodGet, "/customers/CU1", http.StatusOK, "PM1"},
+		{"unknown customer", http.MethodGet, "/customers/CU9", http.StatusNotFound, ""},
+		{"payment", http.MethodGet, "/payments/PM1", http.StatusOK, "insufficient_funds"},
+		{"unknown payment", http.MethodGet, "/payments/PM9", http.StatusNotFound, ""},
+		{"trends", http.MethodGet, "/trends?days=7", http.StatusOK, "Recovered payments"},
+		{"invalid days", http.MethodGet, "/trends?days=0", http.StatusBadRequest, "invalid days"},
+		{"head", http.MethodHead, "/", http.StatusOK, ""},
+		{"read only", http.MethodPost, "/", http.StatusMethodNotAllowed, "read only"},
+	}
+	srv := testServer(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			srv.ServeHTTP(w, httptest.NewRequest(tt.method, tt.target, nil))
+			if w.Code != tt.status {
+				t.Fatalf("%s %s = %d, want %d: %s", tt.method, tt.target, w.Code, tt.status, w.Body)
+			}
+			if !strings.Contains(w.Body.String(), tt.want) {
+				t.Errorf("%s %s doesn't contain %q: %s", tt.method, tt.target, tt.want, w.Body)
+			}
+		})
+	}
+}
+
+func TestFillDays(t *testing.T) {
+	from := time.Date(2020, 1, 1, 0, 0, 0, 0, time.Local)
+	trend := []store.TrendDay{
+		{Date: "2020-01-02", Failures: 3, Actions: map[string]int{"warn": 1}},
+		{Date: "2019-12-31", Failures: 9},
+	}
+	days := fillDays(trend, from, from.AddDate(0, 0, 2))
+	want := []int{0, 3, 0}
+	if len(days) != len(want) {
+		t.Fatalf("fillDays() = %+v, want %d days", days, len(want))
+	}
+	for i, day := range days {
+		if date := from.AddDate(0, 0, i).Format(store.ISODate); day.Date != date || day.Failures != want[i] {
+			t.Errorf("fillDays()[%d] = %s with %d failures, want %s with %d", i, day.Date, day.Failures, date, want[i])
+		}
+		if day.Actions == nil {
+			t.Errorf("fillDays()[%d].Actions = nil, want a map", i)
+		}
+	}
+}
+
+func TestTimeline(t *testing.T) {
+	events := []store.FailedPaymentEvent{
+		{ID: "EV1", CreatedAt: "2020-01-01T10:00:00.000Z", Action: "failed", DetailsCause: "insufficient_funds"},
+		{ID: "EV2", CreatedAt: "2020-01-02T10:00:00.000Z", Action: "failed"},
+	}
+	history := []store.DunningAction{
+		{Date: "2020-01-02", Action: "warn", Rule: "warn", Level: store.HistoryPayment},
+		{Date: "2020-01-01", Action: "warn", Rule: "warn", Level: store.HistoryCustomer, CustomerKey: "id:CU1"},
+	}
+	var got []string
+	for _, entry := range timeline(events, history) {
+		got = append(got, entry.Time+" "+entry.Action+" "+entry.Detail)
+	}
+	want := []string{
+		"2020-01-01T10:00:00.000Z failed insufficient_funds",
+		"2020-01-01 warn customer id:CU1 warn",
+		"2020-01-02T10:00:00.000Z failed ",
+		"2020-01-02 warn warn",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("timeline() =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestChart(t *testing.T) {
+	trend := []store.TrendDay{{Date: "2020-01-01", Failures: 2}, {Date: "2020-01-02", Failures: 4}, {Date: "2020-01-03"}}
+	c := chart("Failures", "failures", trend, func(d store.TrendDay) int { return d.Failures })
+	if c.Max != 4 || c.Total != 6 || len(c.Bars) != 3 {
+		t.Fatalf("chart() = %+v, want max 4, total 6 and 3 bars", c)
+	}
+	wantHeights := []float64{chartHeight / 2, chartHeight, 0}
+	for i, bar := range c.Bars {
+		if bar.Height != wantHeights[i] || bar.Y != chartHeight-wantHeights[i] {
+			t.Errorf("bar %d = %+v, want height %v", i, bar, wantHeights[i])
+		}
+	}
+	if empty := chart("Failures", "failures", nil, func(d store.TrendDay) int { return d.Failures }); len(empty.Bars) != 0 {
+		t.Errorf("chart() of no days = %+v, want no bars", empty)
+	}
+}
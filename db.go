@@ -0,0 +1,172 @@
+/********************************************************************************************************************
+ * name: db
+ * description: fp db, schema version, migrations, the imports ledger and the account versions of the database
+ ********************************************************************************************************************/
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/tobkle/fp/store"
+)
+
+// cmdDB implements `fp db status|migrate|imports|accounts <key>`, `fp migrate status|up` and `fp imports` of
+// former versions are the same commands
+func cmdDB(args []string) {
+	var o dbOptions
+	s := loadSettings(args)
+	flags := newDBFlags(&o, s)
+	s.apply(flags)
+	command, key := "", ""
+	if positional := parseArgs(flags, args); len(positional) > 0 {
+		command = positional[0]
+		if len(positional) > 1 {
+			key = positional[1]
+		}
+	}
+
+	db, err := store.Open(o.dbName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	switch command {
+	case "imports":
+		err = runImports(db, o.eventID)
+	case "accounts":
+		err = runAccounts(db, key)
+	case "migrate":
+		fmt.Println("Received      Database Name      :", o.dbName)
+		err = runMigrate(db, "up")
+	default:
+		fmt.Println("Received      Database Name      :", o.dbName)
+		err = runMigrate(db, command)
+	}
+	if err != nil {
+		log.Fatalf("fp db %s failed: %s", command, err)
+	}
+}
+
+// dbOptions are the parameters of fp db
+type dbOptions struct {
+	dbName  string
+	eventID string
+}
+
+// newDBFlags returns the parameters of fp db with the defaults in the data directory
+func newDBFlags(o *dbOptions, s *settings) *flag.FlagSet {
+	flags := flag.NewFlagSet("db", flag.ExitOnError)
+	flags.StringVar(&o.dbName, "db", defaultDatabase(s.dir), "Sqlite database to show or migrate")
+	flags.StringVar(&o.eventID, "event", "", "fp db imports: only show the import that introduced this payment event id")
+	s.register(flags)
+	return flags
+}
+
+// runImports implements `fp db imports`, the imports ledger or the import of one event
+func runImports(db *store.SQLiteStore, eventID string) error {
+	if _, err := db.Migrate(); err != nil {
+		return err
+	}
+	var imports []store.Import
+	if eventID != "" {
+		imp, err := db.EventImport(eventID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("no import known for event %s", eventID)
+		}
+		if err != nil {
+			return err
+		}
+		imports = append(imports, imp)
+	} else {
+		var err error
+		if imports, err = db.Imports(""); err != nil {
+			return err
+		}
+	}
+	for _, imp := range imports {
+		hash := imp.SHA256
+		if len(hash) > 12 {
+			hash = hash[:12]
+		}
+		fmt.Printf("%5d  %-25s  %-11s  %-8s  inserted %d, updated %d, skipped %d, rejected %d  %s  sha256 %s  fp %s\n",
+			imp.ID, imp.StartedAt, imp.Status, imp.Source, imp.Inserted, imp.Updated, imp.Skipped, imp.Rejected, imp.FileName,
+			hash, imp.ToolVersion)
+	}
+	return nil
+}
+
+// runAccounts implements `fp db accounts <key>`, the versions of the Elevate and CRM accounts of a mandate
+// reference or account number
+func runAccounts(db store.Store, key string) error {
+	if _, err := db.Migrate(); err != nil {
+		return err
+	}
+	if key == "" {
+		return fmt.Errorf("fp db accounts needs a mandate reference or account number")
+	}
+	versions, err := db.AccountHistory(key)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%-8s %-14s %-10s %-10s %6s %-40s %s\n", "SOURCE", "KEY", "FROM", "TO", "IMPORT", "CHANGE", "VALUES")
+	for _, v := range versions {
+		names := make([]string, 0, len(v.Values))
+		for name := range v.Values {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		values := make([]string, 0, len(names))
+		for _, name := range names {
+			values = append(values, name+"="+v.Values[name])
+		}
+		fmt.Printf("%-8s %-14s %-10s %-10s %6d %-40s %s\n", v.Source, v.Key, v.ValidFrom, v.ValidTo, v.ImportID, v.Change,
+			strings.Join(values, " "))
+	}
+	fmt.Println(len(versions), "versions of the accounts of", key)
+	return nil
+}
+
+// runMigrate shows the schema version and migrations (status) or applies the pending ones (up)
+func runMigrate(db store.Store, command string) error {
+	switch command {
+	case "up":
+		done, err := db.Migrate()
+		for _, m := range done {
+			fmt.Printf("SUCCESS: Applied migration %d: %s\n", m.Version, m.Name)
+		}
+		if err != nil {
+			return err
+		}
+		if len(done) == 0 {
+			fmt.Println("Database schema is up to date")
+		}
+		return nil
+	case "status", "":
+		states, err := db.MigrationStatus()
+		if err != nil {
+			return err
+		}
+		version, err := db.SchemaVersion()
+		if err != nil {
+			return err
+		}
+		fmt.Println("Schema version:", version, "of", store.LatestSchemaVersion())
+		for _, state := range states {
+			appliedAt := state.AppliedAt
+			if appliedAt == "" {
+				appliedAt = "pending"
+			}
+			fmt.Printf("  %4d  %-25s  %s\n", state.Version, appliedAt, state.Name)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown command %q, use status, migrate, imports or accounts", command)
+	}
+}
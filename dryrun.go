@@ -0,0 +1,136 @@
+/********************************************************************************************************************
+ * name: dryrun
+ * description: run fp against a temporary copy of the database and show what would change
+ ********************************************************************************************************************/
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/tobkle/fp/store"
+)
+
+// actionSnapshot are the rows of paymentsActions and customersActions by payment or customer and bucket,
+// and the states of the payments
+type actionSnapshot struct {
+	payments  map[string]store.PaymentAction
+	customers map[string]store.CustomerAction
+	states    map[string]store.PaymentState
+}
+
+// prepareDryRun copies dbName into a new temporary directory and returns the directory and the copy.
+// Without an existing database the copy starts empty.
+func prepareDryRun(dbName string) (string, string, error) {
+	dir, err := os.MkdirTemp("", "fp-dry-run-")
+	if err != nil {
+		return "", "", err
+	}
+	copyName := filepath.Join(dir, filepath.Base(dbName))
+	if _, err = os.Stat(dbName); err != nil {
+		return dir, copyName, nil
+	}
+	db, err := store.Open(dbName)
+	if err != nil {
+		return "", "", err
+	}
+	defer db.Close()
+	return dir, copyName, db.CopyTo(copyName)
+}
+
+// snapshot reads the action tables
+func snapshot(db store.Store) (actionSnapshot, error) {
+	snap := actionSnapshot{payments: map[string]store.PaymentAction{}, customers: map[string]store.CustomerAction{},
+		states: map[string]store.PaymentState{}}
+	payments, err := db.Actions()
+	if err != nil {
+		return snap, err
+	}
+	for _, a := range payments {
+		snap.payments[a.PaymentID+"/"+a.Bucket] = a
+	}
+	customers, err := db.CustomerActions()
+	if err != nil {
+		return snap, err
+	}
+	for _, a := range customers {
+		snap.customers[a.CustomerKey+"/"+a.Bucket] = a
+	}
+	states, err := db.PaymentStates("")
+	if err != nil {
+		return snap, err
+	}
+	for _, st := range states {
+		snap.states[st.PaymentID] = st
+	}
+	return snap, nil
+}
+
+// printDryRun lists the actions that are new or got a higher count in after, the payments that change their state
+// from warned or suspended, and a total per bucket
+func printDryRun(dbName string, before, after actionSnapshot) {
+	fmt.Println("***********************************************************")
+	fmt.Println("DRY RUN -- changes compared with", dbName)
+	fmt.Println("***********************************************************")
+
+	var lines []string
+	totals := map[string]int{}
+	for _, key := range sortedKeys(after.payments) {
+		a := after.payments[key]
+		old, ok := before.payments[key]
+		switch {
+		case !ok:
+			lines = append(lines, fmt.Sprintf("NEW    %-13s for payments_id : %s (rule %s, %d requests)", a.Bucket, a.PaymentID, a.Rule, a.Count))
+		case a.Count > old.Count:
+			lines = append(lines, fmt.Sprintf("AGAIN  %-13s for payments_id : %s (rule %s, %d -> %d requests)", a.Bucket, a.PaymentID, a.Rule, old.Count, a.Count))
+		default:
+			continue
+		}
+		totals[a.Bucket]++
+	}
+	for _, key := range sortedKeys(after.customers) {
+		a := after.customers[key]
+		old, ok := before.customers[key]
+		switch {
+		case !ok:
+			lines = append(lines, fmt.Sprintf("NEW    %-13s for customer    : %s (rule %s, %d requests, %d payments)", a.Bucket, a.CustomerKey, a.Rule, a.Count, a.PaymentCount))
+		case a.Count > old.Count:
+			lines = append(lines, fmt.Sprintf("AGAIN  %-13s for customer    : %s (rule %s, %d -> %d requests)", a.Bucket, a.CustomerKey, a.Rule, old.Count, a.Count))
+		default:
+			continue
+		}
+		totals[a.Bucket]++
+	}
+	for _, id := range sortedKeys(after.states) {
+		st, old := after.states[id], before.states[id]
+		if old.State != store.StateWarned && old.State != store.StateSuspended || st.State == old.State {
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("STATE  %-13s for payments_id : %s (%s %s)", st.State, id, st.LastEventAction, st.LastEventID))
+		if old.State == store.StateSuspended && st.State == store.StateRecovered {
+			totals["reinstate"]++
+		}
+	}
+
+	for _, line := range lines {
+		fmt.Println(line)
+	}
+	if len(lines) == 0 {
+		fmt.Println("Nothing would be warned, suspended or escalated")
+	}
+	for _, bucket := range sortedKeys(totals) {
+		fmt.Printf("TOTAL  %-13s : %d\n", bucket, totals[bucket])
+	}
+}
+
+// sortedKeys returns the keys of m in ascending order
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
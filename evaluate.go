@@ -0,0 +1,163 @@
+/********************************************************************************************************************
+ * name: evaluate
+ * description: fp evaluate, assign the payments or customers to the buckets of the rules and record the actions
+ ********************************************************************************************************************/
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/tobkle/fp/rules"
+	"github.com/tobkle/fp/store"
+)
+
+// cmdEvaluate implements `fp evaluate`, the rules evaluated on the imported payments without importing or exporting
+func cmdEvaluate(args []string) {
+	var timestamp = time.Now().Format("2006-01-02")
+	var o evaluateOptions
+	s := loadSettings(args)
+	flags := newEvaluateFlags(&o, s, timestamp)
+	s.apply(flags)
+	flags.Parse(args)
+
+	now := time.Now()
+	if o.asOf != timestamp {
+		day, err := parseDate(o.asOf)
+		if err != nil {
+			log.Fatal(err)
+		}
+		now = day
+	}
+	ruleset, err := o.rf.ruleset()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	db, err := store.Open(o.dbName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	fmt.Println("Received      Database Name      :", o.dbName)
+	if _, err = db.Migrate(); err != nil {
+		log.Fatalf("Database migration failed: %s", err)
+	}
+	evaluate(db, ruleset, now, o.asOf, o.operator)
+}
+
+// evaluateOptions are the parameters of fp evaluate
+type evaluateOptions struct {
+	dbName   string
+	rf       rulesFlags
+	asOf     string
+	operator string
+}
+
+// newEvaluateFlags returns the parameters of fp evaluate with the defaults in the data directory
+func newEvaluateFlags(o *evaluateOptions, s *settings, timestamp string) *flag.FlagSet {
+	flags := flag.NewFlagSet("evaluate", flag.ExitOnError)
+	flags.StringVar(&o.dbName, "db", defaultDatabase(s.dir), "Sqlite database to evaluate")
+	o.rf.register(flags)
+	flags.StringVar(&o.asOf, "as-of", timestamp, "date YYYY-MM-DD the actions are recorded with, time windows end with that day")
+	flags.StringVar(&o.operator, "operator", defaultOperator(), "name recorded with the actions in the dunning history")
+	s.register(flags)
+	return flags
+}
+
+// evaluate moves paid and cancelled payments out of the dunning, evaluates the rules and derives the states
+// of the new warnings and suspensions
+func evaluate(db store.Store, ruleset *rules.Ruleset, now time.Time, timestamp string, operator string) {
+	fmt.Println("***********************************************************")
+	fmt.Printf("EVALUATE %d RULES FOR %sS WITH %d OR MORE REQUESTS --   started\n", len(ruleset.Rules), strings.ToUpper(ruleset.Level), ruleset.MinFailures())
+	fmt.Println("***********************************************************")
+
+	// paid and cancelled payments leave the dunning before the rules are evaluated, new warnings and
+	// suspensions change the state afterwards
+	updateStates(db, timestamp, operator)
+	if ruleset.Level == rules.LevelCustomer {
+		evaluateCustomers(db, ruleset, now, timestamp, operator)
+	} else {
+		evaluatePayments(db, ruleset, now, timestamp, operator)
+	}
+	updateStates(db, timestamp, operator)
+
+	fmt.Println("***********************************************************")
+	fmt.Printf("EVALUATE %d RULES FOR %sS WITH %d OR MORE REQUESTS --   ended\n", len(ruleset.Rules), strings.ToUpper(ruleset.Level), ruleset.MinFailures())
+	fmt.Println("***********************************************************")
+	fmt.Println(" ")
+}
+
+// evaluatePayments assigns the payments to buckets and records the new actions in the dunning history
+func evaluatePayments(db store.Store, ruleset *rules.Ruleset, now time.Time, timestamp string, operator string) {
+	summaries, err := db.PaymentSummaries(ruleset.Query(now))
+	if err != nil {
+		log.Fatal(err)
+	}
+	var actions []store.PaymentAction
+	for _, d := range ruleset.Evaluate(summaries, now) {
+		if d.Bucket != rules.BucketIgnore {
+			actions = append(actions, d.Action(timestamp))
+		}
+	}
+
+	// paymentsActions, paymentsWarnings and paymentsSuspended are derived from the recorded actions
+	added, err := db.RecordActions(actions, rules.TableBuckets, operator)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, a := range added {
+		fmt.Printf("SUCCESS: Inserted new %-13s for payments_id : %s (rule %s, %d requests)\n", a.Bucket, a.PaymentID, a.Rule, a.Count)
+	}
+}
+
+// evaluateCustomers assigns the customers to buckets and records the new customer actions in the dunning history
+func evaluateCustomers(db store.Store, ruleset *rules.Ruleset, now time.Time, timestamp string, operator string) {
+	customers, err := db.CustomerSummaries(ruleset.Query(now))
+	if err != nil {
+		log.Fatal(err)
+	}
+	var actions []store.CustomerAction
+	for _, d := range ruleset.EvaluateCustomers(customers, now) {
+		if d.Bucket != rules.BucketIgnore {
+			actions = append(actions, d.Action(timestamp))
+		}
+	}
+	added, err := db.RecordCustomerActions(actions, operator)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, a := range added {
+		fmt.Printf("SUCCESS: Inserted new %-13s for customer    : %s (rule %s, %d requests, %d payments)\n", a.Bucket, a.CustomerKey, a.Rule, a.Count, a.PaymentCount)
+	}
+}
+
+// updateStates derives the lifecycle state of the payments, lists the changes and records the payments
+// leaving the dunning in the dunning history
+func updateStates(db store.Store, timestamp string, operator string) {
+	changed, err := db.UpdatePaymentStates(rules.StateBuckets, timestamp)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var entries []store.DunningAction
+	for _, st := range changed {
+		if st.PreviousState == "" {
+			continue
+		}
+		fmt.Printf("SUCCESS: Changed state of payments_id : %s from %s to %s (%s %s)\n", st.PaymentID, st.PreviousState, st.State, st.LastEventAction, st.LastEventID)
+		if st.State == store.StateRecovered || st.State == store.StateWrittenOff {
+			entry, err := store.StateEntry(st, operator)
+			if err != nil {
+				log.Fatal(err)
+			}
+			entries = append(entries, entry)
+		}
+	}
+	if err = db.AppendHistory(entries); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,289 @@
+/********************************************************************************************************************
+ * name: export
+ * description: export files of a day, written by every run and by fp export for any past date
+ ********************************************************************************************************************/
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/tobkle/fp/exporter"
+	"github.com/tobkle/fp/rules"
+	"github.com/tobkle/fp/store"
+)
+
+// cmdExport implements `fp export`, the export files of -date rebuilt from the database
+func cmdExport(args []string) {
+	var o exportOptions
+	s := loadSettings(args)
+	flags := newExportFlags(&o, s)
+	s.apply(flags)
+	flags.Parse(args)
+
+	if _, err := parseDate(o.date); err != nil {
+		log.Fatal(err)
+	}
+	for _, file := range []struct {
+		prefix string
+		name   *string
+	}{
+		{"customers-to-warn-", &o.csvNameToWarn},
+		{"customers-to-suspend-small-", &o.csvNameToSuspendSmall},
+		{"customers-to-suspend-large-", &o.csvNameToSuspendLarge},
+		{"customers-to-reinstate-", &o.csvNameToReinstate},
+	} {
+		if *file.name == "" {
+			*file.name = datedName(s.dir, file.prefix, o.date)
+		}
+	}
+	expandDate(o.date, &o.csvNameToWarn, &o.csvNameToSuspendSmall, &o.csvNameToSuspendLarge, &o.csvNameToReinstate, &o.ff.xlsxTo)
+	ruleset, err := o.rf.ruleset()
+	if err != nil {
+		log.Fatal(err)
+	}
+	ex, err := o.ff.exporter()
+	if err != nil {
+		log.Fatal(err)
+	}
+	files := exports{
+		buckets:   outputFiles(ruleset, o.date, s.dir, o.csvNameToWarn, o.csvNameToSuspendSmall, o.csvNameToSuspendLarge),
+		reinstate: o.csvNameToReinstate,
+		xlsx:      o.ff.xlsxTo,
+	}
+	files.withExtension(ex)
+
+	db, err := store.Open(o.dbName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	fmt.Println("Received      Database Name      :", o.dbName)
+	if err = runExport(db, ex, ruleset, files, o.date); err != nil {
+		log.Fatalf("Export failed: %s", err)
+	}
+}
+
+// exportOptions are the parameters of fp export
+type exportOptions struct {
+	dbName                string
+	date                  string
+	rf                    rulesFlags
+	ff                    formatFlags
+	csvNameToWarn         string
+	csvNameToSuspendSmall string
+	csvNameToSuspendLarge string
+	csvNameToReinstate    string
+}
+
+// newExportFlags returns the parameters of fp export with the defaults in the data directory
+func newExportFlags(o *exportOptions, s *settings) *flag.FlagSet {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	flags.StringVar(&o.dbName, "db", defaultDatabase(s.dir), "Sqlite database to export from")
+	flags.StringVar(&o.date, "date", time.Now().Format("2006-01-02"), "date YYYY-MM-DD whose export files are rebuilt from the recorded actions")
+	o.rf.register(flags)
+	o.ff.register(flags)
+	flags.StringVar(&o.csvNameToWarn, "warn", "", "file to export the warned payments to (default customers-to-warn-<date>.csv)")
+	flags.StringVar(&o.csvNameToSuspendSmall, "toSmall", "", "file to export the small suspensions to (default customers-to-suspend-small-<date>.csv)")
+	flags.StringVar(&o.csvNameToSuspendLarge, "toLarge", "", "file to export the large suspensions to (default customers-to-suspend-large-<date>.csv)")
+	flags.StringVar(&o.csvNameToReinstate, "toReinstate", "", "file to export the suspended payments paid that day to (default customers-to-reinstate-<date>.csv)")
+	s.register(flags)
+	return flags
+}
+
+// exports are the files of a day
+type exports struct {
+	// buckets are the file per bucket
+	buckets   map[rules.Bucket]string
+	reinstate string
+	// xlsx is the workbook of all files, empty for none
+	xlsx string
+}
+
+// newExporter returns the exporter of the -format, -delimiter, -decimal, -bom and -crlf parameters
+func newExporter(format string, delimiter string, decimal string, bom bool, crlf bool) (*exporter.Exporter, error) {
+	ex := exporter.New()
+	var err error
+	if ex.Delimiter, err = exporter.ParseDelimiter(delimiter); err != nil {
+		return nil, err
+	}
+	if decimal != "." && decimal != "," {
+		return nil, fmt.Errorf("invalid decimal separator %q, use . or ,", decimal)
+	}
+	ex.DecimalSeparator, ex.BOM, ex.CRLF = decimal, bom, crlf
+	if ex.Format, err = exporter.ParseFormat(format); err != nil {
+		return nil, err
+	}
+	return ex, nil
+}
+
+// parseDate checks a YYYY-MM-DD date of -as-of or -date and returns the end of that day,
+// the time the rules are evaluated at
+func parseDate(date string) (time.Time, error) {
+	day, err := time.ParseInLocation(store.ISODate, date, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid date %q, use YYYY-MM-DD", date)
+	}
+	return day.AddDate(0, 0, 1).Add(-time.Nanosecond), nil
+}
+
+// datedName returns the default name of a file of date in dir, e.g. customers-to-warn-2022-05-28.csv
+func datedName(dir string, prefix string, date string) string {
+	return filepath.Join(dir, prefix+date+".csv")
+}
+
+// outputFiles returns the export file per bucket, the -warn, -toSmall and -toLarge names apply unless
+// the ruleset names a file, other buckets are written to dir
+func outputFiles(ruleset *rules.Ruleset, date string, dir string, warn string, small string, large string) map[rules.Bucket]string {
+	outputs := make(map[rules.Bucket]string)
+	for _, bucket := range rules.Buckets {
+		if _, ok := ruleset.Outputs[bucket]; ok || rules.DefaultOutputs[bucket] == "" {
+			outputs[bucket] = ruleset.Output(bucket, date)
+			if outputs[bucket] != "" && !filepath.IsAbs(outputs[bucket]) {
+				outputs[bucket] = filepath.Join(dir, outputs[bucket])
+			}
+			continue
+		}
+		switch bucket {
+		case rules.BucketWarn:
+			outputs[bucket] = warn
+		case rules.BucketSuspendSmall:
+			outputs[bucket] = small
+		case rules.BucketSuspendLarge:
+			outputs[bucket] = large
+		default:
+			outputs[bucket] = filepath.Join(dir, ruleset.Output(bucket, date))
+		}
+	}
+	return outputs
+}
+
+// withExtension gives the csv files the extension of the export format
+func (files *exports) withExtension(ex *exporter.Exporter) {
+	for bucket, name := range files.buckets {
+		if strings.HasSuffix(name, ".csv") {
+			files.buckets[bucket] = strings.TrimSuffix(name, ".csv") + ex.Extension()
+		}
+	}
+	if strings.HasSuffix(files.reinstate, ".csv") {
+		files.reinstate = strings.TrimSuffix(files.reinstate, ".csv") + ex.Extension()
+	}
+}
+
+// writeExports writes the bucket files, the reinstate file and the workbook of the actions recorded on date.
+// exported is called after each bucket file, e.g. to notify its customers.
+func writeExports(db store.Store, ex *exporter.Exporter, ruleset *rules.Ruleset, files exports, date string, exported func(bucket rules.Bucket) error) error {
+	// the warn and suspend files are always written, other buckets only if a rule uses them
+	buckets := []rules.Bucket{rules.BucketWarn, rules.BucketSuspendSmall, rules.BucketSuspendLarge}
+	for _, bucket := range ruleset.UsedBuckets() {
+		if bucket != rules.BucketWarn && bucket != rules.BucketSuspendSmall && bucket != rules.BucketSuspendLarge {
+			buckets = append(buckets, bucket)
+		}
+	}
+	var sheets []exporter.Sheet
+	for _, bucket := range buckets {
+		fmt.Println("***********************************************************")
+		fmt.Printf("CREATE %s file -- started\n", bucket)
+		fmt.Println("***********************************************************")
+		fmt.Println(" ")
+
+		var sheet exporter.Sheet
+		var err error
+		if ruleset.Level == rules.LevelCustomer {
+			sheet, err = exportCustomers(db, ex, bucket, date, files.buckets[bucket])
+		} else {
+			sheet, err = exportPayments(db, ex, bucket, date, files.buckets[bucket])
+		}
+		if err != nil {
+			return fmt.Errorf("export to %s failed: %w", files.buckets[bucket], err)
+		}
+		sheets = append(sheets, sheet)
+
+		if exported != nil {
+			if err = exported(bucket); err != nil {
+				return err
+			}
+		}
+
+		fmt.Println("***********************************************************")
+		fmt.Printf("CREATE %s file --   ended\n", bucket)
+		fmt.Println("***********************************************************")
+		fmt.Println(" ")
+	}
+
+	// suspended payments paid on date, always per payment
+	fmt.Println("***********************************************************")
+	fmt.Println("CREATE reinstate file -- started")
+	fmt.Println("***********************************************************")
+	reinstate, err := exportReinstate(db, ex, date, files.reinstate)
+	if err != nil {
+		return fmt.Errorf("export to %s failed: %w", files.reinstate, err)
+	}
+	sheets = append(sheets, reinstate)
+	fmt.Println("***********************************************************")
+	fmt.Println("CREATE reinstate file --   ended")
+	fmt.Println("***********************************************************")
+	fmt.Println(" ")
+
+	// the same rows as workbook, the summary sheet first
+	if files.xlsx != "" {
+		if err = ex.WriteWorkbook(files.xlsx, append([]exporter.Sheet{exporter.SummarySheet(sheets)}, sheets...)); err != nil {
+			return fmt.Errorf("export to %s failed: %w", files.xlsx, err)
+		}
+		fmt.Println("SUCCESS: Created workbook", files.xlsx)
+	}
+	return nil
+}
+
+// exportPayments writes the payments put into bucket on date to fileName and returns them as sheet
+func exportPayments(db store.Store, ex *exporter.Exporter, bucket rules.Bucket, date string, fileName string) (exporter.Sheet, error) {
+	rows, err := db.ActionExports(string(bucket), date)
+	if err != nil {
+		return exporter.Sheet{}, err
+	}
+	for _, row := range rows {
+		log.Printf("customer_id %s for payments_id %s had %d payment requests and exceeded the allowed limit --> %s", row.Event.CustomerID, row.Event.PaymentID, row.Count, fileName)
+	}
+	return exporter.PaymentSheet(string(bucket), rows), ex.WriteFile(fileName, rows)
+}
+
+// exportCustomers writes the customers put into bucket on date to fileName and returns them as sheet
+func exportCustomers(db store.Store, ex *exporter.Exporter, bucket rules.Bucket, date string, fileName string) (exporter.Sheet, error) {
+	rows, err := db.CustomerActionExports(string(bucket), date)
+	if err != nil {
+		return exporter.Sheet{}, err
+	}
+	for _, row := range rows {
+		log.Printf("customer %s with %d failing payments had %d payment requests and exceeded the allowed limit --> %s", row.Action.CustomerKey, row.Action.PaymentCount, row.Action.Count, fileName)
+	}
+	return exporter.CustomerSheet(string(bucket), rows), ex.WriteCustomerFile(fileName, rows)
+}
+
+// exportReinstate writes the suspended payments paid on date to fileName and returns them as sheet
+func exportReinstate(db store.Store, ex *exporter.Exporter, date string, fileName string) (exporter.Sheet, error) {
+	rows, err := db.ReinstateExports(date)
+	if err != nil {
+		return exporter.Sheet{}, err
+	}
+	for _, row := range rows {
+		log.Printf("customer_id %s for payments_id %s paid after suspension --> %s", row.Event.CustomerID, row.Event.PaymentID, fileName)
+	}
+	return exporter.PaymentSheet("reinstate", rows), ex.WriteFile(fileName, rows)
+}
+
+// runExport implements `fp export`, the files of date rebuilt from the actions recorded in the database
+func runExport(db store.Store, ex *exporter.Exporter, ruleset *rules.Ruleset, files exports, date string) error {
+	if _, err := db.Migrate(); err != nil {
+		return err
+	}
+	fmt.Println("***********************************************************")
+	fmt.Println("EXPORT", strings.ToUpper(ruleset.Level), "ACTIONS OF", date)
+	fmt.Println("***********************************************************")
+	fmt.Println(" ")
+	return writeExports(db, ex, ruleset, files, date, nil)
+}
@@ -0,0 +1,202 @@
+/********************************************************************************************************************
+ * name: exporter
+ * description: write warned and suspended payments or customers to the customers-to-* csv files
+ ********************************************************************************************************************/
+package exporter
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/tobkle/fp/store"
+)
+
+// Header is the first line of every export file
+var Header = []string{
+	"resource_type", "action", "details_origin", "details_cause", "details_description", "details_scheme",
+	"details_reason_code", "links_parent_event", "links_payment", "payments_id", "payments_created_at",
+	"payments_charge_date", "payments_amount", "payments_description", "payments_currency", "payments_status",
+	"customers_id", "customers_given_name", "customers_family_name", "customers_metadata_leadID",
+	"payments_links_mandate", "payments_metadata_identity", "elevate_account_number", "elevate_customer_name",
+	"payment_requests_counted", "crm_id", "crm_name", "crm_email", "crm_premise_address", "crm_stage_name",
+	"crm_zen_user_id",
+}
+
+// CustomerHeader is the first line of the export files on customer level, lists are separated by blanks
+var CustomerHeader = []string{
+	"customer_key", "customers_ids", "customers_given_name", "customers_family_name", "customers_metadata_leadID",
+	"payments_ids", "payments_links_mandates", "failed_payments_counted", "payment_requests_counted",
+	"outstanding_amount", "payments_currency", "worst_payments_status", "last_failure_at", "rule",
+	"elevate_account_number", "elevate_customer_name", "crm_id", "crm_name", "crm_email", "crm_premise_address",
+	"crm_stage_name", "crm_zen_user_id",
+}
+
+// amountColumns are written with the DecimalSeparator of the Exporter
+var amountColumns = map[string]bool{
+	"payments_amount":    true,
+	"outstanding_amount": true,
+}
+
+// formats of the export files
+const (
+	FormatCSV    = "csv"
+	FormatJSON   = "json"
+	FormatNDJSON = "ndjson"
+)
+
+// Exporter writes export rows to csv files, values are quoted where needed, or to json files
+type Exporter struct {
+	// Format of the files, FormatCSV by default, the csv options don't apply to json
+	Format string
+	// Delimiter separates the values, ',' by default, ';' for a German Excel
+	Delimiter rune
+	// BOM starts the file with a UTF-8 byte order mark, so Excel detects the encoding
+	BOM bool
+	// CRLF ends lines with \r\n instead of \n
+	CRLF bool
+	// DecimalSeparator of amounts, "." by default
+	DecimalSeparator string
+}
+
+// New returns an Exporter writing comma separated files with "\n" line endings and "." in amounts
+func New() *Exporter {
+	return &Exporter{Format: FormatCSV, Delimiter: ',', DecimalSeparator: "."}
+}
+
+// ParseFormat checks a format parameter
+func ParseFormat(value string) (string, error) {
+	switch value {
+	case "", FormatCSV:
+		return FormatCSV, nil
+	case FormatJSON, FormatNDJSON:
+		return value, nil
+	}
+	return "", fmt.Errorf("invalid format %q, use csv, json or ndjson", value)
+}
+
+// Extension is the file name extension of the format, with the dot
+func (ex *Exporter) Extension() string {
+	if ex.Format == "" {
+		return "." + FormatCSV
+	}
+	return "." + ex.Format
+}
+
+// ParseDelimiter reads a delimiter parameter: ",", ";", "tab" or any single character
+func ParseDelimiter(value string) (rune, error) {
+	switch value {
+	case "tab", "\\t":
+		return '\t', nil
+	case "comma":
+		return ',', nil
+	case "semicolon":
+		return ';', nil
+	}
+	runes := []rune(value)
+	if len(runes) != 1 || runes[0] == '"' || runes[0] == '\r' || runes[0] == '\n' {
+		return 0, fmt.Errorf("invalid delimiter %q, use a single character like , or ; or tab", value)
+	}
+	return runes[0], nil
+}
+
+// Record returns the values of a row in the order of Header
+func Record(row store.ExportRow) []string {
+	e := row.Event
+	return []string{
+		e.ResourceType, e.Action, e.DetailsOrigin, e.DetailsCause, e.DetailsDescription, e.DetailsScheme,
+		e.DetailsReasonCode, e.LinksParentEvent, e.LinksPayment, e.PaymentID, e.PaymentCreatedAt,
+		e.PaymentChargeDate, store.FormatAmount(e.AmountMinor, e.Currency), e.PaymentDescription, e.Currency,
+		e.PaymentStatus, e.CustomerID, e.CustomerGivenName, e.CustomerFamilyName, e.CustomerLeadID,
+		e.MandateID, e.PaymentIdentity, row.Account.AccountNumber, row.Account.CustomerName,
+		strconv.Itoa(row.Count), row.CRM.ID, row.CRM.Name, row.CRM.Email, row.CRM.PremiseAddress,
+		row.CRM.StageName, row.CRM.ZenUserID,
+	}
+}
+
+// CustomerRecord returns the values of a customer row in the order of CustomerHeader
+func CustomerRecord(row store.CustomerExportRow) []string {
+	a := row.Action
+	return []string{
+		a.CustomerKey, strings.Join(a.CustomerIDs, " "), a.CustomerGivenName, a.CustomerFamilyName, a.CustomerLeadID,
+		strings.Join(a.PaymentIDs, " "), strings.Join(a.Mandates, " "), strconv.Itoa(a.PaymentCount),
+		strconv.Itoa(a.Count), store.FormatAmount(a.OutstandingMinor, a.Currency), a.Currency, a.WorstStatus,
+		a.LastFailureAt, a.Rule, row.Account.AccountNumber, row.Account.CustomerName, row.CRM.ID, row.CRM.Name,
+		row.CRM.Email, row.CRM.PremiseAddress, row.CRM.StageName, row.CRM.ZenUserID,
+	}
+}
+
+// WriteFile creates or overwrites fileName with the header and one line per row, or a json document per row
+func (ex *Exporter) WriteFile(fileName string, rows []store.ExportRow) error {
+	if ex.Format == FormatJSON || ex.Format == FormatNDJSON {
+		var documents []interface{}
+		for _, row := range rows {
+			documents = append(documents, PaymentJSONDocument(row))
+		}
+		return ex.writeJSON(fileName, documents)
+	}
+	records := make([][]string, 0, len(rows))
+	for _, row := range rows {
+		records = append(records, Record(row))
+	}
+	return ex.write(fileName, Header, records)
+}
+
+// WriteCustomerFile creates or overwrites fileName with the customer header and one line per customer,
+// or a json document per customer
+func (ex *Exporter) WriteCustomerFile(fileName string, rows []store.CustomerExportRow) error {
+	if ex.Format == FormatJSON || ex.Format == FormatNDJSON {
+		var documents []interface{}
+		for _, row := range rows {
+			documents = append(documents, CustomerJSONDocument(row))
+		}
+		return ex.writeJSON(fileName, documents)
+	}
+	records := make([][]string, 0, len(rows))
+	for _, row := range rows {
+		records = append(records, CustomerRecord(row))
+	}
+	return ex.write(fileName, CustomerHeader, records)
+}
+
+// write creates or overwrites fileName with the header and the records
+func (ex *Exporter) write(fileName string, header []string, records [][]string) error {
+	f, err := os.OpenFile(fileName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if ex.BOM {
+		if _, err = f.WriteString("\ufeff"); err != nil {
+			return err
+		}
+	}
+	w := csv.NewWriter(f)
+	if ex.Delimiter != 0 {
+		w.Comma = ex.Delimiter
+	}
+	w.UseCRLF = ex.CRLF
+	if err = w.Write(header); err != nil {
+		return err
+	}
+	for _, values := range records {
+		if ex.DecimalSeparator != "" && ex.DecimalSeparator != "." {
+			for i, value := range values {
+				if amountColumns[header[i]] {
+					values[i] = strings.Replace(value, ".", ex.DecimalSeparator, 1)
+				}
+			}
+		}
+		if err = w.Write(values); err != nil {
+			return err
+		}
+	}
+	w.Flush()
+	if err = w.Error(); err != nil {
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,102 @@
+package exporter
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/tobkle/fp/store"
+)
+
+// exportRow is a payment of a customer whose name and address need quoting
+func exportRow() store.ExportRow {
+	return store.ExportRow{
+		Event: store.FailedPaymentEvent{PaymentID: "PM1", AmountMinor: 1250, Currency: "GBP", CustomerID: "CU1",
+			CustomerGivenName: "Anne", CustomerFamilyName: `O'Neil, "Annie"`, PaymentDescription: "line 1\nline 2"},
+		Count:   4,
+		Account: store.ElevateAccount{AccountNumber: "A1", CustomerName: "Anne O'Neil"},
+		CRM:     store.CRMAccount{ID: "C1", Email: "anne@example.com", PremiseAddress: "1 High St; Leeds"},
+	}
+}
+
+func TestParseDelimiter(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    rune
+		wantErr bool
+	}{
+		{",", ',', false},
+		{";", ';', false},
+		{"tab", '\t', false},
+		{`\t`, '\t', false},
+		{"semicolon", ';', false},
+		{"|", '|', false},
+		{"", 0, true},
+		{";;", 0, true},
+		{`"`, 0, true},
+		{"\n", 0, true},
+	}
+	for _, test := range tests {
+		got, err := ParseDelimiter(test.value)
+		if (err != nil) != test.wantErr || got != test.want {
+			t.Errorf("ParseDelimiter(%q) = %q, %v, want %q, error %v", test.value, got, err, test.want, test.wantErr)
+		}
+	}
+}
+
+func TestWriteFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		exporter Exporter
+		prefix   string
+		contains []string
+	}{
+		{"defaults", *New(), "resource_type,action,",
+			[]string{`,"line 1` + "\n" + `line 2",`, `,"O'Neil, ""Annie""",`, ",12.50,", ",4,", ",1 High St; Leeds,"}},
+		{"german excel", Exporter{Delimiter: ';', DecimalSeparator: ",", BOM: true, CRLF: true}, "\ufeffresource_type;action;",
+			[]string{";12,50;", ";\"1 High St; Leeds\";", "crm_zen_user_id\r\n", `;"O'Neil, ""Annie""";`}},
+		{"tab", Exporter{Delimiter: '\t', DecimalSeparator: "."}, "resource_type\taction\t",
+			[]string{"\t12.50\t", "\t1 High St; Leeds\t"}},
+	}
+	for _, test := range tests {
+		fileName := filepath.Join(t.TempDir(), "export.csv")
+		if err := test.exporter.WriteFile(fileName, []store.ExportRow{exportRow()}); err != nil {
+			t.Fatal(err)
+		}
+		content, err := os.ReadFile(fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(string(content), test.prefix) {
+			t.Errorf("%s: file starts with %q, want %q", test.name, string(content)[:20], test.prefix)
+		}
+		for _, part := range test.contains {
+			if !strings.Contains(string(content), part) {
+				t.Errorf("%s: file %q doesn't contain %q", test.name, content, part)
+			}
+		}
+		if !test.exporter.CRLF && strings.Contains(string(content), "\r") {
+			t.Errorf("%s: file has CR line endings", test.name)
+		}
+	}
+}
+
+func TestCustomerRecord(t *testing.T) {
+	row := store.CustomerExportRow{Action: store.CustomerAction{CustomerKey: "A1", CustomerIDs: []string{"CU1", "CU2"},
+		PaymentIDs: []string{"PM1", "PM2"}, PaymentCount: 2, Count: 7, OutstandingMinor: 150000, Currency: "JPY"}}
+	record := CustomerRecord(row)
+	if len(record) != len(CustomerHeader) {
+		t.Fatalf("CustomerRecord() has %d values, CustomerHeader %d", len(record), len(CustomerHeader))
+	}
+	want := map[string]string{"customers_ids": "CU1 CU2", "payments_ids": "PM1 PM2", "failed_payments_counted": "2",
+		"payment_requests_counted": "7", "outstanding_amount": "150000"}
+	for i, column := range CustomerHeader {
+		if value, ok := want[column]; ok && record[i] != value {
+			t.Errorf("%s = %q, want %q", column, record[i], value)
+		}
+	}
+	if len(Record(exportRow())) != len(Header) {
+		t.Errorf("Record() has %d values, Header %d", len(Record(exportRow())), len(Header))
+	}
+}
@@ -0,0 +1,201 @@
+/********************************************************************************************************************
+ * name: json
+ * description: write the export rows as json array or newline delimited json with nested objects
+ ********************************************************************************************************************/
+package exporter
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+
+	"github.com/tobkle/fp/store"
+)
+
+// PaymentDocument is the json form of an ExportRow
+type PaymentDocument struct {
+	Event                  EventJSON       `json:"event"`
+	Payment                PaymentJSON     `json:"payment"`
+	Customer               CustomerJSON    `json:"customer"`
+	PaymentRequestsCounted int             `json:"payment_requests_counted"`
+	ElevateAccount         *ElevateJSON    `json:"elevate_account"`
+	CRMAccount             *CRMAccountJSON `json:"crm_account"`
+}
+
+// CustomerDocument is the json form of a CustomerExportRow
+type CustomerDocument struct {
+	CustomerKey            string          `json:"customer_key"`
+	Customer               CustomerJSON    `json:"customer"`
+	CustomerIDs            []string        `json:"customers_ids"`
+	PaymentIDs             []string        `json:"payments_ids"`
+	Mandates               []string        `json:"mandates"`
+	FailedPaymentsCounted  int             `json:"failed_payments_counted"`
+	PaymentRequestsCounted int             `json:"payment_requests_counted"`
+	OutstandingAmount      json.Number     `json:"outstanding_amount"`
+	Currency               string          `json:"currency"`
+	WorstStatus            string          `json:"worst_status"`
+	LastFailureAt          string          `json:"last_failure_at"`
+	Rule                   string          `json:"rule"`
+	ElevateAccount         *ElevateJSON    `json:"elevate_account"`
+	CRMAccount             *CRMAccountJSON `json:"crm_account"`
+}
+
+// EventJSON is the failed payment event of the payment provider
+type EventJSON struct {
+	ID           string `json:"id"`
+	CreatedAt    string `json:"created_at"`
+	ResourceType string `json:"resource_type"`
+	Action       string `json:"action"`
+	Details      struct {
+		Origin      string `json:"origin"`
+		Cause       string `json:"cause"`
+		Description string `json:"description"`
+		Scheme      string `json:"scheme"`
+		ReasonCode  string `json:"reason_code"`
+	} `json:"details"`
+	Links struct {
+		ParentEvent string `json:"parent_event"`
+		Payment     string `json:"payment"`
+	} `json:"links"`
+}
+
+// PaymentJSON is the failed payment, Amount in major units and AmountMinor in the smallest unit of Currency
+type PaymentJSON struct {
+	ID          string      `json:"id"`
+	CreatedAt   string      `json:"created_at"`
+	ChargeDate  string      `json:"charge_date"`
+	Amount      json.Number `json:"amount"`
+	AmountMinor int64       `json:"amount_minor"`
+	Currency    string      `json:"currency"`
+	Description string      `json:"description"`
+	Status      string      `json:"status"`
+	Mandate     string      `json:"mandate"`
+	Identity    string      `json:"identity"`
+}
+
+// CustomerJSON is the customer of the payment provider
+type CustomerJSON struct {
+	ID         string `json:"id,omitempty"`
+	GivenName  string `json:"given_name"`
+	FamilyName string `json:"family_name"`
+	LeadID     string `json:"lead_id"`
+}
+
+// ElevateJSON is the Elevate account of a mandate
+type ElevateJSON struct {
+	MandateReference string `json:"mandate_reference"`
+	AccountNumber    string `json:"account_number"`
+	CustomerName     string `json:"customer_name"`
+}
+
+// CRMAccountJSON is the CRM account of an Elevate account
+type CRMAccountJSON struct {
+	AccountNumber  string `json:"account_number"`
+	ID             string `json:"id"`
+	Name           string `json:"name"`
+	Email          string `json:"email"`
+	PremiseAddress string `json:"premise_address"`
+	StageName      string `json:"stage_name"`
+	ZenUserID      string `json:"zen_user_id"`
+}
+
+// PaymentJSONDocument converts an export row, accounts not found are null
+func PaymentJSONDocument(row store.ExportRow) PaymentDocument {
+	e := row.Event
+	doc := PaymentDocument{
+		Event: EventJSON{ID: e.ID, CreatedAt: e.CreatedAt, ResourceType: e.ResourceType, Action: e.Action},
+		Payment: PaymentJSON{ID: e.PaymentID, CreatedAt: e.PaymentCreatedAt, ChargeDate: e.PaymentChargeDate,
+			Amount: json.Number(store.FormatAmount(e.AmountMinor, e.Currency)), AmountMinor: e.AmountMinor,
+			Currency: e.Currency, Description: e.PaymentDescription, Status: e.PaymentStatus, Mandate: e.MandateID,
+			Identity: e.PaymentIdentity},
+		Customer: CustomerJSON{ID: e.CustomerID, GivenName: e.CustomerGivenName, FamilyName: e.CustomerFamilyName,
+			LeadID: e.CustomerLeadID},
+		PaymentRequestsCounted: row.Count,
+		ElevateAccount:         elevateJSON(row.Account),
+		CRMAccount:             crmJSON(row.CRM),
+	}
+	doc.Event.Details.Origin, doc.Event.Details.Cause = e.DetailsOrigin, e.DetailsCause
+	doc.Event.Details.Description, doc.Event.Details.Scheme = e.DetailsDescription, e.DetailsScheme
+	doc.Event.Details.ReasonCode = e.DetailsReasonCode
+	doc.Event.Links.ParentEvent, doc.Event.Links.Payment = e.LinksParentEvent, e.LinksPayment
+	return doc
+}
+
+// CustomerJSONDocument converts a customer export row, accounts not found are null
+func CustomerJSONDocument(row store.CustomerExportRow) CustomerDocument {
+	a := row.Action
+	return CustomerDocument{
+		CustomerKey:            a.CustomerKey,
+		Customer:               CustomerJSON{GivenName: a.CustomerGivenName, FamilyName: a.CustomerFamilyName, LeadID: a.CustomerLeadID},
+		CustomerIDs:            nonNil(a.CustomerIDs),
+		PaymentIDs:             nonNil(a.PaymentIDs),
+		Mandates:               nonNil(a.Mandates),
+		FailedPaymentsCounted:  a.PaymentCount,
+		PaymentRequestsCounted: a.Count,
+		OutstandingAmount:      json.Number(store.FormatAmount(a.OutstandingMinor, a.Currency)),
+		Currency:               a.Currency,
+		WorstStatus:            a.WorstStatus,
+		LastFailureAt:          a.LastFailureAt,
+		Rule:                   a.Rule,
+		ElevateAccount:         elevateJSON(row.Account),
+		CRMAccount:             crmJSON(row.CRM),
+	}
+}
+
+func elevateJSON(account store.ElevateAccount) *ElevateJSON {
+	if account.AccountNumber == "" && account.MandateReference == "" {
+		return nil
+	}
+	return &ElevateJSON{MandateReference: account.MandateReference, AccountNumber: account.AccountNumber,
+		CustomerName: account.CustomerName}
+}
+
+func crmJSON(account store.CRMAccount) *CRMAccountJSON {
+	if account.AccountNumber == "" && account.ID == "" {
+		return nil
+	}
+	return &CRMAccountJSON{AccountNumber: account.AccountNumber, ID: account.ID, Name: account.Name,
+		Email: account.Email, PremiseAddress: account.PremiseAddress, StageName: account.StageName,
+		ZenUserID: account.ZenUserID}
+}
+
+// nonNil makes empty lists [] instead of null
+func nonNil(values []string) []string {
+	if values == nil {
+		return []string{}
+	}
+	return values
+}
+
+// writeJSON creates or overwrites fileName with the documents as indented json array,
+// or with one document per line for FormatNDJSON
+func (ex *Exporter) writeJSON(fileName string, documents []interface{}) error {
+	f, err := os.OpenFile(fileName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	if ex.Format == FormatNDJSON {
+		for _, doc := range documents {
+			if err = enc.Encode(doc); err != nil {
+				return err
+			}
+		}
+	} else {
+		enc.SetIndent("", "  ")
+		if documents == nil {
+			documents = []interface{}{}
+		}
+		if err = enc.Encode(documents); err != nil {
+			return err
+		}
+	}
+	if err = w.Flush(); err != nil {
+		return err
+	}
+	return f.Close()
+}
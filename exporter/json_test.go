@@ -0,0 +1,113 @@
+package exporter
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/tobkle/fp/store"
+)
+
+func TestPaymentJSONDocument(t *testing.T) {
+	noAccounts := exportRow()
+	noAccounts.Account, noAccounts.CRM = store.ElevateAccount{}, store.CRMAccount{}
+	jpy := exportRow()
+	jpy.Event.AmountMinor, jpy.Event.Currency = 1500, "JPY"
+	tests := []struct {
+		name     string
+		row      store.ExportRow
+		contains []string
+	}{
+		{"accounts", exportRow(), []string{`"amount":12.50,`, `"amount_minor":1250,`, `"payment_requests_counted":4,`,
+			`"elevate_account":{"mandate_reference":"","account_number":"A1"`, `"email":"anne@example.com"`,
+			`"family_name":"O'Neil, \"Annie\""`, `"description":"line 1\nline 2"`}},
+		{"no accounts", noAccounts, []string{`"elevate_account":null,"crm_account":null}`}},
+		{"no decimals", jpy, []string{`"amount":1500,`, `"currency":"JPY"`}},
+	}
+	for _, test := range tests {
+		content, err := json.Marshal(PaymentJSONDocument(test.row))
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		for _, want := range test.contains {
+			if !strings.Contains(string(content), want) {
+				t.Errorf("%s: document %s doesn't contain %s", test.name, content, want)
+			}
+		}
+	}
+}
+
+func TestCustomerJSONDocument(t *testing.T) {
+	tests := []struct {
+		name     string
+		row      store.CustomerExportRow
+		contains []string
+	}{
+		{"accounts", store.CustomerExportRow{
+			Action: store.CustomerAction{CustomerKey: "lead:L1", Count: 7, PaymentCount: 2, OutstandingMinor: 3000,
+				Currency: "EUR", CustomerIDs: []string{"CU1", "CU2"}, PaymentIDs: []string{"PM1", "PM2"},
+				Mandates: []string{"MD1"}, CustomerGivenName: "Anne"},
+			Account: store.ElevateAccount{AccountNumber: "A1"}},
+			[]string{`"customer_key":"lead:L1"`, `"customers_ids":["CU1","CU2"]`, `"outstanding_amount":30.00,`,
+				`"failed_payments_counted":2,"payment_requests_counted":7,`, `"crm_account":null}`}},
+		{"empty lists", store.CustomerExportRow{Action: store.CustomerAction{CustomerKey: "id:CU1", Currency: "GBP"}},
+			[]string{`"customers_ids":[],"payments_ids":[],"mandates":[]`, `"elevate_account":null,"crm_account":null}`,
+				`"customer":{"given_name":""`}},
+	}
+	for _, test := range tests {
+		content, err := json.Marshal(CustomerJSONDocument(test.row))
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		for _, want := range test.contains {
+			if !strings.Contains(string(content), want) {
+				t.Errorf("%s: document %s doesn't contain %s", test.name, content, want)
+			}
+		}
+	}
+}
+
+func TestWriteJSON(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		rows   []store.ExportRow
+		want   func(content string) bool
+	}{
+		{"json", FormatJSON, []store.ExportRow{exportRow(), exportRow()}, func(content string) bool {
+			var documents []PaymentDocument
+			return json.Unmarshal([]byte(content), &documents) == nil && len(documents) == 2 &&
+				strings.HasPrefix(content, "[\n  {\n") && documents[0].Payment.ID == "PM1"
+		}},
+		{"empty json", FormatJSON, nil, func(content string) bool { return content == "[]\n" }},
+		{"ndjson", FormatNDJSON, []store.ExportRow{exportRow(), exportRow()}, func(content string) bool {
+			lines := strings.Split(strings.TrimSuffix(content, "\n"), "\n")
+			for _, line := range lines {
+				var document PaymentDocument
+				if json.Unmarshal([]byte(line), &document) != nil || document.Payment.ID != "PM1" {
+					return false
+				}
+			}
+			return len(lines) == 2
+		}},
+		{"empty ndjson", FormatNDJSON, nil, func(content string) bool { return content == "" }},
+		{"no html escaping", FormatNDJSON, []store.ExportRow{{Event: store.FailedPaymentEvent{PaymentDescription: "<a&b>"}}},
+			func(content string) bool { return strings.Contains(content, `"description":"<a&b>"`) }},
+	}
+	for _, test := range tests {
+		ex := &Exporter{Format: test.format}
+		fileName := filepath.Join(t.TempDir(), "export"+ex.Extension())
+		if err := ex.WriteFile(fileName, test.rows); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		content, err := os.ReadFile(fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !test.want(string(content)) {
+			t.Errorf("%s: unexpected file %q", test.name, content)
+		}
+	}
+}
@@ -0,0 +1,356 @@
+/********************************************************************************************************************
+ * name: xlsx
+ * description: write the export rows as xlsx workbook, one sheet per bucket and a summary sheet
+ ********************************************************************************************************************/
+package exporter
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tobkle/fp/store"
+)
+
+// Sheet is one worksheet, the records are the values of Record or CustomerRecord
+type Sheet struct {
+	Name    string
+	Header  []string
+	Records [][]string
+}
+
+// kinds of cells, by column name
+var (
+	numberColumns = map[string]bool{
+		"payments_amount":          true,
+		"outstanding_amount":       true,
+		"payment_requests_counted": true,
+		"failed_payments_counted":  true,
+		"rows":                     true,
+		"amount":                   true,
+	}
+	dateColumns     = map[string]bool{"payments_charge_date": true}
+	dateTimeColumns = map[string]bool{"payments_created_at": true, "last_failure_at": true}
+)
+
+// cell styles, the positions in cellXfs of stylesXML
+const (
+	styleDefault = iota
+	styleHeader
+	styleDate
+	styleDateTime
+	styleAmount
+	styleInteger
+)
+
+// plainNumber is a number cell value, strconv.ParseFloat would also take NaN, Inf and exponents Excel rejects
+var plainNumber = regexp.MustCompile(`^-?[0-9]+(\.[0-9]+)?$`)
+
+// excelEpoch is day 0 of the serial dates of Excel
+var excelEpoch = time.Date(1899, 12, 30, 0, 0, 0, 0, time.UTC)
+
+// PaymentSheet returns the payment rows of a bucket as sheet
+func PaymentSheet(name string, rows []store.ExportRow) Sheet {
+	sheet := Sheet{Name: name, Header: Header}
+	for _, row := range rows {
+		sheet.Records = append(sheet.Records, Record(row))
+	}
+	return sheet
+}
+
+// CustomerSheet returns the customer rows of a bucket as sheet
+func CustomerSheet(name string, rows []store.CustomerExportRow) Sheet {
+	sheet := Sheet{Name: name, Header: CustomerHeader}
+	for _, row := range rows {
+		sheet.Records = append(sheet.Records, CustomerRecord(row))
+	}
+	return sheet
+}
+
+// SummarySheet counts the rows, payment requests and amounts per sheet and currency
+func SummarySheet(sheets []Sheet) Sheet {
+	summary := Sheet{Name: "summary", Header: []string{"bucket", "currency", "rows", "payment_requests_counted", "amount"}}
+	for _, sheet := range sheets {
+		column := func(name string) int {
+			for i, h := range sheet.Header {
+				if h == name {
+					return i
+				}
+			}
+			return -1
+		}
+		currencyAt, requestsAt := column("payments_currency"), column("payment_requests_counted")
+		amountAt := column("payments_amount")
+		if amountAt < 0 {
+			amountAt = column("outstanding_amount")
+		}
+
+		type total struct {
+			rows, requests int
+			amount         int64
+		}
+		totals := map[string]*total{}
+		var currencies []string
+		for _, record := range sheet.Records {
+			currency := record[currencyAt]
+			t, ok := totals[currency]
+			if !ok {
+				t = &total{}
+				totals[currency] = t
+				currencies = append(currencies, currency)
+			}
+			t.rows++
+			n, _ := strconv.Atoi(record[requestsAt])
+			t.requests += n
+			amount, _ := store.ParseAmount(record[amountAt], currency)
+			t.amount += amount
+		}
+		if len(currencies) == 0 {
+			summary.Records = append(summary.Records, []string{sheet.Name, "", "0", "0", ""})
+		}
+		for _, currency := range currencies {
+			t := totals[currency]
+			summary.Records = append(summary.Records, []string{sheet.Name, currency, strconv.Itoa(t.rows),
+				strconv.Itoa(t.requests), store.FormatAmount(t.amount, currency)})
+		}
+	}
+	return summary
+}
+
+// WriteWorkbook creates or overwrites an xlsx file with one worksheet per sheet. Every sheet has a frozen
+// header row with an auto filter, numbers and dates are typed cells.
+func (ex *Exporter) WriteWorkbook(fileName string, sheets []Sheet) error {
+	f, err := os.OpenFile(fileName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	z := zip.NewWriter(f)
+	files := []struct{ name, content string }{
+		{"[Content_Types].xml", contentTypesXML(len(sheets))},
+		{"_rels/.rels", rootRelsXML},
+		{"xl/workbook.xml", workbookXML(sheets)},
+		{"xl/_rels/workbook.xml.rels", workbookRelsXML(len(sheets))},
+		{"xl/styles.xml", stylesXML},
+	}
+	for i, sheet := range sheets {
+		files = append(files, struct{ name, content string }{fmt.Sprintf("xl/worksheets/sheet%d.xml", i+1), sheetXML(sheet)})
+	}
+	for _, file := range files {
+		w, err := z.Create(file.name)
+		if err != nil {
+			return err
+		}
+		if _, err = w.Write([]byte(file.content)); err != nil {
+			return err
+		}
+	}
+	if err = z.Close(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+const xmlHeader = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` + "\n"
+
+const rootRelsXML = xmlHeader + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+	`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>` +
+	`</Relationships>`
+
+// stylesXML defines the cell styles in the order of the style constants
+const stylesXML = xmlHeader + `<styleSheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">` +
+	`<numFmts count="1"><numFmt numFmtId="164" formatCode="yyyy-mm-dd hh:mm:ss"/></numFmts>` +
+	`<fonts count="2"><font><sz val="11"/><name val="Calibri"/></font><font><b/><sz val="11"/><name val="Calibri"/></font></fonts>` +
+	`<fills count="2"><fill><patternFill patternType="none"/></fill><fill><patternFill patternType="gray125"/></fill></fills>` +
+	`<borders count="1"><border><left/><right/><top/><bottom/><diagonal/></border></borders>` +
+	`<cellStyleXfs count="1"><xf numFmtId="0" fontId="0" fillId="0" borderId="0"/></cellStyleXfs>` +
+	`<cellXfs count="6">` +
+	`<xf numFmtId="0" fontId="0" fillId="0" borderId="0" xfId="0"/>` +
+	`<xf numFmtId="0" fontId="1" fillId="0" borderId="0" xfId="0" applyFont="1"/>` +
+	`<xf numFmtId="14" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/>` +
+	`<xf numFmtId="164" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/>` +
+	`<xf numFmtId="4" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/>` +
+	`<xf numFmtId="1" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/>` +
+	`</cellXfs>` +
+	`<cellStyles count="1"><cellStyle name="Normal" xfId="0" builtinId="0"/></cellStyles>` +
+	`</styleSheet>`
+
+func contentTypesXML(sheets int) string {
+	var b strings.Builder
+	b.WriteString(xmlHeader + `<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">`)
+	b.WriteString(`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>`)
+	b.WriteString(`<Default Extension="xml" ContentType="application/xml"/>`)
+	b.WriteString(`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>`)
+	b.WriteString(`<Override PartName="/xl/styles.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.styles+xml"/>`)
+	for i := 1; i <= sheets; i++ {
+		fmt.Fprintf(&b, `<Override PartName="/xl/worksheets/sheet%d.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>`, i)
+	}
+	b.WriteString(`</Types>`)
+	return b.String()
+}
+
+func workbookXML(sheets []Sheet) string {
+	var b strings.Builder
+	b.WriteString(xmlHeader + `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" ` +
+		`xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets>`)
+	for i, sheet := range sheets {
+		fmt.Fprintf(&b, `<sheet name="%s" sheetId="%d" r:id="rId%d"/>`, escape(sheetName(sheet.Name)), i+1, i+1)
+	}
+	b.WriteString(`</sheets><definedNames>`)
+	// the auto filter of a sheet is a hidden name, Excel expects it
+	for i, sheet := range sheets {
+		fmt.Fprintf(&b, `<definedName name="_xlnm._FilterDatabase" localSheetId="%d" hidden="1">'%s'!%s</definedName>`,
+			i, escape(strings.ReplaceAll(sheetName(sheet.Name), "'", "''")), filterRange(sheet, true))
+	}
+	b.WriteString(`</definedNames></workbook>`)
+	return b.String()
+}
+
+func workbookRelsXML(sheets int) string {
+	var b strings.Builder
+	b.WriteString(xmlHeader + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">`)
+	for i := 1; i <= sheets; i++ {
+		fmt.Fprintf(&b, `<Relationship Id="rId%d" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet%d.xml"/>`, i, i)
+	}
+	fmt.Fprintf(&b, `<Relationship Id="rId%d" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/styles" Target="styles.xml"/>`, sheets+1)
+	b.WriteString(`</Relationships>`)
+	return b.String()
+}
+
+// sheetXML renders a worksheet with frozen header row, auto filter and column widths fitting the values
+func sheetXML(sheet Sheet) string {
+	var b strings.Builder
+	b.WriteString(xmlHeader + `<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">`)
+	fmt.Fprintf(&b, `<dimension ref="%s"/>`, filterRange(sheet, false))
+	b.WriteString(`<sheetViews><sheetView workbookViewId="0"><pane ySplit="1" topLeftCell="A2" activePane="bottomLeft" state="frozen"/>` +
+		`<selection pane="bottomLeft" activeCell="A2" sqref="A2"/></sheetView></sheetViews>`)
+
+	b.WriteString(`<cols>`)
+	for i, name := range sheet.Header {
+		width := len(name)
+		for _, record := range sheet.Records {
+			if n := len([]rune(record[i])); n > width {
+				width = n
+			}
+		}
+		if dateTimeColumns[name] {
+			width = 19
+		}
+		if width > 60 {
+			width = 60
+		}
+		fmt.Fprintf(&b, `<col min="%d" max="%d" width="%d" customWidth="1"/>`, i+1, i+1, width+2)
+	}
+	b.WriteString(`</cols><sheetData>`)
+
+	b.WriteString(`<row r="1">`)
+	for i, name := range sheet.Header {
+		writeString(&b, cellName(i, 1), name, styleHeader)
+	}
+	b.WriteString(`</row>`)
+	for r, record := range sheet.Records {
+		fmt.Fprintf(&b, `<row r="%d">`, r+2)
+		for i, value := range record {
+			writeCell(&b, cellName(i, r+2), sheet.Header[i], value, currencyOf(sheet.Header, record))
+		}
+		b.WriteString(`</row>`)
+	}
+	b.WriteString(`</sheetData>`)
+	fmt.Fprintf(&b, `<autoFilter ref="%s"/>`, filterRange(sheet, false))
+	b.WriteString(`</worksheet>`)
+	return b.String()
+}
+
+// writeCell writes a typed cell for number and date columns, values that don't parse are written as text
+func writeCell(b *strings.Builder, ref string, column string, value string, currency string) {
+	switch {
+	case value == "":
+		return
+	case numberColumns[column]:
+		if plainNumber.MatchString(value) {
+			style := styleInteger
+			if strings.Contains(column, "amount") && store.CurrencyExponent(currency) > 0 {
+				style = styleAmount
+			}
+			fmt.Fprintf(b, `<c r="%s" s="%d"><v>%s</v></c>`, ref, style, value)
+			return
+		}
+	case dateColumns[column]:
+		if t, err := time.Parse(store.ISODate, value); err == nil {
+			fmt.Fprintf(b, `<c r="%s" s="%d"><v>%s</v></c>`, ref, styleDate, serial(t))
+			return
+		}
+	case dateTimeColumns[column]:
+		if t, err := store.ParseTimestamp(value); err == nil {
+			fmt.Fprintf(b, `<c r="%s" s="%d"><v>%s</v></c>`, ref, styleDateTime, serial(t))
+			return
+		}
+	}
+	writeString(b, ref, value, styleDefault)
+}
+
+// writeString writes an inline string cell
+func writeString(b *strings.Builder, ref string, value string, style int) {
+	fmt.Fprintf(b, `<c r="%s" s="%d" t="inlineStr"><is><t xml:space="preserve">%s</t></is></c>`, ref, style, escape(value))
+}
+
+// currencyOf returns the payments_currency of a record
+func currencyOf(header []string, record []string) string {
+	for i, name := range header {
+		if name == "payments_currency" || name == "currency" {
+			return record[i]
+		}
+	}
+	return ""
+}
+
+// serial converts a time into an Excel serial date, days since 1899-12-30
+func serial(t time.Time) string {
+	days := t.UTC().Sub(excelEpoch).Hours() / 24
+	return strconv.FormatFloat(days, 'f', -1, 64)
+}
+
+// cellName returns the A1 reference of a zero based column and a row
+func cellName(column int, row int) string {
+	name := ""
+	for column++; column > 0; column = (column - 1) / 26 {
+		name = string(rune('A'+(column-1)%26)) + name
+	}
+	return name + strconv.Itoa(row)
+}
+
+// filterRange is the range of header and records, absolute for defined names
+func filterRange(sheet Sheet, absolute bool) string {
+	from, to := cellName(0, 1), cellName(len(sheet.Header)-1, len(sheet.Records)+1)
+	if absolute {
+		split := func(ref string) string {
+			i := strings.IndexAny(ref, "0123456789")
+			return "$" + ref[:i] + "$" + ref[i:]
+		}
+		from, to = split(from), split(to)
+	}
+	return from + ":" + to
+}
+
+// sheetName removes the characters Excel doesn't allow in sheet names and shortens it to 31 characters
+func sheetName(name string) string {
+	name = strings.NewReplacer("[", "", "]", "", ":", "", "*", "", "?", "", "/", "", "\\", "").Replace(name)
+	if runes := []rune(name); len(runes) > 31 {
+		name = string(runes[:31])
+	}
+	return name
+}
+
+// escape escapes a value for xml text and attributes, invalid characters become U+FFFD
+func escape(value string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(value))
+	return buf.String()
+}
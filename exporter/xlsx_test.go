@@ -0,0 +1,142 @@
+package exporter
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/tobkle/fp/store"
+)
+
+func TestWriteCell(t *testing.T) {
+	tests := []struct {
+		column   string
+		value    string
+		currency string
+		want     string
+	}{
+		{"payments_amount", "12.50", "GBP", `<c r="A2" s="4"><v>12.50</v></c>`},
+		{"payments_amount", "1500", "JPY", `<c r="A2" s="5"><v>1500</v></c>`},
+		{"payment_requests_counted", "4", "GBP", `<c r="A2" s="5"><v>4</v></c>`},
+		{"payments_amount", "-3.20", "GBP", `<c r="A2" s="4"><v>-3.20</v></c>`},
+		{"payments_amount", "NaN", "GBP", `<c r="A2" s="0" t="inlineStr"><is><t xml:space="preserve">NaN</t></is></c>`},
+		{"payments_amount", "1e5", "GBP", `<c r="A2" s="0" t="inlineStr"><is><t xml:space="preserve">1e5</t></is></c>`},
+		{"payments_amount", "12,50", "GBP", `<c r="A2" s="0" t="inlineStr"><is><t xml:space="preserve">12,50</t></is></c>`},
+		{"payments_charge_date", "2022-05-28", "GBP", `<c r="A2" s="2"><v>44709</v></c>`},
+		{"payments_charge_date", "28/05/2022", "GBP", `<c r="A2" s="0" t="inlineStr"><is><t xml:space="preserve">28/05/2022</t></is></c>`},
+		{"payments_created_at", "2022-05-28T12:00:00.000Z", "GBP", `<c r="A2" s="3"><v>44709.5</v></c>`},
+		{"customers_id", "0042", "GBP", `<c r="A2" s="0" t="inlineStr"><is><t xml:space="preserve">0042</t></is></c>`},
+		{"customers_family_name", `<O'Neil & "Sons">`, "GBP",
+			`<c r="A2" s="0" t="inlineStr"><is><t xml:space="preserve">&lt;O&#39;Neil &amp; &#34;Sons&#34;&gt;</t></is></c>`},
+		{"payments_description", "bad \x01 byte", "GBP",
+			`<c r="A2" s="0" t="inlineStr"><is><t xml:space="preserve">bad ` + "�" + ` byte</t></is></c>`},
+		{"payments_amount", "", "GBP", ""},
+	}
+	for _, test := range tests {
+		var b strings.Builder
+		writeCell(&b, "A2", test.column, test.value, test.currency)
+		if b.String() != test.want {
+			t.Errorf("writeCell(%s, %q) = %s, want %s", test.column, test.value, b.String(), test.want)
+		}
+	}
+}
+
+func TestSheetName(t *testing.T) {
+	tests := []struct{ name, want string }{
+		{"warn", "warn"},
+		{"suspend/small [GBP]: a*b?", "suspendsmall GBP ab"},
+		{`back\slash`, "backslash"},
+		{"customers-to-suspend-large-2022-05-28", "customers-to-suspend-large-2022"},
+		{"überfällige-zahlungen-mit-umlauten-äöü", "überfällige-zahlungen-mit-umlau"},
+	}
+	for _, test := range tests {
+		if got := sheetName(test.name); got != test.want {
+			t.Errorf("sheetName(%q) = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestCellName(t *testing.T) {
+	tests := []struct {
+		column, row int
+		want        string
+	}{
+		{0, 1, "A1"}, {25, 2, "Z2"}, {26, 3, "AA3"}, {51, 4, "AZ4"}, {52, 5, "BA5"}, {701, 6, "ZZ6"}, {702, 7, "AAA7"},
+	}
+	for _, test := range tests {
+		if got := cellName(test.column, test.row); got != test.want {
+			t.Errorf("cellName(%d, %d) = %s, want %s", test.column, test.row, got, test.want)
+		}
+	}
+}
+
+func TestSummarySheet(t *testing.T) {
+	row := func(amount int64, currency string, count int) store.ExportRow {
+		return store.ExportRow{Event: store.FailedPaymentEvent{AmountMinor: amount, Currency: currency}, Count: count}
+	}
+	summary := SummarySheet([]Sheet{
+		PaymentSheet("warn", []store.ExportRow{row(1250, "GBP", 3), row(750, "GBP", 3), row(1000, "JPY", 3)}),
+		PaymentSheet("escalate", nil),
+	})
+	want := [][]string{
+		{"warn", "GBP", "2", "6", "20.00"},
+		{"warn", "JPY", "1", "3", "1000"},
+		{"escalate", "", "0", "0", ""},
+	}
+	if len(summary.Records) != len(want) {
+		t.Fatalf("SummarySheet() = %v, want %v", summary.Records, want)
+	}
+	for i := range want {
+		if strings.Join(summary.Records[i], "|") != strings.Join(want[i], "|") {
+			t.Errorf("summary row %d = %v, want %v", i, summary.Records[i], want[i])
+		}
+	}
+}
+
+// TestWriteWorkbook checks that every part of the workbook is well-formed xml
+func TestWriteWorkbook(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "export.xlsx")
+	sheets := []Sheet{PaymentSheet("warn", []store.ExportRow{exportRow()}), PaymentSheet("O'Brien's [list]", nil)}
+	sheets = append(sheets, SummarySheet(sheets))
+	if err := New().WriteWorkbook(fileName, sheets); err != nil {
+		t.Fatal(err)
+	}
+	z, err := zip.OpenReader(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer z.Close()
+	names := map[string]bool{}
+	for _, f := range z.File {
+		names[f.Name] = true
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoder := xml.NewDecoder(strings.NewReader(string(content)))
+		for {
+			if _, err = decoder.Token(); err != nil {
+				break
+			}
+		}
+		if err != io.EOF {
+			t.Errorf("%s is not well-formed: %v", f.Name, err)
+		}
+		if f.Name == "xl/workbook.xml" && !strings.Contains(string(content), `'O&#39;&#39;Brien&#39;&#39;s list'!$A$1:$AE$1`) {
+			t.Errorf("workbook.xml = %s, want the quoted filter range of O'Brien's list", content)
+		}
+	}
+	for _, name := range []string{"[Content_Types].xml", "xl/workbook.xml", "xl/styles.xml", "xl/worksheets/sheet3.xml"} {
+		if !names[name] {
+			t.Errorf("workbook has no %s", name)
+		}
+	}
+}
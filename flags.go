@@ -0,0 +1,112 @@
+/********************************************************************************************************************
+ * name: flags
+ * description: parameters shared by the fp commands
+ ********************************************************************************************************************/
+package main
+
+import (
+	"flag"
+	"path/filepath"
+
+	"github.com/tobkle/fp/exporter"
+	"github.com/tobkle/fp/importer"
+	"github.com/tobkle/fp/rules"
+	"github.com/tobkle/fp/store"
+)
+
+// parseArgs parses the parameters of args, also those following a positional argument like
+// `fp import payments file.csv -db x`, and returns the positional arguments
+func parseArgs(flags *flag.FlagSet, args []string) []string {
+	var positional []string
+	for {
+		flags.Parse(args)
+		args = flags.Args()
+		if len(args) == 0 {
+			return positional
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+// defaultDatabase is the database of the data directory, by default next to the executable
+func defaultDatabase(dir string) string {
+	return filepath.Join(dir, "failed-payment-requests-database.sqlite3")
+}
+
+// rulesFlags are the parameters of the dunning rules
+type rulesFlags struct {
+	thresholds  rules.Thresholds
+	rulesFrom   string
+	countWindow string
+	countBy     string
+	level       string
+}
+
+func (f *rulesFlags) register(flags *flag.FlagSet) {
+	flags.IntVar(&f.thresholds.WarnCount, "count-warn", 3, "payment requests to warn - for exporting")
+	flags.IntVar(&f.thresholds.SuspendCount, "count-suspend", 4, "minimum payment requests  to suspend- for exporting")
+	flags.Float64Var(&f.thresholds.AmountSwitch, "amount", 20.0, "amount to switch between small and large amounts")
+	flags.StringVar(&f.rulesFrom, "rules", "", "YAML or JSON ruleset file, replaces -count-warn, -count-suspend and -amount (optional)")
+	flags.StringVar(&f.countWindow, "window", "", "count only failures of this period, e.g. 60d, 8w (default: all failures or count_window of the ruleset)")
+	flags.StringVar(&f.countBy, "window-by", "", "date to apply -window on: created_at or payments_charge_date (default: created_at)")
+	flags.StringVar(&f.level, "level", "", "evaluate rules and export per payment or per customer (default: payment or level of the ruleset)")
+}
+
+// ruleset loads the ruleset of the parameters
+func (f *rulesFlags) ruleset() (*rules.Ruleset, error) {
+	return loadRuleset(f.thresholds, f.rulesFrom, f.countWindow, f.countBy, f.level)
+}
+
+// formatFlags are the parameters of the export files
+type formatFlags struct {
+	format    string
+	delimiter string
+	decimal   string
+	bom       bool
+	crlf      bool
+	xlsxTo    string
+}
+
+func (f *formatFlags) register(flags *flag.FlagSet) {
+	flags.StringVar(&f.format, "format", "csv", "format of the export files: csv, json or ndjson")
+	flags.StringVar(&f.delimiter, "delimiter", ",", "delimiter of the exported csv files: , or ; or tab")
+	flags.StringVar(&f.decimal, "decimal", ".", "decimal separator of amounts in the exported csv files: . or ,")
+	flags.BoolVar(&f.bom, "bom", false, "start the exported csv files with a UTF-8 byte order mark (for Excel)")
+	flags.BoolVar(&f.crlf, "crlf", false, "end the lines of the exported csv files with CR LF (Windows)")
+	flags.StringVar(&f.xlsxTo, "xlsx", "", "xlsx workbook to export the buckets and a summary to, e.g. customers-YYYY-MM-DD.xlsx (optional)")
+}
+
+// exporter returns the exporter of the parameters
+func (f *formatFlags) exporter() (*exporter.Exporter, error) {
+	return newExporter(f.format, f.delimiter, f.decimal, f.bom, f.crlf)
+}
+
+// importFlags are the parameters of the imports
+type importFlags struct {
+	columnsFrom string
+	rejectedTo  string
+	maxRejected int
+	reimport    bool
+}
+
+func (f *importFlags) register(flags *flag.FlagSet, defaultRejected string) {
+	flags.StringVar(&f.columnsFrom, "columns", "", "JSON file mapping csv header names to database fields per source (optional)")
+	flags.StringVar(&f.rejectedTo, "rejected", defaultRejected, "CSV file listing the rows that could not be imported, written if there are any")
+	flags.IntVar(&f.maxRejected, "max-rejected", 10, "rejected rows allowed before the import is rolled back and fp stops, -1 for no limit")
+	flags.BoolVar(&f.reimport, "reimport", false, "import files even if a file with the same content was imported before")
+}
+
+// columns loads the header names of -columns
+func (f *importFlags) columns() (map[string]importer.ColumnMapping, error) {
+	return importer.LoadColumnMappings(f.columnsFrom)
+}
+
+// importer returns the importer into db of the parameters
+func (f *importFlags) importer(db store.Store, columns map[string]importer.ColumnMapping) *importer.Importer {
+	imp := importer.New(db, columns)
+	imp.MaxRejected = f.maxRejected
+	imp.Reimport = f.reimport
+	imp.Version = version
+	return imp
+}
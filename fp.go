@@ -10,382 +10,299 @@
 package main
 
 import (
-	"database/sql"
-	"encoding/csv"
-	"errors"
 	"flag"
-	"io"
+	"fmt"
 	"log"
 	"os"
-	"fmt"
-	"strconv"
+	"path/filepath"
 	"strings"
 	"time"
-	"path/filepath"
-	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/tobkle/fp/importer"
+	"github.com/tobkle/fp/matcher"
+	"github.com/tobkle/fp/notifier"
+	"github.com/tobkle/fp/rules"
+	"github.com/tobkle/fp/store"
 )
 
+// version is recorded in the imports ledger, set it at build time with -ldflags "-X main.version=..."
+var version = "9"
+
+// getCurrentPath returns the directory of the executable
 func getCurrentPath() string {
 	ex, err := os.Executable()
-    if err != nil {
-        panic(err)
-    }
-    exPath := filepath.Dir(ex)
-    fmt.Println(exPath)
-	return exPath
+	if err != nil {
+		panic(err)
+	}
+	return filepath.Dir(ex)
+}
+
+// sendSMTP is the -send mode delivering the notifications right away, store.NotificationOutbox only queues them
+const sendSMTP = "smtp"
+
+// notification are the notification settings of a run
+type notification struct {
+	notifier *notifier.Notifier
+	// dispatcher queues and sends the notifications, nil without -send
+	dispatcher *notifier.Dispatcher
+	// dir to write the notification files to, empty for none
+	dir  string
+	send string
 }
 
 func main() {
-	var dbName string
-	var csvAccountsFrom string
-	var csvCRMFrom string
-	var csvNameFrom string
-	var csvNameToWarn string
-	var csvNameToSuspendSmall string
-	var csvNameToSuspendLarge string
-	var paymentRequestsToWarn int
-	var minPaymentRequestsToSuspend int
-	var amountToSwitch float64
+	command, args := "run", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+	switch command {
+	case "run":
+		cmdRun(args)
+	case "import":
+		cmdImport(args)
+	case "evaluate":
+		cmdEvaluate(args)
+	case "export":
+		cmdExport(args)
+	case "report":
+		cmdReport(args)
+	case "db":
+		cmdDB(args)
+	case "migrate":
+		// fp migrate status|up of former versions
+		cmdDB(args)
+	case "imports":
+		// fp imports of former versions
+		cmdDB(append([]string{command}, args...))
+	case "outbox":
+		cmdOutbox(args)
+	case "history":
+		cmdHistory(args)
+	case "match":
+		cmdMatch(args)
+	case "serve":
+		cmdServe(args)
+	case "config":
+		cmdConfig(args)
+	case "help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", command, usage)
+		os.Exit(2)
+	}
+}
+
+// usage lists the commands
+const usage = `usage: fp [command] [parameters], fp <command> -h lists the parameters of a command
+
+  run                                  import, evaluate, export and notify in one pass (default)
+  import payments|accounts|crm         import a csv file into the database
+  evaluate                             evaluate the rules and record the actions of the day
+  export                               write the export files of a day from the database
+  report summary|data-quality          the payments by state, the actions and notifications of a day, data quality
+  db status|migrate|imports|accounts   schema version, migrations, the imports ledger, the versions of an account
+  outbox list|show|send|discard        review and send the queued notifications
+  history <payment|customer>           the dunning history, fp history rebuild derives the current state again
+  match run|list|confirm|reject        match the mandates without Elevate account, review the matches
+  serve                                the local web dashboard and the REST API of the database
+  config show                          the parameters of the config file, its profile and the environment
+`
+
+// cmdRun implements `fp run`, also run without a command: import the files of the day, evaluate the rules,
+// write the export files and notify the customers in one pass
+func cmdRun(args []string) {
 	var timestamp = time.Now().Format("2006-01-02")
-	var current_path = getCurrentPath()
-	var defaultDatabaseName      = filepath.Join( current_path, "failed-payment-requests-database.sqlite3"      )
-	var defaultSourceFileName    = filepath.Join( current_path, "failed-payment-requests-" + timestamp + ".csv" )
-	var defaultAccountsFileName  = filepath.Join( current_path, "elevate-accounts-"        + timestamp + ".csv" )
-	var defaultCRMFileName       = filepath.Join( current_path, "crm-accounts-"                     + timestamp + ".csv" )
-	var defaultToWarnFileName    = filepath.Join( current_path, "customers-to-warn-"       + timestamp + ".csv" )
-	var defaultToSuspendFileNameSmall = filepath.Join( current_path, "customers-to-suspend-small-"    + timestamp + ".csv" )
-	var defaultToSuspendFileNameLarge = filepath.Join( current_path, "customers-to-suspend-large-"    + timestamp + ".csv" )
+	var o runOptions
+	s := loadSettings(args)
 
 	fmt.Println(" ")
 	fmt.Println("***********************************************************")
 	fmt.Println("PROCESSING PAYMENT REQUESTS -- started")
 	fmt.Println("***********************************************************")
-	
-	// get command-line parameters or use defaults
-	flag.StringVar(&dbName, "db", defaultDatabaseName, "Sqlite database to import to")
-	flag.StringVar(&csvNameFrom, "from", defaultSourceFileName, "CSV file to import from")
-	flag.StringVar(&csvAccountsFrom, "accounts", defaultAccountsFileName, "CSV file to import accounts from")
-	flag.StringVar(&csvCRMFrom, "crm", defaultCRMFileName, "CSV file to import crm from")
-	flag.StringVar(&csvNameToWarn, "warn", defaultToWarnFileName, "CSV file to export result to")
-	flag.StringVar(&csvNameToSuspendSmall, "toSmall", defaultToSuspendFileNameSmall, "CSV file small to export result to")
-	flag.StringVar(&csvNameToSuspendLarge, "toLarge", defaultToSuspendFileNameLarge, "CSV file large to export result to")
-	flag.IntVar(&paymentRequestsToWarn, "count-warn", 3, "payment requests to warn - for exporting")
-	flag.IntVar(&minPaymentRequestsToSuspend, "count-suspend", 4, "minimum payment requests  to suspend- for exporting")
-	flag.Float64Var(&amountToSwitch, "amount", 20.0, "amount to switch between small and large amounts")
-	flag.Parse()
-	
-	if dbName == "" || csvNameFrom == ""|| csvNameToWarn == "" || csvNameToSuspendSmall == "" {
-		flag.PrintDefaults()
-	}
-	
-	fmt.Println("Received      Database Name      :", dbName)
-	fmt.Println("Received CSV-From-File Accounts  :", csvAccountsFrom)
-	fmt.Println("Received CSV-From-File CRM       :", csvCRMFrom)
-	fmt.Println("Received CSV-From-File Name      :", csvNameFrom)
-	fmt.Println("Received CSV-To-Warn-File Name   :", csvNameToWarn)
-	fmt.Println("Received CSV-To-Suspend File Name:", csvNameToSuspendSmall)
-	fmt.Println("Received CSV-To-Suspend File Name:", csvNameToSuspendLarge)
-	fmt.Println("Minimum Payment Requests Warn    :", paymentRequestsToWarn)
-	fmt.Println("Minimum Payment Requests Suspend :", minPaymentRequestsToSuspend)
+
+	flags := newRunFlags(&o, s, timestamp)
+	s.apply(flags)
+	flags.Parse(args)
+
+	// a run for another day takes that day's files unless they are named and records its actions with that date
+	now := time.Now()
+	if o.asOf != timestamp {
+		day, err := parseDate(o.asOf)
+		if err != nil {
+			log.Fatal(err)
+		}
+		named := map[string]bool{}
+		flags.Visit(func(f *flag.Flag) { named[f.Name] = true })
+		for _, file := range []struct {
+			flag, prefix string
+			name         *string
+		}{
+			{"from", "failed-payment-requests-", &o.csvNameFrom},
+			{"accounts", "elevate-accounts-", &o.csvAccountsFrom},
+			{"crm", "crm-accounts-", &o.csvCRMFrom},
+			{"warn", "customers-to-warn-", &o.csvNameToWarn},
+			{"toSmall", "customers-to-suspend-small-", &o.csvNameToSuspendSmall},
+			{"toLarge", "customers-to-suspend-large-", &o.csvNameToSuspendLarge},
+			{"toReinstate", "customers-to-reinstate-", &o.csvNameToReinstate},
+			{"rejected", "rejected-rows-", &o.imf.rejectedTo},
+		} {
+			if !named[file.flag] {
+				*file.name = datedName(s.dir, file.prefix, o.asOf)
+			}
+		}
+		now, timestamp = day, o.asOf
+	}
+	expandDate(timestamp, &o.csvNameFrom, &o.csvAccountsFrom, &o.csvCRMFrom, &o.csvNameToWarn, &o.csvNameToSuspendSmall,
+		&o.csvNameToSuspendLarge, &o.csvNameToReinstate, &o.imf.rejectedTo, &o.ff.xlsxTo)
+
+	if o.dbName == "" || o.csvNameFrom == "" || o.csvNameToWarn == "" || o.csvNameToSuspendSmall == "" {
+		flags.PrintDefaults()
+	}
+
+	fmt.Println("Received      Database Name      :", o.dbName)
+	fmt.Println("Received CSV-From-File Accounts  :", o.csvAccountsFrom)
+	fmt.Println("Received CSV-From-File CRM       :", o.csvCRMFrom)
+	fmt.Println("Received CSV-From-File Name      :", o.csvNameFrom)
+	fmt.Println("Received CSV-To-Warn-File Name   :", o.csvNameToWarn)
+	fmt.Println("Received CSV-To-Suspend File Name:", o.csvNameToSuspendSmall)
+	fmt.Println("Received CSV-To-Suspend File Name:", o.csvNameToSuspendLarge)
+	fmt.Println("Received CSV-To-Reinstate Name   :", o.csvNameToReinstate)
+	fmt.Println("Minimum Payment Requests Warn    :", o.rf.thresholds.WarnCount)
+	fmt.Println("Minimum Payment Requests Suspend :", o.rf.thresholds.SuspendCount)
+	fmt.Println("Received Column Mapping File     :", o.imf.columnsFrom)
+	fmt.Println("Received CSV-Rejected-File Name  :", o.imf.rejectedTo)
+	fmt.Println("Received XLSX-To-File Name       :", o.ff.xlsxTo)
+	fmt.Println("Export Format                    :", o.ff.format)
+	fmt.Println("Received Notifications Directory :", o.notifyTo, o.notifyFormat)
+	fmt.Println("Received Templates Directory     :", o.templatesFrom)
+	fmt.Println("Send Notifications               :", o.sendMode, o.smtpServer.Addr)
+	fmt.Println("Maximum Rejected Rows            :", o.imf.maxRejected)
+	fmt.Println("Received Ruleset File            :", o.rf.rulesFrom)
+	fmt.Println("Count Failures Within            :", o.rf.countWindow, o.rf.countBy)
+	fmt.Println("Evaluate Rules Per               :", o.rf.level)
+	fmt.Println("Operator                         :", o.operator)
+	fmt.Println("As Of                            :", timestamp)
+	fmt.Println("Dry Run                          :", o.dryRun)
 	fmt.Println("***********************************************************")
 
-	// Create or Open Sqlite3 database with name of provided parameter 
-	db, err := sql.Open("sqlite3", dbName)
+	// header names to look for in the csv files
+	columnMappings, err := o.imf.columns()
 	if err != nil {
-		log.Fatal(err)
+		log.Fatalf("Loading column mapping failed: %s", err)
 	}
-	defer db.Close()
 
-	err = db.Ping()
+	// the dunning rules, by default built from the count and amount parameters
+	ruleset, err := o.rf.ruleset()
 	if err != nil {
-		log.Fatalf("Cannot connect to database: %s", err)
+		log.Fatal(err)
 	}
 
-	// Create or Open Accounts table within Database
-	SQLCreateAccountsDB := `
-	  CREATE TABLE IF NOT EXISTS elevateAccounts (
-		elevate_mandate_reference text primary key,
-		elevate_account_number    text,
-		elevate_customer_name     text 
-	)`
-
-	stmt, err := db.Prepare(SQLCreateAccountsDB)
-	if err != nil {
-		log.Fatalf("SQL Statement prepare failed: %s", err)
-	}
-	_, err = stmt.Exec()
-	if err != nil {
-		log.Fatalf("SQL Statement execution failed: %s", err)
+	// output file per bucket, the -warn, -toSmall and -toLarge parameters apply unless the ruleset names a file
+	files := exports{
+		buckets:   outputFiles(ruleset, timestamp, s.dir, o.csvNameToWarn, o.csvNameToSuspendSmall, o.csvNameToSuspendLarge),
+		reinstate: o.csvNameToReinstate,
+		xlsx:      o.ff.xlsxTo,
 	}
 
-	// Create or Open failedPayments table within Database
-	SQLCreateDB := `
-	  CREATE TABLE IF NOT EXISTS failedPaymentRequests (
-		id                         text primary key, 
-		created_at                 text,
-		resource_type              text,
-		action                     text,
-		details_origin             text,
-		details_cause              text,
-		details_description        text,
-		details_scheme             text,
-		details_reason_code        text,
-		links_parent_event         text,
-		links_payment              text,
-		payments_id                text,
-		payments_created_at        text,
-		payments_charge_date       text,
-		payments_amount            text,
-		payments_description       text,
-		payments_currency          text,
-		payments_status            text,
-		customers_id               text,
-		customers_given_name       text,
-		customers_family_name      text,
-		customers_metadata_leadID  text,
-		payments_links_mandate     text,
-		payments_metadata_identity text
-	)`
-
-	stmt2, err := db.Prepare(SQLCreateDB)
-	if err != nil {
-		log.Fatalf("SQL Statement prepare failed: %s", err)
-	}
-	_, err = stmt2.Exec()
-	if err != nil {
-		log.Fatalf("SQL Statement execution failed: %s", err)
+	// a dry run works on a copy of the database and writes the export files next to it
+	dbFile := o.dbName
+	previewDir := ""
+	if o.dryRun {
+		if previewDir, dbFile, err = prepareDryRun(o.dbName); err != nil {
+			log.Fatalf("Copying the database for the dry run failed: %s", err)
+		}
+		defer os.Remove(dbFile)
+		for bucket, name := range files.buckets {
+			if name != "" {
+				files.buckets[bucket] = filepath.Join(previewDir, filepath.Base(name))
+			}
+		}
+		files.reinstate = filepath.Join(previewDir, filepath.Base(files.reinstate))
+		o.imf.rejectedTo = filepath.Join(previewDir, filepath.Base(o.imf.rejectedTo))
+		if files.xlsx != "" {
+			files.xlsx = filepath.Join(previewDir, filepath.Base(files.xlsx))
+		}
+		if o.notifyTo != "" {
+			o.notifyTo = filepath.Join(previewDir, "notifications")
+		}
+		if o.sendMode == sendSMTP {
+			fmt.Println("Dry run: the notifications are only queued in the outbox of the copy, nothing is sent")
+			o.sendMode = store.NotificationOutbox
+		}
 	}
 
-	// Create or Open CRM table within Database
-	SQLCreateCRMAccountsDB := `
-	  CREATE TABLE IF NOT EXISTS crmAccounts (
-		crm_account_number    text primary key,
-		crm_id                text,
-		crm_name              text,
-		crm_email             text,
-		crm_premise_address   text,
-		crm_stage_name        text,
-		crm_zen_user_id       text
-	   )
-	`
-
-	stmt3, err := db.Prepare(SQLCreateCRMAccountsDB)
+	// format of the export files, json files get their extension instead of .csv
+	ex, err := o.ff.exporter()
 	if err != nil {
-		log.Fatalf("SQL Statement prepare failed: %s", err)
-	}
-	_, err = stmt3.Exec()
-	if err != nil {
-		log.Fatalf("SQL Statement execution failed: %s", err)
+		log.Fatal(err)
 	}
+	files.withExtension(ex)
 
-	// Create or Open paymentsWarnings table within Database
-	SQLCreateTableWarnings := `
-	  CREATE TABLE IF NOT EXISTS paymentsWarnings (
-		payments_id               text primary key,
-		timestamp                 text,
-		payment_requests_count    integer,
-		customers_id              text,
-		customers_given_name      text,
-		customers_family_name     text,
-		customers_metadata_leadID text
-	)`
-
-	stmt, err = db.Prepare(SQLCreateTableWarnings)
-	if err != nil {
-		log.Fatalf("SQL Statement prepare failed for table paymentsWarnings: %s", err)
+	// notifications to the customers of the exported buckets
+	notify := notification{dir: o.notifyTo, send: o.sendMode}
+	if o.notifyTo != "" || o.sendMode != "" {
+		if notify.notifier, err = notifier.New(o.templatesFrom); err != nil {
+			log.Fatalf("Loading notification templates failed: %s", err)
+		}
+		if notify.notifier.Format, err = notifier.ParseFormat(o.notifyFormat); err != nil {
+			log.Fatal(err)
+		}
+		notify.notifier.From = o.mailFrom
 	}
-	_, err = stmt.Exec()
-	if err != nil {
-		log.Fatalf("SQL Statement execution failed for table paymentsWarnings: %s", err)
+	if o.notifyTo != "" {
+		if err = os.MkdirAll(o.notifyTo, 0755); err != nil {
+			log.Fatal(err)
+		}
 	}
-
-	// Create or Open paymentsSuspended table within Database
-	SQLCreateTableSuspended := `
-	  CREATE TABLE IF NOT EXISTS paymentsSuspended (
-		payments_id               text primary key,
-		timestamp                 text,
-		payment_requests_count    integer,
-		customers_id              text,
-		customers_given_name      text,
-		customers_family_name     text,
-		customers_metadata_leadID text
-	)`
-
-	stmt, err = db.Prepare(SQLCreateTableSuspended)
-	if err != nil {
-		log.Fatalf("SQL Statement prepare failed for table paymentsSuspended: %s", err)
+	switch o.sendMode {
+	case "", store.NotificationOutbox:
+	case sendSMTP:
+		if o.smtpServer.Addr == "" {
+			log.Fatal("-send smtp needs the server with -smtp host:port")
+		}
+	default:
+		log.Fatalf("invalid -send %q, use outbox or smtp", o.sendMode)
 	}
-	_, err = stmt.Exec()
-	if err != nil {
-		log.Fatalf("SQL Statement execution failed for table paymentsSuspended: %s", err)
+	if o.sendMode != "" && o.mailFrom == "" {
+		log.Fatal("-send needs the sender address with -mail-from")
 	}
+	o.smtpServer.Password = os.Getenv("FP_SMTP_PASSWORD")
 
-	// Create Index idx_payments_id
-	SQLCreateDBIndexOnPaymentsId := `
-       CREATE INDEX IF NOT EXISTS idx_payments_id 
-	   ON failedPaymentRequests(payments_id)
-	`
-
-	stmt, err = db.Prepare(SQLCreateDBIndexOnPaymentsId)
-	if err != nil {
-		log.Fatalf("SQL Statement prepare failed for index on payments_id: %s", err)
-	}
-	_, err = stmt.Exec()
+	// Create or Open Sqlite3 database with name of provided parameter
+	db, err := store.Open(dbFile)
 	if err != nil {
-		log.Fatalf("SQL Statement execution failed for index on payments_id: %s", err)
+		log.Fatal(err)
 	}
+	defer db.Close()
 
-	// Create Index idx_customers_id
-	SQLCreateDBIndexOnCustomersId := `
-       CREATE INDEX IF NOT EXISTS idx_customers_id 
-	   ON failedPaymentRequests(customers_id)
-	`
-
-	stmt, err = db.Prepare(SQLCreateDBIndexOnCustomersId)
-	if err != nil {
-		log.Fatalf("SQL Statement prepare failed for index on customers_id: %s", err)
+	// Create or upgrade the tables within Database
+	applied, err := db.Migrate()
+	for _, m := range applied {
+		fmt.Println("SUCCESS: Applied database migration", m.Version, ":", m.Name)
 	}
-	_, err = stmt.Exec()
 	if err != nil {
-		log.Fatalf("SQL Statement execution failed for index on customers_id: %s", err)
+		log.Fatalf("Database migration failed: %s", err)
 	}
-
-	// Create Index idx_customers_family_name
-	SQLCreateDBIndexOnCustomersFamilyName := `
-       CREATE INDEX IF NOT EXISTS idx_customers_family_name 
-	   ON failedPaymentRequests(customers_family_name)
-	`
-
-	stmt, err = db.Prepare(SQLCreateDBIndexOnCustomersFamilyName)
-	if err != nil {
-		log.Fatalf("SQL Statement prepare failed for index on customers_family_name: %s", err)
-	}
-	_, err = stmt.Exec()
-	if err != nil {
-		log.Fatalf("SQL Statement execution failed for index on customers_family_name: %s", err)
+	var before actionSnapshot
+	if o.dryRun {
+		if before, err = snapshot(db); err != nil {
+			log.Fatal(err)
+		}
 	}
-	
-	// Create Index idx_customers_family_name
-	SQLCreateDBIndexOnPaymentsWarningTimestamp := `
-       CREATE INDEX IF NOT EXISTS idx_payments_warning_timestamp 
-	   ON paymentsWarnings(timestamp)
-	`
 
-	stmt, err = db.Prepare(SQLCreateDBIndexOnPaymentsWarningTimestamp)
-	if err != nil {
-		log.Fatalf("SQL Statement prepare failed for index on paymentsWarning timestamp: %s", err)
-	}
-	_, err = stmt.Exec()
-	if err != nil {
-		log.Fatalf("SQL Statement execution failed for index on paymentsWarning timestamp: %s", err)
+	if o.sendMode != "" {
+		notify.dispatcher = &notifier.Dispatcher{Store: db, Notifier: notify.notifier, Sender: &o.smtpServer, Throttle: o.throttle}
 	}
 
-	// Create Index idx_customers_family_name
-	SQLCreateDBIndexOnPaymentsSuspendedTimestamp := `
-       CREATE INDEX IF NOT EXISTS idx_payments_suspended_timestamp 
-	   ON paymentsSuspended(timestamp)
-	`
-
-	stmt, err = db.Prepare(SQLCreateDBIndexOnPaymentsSuspendedTimestamp)
-	if err != nil {
-		log.Fatalf("SQL Statement prepare failed for index on paymentsSuspended timestamp: %s", err)
-	}
-	_, err = stmt.Exec()
-	if err != nil {
-		log.Fatalf("SQL Statement execution failed for index on paymentsSuspended timestamp: %s", err)
-	}
+	imp := o.imf.importer(db, columnMappings)
+	imp.SnapshotDate = timestamp
 
 	// **********************************************************************************************
-	// Open CSV File for Accounts
+	// Import CSV File for Accounts
 	// **********************************************************************************************
-	f, err := os.Open(csvAccountsFrom)
-	if err != nil {
-		log.Fatalf("Open CSV file failed: %s", err)
-	}
-
-	// Read the header row
-	r := csv.NewReader(f)
-	_, err = r.Read()
-	if err != nil {
-		log.Fatalf("Missing header row(?): %s", err)
-	}
-
-	// prepare insert record for Accounts
-	SQLInsertAccountsDB := `
-	INSERT INTO elevateAccounts(
-		elevate_mandate_reference,
-		elevate_account_number,
-		elevate_customer_name       
-	) values(?, ?, ?)
-	`
-	stmt, err = db.Prepare(SQLInsertAccountsDB)
-	if err != nil {
-		log.Fatalf("Prepare SQL statement for insert into table failed: %s", err)
-	}
-
-	// Loop over the records
-	for {
-		// get next record in csv file
-		record, err := r.Read()
-
-		// End of File reached
-		if errors.Is(err, io.EOF) {
-			break
-		}
-
-		//  Map the fields of a csv record to variables	
-		   customer_account_number			 := record[0]
-		// Customer_ID	                  	 := record[1]
-		   customer_name					 := record[2]
-		// Site_ID							 := record[3]
-		// site_reference					 := record[4]
-		// product_category_name			 := record[5]
-		// product_type				    	 := record[6]
-		// service_id						 := record[7]
-		// product_reference				 := record[8]
-		// supplier_name					 := record[9]
-		// override						     := record[10]
-		// start_date						 := record[11]
-		// end_date						     := record[12]
-		// rental_product_name				 := record[13]
-		// cap_price_in_pence				 := record[14]
-		// provisioning_status				 := record[15]
-		// billable						     := record[16]
-		// in_flight_order					 := record[17]
-		// force_billing					 := record[18]
-		// invoice_frequency				 := record[19]
-		// bill_initial_charges_immediately  := record[20]
-		// contractName					     := record[21]
-		// contractStartDate				 := record[22]
-		// contractEndDate					 := record[23]
-		// EtcFixed						     := record[24]
-		// EtcPercentage					 := record[25]
-		// contract_expires_in_months		 := record[26]
-		// customerContractDueRenewal		 := record[27]
-		// customerContractAutoRollOver	     := record[28]
-		// contractProfileName				 := record[29]
-		   mandate_reference				 := record[30]
-		// site_address_line1                := record[31]
-		// site_address_line2                := record[32]
-		// town                              := record[33]
-		// county                            := record[34]
-		// post_code                         := record[35]
-		// country                           := record[36]
-
-
-		_, err = stmt.Exec(
-							mandate_reference         , 
-							customer_account_number   ,
-							customer_name             )
-		if err != nil {
-			if strings.Contains(fmt.Sprint(err), "UNIQUE constraint failed") {
-				// fmt.Println("SUCCESS: Skipped existing record with id:", customer_account_number)
-			} else {
-				fmt.Println("ERROR:   Insert into table elevateAccounts failed for id =", customer_account_number, err)
-			}
-		} else {
-			    fmt.Println("SUCCESS: Insert into table elevateAccounts with id:", customer_account_number)
-		}
+	if _, err = imp.ImportAccounts(o.csvAccountsFrom); err != nil {
+		writeRejected(imp, o.imf.rejectedTo)
+		log.Fatalf("Import of accounts failed: %s", err)
 	}
 
 	fmt.Println("***********************************************************")
@@ -394,782 +311,237 @@ func main() {
 	fmt.Println(" ")
 
 	// **********************************************************************************************
-	// Open CSV File for CRM Accounts
+	// Import CSV File for CRM Accounts
 	// **********************************************************************************************
-	f3, err := os.Open(csvCRMFrom)
-	if err != nil {
+	if _, err = os.Stat(o.csvCRMFrom); err != nil {
 		// skip this if not exists
 		fmt.Println("Skipping CRM Accounts file, as there is no current crm-accounts-YYYY-MM-DD.csv file provided....")
-	} else {
-		// process only if the CRM Accounts file exists
-		// Read the header row
-		semiReader := csv.NewReader(f3)
-		// semiReader.Comma = ';'
-		_, err = semiReader.Read()
-		if err != nil {
-			log.Fatalf("Missing header row(?): %s", err)
-		}
-
-		// prepare insert record for Accounts
-		SQLInsertCRMAccountsDB := `
-		INSERT INTO crmAccounts(
-			crm_account_number,
-			crm_id,
-			crm_name,
-			crm_email,
-			crm_premise_address,
-			crm_stage_name,
-			crm_zen_user_id     
-		) values(?, ?, ?, ?, ?, ?, ?)`
-
-		stmt, err = db.Prepare(SQLInsertCRMAccountsDB)
-		if err != nil {
-			log.Fatalf("Prepare SQL statement for insert into table failed: %s", err)
-		}
-
-		// Loop over the records
-		for {
-			// get next record in csv file
-			record, err := semiReader.Read()
-
-			// End of File reached
-			if errors.Is(err, io.EOF) {
-				break
-			}
-
-			//  Map the fields of a csv record to variables	
-			crm_account_number			  := record[0]
-			// C0UserID	                  := record[1]
-			crm_premise_address           := record[2]
-			// Premise_Type	              := record[3]
-			crm_stage_name                := record[4]
-			// Status	                  := record[5]
-			crm_name	                  := record[6]
-			crm_email	                  := record[7]
-			// C0_Go_CardLess_Customer_ID := record[8]	
-			crm_id	                      := record[9]
-			crm_zen_user_id               := record[10]			           
-			// Count                      := record[11]
-
-			_, err = stmt.Exec(
-						crm_account_number,
-						crm_id,
-						crm_name,
-						crm_email,
-						crm_premise_address,
-						crm_stage_name,
-						crm_zen_user_id       )
-			if err != nil {
-				if strings.Contains(fmt.Sprint(err), "UNIQUE constraint failed") {
-					// fmt.Println("SUCCESS: Skipped existing record with id:", customer_account_number)
-				} else {
-					fmt.Println("ERROR:   Insert into table crmAccounts failed for id =", crm_account_number, crm_id, err)
-				}
-			} else {
-					fmt.Println("SUCCESS: Insert into table crmAccounts with id:", crm_account_number, crm_id)
-			}
-		}
+	} else if _, err = imp.ImportCRM(o.csvCRMFrom); err != nil {
+		writeRejected(imp, o.imf.rejectedTo)
+		log.Fatalf("Import of crm accounts failed: %s", err)
 	}
+
 	fmt.Println("***********************************************************")
 	fmt.Println("PROCESSING ELEVATE CRM ACCOUNTS --   ended")
 	fmt.Println("***********************************************************")
 	fmt.Println(" ")
 
 	// **********************************************************************************************
-	// Open CSV File for FailedPayments
+	// Import CSV File for FailedPayments
 	// **********************************************************************************************
-	f2, err := os.Open(csvNameFrom)
-	if err != nil {
-		log.Fatalf("Open CSV file failed: %s", err)
-	}
-
-	// Read the header row
-	r2 := csv.NewReader(f2)
-	_, err = r2.Read()
-	if err != nil {
-		log.Fatalf("Missing header row(?): %s", err)
-	}
-
-	// prepare insert record for FailedPayments
-	SQLInsertDB := `
-	INSERT INTO failedPaymentRequests(
-		id                        , 
-		created_at                ,
-		resource_type             ,
-		action                    ,
-		details_origin            ,
-		details_cause             ,
-		details_description       ,
-		details_scheme            ,
-		details_reason_code       ,
-		links_parent_event        ,
-		links_payment             ,
-		payments_id               ,
-		payments_created_at       ,
-		payments_charge_date      ,
-		payments_amount           ,
-		payments_description      ,
-		payments_currency         ,
-		payments_status           ,
-		customers_id              ,
-		customers_given_name      ,
-		customers_family_name     ,
-		customers_metadata_leadID ,
-		payments_links_mandate    ,
-		payments_metadata_identity
-	) values(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
-	`
-	stmt, err = db.Prepare(SQLInsertDB)
-	if err != nil {
-		log.Fatalf("Prepare SQL statement for insert into table failed: %s", err)
+	if _, err = imp.ImportPayments(o.csvNameFrom); err != nil {
+		writeRejected(imp, o.imf.rejectedTo)
+		log.Fatalf("Import of payment requests failed: %s", err)
 	}
 
-	// Loop over the records
-	for {
-		// get next record in csv file
-		record, err := r2.Read()
-
-		// End of File reached
-		if errors.Is(err, io.EOF) {
-			break
-		}
-
-		//  Map the fields of a csv record to variables		
-		id := record[0]
-		created_at := record[1]
-		resource_type := record[2]
-		action := record[3]
-		details_origin := record[4]
-		details_cause := record[5]
-		details_description := record[6]
-		details_scheme := record[7]
-		details_reason_code := record[8]
-		links_parent_event := record[9]
-		links_payment := record[10]
-		payments_id := record[11]
-		payments_created_at := record[12]
-		payments_charge_date := record[13]
-		payments_amount := record[14]
-		payments_description := record[15]
-		payments_currency := record[16]
-		payments_status := record[17]
-		// payments_amount_refunded := record[19]
-		// payments_reference := record[20]
-		payments_links_mandate := record[20]
-		// payments_links_creditor := record[22]
-		// payments_links_payout := record[23]
-		// payments_links_subscription := record[24]
-		customers_id := record[24]
-		customers_given_name := record[25]
-		customers_family_name := record[26]
-		// customers_company_name := record[28]
-		customers_metadata_leadID := record[28]
-		// customers_metadata_link := record[30]
-		// customers_metadata_xero := record[31]
-		payments_metadata_identity := record[32]
-		// payments_metadata_invoiceNumber := record[33]
-		// payments_metadata_invoiceType := record[34]
-		// payments_metadata_xero := record[35]
-
-		_, err = stmt.Exec(
-							id                        , 
-							created_at                ,
-							resource_type             ,
-							action                    ,
-							details_origin            ,
-							details_cause             ,
-							details_description       ,
-							details_scheme            ,
-							details_reason_code       ,
-							links_parent_event        ,
-							links_payment             ,
-							payments_id               ,
-							payments_created_at       ,
-							payments_charge_date      ,
-							payments_amount           ,
-							payments_description      ,
-							payments_currency         ,
-							payments_status           ,
-							customers_id              ,
-							customers_given_name      ,
-							customers_family_name     ,
-							customers_metadata_leadID ,
-						    payments_links_mandate    ,
-							payments_metadata_identity)
-		if err != nil {
-			if strings.Contains(fmt.Sprint(err), "UNIQUE constraint failed") {
-				fmt.Println("SUCCESS: Skipped existing record with id:", id)
-			} else {
-				fmt.Println("ERROR:   Insert into table failed for id =", id, err)
-			}
-		} else {
-			    fmt.Println("SUCCESS: Insert into table with id:", id)
-		}
-	}
+	writeRejected(imp, o.imf.rejectedTo)
 
 	fmt.Println("***********************************************************")
 	fmt.Println("PROCESSING PAYMENT REQUESTS --   ended")
 	fmt.Println("***********************************************************")
 	fmt.Println(" ")
-	fmt.Println("***********************************************************")
-	fmt.Println(fmt.Sprintf("FIND PAYMENTS WITH MORE THAN %s REQUESTS --   started", strconv.Itoa(paymentRequestsToWarn)))
-	fmt.Println("***********************************************************")
-	// avoiding database is locked error by setting up a transaction
-    // https://github.com/mattn/go-sqlite3/issues/569
-	tx, err := db.Begin()
 
-    // prepare insert record
-	SQLInsertTablePaymentsWarning := `
-		INSERT INTO paymentsWarnings(
-			payments_id               ,
-			timestamp                 ,
-			payment_requests_count    ,
-			customers_id              ,
-			customers_given_name      ,
-			customers_family_name     ,
-			customers_metadata_leadID 
-		) values(?, ?, ?, ?, ?, ?, ?)
-	`
-	stmtInsertWarnings, err := tx.Prepare(SQLInsertTablePaymentsWarning)
+	// **********************************************************************************************
+	// Match the mandates without Elevate account, the matches are used once confirmed with fp match
+	// **********************************************************************************************
+	result, err := matcher.New(db).Run()
 	if err != nil {
-		log.Fatalf("Prepare SQL statement for insert into table paymentsWarnings failed: %s", err)
+		log.Fatalf("Matching of mandates failed: %s", err)
 	}
-
-	// prepare upsert record
-	SQLInsertTablePaymentsSuspended := `
-		INSERT INTO paymentsSuspended(
-			payments_id               ,
-			timestamp                 ,
-			payment_requests_count    ,
-			customers_id              ,
-			customers_given_name      ,
-			customers_family_name     ,
-			customers_metadata_leadID 
-		) values(?, ?, ?, ?, ?, ?, ?)
-		ON CONFLICT(payments_id) 
-		DO UPDATE SET
-			timestamp                         = excluded.timestamp,
-			payment_requests_count            = excluded.payment_requests_count
-		WHERE excluded.payment_requests_count > paymentsSuspended.payment_requests_count
-	`
-	stmtInsertSuspended, err := tx.Prepare(SQLInsertTablePaymentsSuspended)
-	if err != nil {
-		log.Fatalf("Prepare SQL statement for insert into table paymentsSuspended failed: %s", err)
+	if len(result.Added) > 0 {
+		fmt.Printf("SUCCESS: Queued %d matches for %d mandates without Elevate account, review them with fp match list\n",
+			len(result.Added), result.Mandates)
 	}
+	evaluate(db, ruleset, now, timestamp, o.operator)
 
-	SQLQuery := fmt.Sprintf(`
-		SELECT 
-			resource_type             ,
-			action                    ,
-			details_origin            ,
-			details_cause             ,
-			details_description       ,
-			details_scheme            ,
-			details_reason_code       ,
-			links_parent_event        ,
-			links_payment             ,
-			payments_id               ,
-			payments_created_at       ,
-			payments_charge_date      ,
-			payments_amount           ,
-			payments_description      ,
-			payments_currency         ,
-			payments_status           ,
-			customers_id              ,
-			customers_given_name      ,
-			customers_family_name     ,
-			customers_metadata_leadID ,
-			COUNT(payments_id) 
-		FROM failedPaymentRequests 
-		WHERE action = "failed"
-		GROUP BY payments_id 
-		HAVING count(payments_id) >= %s 
-		ORDER BY payments_id
-	`, strconv.Itoa(paymentRequestsToWarn))
-
-	row, err := tx.Query(SQLQuery)
+	// the export files, the customers of each bucket are notified right after its file is written
+	err = writeExports(db, ex, ruleset, files, timestamp, func(bucket rules.Bucket) error {
+		if notify.notifier == nil {
+			return nil
+		}
+		if err := notifyCustomers(db, notify, ruleset, bucket, now, timestamp); err != nil {
+			return fmt.Errorf("notifications for %s failed: %w", bucket, err)
+		}
+		return nil
+	})
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer row.Close()
-
-	for row.Next() {
-		var resource_type string
-		var action string
-		var details_origin string
-		var details_cause string
-		var details_description string
-		var details_scheme string
-		var details_reason_code string
-		var links_parent_event string
-		var links_payment string
-		var payments_id string
-		var payments_created_at string
-		var payments_charge_date string
-		var payments_amount string
-		var payments_description string
-		var payments_currency string
-		var payments_status string
-		var customers_id string
-		var customers_given_name string
-		var customers_family_name string
-		var customers_metadata_leadID string
-		var payment_requests_count string
-
-		row.Scan(
-			&resource_type, 
-			&action, 
-			&details_origin, 
-			&details_cause, 
-			&details_description, 
-			&details_scheme, 
-			&details_reason_code, 
-			&links_parent_event, 
-			&links_payment, 
-			&payments_id, 
-			&payments_created_at, 
-			&payments_charge_date, 
-			&payments_amount, 
-			&payments_description, 
-			&payments_currency, 
-			&payments_status, 
-			&customers_id, 
-			&customers_given_name, 
-			&customers_family_name, 
-			&customers_metadata_leadID, 
-			&payment_requests_count)
-
-		// create record into paymentsWarnings
-		if payment_requests_count == strconv.Itoa(paymentRequestsToWarn) {
-			_, err = stmtInsertWarnings.Exec(
-				payments_id               ,
-				timestamp                 ,
-				payment_requests_count    ,
-				customers_id              ,
-				customers_given_name      ,
-				customers_family_name     ,
-				customers_metadata_leadID )
-			if err != nil {
-				if strings.Contains(fmt.Sprint(err), "UNIQUE constraint failed") {
-					fmt.Println("SUCCESS: Skipped existing warning for payments_id                :", payments_id)
-				} else {
-					fmt.Println("ERROR:   Insert into table paymentWarnings failed for payments_id:", payments_id, err)
-				}
-			} else {
-					fmt.Println("SUCCESS: Inserted new warning for payments_id                    :", payments_id)
-			}
-		} 
-
-		// create record into paymentsSuspended
-		if payment_requests_count >= strconv.Itoa(minPaymentRequestsToSuspend) {
-			_, err = stmtInsertSuspended.Exec(
-				payments_id               ,
-				timestamp                 ,
-				payment_requests_count    ,
-				customers_id              ,
-				customers_given_name      ,
-				customers_family_name     ,
-				customers_metadata_leadID )
-			if err != nil {
-				if strings.Contains(fmt.Sprint(err), "UNIQUE constraint failed") {
 
-					fmt.Println("SUCCESS: Skipped existing suspend for payments_id                 :", payments_id)
-				} else {
-					fmt.Println("ERROR:   Insert into table paymentSuspended failed for payments_id:", payments_id, err)
-				}
-			} else {
-					fmt.Println("SUCCESS: Inserted new suspend for payments_id                     :", payments_id)
-			}
+	if o.dryRun {
+		after, err := snapshot(db)
+		if err != nil {
+			log.Fatal(err)
 		}
+		printDryRun(o.dbName, before, after)
+		fmt.Println("Preview Of The Export Files      :", previewDir)
+		fmt.Println("The database and today's export files were not changed")
 	}
-	err = row.Err()
-	tx.Commit()
-	row.Close()
 
 	fmt.Println("***********************************************************")
-	fmt.Println(fmt.Sprintf("FIND PAYMENTS WITH MORE THAN %s REQUESTS --   ended", strconv.Itoa(paymentRequestsToWarn)))
+	fmt.Println(" F I N I S H E D")
 	fmt.Println("***********************************************************")
-	fmt.Println(" ")
+}
 
-	headerText := "resource_type,action,details_origin,details_cause,details_description,details_scheme,details_reason_code,links_parent_event,links_payment,payments_id,payments_created_at,payments_charge_date,payments_amount,payments_description,payments_currency,payments_status,customers_id,customers_given_name,customers_family_name,customers_metadata_leadID,payments_links_mandate,payments_metadata_identity,elevate_account_number,elevate_customer_name,payment_requests_counted,crm_id,crm_name,crm_email,crm_premise_address,crm_stage_name,crm_zen_user_id\n"
-	
+// runOptions are the parameters of fp run
+type runOptions struct {
+	dbName                string
+	csvAccountsFrom       string
+	csvCRMFrom            string
+	csvNameFrom           string
+	csvNameToWarn         string
+	csvNameToSuspendSmall string
+	csvNameToSuspendLarge string
+	csvNameToReinstate    string
+	rf                    rulesFlags
+	ff                    formatFlags
+	imf                   importFlags
+	dryRun                bool
+	notifyTo              string
+	notifyFormat          string
+	templatesFrom         string
+	mailFrom              string
+	sendMode              string
+	smtpServer            notifier.SMTP
+	throttle              time.Duration
+	operator              string
+	asOf                  string
+}
 
-	fmt.Println("***********************************************************")
-	fmt.Println(fmt.Sprintf("CREATE customers-to-warn file WITH %s REQUESTS --   started", strconv.Itoa(paymentRequestsToWarn)))
-	fmt.Println("***********************************************************")
-	fmt.Println(" ")
+// newRunFlags returns the parameters of fp run with the default files of timestamp in the data directory
+func newRunFlags(o *runOptions, s *settings, timestamp string) *flag.FlagSet {
+	// get command-line parameters or use defaults
+	flags := flag.NewFlagSet("run", flag.ExitOnError)
+	flags.StringVar(&o.dbName, "db", defaultDatabase(s.dir), "Sqlite database to import to")
+	flags.StringVar(&o.csvNameFrom, "from", datedName(s.dir, "failed-payment-requests-", timestamp), "CSV file to import from")
+	flags.StringVar(&o.csvAccountsFrom, "accounts", datedName(s.dir, "elevate-accounts-", timestamp), "CSV file to import accounts from")
+	flags.StringVar(&o.csvCRMFrom, "crm", datedName(s.dir, "crm-accounts-", timestamp), "CSV file to import crm from")
+	flags.StringVar(&o.csvNameToWarn, "warn", datedName(s.dir, "customers-to-warn-", timestamp), "CSV file to export result to")
+	flags.StringVar(&o.csvNameToSuspendSmall, "toSmall", datedName(s.dir, "customers-to-suspend-small-", timestamp), "CSV file small to export result to")
+	flags.StringVar(&o.csvNameToSuspendLarge, "toLarge", datedName(s.dir, "customers-to-suspend-large-", timestamp), "CSV file large to export result to")
+	flags.StringVar(&o.csvNameToReinstate, "toReinstate", datedName(s.dir, "customers-to-reinstate-", timestamp), "CSV file to export the suspended payments paid today to")
+	o.rf.register(flags)
+	o.ff.register(flags)
+	o.imf.register(flags, datedName(s.dir, "rejected-rows-", timestamp))
+	flags.StringVar(&o.notifyTo, "notify", "", "directory to write a notification per warned or suspended customer to (optional)")
+	flags.StringVar(&o.notifyFormat, "notify-format", "eml", "format of the notifications: eml (a file per customer) or merge (a mail-merge csv per bucket)")
+	flags.StringVar(&o.templatesFrom, "templates", "", "directory with <bucket>.txt and <bucket>.html templates replacing the built-in notifications (optional)")
+	flags.StringVar(&o.mailFrom, "mail-from", "", "sender address of the notifications, e.g. \"Accounts <accounts@example.com>\" (optional)")
+	flags.StringVar(&o.sendMode, "send", "", "queue the notifications in the outbox of the database (outbox) or also send them (smtp), not sent twice (optional)")
+	flags.StringVar(&o.smtpServer.Addr, "smtp", "", "SMTP server host:port to send the notifications with, e.g. localhost:1025")
+	flags.StringVar(&o.smtpServer.Username, "smtp-user", "", "SMTP user name, the password is read from the environment variable FP_SMTP_PASSWORD")
+	flags.DurationVar(&o.throttle, "throttle", time.Second, "minimum time between two sent notifications, e.g. 500ms or 2s")
+	flags.StringVar(&o.operator, "operator", defaultOperator(), "name recorded with the actions in the dunning history")
+	flags.BoolVar(&o.dryRun, "dry-run", false, "import, evaluate and export into a temporary copy of the database and show what would change")
+	flags.StringVar(&o.asOf, "as-of", timestamp, "date YYYY-MM-DD to run for: the dated default file names, the date of the recorded actions and the exports")
+	s.register(flags)
+	return flags
+}
 
-	// write export file to customers-to-warn-YYYY-MM-DD.csv
-	targetFileWarn, err := os.OpenFile(csvNameToWarn, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
-	if err != nil {
-		panic(err)
+// loadRuleset returns the ruleset of rulesFrom, or without the one of the thresholds, with the window and level
+// parameters applied
+func loadRuleset(thresholds rules.Thresholds, rulesFrom string, countWindow string, countBy string, level string) (*rules.Ruleset, error) {
+	ruleset := thresholds.Ruleset()
+	if rulesFrom != "" {
+		var err error
+		if ruleset, err = rules.Load(rulesFrom); err != nil {
+			return nil, fmt.Errorf("loading ruleset failed: %w", err)
+		}
 	}
-	defer targetFileWarn.Close()
-
-	if _, err = targetFileWarn.WriteString(headerText); err != nil {
-		panic(err)
+	if countWindow != "" {
+		ruleset.CountWindow = countWindow
 	}
-
-	SQLQueryExportWarnings := fmt.Sprintf(`
-		SELECT DISTINCT
-			failedPaymentRequests.resource_type              ,
-			failedPaymentRequests.action                     ,
-			failedPaymentRequests.details_origin             ,
-			failedPaymentRequests.details_cause              ,
-			failedPaymentRequests.details_description        ,
-			failedPaymentRequests.details_scheme             ,
-			failedPaymentRequests.details_reason_code        ,
-			failedPaymentRequests.links_parent_event         ,
-			failedPaymentRequests.links_payment              ,
-			failedPaymentRequests.payments_id                ,
-			failedPaymentRequests.payments_created_at        ,
-			failedPaymentRequests.payments_charge_date       ,
-			failedPaymentRequests.payments_amount            ,
-			failedPaymentRequests.payments_description       ,
-			failedPaymentRequests.payments_currency          ,
-			failedPaymentRequests.payments_status            ,
-			failedPaymentRequests.customers_id               ,
-			failedPaymentRequests.customers_given_name       ,
-			failedPaymentRequests.customers_family_name      ,
-			failedPaymentRequests.customers_metadata_leadID  ,
-			failedPaymentRequests.payments_links_mandate     ,
-			failedPaymentRequests.payments_metadata_identity ,
-			COUNT(paymentsWarnings.payments_id)              ,
-			elevateAccounts.elevate_account_number           ,
-			elevateAccounts.elevate_customer_name            ,
-			crmAccounts.crm_id                               ,
-			crmAccounts.crm_name                             ,
-			crmAccounts.crm_email                            ,
-			crmAccounts.crm_premise_address                  ,
-			crmAccounts.crm_stage_name                       ,
-			crmAccounts.crm_zen_user_id    
-		FROM paymentsWarnings
-		INNER JOIN failedPaymentRequests 
-		ON failedPaymentRequests.payments_id = paymentsWarnings.payments_id
-		LEFT  JOIN elevateAccounts
-		ON failedPaymentRequests.payments_links_mandate = elevateAccounts.elevate_mandate_reference
-		LEFT JOIN crmAccounts
-		ON elevateAccounts.elevate_account_number = crmAccounts.crm_account_number
-		WHERE paymentsWarnings.timestamp = "%s"
-		GROUP BY   paymentsWarnings.payments_id 
-		ORDER BY   paymentsWarnings.payments_id
-	`, timestamp)
-
-	rowWarnings, err := db.Query(SQLQueryExportWarnings)
-	if err != nil {
-		log.Fatal(err)
+	if countBy != "" {
+		ruleset.CountBy = countBy
 	}
-	defer rowWarnings.Close()
-
-	for rowWarnings.Next() {
-		var resource_type string
-		var action string
-		var details_origin string
-		var details_cause string
-		var details_description string
-		var details_scheme string
-		var details_reason_code string
-		var links_parent_event string
-		var links_payment string
-		var payments_id string
-		var payments_created_at string
-		var payments_charge_date string
-		var payments_amount string
-		var payments_description string
-		var payments_currency string
-		var payments_status string
-		var customers_id string
-		var customers_given_name string
-		var customers_family_name string
-		var customers_metadata_leadID string
-		var payments_links_mandate     string
-	    var payments_metadata_identity string
-		var payment_requests_count string      
-	    var elevate_account_number     string
-		var elevate_customer_name      string
-		var crm_id                 string
-		var crm_name               string
-		var crm_email              string
-		var crm_premise_address    string
-		var crm_stage_name         string
-		var crm_zen_user_id        string
-
-		rowWarnings.Scan(&resource_type, 
-			&action, 
-			&details_origin, 
-			&details_cause, 
-			&details_description, 
-			&details_scheme, 
-			&details_reason_code, 
-			&links_parent_event, 
-			&links_payment, 
-			&payments_id, 
-			&payments_created_at, 
-			&payments_charge_date, 
-			&payments_amount, 
-			&payments_description, 
-			&payments_currency, 
-			&payments_status, 
-			&customers_id, 
-			&customers_given_name, 
-			&customers_family_name, 
-			&customers_metadata_leadID, 
-			&payments_links_mandate, 
-			&payments_metadata_identity, 
-			&payment_requests_count, 
-			&elevate_account_number, 
-			&elevate_customer_name,
-			&crm_id,
-			&crm_name,
-			&crm_email,
-			&crm_premise_address,
-			&crm_stage_name,
-		    &crm_zen_user_id )
-
-		resultText := 	"\"" + resource_type + "\"," +
-						"\"" + action + "\"," + 
-						"\"" + details_origin + "\"," + 
-						"\"" + details_cause + "\"," + 
-						"\"" + details_description + "\"," + 
-						"\"" + details_scheme + "\"," + 
-						"\"" + details_reason_code + "\"," + 
-						"\"" + links_parent_event + "\"," + 
-						"\"" + links_payment + "\"," + 
-						"\"" + payments_id + "\"," + 
-						"\"" + payments_created_at + "\"," + 
-						"\"" + payments_charge_date + "\"," + 
-							payments_amount + "," + 
-						"\"" + payments_description + "\"," + 
-						"\"" + payments_currency + "\"," + 
-						"\"" + payments_status + "\"," + 
-						"\"" + customers_id + "\"," + 
-						"\"" + customers_given_name + "\"," + 
-						"\"" + customers_family_name + "\"," + 
-						"\"" + customers_metadata_leadID + "\"," + 
-						"\"" + payments_links_mandate + "\"," + 
-						"\"" + payments_metadata_identity + "\"," + 
-						"\"" + elevate_account_number + "\"," + 
-						"\"" + elevate_customer_name + "\"," + 
-						       payment_requests_count + ","  +
-						"\"" + crm_id + "\"," + 
-						"\"" + crm_name + "\"," + 
-						"\"" + crm_email + "\"," + 
-						"\"" + crm_premise_address + "\"," + 
-						"\"" + crm_stage_name + "\"," + 
-						"\"" + crm_zen_user_id  + "\"\n"
-
+	if level != "" {
+		ruleset.Level = level
+	}
+	if err := ruleset.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid ruleset: %w", err)
+	}
+	return ruleset, nil
+}
 
-		log.Println(fmt.Sprintf("customer_id %s for payments_id %s had %s payment requests and exceeded the allowed limit --> %s", customers_id, payments_id, payment_requests_count, csvNameToWarn))
-		
-		if _, err = targetFileWarn.WriteString(resultText); err != nil {
-			panic(err)
+// notifyCustomers writes the notifications to the customers put into bucket today, queues and sends them
+func notifyCustomers(db store.Store, notify notification, ruleset *rules.Ruleset, bucket rules.Bucket, now time.Time, timestamp string) error {
+	if !notify.notifier.HasTemplate(string(bucket)) {
+		fmt.Printf("Skipping notifications for %s, as there is no template %s.txt....\n", bucket, bucket)
+		return nil
+	}
+	var notes []notifier.Notification
+	if ruleset.Level == rules.LevelCustomer {
+		rows, err := db.CustomerActionExports(string(bucket), timestamp)
+		if err != nil {
+			return err
+		}
+		summaries, err := db.PaymentSummaries(ruleset.Query(now))
+		if err != nil {
+			return err
+		}
+		payments := make(map[string]store.PaymentSummary, len(summaries))
+		for _, p := range summaries {
+			payments[p.Event.PaymentID] = p
 		}
+		notes = notifier.FromCustomers(string(bucket), timestamp, rows, payments)
+	} else {
+		rows, err := db.ActionExports(string(bucket), timestamp)
+		if err != nil {
+			return err
+		}
+		notes = notifier.FromPayments(string(bucket), timestamp, rows)
 	}
 
-	 rowWarnings.Close()
-
-	fmt.Println("***********************************************************")
-	fmt.Println(fmt.Sprintf("CREATE customers-to-warn file WITH %s REQUESTS --      ended", strconv.Itoa(paymentRequestsToWarn)))
-	fmt.Println("***********************************************************")
-	fmt.Println(" ")
-
-	fmt.Println("***********************************************************")
-	fmt.Println(fmt.Sprintf("CREATE customers-to-suspend file WITH %s REQUESTS -- started", strconv.Itoa(minPaymentRequestsToSuspend)))
-	fmt.Println("***********************************************************")
-	fmt.Println(" ")
-
-	// write export file to customers-to-suspend-small-YYYY-MM-DD.csv
-	targetFileSuspendSmall, err := os.OpenFile(csvNameToSuspendSmall, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
-	if err != nil {
-		panic(err)
+	// customers are notified once per payment and bucket
+	var err error
+	if notify.dispatcher != nil {
+		if notes, err = notify.dispatcher.Unsent(string(bucket), notes); err != nil {
+			return err
+		}
 	}
-	defer targetFileSuspendSmall.Close()
-
-	if _, err = targetFileSuspendSmall.WriteString(headerText); err != nil {
-		panic(err)
+	for _, note := range notes {
+		if note.Email == "" {
+			fmt.Println("ERROR:   No crm_email for customer", note.CustomerKey, "- notification skipped")
+		}
 	}
 
-	// write export file to customers-to-suspend-large-YYYY-MM-DD.csv
-	targetFileSuspendLarge, err := os.OpenFile(csvNameToSuspendLarge, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if notify.dir != "" {
+		result, err := notify.notifier.Write(notify.dir, string(bucket), timestamp, notes)
+		if err != nil {
+			return err
+		}
+		fmt.Println("SUCCESS: Created", result.Written, "notifications in", result.Output)
+	}
+	if notify.dispatcher == nil {
+		return nil
+	}
+	queued, err := notify.dispatcher.Queue(notes)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	defer targetFileSuspendLarge.Close()
-
-	if _, err = targetFileSuspendLarge.WriteString(headerText); err != nil {
-		panic(err)
+	fmt.Println("SUCCESS: Queued", countMessages(queued), "notifications in the outbox")
+	if notify.send != sendSMTP {
+		return nil
 	}
-
-	SQLQueryExportSuspended := fmt.Sprintf(`
-		SELECT DISTINCT
-			failedPaymentRequests.resource_type              ,
-			failedPaymentRequests.action                     ,
-			failedPaymentRequests.details_origin             ,
-			failedPaymentRequests.details_cause              ,
-			failedPaymentRequests.details_description        ,
-			failedPaymentRequests.details_scheme             ,
-			failedPaymentRequests.details_reason_code        ,
-			failedPaymentRequests.links_parent_event         ,
-			failedPaymentRequests.links_payment              ,
-			failedPaymentRequests.payments_id                ,
-			failedPaymentRequests.payments_created_at        ,
-			failedPaymentRequests.payments_charge_date       ,
-			failedPaymentRequests.payments_amount            ,
-			failedPaymentRequests.payments_description       ,
-			failedPaymentRequests.payments_currency          ,
-			failedPaymentRequests.payments_status            ,
-			failedPaymentRequests.customers_id               ,
-			failedPaymentRequests.customers_given_name       ,
-			failedPaymentRequests.customers_family_name      ,
-			failedPaymentRequests.customers_metadata_leadID  ,
-			failedPaymentRequests.payments_links_mandate     ,
-			failedPaymentRequests.payments_metadata_identity ,
-			COUNT(failedPaymentRequests.payments_id)         ,
-			elevateAccounts.elevate_account_number           ,
-			elevateAccounts.elevate_customer_name            ,
-			crmAccounts.crm_id                               ,
-			crmAccounts.crm_name                             ,
-			crmAccounts.crm_email                            ,
-			crmAccounts.crm_premise_address                  ,
-			crmAccounts.crm_stage_name  			         ,
-			crmAccounts.crm_zen_user_id	
-		FROM       paymentsSuspended
-		INNER JOIN failedPaymentRequests 
-		ON         failedPaymentRequests.payments_id = paymentsSuspended.payments_id
-		LEFT JOIN elevateAccounts
-		ON failedPaymentRequests.payments_links_mandate = elevateAccounts.elevate_mandate_reference
-		LEFT JOIN crmAccounts
-		ON elevateAccounts.elevate_account_number = crmAccounts.crm_account_number
-		WHERE      paymentsSuspended.timestamp = "%s"
-		GROUP BY   failedPaymentRequests.payments_id 
-		ORDER BY   failedPaymentRequests.payments_id
-	`, timestamp)
-
-	rowSuspended, err := db.Query(SQLQueryExportSuspended)
+	sent, failed, err := notify.dispatcher.Send(queued)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	defer rowSuspended.Close()
-
-	for rowSuspended.Next() {
-		var resource_type string
-		var action string
-		var details_origin string
-		var details_cause string
-		var details_description string
-		var details_scheme string
-		var details_reason_code string
-		var links_parent_event string
-		var links_payment string
-		var payments_id string
-		var payments_created_at string
-		var payments_charge_date string
-		var payments_amount string
-		var payments_description string
-		var payments_currency string
-		var payments_status string
-		var customers_id string
-		var customers_given_name string
-		var customers_family_name string
-		var customers_metadata_leadID  string
-		var payments_links_mandate     string
-		var payments_metadata_identity string
-		var payment_requests_count     string
-		var elevate_account_number     string
-		var elevate_customer_name      string
-		var crm_id                 string
-		var crm_name               string
-		var crm_email              string
-		var crm_premise_address    string
-		var crm_stage_name         string
-		var crm_zen_user_id        string
-
-		rowSuspended.Scan(
-			&resource_type, 
-			&action, 
-			&details_origin, 
-			&details_cause,
-			&details_description, 
-			&details_scheme, 
-			&details_reason_code, 
-			&links_parent_event, 
-			&links_payment, 
-			&payments_id, 
-			&payments_created_at, 
-			&payments_charge_date, 
-			&payments_amount, 
-			&payments_description, 
-			&payments_currency, 
-			&payments_status, 
-			&customers_id, 
-			&customers_given_name, 
-			&customers_family_name, 
-			&customers_metadata_leadID, 
-			&payments_links_mandate, 
-			&payments_metadata_identity, 
-			&payment_requests_count,
-			&elevate_account_number, 
-			&elevate_customer_name,
-			&crm_id,
-			&crm_name,
-			&crm_email,
-			&crm_premise_address,
-			&crm_stage_name,
-		    &crm_zen_user_id )
-
-		resultText := 	"\"" + resource_type + "\"," +
-						"\"" + action + "\"," + 
-						"\"" + details_origin + "\"," + 
-						"\"" + details_cause + "\"," + 
-						"\"" + details_description + "\"," + 
-						"\"" + details_scheme + "\"," + 
-						"\"" + details_reason_code + "\"," + 
-						"\"" + links_parent_event + "\"," + 
-						"\"" + links_payment + "\"," + 
-						"\"" + payments_id + "\"," + 
-						"\"" + payments_created_at + "\"," + 
-						"\"" + payments_charge_date + "\"," + 
-						       payments_amount + "," + 
-						"\"" + payments_description + "\"," + 
-						"\"" + payments_currency + "\"," + 
-						"\"" + payments_status + "\"," + 
-						"\"" + customers_id + "\"," + 
-						"\"" + customers_given_name + "\"," + 
-						"\"" + customers_family_name + "\"," + 
-						"\"" + customers_metadata_leadID + "\"," + 
-						"\"" + payments_links_mandate + "\"," + 
-						"\"" + payments_metadata_identity + "\"," + 
-						"\"" + elevate_account_number + "\"," + 
-						"\"" + elevate_customer_name + "\"," + 
-						       payment_requests_count +  "," +
-						"\"" + crm_id + "\"," + 
-						"\"" + crm_name + "\"," + 
-						"\"" + crm_email + "\"," + 
-						"\"" + crm_premise_address + "\"," + 
-						"\"" + crm_stage_name + "\"," + 
-						"\"" + crm_zen_user_id  + "\"\n"
-
-		paymentValue, err := strconv.ParseFloat(payments_amount, 64)
-		if paymentValue < amountToSwitch {
-			log.Println(fmt.Sprintf("customer_id %s for payments_id %s had %s payment requests and exceeded the allowed limit --> %s", customers_id, payments_id, payment_requests_count, csvNameToSuspendSmall))
-			if _, err = targetFileSuspendSmall.WriteString(resultText); err != nil {
-				panic(err)
-			}
-		} else {			
-			log.Println(fmt.Sprintf("customer_id %s for payments_id %s had %s payment requests and exceeded the allowed limit --> %s", customers_id, payments_id, payment_requests_count, csvNameToSuspendLarge))
-			if _, err = targetFileSuspendLarge.WriteString(resultText); err != nil {
-				panic(err)
-			}
-		}
+	fmt.Println("SUCCESS: Sent", sent, "notifications")
+	if failed > 0 {
+		fmt.Println("ERROR:  ", failed, "notifications could not be sent, see fp outbox")
 	}
+	return nil
+}
 
-	rowSuspended.Close()
-
-	fmt.Println("***********************************************************")
-	fmt.Println(fmt.Sprintf("CREATE customers-to-suspend file WITH %s REQUESTS -- ended", strconv.Itoa(minPaymentRequestsToSuspend)))
-	fmt.Println("***********************************************************")
-	fmt.Println(" ")
-	fmt.Println("***********************************************************")
-	fmt.Println(" F I N I S H E D")
-	fmt.Println("***********************************************************")
-}
\ No newline at end of file
+// writeRejected writes the rows the importer rejected to fileName, nothing is written if all rows were imported
+func writeRejected(imp *importer.Importer, fileName string) {
+	if len(imp.Rejected) == 0 {
+		return
+	}
+	if err := imp.WriteRejected(fileName); err != nil {
+		log.Printf("Writing the rejected rows to %s failed: %s", fileName, err)
+		return
+	}
+	fmt.Println("ERROR:  ", len(imp.Rejected), "rows could not be imported, see", fileName)
+}
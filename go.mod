@@ -2,4 +2,6 @@ module github.com/tobkle/fp
 
 go 1.18
 
-require github.com/mattn/go-sqlite3 v1.14.13 // indirect
+require github.com/mattn/go-sqlite3 v1.14.13
+
+require gopkg.in/yaml.v3 v3.0.1
@@ -0,0 +1,94 @@
+/********************************************************************************************************************
+ * name: history
+ * description: fp history, the dunning timeline of a payment or customer, or rebuild the current-state tables
+ ********************************************************************************************************************/
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/tobkle/fp/rules"
+	"github.com/tobkle/fp/store"
+)
+
+// cmdHistory implements `fp history <payments_id|customers_id|account number>|rebuild`
+func cmdHistory(args []string) {
+	var o historyOptions
+	s := loadSettings(args)
+	flags := newHistoryFlags(&o, s)
+	key := ""
+	s.apply(flags)
+	if positional := parseArgs(flags, args); len(positional) > 0 {
+		key = positional[0]
+	}
+
+	db, err := store.Open(o.dbName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	if err = runHistory(db, key); err != nil {
+		log.Fatalf("History failed: %s", err)
+	}
+}
+
+// historyOptions are the parameters of fp history
+type historyOptions struct {
+	dbName string
+}
+
+// newHistoryFlags returns the parameters of fp history with the defaults in the data directory
+func newHistoryFlags(o *historyOptions, s *settings) *flag.FlagSet {
+	flags := flag.NewFlagSet("history", flag.ExitOnError)
+	flags.StringVar(&o.dbName, "db", defaultDatabase(s.dir), "Sqlite database with the dunning history")
+	s.register(flags)
+	return flags
+}
+
+// runHistory prints the dunning history of key, a payments_id, customers_id or Elevate account number,
+// or with key rebuild derives the current-state tables again from the history
+func runHistory(db store.Store, key string) error {
+	if _, err := db.Migrate(); err != nil {
+		return err
+	}
+	if key == "" {
+		return fmt.Errorf("fp history needs a payments_id, customers_id or account number, or rebuild")
+	}
+	if key == "rebuild" {
+		if err := db.RebuildCurrentState(rules.TableBuckets); err != nil {
+			return err
+		}
+		fmt.Println("SUCCESS: Rebuilt paymentsActions, paymentsWarnings, paymentsSuspended and customersActions from the dunning history")
+		return nil
+	}
+
+	entries, err := db.History(key)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%-10s %-24s %-8s %-13s %-20s %-14s %6s %-12s %s\n", "DATE", "RECORDED", "LEVEL", "ACTION", "PAYMENTS", "CUSTOMER", "COUNT", "OPERATOR", "RULE / REASON")
+	for _, e := range entries {
+		why := e.Rule
+		if e.Reason != "" {
+			why = e.Reason
+		}
+		fmt.Printf("%-10s %-24s %-8s %-13s %-20s %-14s %6d %-12s %s\n", e.Date, e.Timestamp, e.Level, e.Action,
+			e.PaymentID, e.CustomerKey, e.Count, e.Operator, why)
+	}
+	fmt.Println(len(entries), "entries in the dunning history of", key)
+	return nil
+}
+
+// defaultOperator is the user running fp, recorded with the dunning history
+func defaultOperator() string {
+	for _, name := range []string{"USER", "USERNAME"} {
+		if user := os.Getenv(name); user != "" {
+			return user
+		}
+	}
+	return "fp"
+}
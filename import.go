@@ -0,0 +1,110 @@
+/********************************************************************************************************************
+ * name: import
+ * description: fp import, import one payments, Elevate accounts or CRM csv file into the database
+ ********************************************************************************************************************/
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/tobkle/fp/importer"
+	"github.com/tobkle/fp/store"
+)
+
+// sources of fp import with the prefix of their dated default file
+var importSources = map[string]string{
+	"payments": "failed-payment-requests-",
+	"accounts": "elevate-accounts-",
+	"crm":      "crm-accounts-",
+}
+
+// cmdImport implements `fp import payments|accounts|crm [file]`, by default the file of today
+func cmdImport(args []string) {
+	var timestamp = time.Now().Format("2006-01-02")
+	var o importOptions
+	s := loadSettings(args)
+	flags := newImportFlags(&o, s, timestamp)
+	s.apply(flags)
+	positional := parseArgs(flags, args)
+	if len(positional) == 0 || importSources[positional[0]] == "" {
+		log.Fatal("fp import needs the kind of file: payments, accounts or crm")
+	}
+	if _, err := parseDate(o.asOf); err != nil {
+		log.Fatal(err)
+	}
+	named := map[string]bool{}
+	flags.Visit(func(f *flag.Flag) { named[f.Name] = true })
+	if !named["rejected"] {
+		o.imf.rejectedTo = datedName(s.dir, "rejected-rows-", o.asOf)
+	}
+	source, fileName := positional[0], datedName(s.dir, importSources[positional[0]], o.asOf)
+	if len(positional) > 1 {
+		fileName = positional[1]
+	}
+	expandDate(o.asOf, &o.imf.rejectedTo)
+
+	columnMappings, err := o.imf.columns()
+	if err != nil {
+		log.Fatalf("Loading column mapping failed: %s", err)
+	}
+	db, err := store.Open(o.dbName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	fmt.Println("Received      Database Name      :", o.dbName)
+	fmt.Println("Received CSV-From-File Name      :", fileName)
+	applied, err := db.Migrate()
+	for _, m := range applied {
+		fmt.Println("SUCCESS: Applied database migration", m.Version, ":", m.Name)
+	}
+	if err != nil {
+		log.Fatalf("Database migration failed: %s", err)
+	}
+
+	imp := o.imf.importer(db, columnMappings)
+	imp.SnapshotDate = o.asOf
+	var result importer.Result
+	switch source {
+	case "payments":
+		result, err = imp.ImportPayments(fileName)
+	case "accounts":
+		result, err = imp.ImportAccounts(fileName)
+	case "crm":
+		result, err = imp.ImportCRM(fileName)
+	}
+	writeRejected(imp, o.imf.rejectedTo)
+	if err != nil {
+		log.Fatalf("Import of %s failed: %s", source, err)
+	}
+	if result.DuplicateOf != 0 {
+		return
+	}
+	if source == "payments" {
+		fmt.Printf("SUCCESS: Imported %s: inserted %d, skipped %d, rejected %d (import %d)\n", fileName, result.Inserted, result.Skipped, result.Failed, result.ImportID)
+		return
+	}
+	fmt.Printf("SUCCESS: Imported %s: inserted %d, updated %d, unchanged %d, disappeared %d, rejected %d (import %d)\n",
+		fileName, result.Inserted, result.Updated, result.Skipped, result.Disappeared, result.Failed, result.ImportID)
+}
+
+// importOptions are the parameters of fp import
+type importOptions struct {
+	dbName string
+	imf    importFlags
+	asOf   string
+}
+
+// newImportFlags returns the parameters of fp import with the defaults in the data directory
+func newImportFlags(o *importOptions, s *settings, timestamp string) *flag.FlagSet {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	flags.StringVar(&o.dbName, "db", defaultDatabase(s.dir), "Sqlite database to import to")
+	o.imf.register(flags, datedName(s.dir, "rejected-rows-", timestamp))
+	flags.StringVar(&o.asOf, "as-of", timestamp, "date YYYY-MM-DD of the default file and of the account snapshot")
+	s.register(flags)
+	return flags
+}
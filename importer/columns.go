@@ -0,0 +1,168 @@
+/********************************************************************************************************************
+ * name: columns
+ * description: resolve csv columns by header name instead of by position, with a configurable mapping per source
+ ********************************************************************************************************************/
+package importer
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Column describes one database field and the csv header names it may appear under
+type Column struct {
+	Field    string
+	Headers  []string
+	Required bool
+}
+
+// ColumnMapping is the ordered list of columns read from one csv source
+type ColumnMapping []Column
+
+// ColumnIndex maps a database field to its position in the csv record
+type ColumnIndex map[string]int
+
+// DefaultColumnMappings are the header names per source, the database field name itself is always accepted as well
+var DefaultColumnMappings = map[string]ColumnMapping{
+	"accounts": {
+		{Field: "elevate_account_number", Headers: []string{"customer_account_number", "account_number"}, Required: true},
+		{Field: "elevate_customer_name", Headers: []string{"customer_name"}, Required: true},
+		{Field: "elevate_mandate_reference", Headers: []string{"mandate_reference"}, Required: true},
+	},
+	"crm": {
+		{Field: "crm_account_number", Headers: []string{"account_number"}, Required: true},
+		{Field: "crm_id", Headers: []string{"id"}, Required: true},
+		{Field: "crm_name", Headers: []string{"name"}, Required: true},
+		{Field: "crm_email", Headers: []string{"email", "e_mail"}, Required: true},
+		{Field: "crm_premise_address", Headers: []string{"premise_address"}, Required: true},
+		{Field: "crm_stage_name", Headers: []string{"stage_name", "stage"}, Required: true},
+		{Field: "crm_zen_user_id", Headers: []string{"zen_user_id"}, Required: false},
+	},
+	"payments": {
+		{Field: "id", Headers: []string{"id"}, Required: true},
+		{Field: "created_at", Headers: []string{"created_at"}, Required: true},
+		{Field: "resource_type", Headers: []string{"resource_type"}, Required: true},
+		{Field: "action", Headers: []string{"action"}, Required: true},
+		{Field: "details_origin", Headers: []string{"details.origin"}, Required: false},
+		{Field: "details_cause", Headers: []string{"details.cause"}, Required: false},
+		{Field: "details_description", Headers: []string{"details.description"}, Required: false},
+		{Field: "details_scheme", Headers: []string{"details.scheme"}, Required: false},
+		{Field: "details_reason_code", Headers: []string{"details.reason_code"}, Required: false},
+		{Field: "links_parent_event", Headers: []string{"links.parent_event"}, Required: false},
+		{Field: "links_payment", Headers: []string{"links.payment"}, Required: false},
+		{Field: "payments_id", Headers: []string{"payments.id"}, Required: true},
+		{Field: "payments_created_at", Headers: []string{"payments.created_at"}, Required: false},
+		{Field: "payments_charge_date", Headers: []string{"payments.charge_date"}, Required: true},
+		{Field: "payments_amount", Headers: []string{"payments.amount"}, Required: true},
+		{Field: "payments_description", Headers: []string{"payments.description"}, Required: false},
+		{Field: "payments_currency", Headers: []string{"payments.currency"}, Required: true},
+		{Field: "payments_status", Headers: []string{"payments.status"}, Required: false},
+		{Field: "customers_id", Headers: []string{"customers.id"}, Required: true},
+		{Field: "customers_given_name", Headers: []string{"customers.given_name"}, Required: false},
+		{Field: "customers_family_name", Headers: []string{"customers.family_name"}, Required: false},
+		{Field: "customers_metadata_leadID", Headers: []string{"customers.metadata.leadID"}, Required: false},
+		{Field: "payments_links_mandate", Headers: []string{"payments.links.mandate"}, Required: true},
+		{Field: "payments_metadata_identity", Headers: []string{"payments.metadata.identity"}, Required: false},
+		{Field: "customers_email", Headers: []string{"customers.email"}, Required: false},
+	},
+}
+
+// normalizeHeader makes header names comparable: "Payments.Links.Mandate" and "payments_links_mandate" are equal
+func normalizeHeader(name string) string {
+	name = strings.TrimPrefix(name, "\ufeff")
+	var b strings.Builder
+	underscore := false
+	for _, r := range strings.ToLower(strings.TrimSpace(name)) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			b.WriteRune(r)
+			underscore = false
+		} else if !underscore && b.Len() > 0 {
+			b.WriteRune('_')
+			underscore = true
+		}
+	}
+	return strings.TrimSuffix(b.String(), "_")
+}
+
+// LoadColumnMappings returns the default mappings, overridden by the json file given with -columns.
+// The file lists per source the header names of a field, e.g.
+//
+//	{ "crm": { "crm_email": ["E-Mail Address"] } }
+func LoadColumnMappings(fileName string) (map[string]ColumnMapping, error) {
+	mappings := make(map[string]ColumnMapping, len(DefaultColumnMappings))
+	for source, mapping := range DefaultColumnMappings {
+		mappings[source] = append(ColumnMapping(nil), mapping...)
+	}
+	if fileName == "" {
+		return mappings, nil
+	}
+
+	content, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	var overrides map[string]map[string][]string
+	if err = json.Unmarshal(content, &overrides); err != nil {
+		return nil, fmt.Errorf("%s: %w", fileName, err)
+	}
+	for source, fields := range overrides {
+		mapping, ok := mappings[source]
+		if !ok {
+			return nil, fmt.Errorf("%s: unknown source %q, expected accounts, crm or payments", fileName, source)
+		}
+		for field, headers := range fields {
+			found := false
+			for i := range mapping {
+				if mapping[i].Field == field {
+					mapping[i].Headers = headers
+					found = true
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("%s: unknown field %q for source %s", fileName, field, source)
+			}
+		}
+	}
+	return mappings, nil
+}
+
+// Resolve finds the position of every field in the header row and fails on missing required columns
+func (mapping ColumnMapping) Resolve(source string, header []string) (ColumnIndex, error) {
+	positions := make(map[string]int, len(header))
+	for i, name := range header {
+		key := normalizeHeader(name)
+		if _, exists := positions[key]; !exists {
+			positions[key] = i
+		}
+	}
+
+	index := make(ColumnIndex, len(mapping))
+	var missing []string
+	for _, col := range mapping {
+		candidates := append([]string{col.Field}, col.Headers...)
+		for _, candidate := range candidates {
+			if i, ok := positions[normalizeHeader(candidate)]; ok {
+				index[col.Field] = i
+				break
+			}
+		}
+		if _, ok := index[col.Field]; !ok && col.Required {
+			missing = append(missing, fmt.Sprintf("%s (looked for: %s)", col.Field, strings.Join(col.Headers, ", ")))
+		}
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("%s file is missing required columns: %s", source, strings.Join(missing, "; "))
+	}
+	return index, nil
+}
+
+// Get returns the value of a field in a record, or an empty string for optional columns not in the file
+func (index ColumnIndex) Get(record []string, field string) string {
+	i, ok := index[field]
+	if !ok || i >= len(record) {
+		return ""
+	}
+	return record[i]
+}
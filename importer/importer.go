@@ -0,0 +1,434 @@
+/********************************************************************************************************************
+ * name: importer
+ * description: read the Elevate accounts, CRM accounts and failed payment requests csv files into the Store
+ ********************************************************************************************************************/
+package importer
+
+import (
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tobkle/fp/store"
+)
+
+// csv sources, also the keys of the column mappings
+const (
+	SourceAccounts = "accounts"
+	SourcePayments = "payments"
+	SourceCRM      = "crm"
+)
+
+// keyFields must not be empty in a record, they identify the record in its table
+var keyFields = map[string][]string{
+	SourceAccounts: {"elevate_mandate_reference"},
+	SourceCRM:      {"crm_account_number"},
+	SourcePayments: {"id", "payments_id"},
+}
+
+// ErrTooManyRejected is returned when a run rejected more records than Importer.MaxRejected
+var ErrTooManyRejected = errors.New("too many rejected records")
+
+// Importer reads csv files into the Store, every file in one transaction
+type Importer struct {
+	Store   store.Store
+	Columns map[string]ColumnMapping
+	Log     io.Writer
+	// MaxRejected is the number of rejected records allowed in a run before the import fails, negative allows any
+	MaxRejected int
+	// Rejected lists the records rejected so far
+	Rejected []Rejection
+	// Reimport imports files even if a file with the same content was imported before
+	Reimport bool
+	// Version is the version of the tool recorded in the imports ledger
+	Version string
+	// SnapshotDate is the day the accounts files are a snapshot of, today if empty
+	SnapshotDate string
+	// Name replaces the path of the file in the imports ledger, the rejections and the log, e.g. for an uploaded
+	// file saved to a temporary path
+	Name string
+}
+
+// Result counts the records of one imported file
+type Result struct {
+	Inserted int
+	// Updated are the accounts with changed values, Disappeared those missing in the accounts file
+	Updated     int
+	Disappeared int
+	Skipped     int
+	Failed      int
+	// ImportID is the entry of the file in the imports ledger
+	ImportID int64
+	// DuplicateOf is the import of the same content if the file was skipped, 0 otherwise
+	DuplicateOf int64
+}
+
+// Rejection is a record that was not imported, Line is its line number in the file
+type Rejection struct {
+	File   string
+	Line   int
+	ID     string
+	Reason string
+}
+
+// New returns an Importer using the given column mappings, nil for the defaults
+func New(s store.Store, columns map[string]ColumnMapping) *Importer {
+	if columns == nil {
+		columns = DefaultColumnMappings
+	}
+	return &Importer{Store: s, Columns: columns, Log: os.Stdout, MaxRejected: -1}
+}
+
+// readFile calls each for every record of a csv file after resolving its header row and done after the last
+// record, if not nil. All records of the file are stored in one transaction, which is rolled back if the file
+// cannot be read, done fails or too many records are rejected. each stores a record and returns its id, an error
+// rejects the record.
+// Every file is recorded in the imports ledger, a file with the same content as an already imported one is skipped.
+func (im *Importer) readFile(fileName string, source string, result *Result,
+	each func(tx store.Store, row ColumnIndex, record []string) (string, error), done func(tx store.Store) error) error {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	if _, err = io.Copy(hash, f); err != nil {
+		return fmt.Errorf("%s: %w", fileName, err)
+	}
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	path, err := filepath.Abs(fileName)
+	if err != nil {
+		return err
+	}
+	if im.Name != "" {
+		fileName, path = im.Name, im.Name
+	}
+	entry := store.Import{Source: source, FileName: path, SHA256: hex.EncodeToString(hash.Sum(nil)),
+		Status: store.ImportRunning, StartedAt: now(), ToolVersion: im.Version}
+
+	if !im.Reimport {
+		previous, err := im.Store.Imports(entry.SHA256)
+		if err != nil {
+			return err
+		}
+		for _, p := range previous {
+			if p.Source == source && p.Status == store.ImportCommitted {
+				fmt.Fprintf(im.Log, "SUCCESS: Skipped %s, it has the same content as %s imported at %s (import %d)\n",
+					fileName, p.FileName, p.FinishedAt, p.ID)
+				entry.Status, entry.FinishedAt = store.ImportDuplicate, now()
+				if entry.ID, err = im.Store.StartImport(entry); err != nil {
+					return err
+				}
+				result.ImportID, result.DuplicateOf = entry.ID, p.ID
+				return im.Store.FinishImport(entry)
+			}
+		}
+	}
+	if entry.ID, err = im.Store.StartImport(entry); err != nil {
+		return err
+	}
+	result.ImportID = entry.ID
+
+	imported := *result
+	rejected := len(im.Rejected)
+	err = im.Store.Transaction(func(tx store.Store) error {
+		r := csv.NewReader(f)
+		r.FieldsPerRecord = -1
+		header, err := r.Read()
+		if err != nil {
+			return fmt.Errorf("%s: missing header row(?): %w", fileName, err)
+		}
+		index, err := im.Columns[source].Resolve(source, header)
+		if err != nil {
+			return fmt.Errorf("%s: %w", fileName, err)
+		}
+
+		for {
+			record, err := r.Read()
+			if errors.Is(err, io.EOF) {
+				if done != nil {
+					return done(tx)
+				}
+				return nil
+			}
+			var parseErr *csv.ParseError
+			if errors.As(err, &parseErr) {
+				if err = im.reject(result, Rejection{File: fileName, Line: parseErr.Line, Reason: parseErr.Err.Error()}); err != nil {
+					return err
+				}
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("%s: %w", fileName, err)
+			}
+
+			line, _ := r.FieldPos(0)
+			id, err := validate(index, header, record, keyFields[source])
+			if err == nil {
+				id, err = each(tx, index, record)
+			}
+			if err != nil {
+				if err = im.reject(result, Rejection{File: fileName, Line: line, ID: id, Reason: err.Error()}); err != nil {
+					return err
+				}
+			}
+		}
+	})
+
+	entry.Status, entry.FinishedAt = store.ImportCommitted, now()
+	entry.Inserted, entry.Updated, entry.Skipped = result.Inserted, result.Updated, result.Skipped
+	entry.Rejected = len(im.Rejected) - rejected
+	if err != nil {
+		*result = imported
+		entry.Status, entry.Inserted, entry.Updated, entry.Skipped = store.ImportRolledBack, 0, 0, 0
+		fmt.Fprintln(im.Log, "ERROR:   Import of", fileName, "rolled back:", err)
+	}
+	if finishErr := im.Store.FinishImport(entry); err == nil {
+		err = finishErr
+	}
+	return err
+}
+
+// now is the current time in the format of the imports ledger
+func now() string {
+	return time.Now().UTC().Format(store.ISOTimestamp)
+}
+
+// validate checks the number of fields and the key fields of a record, it returns the first key for reference
+func validate(index ColumnIndex, header []string, record []string, keys []string) (string, error) {
+	id := index.Get(record, keys[0])
+	if len(record) != len(header) {
+		return id, fmt.Errorf("record has %d fields, the header has %d", len(record), len(header))
+	}
+	for _, key := range keys {
+		if strings.TrimSpace(index.Get(record, key)) == "" {
+			return id, fmt.Errorf("empty %s", key)
+		}
+	}
+	return id, nil
+}
+
+// reject logs and records a rejected record, it fails once the run has more than MaxRejected rejections
+func (im *Importer) reject(result *Result, rejection Rejection) error {
+	result.Failed++
+	im.Rejected = append(im.Rejected, rejection)
+	fmt.Fprintf(im.Log, "ERROR:   Rejected line %d of %s (id %q): %s\n", rejection.Line, rejection.File, rejection.ID, rejection.Reason)
+	if im.MaxRejected >= 0 && len(im.Rejected) > im.MaxRejected {
+		return fmt.Errorf("%w: %d, allowed are %d", ErrTooManyRejected, len(im.Rejected), im.MaxRejected)
+	}
+	return nil
+}
+
+// count logs the outcome of an insert and adds it to the result, it returns the error of a failed insert
+func (im *Importer) count(result *Result, table string, id string, err error) error {
+	switch {
+	case errors.Is(err, store.ErrExists):
+		result.Skipped++
+		return nil
+	case err != nil:
+		return fmt.Errorf("insert into table %s failed: %w", table, err)
+	default:
+		result.Inserted++
+		fmt.Fprintln(im.Log, "SUCCESS: Insert into table", table, "with id:", id)
+		return nil
+	}
+}
+
+// countAccount logs the outcome of storing an account of a snapshot and adds it to the result, it returns the
+// error of a failed insert or update
+func (im *Importer) countAccount(result *Result, table string, id string, change store.AccountChange, err error) error {
+	switch {
+	case errors.Is(err, store.ErrExists):
+		result.Skipped++
+		return nil
+	case err != nil:
+		return fmt.Errorf("upsert into table %s failed: %w", table, err)
+	}
+	switch change.Status {
+	case store.AccountNew:
+		result.Inserted++
+		fmt.Fprintln(im.Log, "SUCCESS: Insert into table", table, "with id:", id)
+	case store.AccountChanged:
+		result.Updated++
+		fmt.Fprintf(im.Log, "SUCCESS: Update of table %s with id: %s, changed %s\n", table, id, strings.Join(change.Fields, ", "))
+	case store.AccountReappeared:
+		result.Updated++
+		fmt.Fprintln(im.Log, "SUCCESS: Account reappeared in table", table, "with id:", id)
+	default:
+		result.Skipped++
+	}
+	return nil
+}
+
+// snapshot returns the snapshot of an accounts file of source, the import id is set once the file is in the ledger
+func (im *Importer) snapshot(source string) store.Snapshot {
+	date := im.SnapshotDate
+	if date == "" {
+		date = time.Now().Format(store.ISODate)
+	}
+	return store.Snapshot{Source: source, Date: date}
+}
+
+// missing lists the fields of source that aren't columns of the file
+func (im *Importer) missing(source string, row ColumnIndex) []string {
+	var fields []string
+	for _, col := range im.Columns[source] {
+		if _, ok := row[col.Field]; !ok {
+			fields = append(fields, col.Field)
+		}
+	}
+	return fields
+}
+
+// markDisappeared flags the accounts which are not in the snapshot, unless the file had no accounts at all
+func (im *Importer) markDisappeared(tx store.Store, table string, snapshot store.Snapshot, result *Result) error {
+	if result.Inserted+result.Updated+result.Skipped == 0 {
+		return nil
+	}
+	keys, err := tx.MarkDisappeared(snapshot)
+	if err != nil {
+		return fmt.Errorf("flagging the disappeared accounts of table %s failed: %w", table, err)
+	}
+	for _, key := range keys {
+		fmt.Fprintln(im.Log, "SUCCESS: Account disappeared from table", table, "with id:", key)
+	}
+	result.Disappeared = len(keys)
+	return nil
+}
+
+// ImportAccounts reads an Elevate accounts export as snapshot of all accounts: new accounts are inserted, changed
+// ones updated and accounts missing in the file flagged as disappeared
+func (im *Importer) ImportAccounts(fileName string) (Result, error) {
+	var result Result
+	snapshot := im.snapshot(SourceAccounts)
+	err := im.readFile(fileName, SourceAccounts, &result, func(tx store.Store, row ColumnIndex, record []string) (string, error) {
+		account := store.ElevateAccount{
+			MandateReference: row.Get(record, "elevate_mandate_reference"),
+			AccountNumber:    row.Get(record, "elevate_account_number"),
+			CustomerName:     row.Get(record, "elevate_customer_name"),
+			ImportID:         result.ImportID,
+		}
+		snapshot.ImportID, snapshot.Missing = result.ImportID, im.missing(SourceAccounts, row)
+		change, err := tx.UpsertElevateAccount(account, snapshot)
+		return account.MandateReference, im.countAccount(&result, "elevateAccounts", account.AccountNumber, change, err)
+	}, func(tx store.Store) error {
+		return im.markDisappeared(tx, "elevateAccounts", snapshot, &result)
+	})
+	return result, err
+}
+
+// ImportCRM reads a CRM accounts export as snapshot like ImportAccounts, the stored values of optional columns
+// missing in the file are kept
+func (im *Importer) ImportCRM(fileName string) (Result, error) {
+	var result Result
+	snapshot := im.snapshot(SourceCRM)
+	err := im.readFile(fileName, SourceCRM, &result, func(tx store.Store, row ColumnIndex, record []string) (string, error) {
+		account := store.CRMAccount{
+			AccountNumber:  row.Get(record, "crm_account_number"),
+			ID:             row.Get(record, "crm_id"),
+			Name:           row.Get(record, "crm_name"),
+			Email:          row.Get(record, "crm_email"),
+			PremiseAddress: row.Get(record, "crm_premise_address"),
+			StageName:      row.Get(record, "crm_stage_name"),
+			ZenUserID:      row.Get(record, "crm_zen_user_id"),
+			ImportID:       result.ImportID,
+		}
+		snapshot.ImportID, snapshot.Missing = result.ImportID, im.missing(SourceCRM, row)
+		change, err := tx.UpsertCRMAccount(account, snapshot)
+		return account.AccountNumber, im.countAccount(&result, "crmAccounts", account.AccountNumber+" "+account.ID, change, err)
+	}, func(tx store.Store) error {
+		return im.markDisappeared(tx, "crmAccounts", snapshot, &result)
+	})
+	return result, err
+}
+
+// ImportPayments reads a failed payment requests export of the payment provider, events already stored are skipped
+func (im *Importer) ImportPayments(fileName string) (Result, error) {
+	var result Result
+	err := im.readFile(fileName, SourcePayments, &result, func(tx store.Store, row ColumnIndex, record []string) (string, error) {
+		event, err := paymentEvent(row, record)
+		if err != nil {
+			return event.ID, err
+		}
+		event.ImportID = result.ImportID
+		err = tx.InsertFailedPaymentEvent(event)
+		if errors.Is(err, store.ErrExists) {
+			fmt.Fprintln(im.Log, "SUCCESS: Skipped existing record with id:", event.ID)
+		}
+		return event.ID, im.count(&result, "failedPaymentRequests", event.ID, err)
+	}, nil)
+	return result, err
+}
+
+// WriteRejected writes the rejected records to a csv file with the columns file, line, id and reason
+func (im *Importer) WriteRejected(fileName string) error {
+	f, err := os.OpenFile(fileName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := csv.NewWriter(f)
+	w.Write([]string{"file", "line", "id", "reason"})
+	for _, r := range im.Rejected {
+		w.Write([]string{r.File, strconv.Itoa(r.Line), r.ID, r.Reason})
+	}
+	w.Flush()
+	if err = w.Error(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// paymentEvent maps a payments csv record, amounts are converted to minor units and dates to ISO format
+func paymentEvent(row ColumnIndex, record []string) (store.FailedPaymentEvent, error) {
+	event := store.FailedPaymentEvent{
+		ID:                 row.Get(record, "id"),
+		ResourceType:       row.Get(record, "resource_type"),
+		Action:             row.Get(record, "action"),
+		DetailsOrigin:      row.Get(record, "details_origin"),
+		DetailsCause:       row.Get(record, "details_cause"),
+		DetailsDescription: row.Get(record, "details_description"),
+		DetailsScheme:      row.Get(record, "details_scheme"),
+		DetailsReasonCode:  row.Get(record, "details_reason_code"),
+		LinksParentEvent:   row.Get(record, "links_parent_event"),
+		LinksPayment:       row.Get(record, "links_payment"),
+		PaymentID:          row.Get(record, "payments_id"),
+		PaymentDescription: row.Get(record, "payments_description"),
+		Currency:           row.Get(record, "payments_currency"),
+		PaymentStatus:      row.Get(record, "payments_status"),
+		CustomerID:         row.Get(record, "customers_id"),
+		CustomerGivenName:  row.Get(record, "customers_given_name"),
+		CustomerFamilyName: row.Get(record, "customers_family_name"),
+		CustomerLeadID:     row.Get(record, "customers_metadata_leadID"),
+		MandateID:          row.Get(record, "payments_links_mandate"),
+		PaymentIdentity:    row.Get(record, "payments_metadata_identity"),
+		CustomerEmail:      row.Get(record, "customers_email"),
+	}
+
+	var err error
+	if event.AmountMinor, err = store.ParseAmount(row.Get(record, "payments_amount"), event.Currency); err != nil {
+		return event, fmt.Errorf("payments_amount: %w", err)
+	}
+	if event.CreatedAt, err = store.NormalizeTimestamp(row.Get(record, "created_at")); err != nil {
+		return event, fmt.Errorf("created_at: %w", err)
+	}
+	if event.PaymentCreatedAt, err = store.NormalizeTimestamp(row.Get(record, "payments_created_at")); err != nil {
+		return event, fmt.Errorf("payments_created_at: %w", err)
+	}
+	if event.PaymentChargeDate, err = store.NormalizeDate(row.Get(record, "payments_charge_date")); err != nil {
+		return event, fmt.Errorf("payments_charge_date: %w", err)
+	}
+	return event, nil
+}
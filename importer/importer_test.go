@@ -0,0 +1,246 @@
+package importer
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/tobkle/fp/store"
+)
+
+// testImporter returns an Importer on a new database with all migrations applied
+func testImporter(t *testing.T) *Importer {
+	t.Helper()
+	s, err := store.Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	if _, err = s.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	im := New(s, nil)
+	im.Log = io.Discard
+	return im
+}
+
+// writeCSV writes content to a file in a temporary directory and returns its path
+func writeCSV(t *testing.T, name string, content string) string {
+	t.Helper()
+	fileName := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(fileName, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return fileName
+}
+
+func TestNormalizeHeader(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"payments_links_mandate", "payments_links_mandate"},
+		{"Payments.Links.Mandate", "payments_links_mandate"},
+		{"\ufeffid", "id"},
+		{"E-Mail  Address", "e_mail_address"},
+		{"(stage)", "stage"},
+	}
+	for _, tt := range tests {
+		if got := normalizeHeader(tt.name); got != tt.want {
+			t.Errorf("normalizeHeader(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestResolve(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  []string
+		want    ColumnIndex
+		wantErr bool
+	}{
+		{"header names", []string{"Mandate Reference", "Customer Name", "Customer Account Number"},
+			ColumnIndex{"elevate_mandate_reference": 0, "elevate_customer_name": 1, "elevate_account_number": 2}, false},
+		{"field names", []string{"elevate_account_number", "elevate_customer_name", "elevate_mandate_reference"},
+			ColumnIndex{"elevate_account_number": 0, "elevate_customer_name": 1, "elevate_mandate_reference": 2}, false},
+		{"first of duplicates", []string{"account_number", "customer_name", "mandate_reference", "account_number"},
+			ColumnIndex{"elevate_account_number": 0, "elevate_customer_name": 1, "elevate_mandate_reference": 2}, false},
+		{"missing required", []string{"customer_account_number", "customer_name"}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := DefaultColumnMappings[SourceAccounts].Resolve(SourceAccounts, tt.header)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Resolve() error = %v, want error %v", err, tt.wantErr)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("Resolve() = %v, want %v", got, tt.want)
+			}
+			for field, i := range tt.want {
+				if got[field] != i {
+					t.Errorf("Resolve()[%s] = %d, want %d", field, got[field], i)
+				}
+			}
+		})
+	}
+}
+
+func TestImportAccountsSnapshots(t *testing.T) {
+	im := testImporter(t)
+	header := "customer_account_number,customer_name,mandate_reference\n"
+	tests := []struct {
+		date    string
+		content string
+		want    Result
+	}{
+		{"2024-03-01", "ACC1,Alice,MR1\nACC2,Bob,MR2\n", Result{Inserted: 2}},
+		{"2024-03-02", "ACC1,Alice Smith,MR1\n", Result{Updated: 1, Disappeared: 1}},
+		{"2024-03-03", "ACC1,Alice Smith,MR1\nACC2,Bob,MR2\n", Result{Updated: 1, Skipped: 1}},
+		{"2024-03-04", "ACC1,Alice Smith,MR1\nACC2,Bob,MR2\nACC3,Carol,MR3\n", Result{Inserted: 1, Skipped: 2}},
+	}
+	for _, tt := range tests {
+		im.SnapshotDate = tt.date
+		got, err := im.ImportAccounts(writeCSV(t, "accounts.csv", header+tt.content))
+		if err != nil {
+			t.Fatalf("%s: ImportAccounts() error = %v", tt.date, err)
+		}
+		got.ImportID = 0
+		if got != tt.want {
+			t.Errorf("%s: ImportAccounts() = %+v, want %+v", tt.date, got, tt.want)
+		}
+	}
+
+	versions, err := im.Store.AccountHistory("MR2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var changes []string
+	for _, v := range versions {
+		changes = append(changes, v.Change+" "+v.ValidFrom+" "+v.ValidTo)
+	}
+	want := []string{"new 2024-03-01 2024-03-02", "reappeared 2024-03-03 "}
+	if len(changes) != len(want) || changes[0] != want[0] || changes[1] != want[1] {
+		t.Errorf("AccountHistory(MR2) = %q, want %q", changes, want)
+	}
+}
+
+func TestImportDuplicateFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		reimport bool
+		want     Result
+	}{
+		{"skipped", false, Result{}},
+		{"reimported", true, Result{Skipped: 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			im := testImporter(t)
+			fileName := writeCSV(t, "accounts.csv", "customer_account_number,customer_name,mandate_reference\nACC1,Alice,MR1\nACC2,Bob,MR2\n")
+			first, err := im.ImportAccounts(fileName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			im.Reimport = tt.reimport
+			got, err := im.ImportAccounts(fileName)
+			if err != nil {
+				t.Fatalf("ImportAccounts() error = %v", err)
+			}
+			if !tt.reimport && got.DuplicateOf != first.ImportID {
+				t.Errorf("ImportAccounts() DuplicateOf = %d, want %d", got.DuplicateOf, first.ImportID)
+			}
+			got.ImportID, got.DuplicateOf = 0, 0
+			if got != tt.want {
+				t.Errorf("ImportAccounts() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestImportCRMMissingOptionalColumn(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"column missing", "account_number,id,name,email,premise_address,stage_name\nACC1,C1,Alice,alice@example.com,1 High St,Live\n", "Z1"},
+		{"column empty", "account_number,id,name,email,premise_address,stage_name,zen_user_id\nACC1,C1,Alice,alice@example.com,1 High St,Live,\n", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			im := testImporter(t)
+			im.SnapshotDate = "2024-03-01"
+			_, err := im.ImportCRM(writeCSV(t, "crm.csv",
+				"account_number,id,name,email,premise_address,stage_name,zen_user_id\nACC1,C1,Alice,alice@example.com,1 High St,Live,Z1\n"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			im.SnapshotDate = "2024-03-02"
+			if _, err = im.ImportCRM(writeCSV(t, "crm.csv", tt.content)); err != nil {
+				t.Fatalf("ImportCRM() error = %v", err)
+			}
+			versions, err := im.Store.AccountHistory("ACC1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := versions[len(versions)-1].Values["crm_zen_user_id"]; got != tt.want {
+				t.Errorf("crm_zen_user_id = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestImportPaymentsRejected(t *testing.T) {
+	content := "id,created_at,resource_type,action,payments.id,payments.charge_date,payments.amount,payments.currency,customers.id,payments.links.mandate\n" +
+		"EV1,2024-03-01T10:00:00Z,payments,failed,PM1,2024-03-01,12.50,GBP,CU1,MD1\n" +
+		"EV2,2024-03-02T10:00:00Z,payments,failed,PM1,2024-03-02,twelve,GBP,CU1,MD1\n" +
+		",2024-03-03T10:00:00Z,payments,failed,PM1,2024-03-03,12.50,GBP,CU1,MD1\n"
+	tests := []struct {
+		name        string
+		maxRejected int
+		want        Result
+		wantErr     error
+		wantEvents  int
+	}{
+		{"any allowed", -1, Result{Inserted: 1, Failed: 2}, nil, 1},
+		{"within limit", 2, Result{Inserted: 1, Failed: 2}, nil, 1},
+		{"rolled back", 1, Result{}, ErrTooManyRejected, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			im := testImporter(t)
+			im.MaxRejected = tt.maxRejected
+			got, err := im.ImportPayments(writeCSV(t, "payments.csv", content))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ImportPayments() error = %v, want %v", err, tt.wantErr)
+			}
+			got.ImportID = 0
+			if got != tt.want {
+				t.Errorf("ImportPayments() = %+v, want %+v", got, tt.want)
+			}
+			if len(im.Rejected) != 2 {
+				t.Errorf("Rejected = %+v, want 2 records", im.Rejected)
+			}
+			events, err := im.Store.PaymentEvents("PM1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(events) != tt.wantEvents {
+				t.Errorf("PaymentEvents() = %d events, want %d", len(events), tt.wantEvents)
+			}
+			imports, err := im.Store.Imports("")
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantStatus := store.ImportCommitted
+			if tt.wantErr != nil {
+				wantStatus = store.ImportRolledBack
+			}
+			if len(imports) != 1 || imports[0].Status != wantStatus {
+				t.Errorf("Imports() = %+v, want one %s import", imports, wantStatus)
+			}
+		})
+	}
+}
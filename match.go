@@ -0,0 +1,129 @@
+/********************************************************************************************************************
+ * name: match
+ * description: fp match, find, review and confirm the accounts of the mandates without Elevate account
+ ********************************************************************************************************************/
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/tobkle/fp/matcher"
+	"github.com/tobkle/fp/store"
+)
+
+// cmdMatch implements `fp match [run]|list|confirm <id>|reject <id>`
+func cmdMatch(args []string) {
+	var o matchOptions
+	s := loadSettings(args)
+	flags := newMatchFlags(&o, s)
+	s.apply(flags)
+	command, id := "run", ""
+	if positional := parseArgs(flags, args); len(positional) > 0 {
+		command = positional[0]
+		if len(positional) > 1 {
+			id = positional[1]
+		}
+	}
+
+	db, err := store.Open(o.dbName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+	if _, err = db.Migrate(); err != nil {
+		log.Fatalf("Database migration failed: %s", err)
+	}
+
+	m := matcher.New(db)
+	m.MinConfidence = o.minConfidence
+	switch command {
+	case "run":
+		if err = runMatching(m); err == nil {
+			err = listMatches(db, store.MatchCandidate)
+		}
+	case "list":
+		err = listMatches(db, o.status)
+	case "confirm", "reject":
+		err = reviewMatch(db, command, id, o.operator)
+	default:
+		err = fmt.Errorf("unknown fp match command %q, use run, list, confirm or reject", command)
+	}
+	if err != nil {
+		log.Fatalf("fp match %s failed: %s", command, err)
+	}
+}
+
+// matchOptions are the parameters of fp match
+type matchOptions struct {
+	dbName        string
+	minConfidence float64
+	status        string
+	operator      string
+}
+
+// newMatchFlags returns the parameters of fp match with the defaults in the data directory
+func newMatchFlags(o *matchOptions, s *settings) *flag.FlagSet {
+	flags := flag.NewFlagSet("match", flag.ExitOnError)
+	flags.StringVar(&o.dbName, "db", defaultDatabase(s.dir), "Sqlite database with the mandates to match")
+	flags.Float64Var(&o.minConfidence, "min-confidence", matcher.New(nil).MinConfidence, "confidence from 0 to 1 a match needs to be queued")
+	flags.StringVar(&o.status, "status", "", "fp match list: only the matches with status candidate, confirmed or rejected")
+	flags.StringVar(&o.operator, "operator", defaultOperator(), "name recorded with the confirmed and rejected matches")
+	s.register(flags)
+	return flags
+}
+
+// runMatching queues the accounts matching the mandates without Elevate account for review
+func runMatching(m *matcher.Matcher) error {
+	result, err := m.Run()
+	if err != nil {
+		return err
+	}
+	for _, match := range result.Added {
+		log.Printf("mandate %s may belong to account %s (mandate %s) by %s, confidence %.2f --> fp match confirm %d",
+			match.Mandate, match.AccountNumber, match.MandateReference, match.Methods, match.Confidence, match.ID)
+	}
+	fmt.Printf("SUCCESS: Queued %d matches for %d mandates without Elevate account\n", len(result.Added), result.Mandates)
+	return nil
+}
+
+// listMatches prints the review queue, only the matches with status if not empty
+func listMatches(db store.Store, status string) error {
+	matches, err := db.MandateMatches(status)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%5s %-10s %-20s %-20s %-14s %10s %-24s %s\n", "ID", "STATUS", "MANDATE", "ACCOUNT MANDATE", "ACCOUNT", "CONFIDENCE", "METHODS", "REVIEWED")
+	for _, m := range matches {
+		fmt.Printf("%5d %-10s %-20s %-20s %-14s %10.2f %-24s %s %s\n", m.ID, m.Status, m.Mandate, m.MandateReference,
+			m.AccountNumber, m.Confidence, m.Methods, m.ReviewedAt, m.Operator)
+	}
+	fmt.Println(len(matches), "matches")
+	return nil
+}
+
+// reviewMatch confirms or rejects the match with id
+func reviewMatch(db store.Store, command string, id string, operator string) error {
+	matchID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return fmt.Errorf("fp match %s needs the ID of a match, see fp match list", command)
+	}
+	status := store.MatchConfirmed
+	if command == "reject" {
+		status = store.MatchRejected
+	}
+	m, err := db.ReviewMatch(matchID, status, operator, time.Now().UTC().Format(store.ISOTimestamp))
+	if err != nil {
+		return err
+	}
+	if status == store.MatchConfirmed {
+		fmt.Printf("SUCCESS: Payments of mandate %s are exported with account %s (mandate %s) from now on, `fp export` rewrites past files\n",
+			m.Mandate, m.AccountNumber, m.MandateReference)
+		return nil
+	}
+	fmt.Printf("SUCCESS: Rejected account %s for mandate %s, it isn't suggested again\n", m.AccountNumber, m.Mandate)
+	return nil
+}
@@ -0,0 +1,213 @@
+/********************************************************************************************************************
+ * name: matcher
+ * description: match the mandates without Elevate account to accounts by lead id, identity, email and name
+ ********************************************************************************************************************/
+package matcher
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/tobkle/fp/store"
+)
+
+// methods, the attributes of the payments which matched an account
+const (
+	MethodLeadID   = "lead_id"
+	MethodIdentity = "identity"
+	MethodEmail    = "email"
+	MethodName     = "name"
+)
+
+// weights are the confidence of a single matching attribute, the confidence of a match combines them
+var weights = map[string]float64{
+	MethodLeadID:   0.9,
+	MethodIdentity: 0.9,
+	MethodEmail:    0.85,
+	MethodName:     0.7,
+}
+
+// minNameSimilarity is the similarity from 0 to 1 two normalized names need to match
+const minNameSimilarity = 0.8
+
+// Matcher finds Elevate accounts for the payments whose mandate has none and queues them for review
+type Matcher struct {
+	Store store.Store
+	// MinConfidence of a match to be queued, from 0 to 1
+	MinConfidence float64
+	// MaxCandidates is the number of matches queued per mandate, the ones with the highest confidence
+	MaxCandidates int
+}
+
+// Result counts the mandates without account and the matches queued for them
+type Result struct {
+	Mandates int
+	// Added are the matches queued by this run, matches queued before are not repeated
+	Added []store.MandateMatch
+}
+
+// New returns a Matcher queueing up to 3 matches of at least 0.5 confidence per mandate
+func New(s store.Store) *Matcher {
+	return &Matcher{Store: s, MinConfidence: 0.5, MaxCandidates: 3}
+}
+
+// Run matches every mandate without Elevate account and confirmed match with the accounts and queues the
+// matches which aren't known yet, also not as rejected
+func (m *Matcher) Run() (Result, error) {
+	var result Result
+	mandates, err := m.Store.UnmatchedMandates()
+	if err != nil {
+		return result, err
+	}
+	result.Mandates = len(mandates)
+	if len(mandates) == 0 {
+		return result, nil
+	}
+	accounts, err := m.Store.MatchAccounts()
+	if err != nil {
+		return result, err
+	}
+	var matches []store.MandateMatch
+	for _, mandate := range mandates {
+		matches = append(matches, m.Candidates(mandate, accounts)...)
+	}
+	result.Added, err = m.Store.AddMatchCandidates(matches)
+	return result, err
+}
+
+// Candidates returns the accounts matching the payments of a mandate with at least MinConfidence,
+// the MaxCandidates with the highest confidence first. A match by name needs one of the other methods as well.
+func (m *Matcher) Candidates(mandate store.UnmatchedMandate, accounts []store.MatchAccount) []store.MandateMatch {
+	now := time.Now().UTC().Format(store.ISOTimestamp)
+	name := normalizeName(mandate.GivenName + " " + mandate.FamilyName)
+	var matches []store.MandateMatch
+	for _, a := range accounts {
+		var methods []string
+		if matchesKey(mandate.LeadID, a) {
+			methods = append(methods, MethodLeadID)
+		}
+		if matchesKey(mandate.Identity, a) {
+			methods = append(methods, MethodIdentity)
+		}
+		if matchesEmail(mandate.Email, a) || matchesEmail(mandate.LeadID, a) || matchesEmail(mandate.Identity, a) {
+			methods = append(methods, MethodEmail)
+		}
+		if name != "" && (similarity(name, normalizeName(a.Account.CustomerName)) >= minNameSimilarity ||
+			similarity(name, normalizeName(a.CRM.Name)) >= minNameSimilarity) {
+			methods = append(methods, MethodName)
+		}
+		// a similar name alone is no match, many customers share a name
+		if len(methods) == 0 || (len(methods) == 1 && methods[0] == MethodName) {
+			continue
+		}
+		confidence := Confidence(methods)
+		if confidence < m.MinConfidence {
+			continue
+		}
+		matches = append(matches, store.MandateMatch{Mandate: mandate.Mandate, MandateReference: a.Account.MandateReference,
+			AccountNumber: a.Account.AccountNumber, Methods: strings.Join(methods, ","), Confidence: confidence, CreatedAt: now})
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].Confidence > matches[j].Confidence
+	})
+	if m.MaxCandidates > 0 && len(matches) > m.MaxCandidates {
+		matches = matches[:m.MaxCandidates]
+	}
+	return matches
+}
+
+// Confidence combines the weights of the matching methods, two independent hints are more certain than one,
+// rounded to two decimals
+func Confidence(methods []string) float64 {
+	unlikely := 1.0
+	for _, method := range methods {
+		unlikely *= 1 - weights[method]
+	}
+	return math.Round((1-unlikely)*100) / 100
+}
+
+// matchesKey tells if value is the account number or CRM id of an account
+func matchesKey(value string, a store.MatchAccount) bool {
+	value = strings.ToLower(strings.TrimSpace(value))
+	if value == "" {
+		return false
+	}
+	for _, key := range []string{a.Account.AccountNumber, a.CRM.AccountNumber, a.CRM.ID} {
+		if value == strings.ToLower(strings.TrimSpace(key)) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesEmail tells if value is an email address and the one of the CRM account
+func matchesEmail(value string, a store.MatchAccount) bool {
+	value = strings.ToLower(strings.TrimSpace(value))
+	return strings.Contains(value, "@") && value == strings.ToLower(strings.TrimSpace(a.CRM.Email))
+}
+
+// normalizeName makes names comparable: lower case letters and digits, the words in alphabetical order,
+// e.g. "O'Neil, Carl" becomes "carl oneil"
+func normalizeName(name string) string {
+	words := strings.FieldsFunc(strings.ToLower(name), func(r rune) bool {
+		return unicode.IsSpace(r) || r == ',' || r == '-' || r == '.'
+	})
+	for i, word := range words {
+		words[i] = strings.Map(func(r rune) rune {
+			if unicode.IsLetter(r) || unicode.IsDigit(r) {
+				return r
+			}
+			return -1
+		}, word)
+	}
+	sort.Strings(words)
+	return strings.TrimSpace(strings.Join(words, " "))
+}
+
+// similarity of two strings from 0 to 1, 1 minus their edit distance relative to the longer one
+func similarity(a string, b string) float64 {
+	if a == "" || b == "" {
+		return 0
+	}
+	ra, rb := []rune(a), []rune(b)
+	longer := len(ra)
+	if len(rb) > longer {
+		longer = len(rb)
+	}
+	return 1 - float64(distance(ra, rb))/float64(longer)
+}
+
+// distance is the Levenshtein distance of two strings
+func distance(a []rune, b []rune) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = minimum(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(b)]
+}
+
+// minimum returns the smallest of the values
+func minimum(values ...int) int {
+	m := values[0]
+	for _, v := range values[1:] {
+		if v < m {
+			m = v
+		}
+	}
+	return m
+}
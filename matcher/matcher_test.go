@@ -0,0 +1,151 @@
+package matcher
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/tobkle/fp/store"
+)
+
+// accounts are the candidates of the tests, two customers of the same name
+var accounts = []store.MatchAccount{
+	{Account: store.ElevateAccount{MandateReference: "MR1", AccountNumber: "A001", CustomerName: "Alice Smith"},
+		CRM: store.CRMAccount{AccountNumber: "A001", ID: "CRMA001", Name: "Alice Smith", Email: "alice@example.com"}},
+	{Account: store.ElevateAccount{MandateReference: "MR2", AccountNumber: "A002", CustomerName: "Smith, Alice"},
+		CRM: store.CRMAccount{AccountNumber: "A002", ID: "CRMA002", Name: "Alice Smith", Email: "a.smith@example.com"}},
+	{Account: store.ElevateAccount{MandateReference: "MR3", AccountNumber: "A003", CustomerName: "Carl O'Neil"},
+		CRM: store.CRMAccount{AccountNumber: "A003", ID: "CRMA003", Name: "Carl O'Neil"}},
+}
+
+func TestConfidence(t *testing.T) {
+	tests := []struct {
+		methods []string
+		want    float64
+	}{
+		{nil, 0},
+		{[]string{MethodName}, 0.7},
+		{[]string{MethodEmail}, 0.85},
+		{[]string{MethodLeadID, MethodName}, 0.97},
+		{[]string{MethodEmail, MethodName}, 0.96},
+		{[]string{MethodLeadID, MethodIdentity, MethodEmail, MethodName}, 1},
+	}
+	for _, tt := range tests {
+		if got := Confidence(tt.methods); got != tt.want {
+			t.Errorf("Confidence(%v) = %v, want %v", tt.methods, got, tt.want)
+		}
+	}
+}
+
+func TestCandidates(t *testing.T) {
+	tests := []struct {
+		name    string
+		mandate store.UnmatchedMandate
+		want    []string
+	}{
+		{"lead id is the CRM id", store.UnmatchedMandate{LeadID: "crma003"},
+			[]string{"MR3 lead_id 0.9"}},
+		{"identity is the account number", store.UnmatchedMandate{Identity: " A002 "},
+			[]string{"MR2 identity 0.9"}},
+		{"customer email", store.UnmatchedMandate{Email: "Alice@Example.com"},
+			[]string{"MR1 email 0.85"}},
+		{"email in the lead id", store.UnmatchedMandate{LeadID: "a.smith@example.com"},
+			[]string{"MR2 email 0.85"}},
+		{"lead id and name", store.UnmatchedMandate{LeadID: "A003", GivenName: "Carl", FamilyName: "ONeil"},
+			[]string{"MR3 lead_id,name 0.97"}},
+		{"email and name first", store.UnmatchedMandate{Email: "alice@example.com", GivenName: "Alice", FamilyName: "Smith"},
+			[]string{"MR1 email,name 0.96"}},
+		{"name only", store.UnmatchedMandate{GivenName: "Alice", FamilyName: "Smith"}, nil},
+		{"nothing matches", store.UnmatchedMandate{LeadID: "X", Email: "nobody@example.com", GivenName: "Bob"}, nil},
+		{"empty attributes", store.UnmatchedMandate{}, nil},
+	}
+	m := New(nil)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.mandate.Mandate = "MD1"
+			var got []string
+			for _, match := range m.Candidates(tt.mandate, accounts) {
+				if match.Mandate != "MD1" {
+					t.Errorf("Mandate = %q, want MD1", match.Mandate)
+				}
+				got = append(got, match.MandateReference+" "+match.Methods+" "+formatConfidence(match.Confidence))
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("Candidates() = %q, want %q", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("Candidates()[%d] = %q, want %q", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestCandidatesLimits(t *testing.T) {
+	tests := []struct {
+		name          string
+		minConfidence float64
+		maxCandidates int
+		want          int
+	}{
+		{"defaults", 0.5, 3, 2},
+		{"one candidate", 0.5, 1, 1},
+		{"no limit", 0.5, 0, 2},
+		{"above confidence", 0.99, 3, 0},
+	}
+	// the lead id matches MR1, the email MR2 and the name both
+	mandate := store.UnmatchedMandate{Mandate: "MD1", LeadID: "A001", Email: "a.smith@example.com", GivenName: "Alice", FamilyName: "Smith"}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &Matcher{MinConfidence: tt.minConfidence, MaxCandidates: tt.maxCandidates}
+			got := m.Candidates(mandate, accounts)
+			if len(got) != tt.want {
+				t.Fatalf("Candidates() = %+v, want %d matches", got, tt.want)
+			}
+			if len(got) > 0 && got[0].MandateReference != "MR1" {
+				t.Errorf("Candidates()[0] = %s, want MR1 of the highest confidence", got[0].MandateReference)
+			}
+		})
+	}
+}
+
+func TestNormalizeName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"O'Neil, Carl", "carl oneil"},
+		{"Carl  O'Neil", "carl oneil"},
+		{"Smith-Jones, Anna-Lena", "anna jones lena smith"},
+		{"J.R. Ewing", "ewing j r"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := normalizeName(tt.name); got != tt.want {
+			t.Errorf("normalizeName(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSimilarity(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want float64
+	}{
+		{"alice smith", "alice smith", 1},
+		{"alice smith", "alice smyth", 1 - 1.0/11},
+		{"abc", "xyz", 0},
+		{"", "alice", 0},
+		{"jose", "josé", 0.75},
+	}
+	for _, tt := range tests {
+		if got := similarity(tt.a, tt.b); got != tt.want {
+			t.Errorf("similarity(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+// formatConfidence prints a confidence with up to two decimals
+func formatConfidence(confidence float64) string {
+	return strconv.FormatFloat(confidence, 'f', -1, 64)
+}
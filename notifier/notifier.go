@@ -0,0 +1,306 @@
+/********************************************************************************************************************
+ * name: notifier
+ * description: render a notification per customer of a bucket from text and html templates
+ ********************************************************************************************************************/
+package notifier
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	htmltemplate "html/template"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	texttemplate "text/template"
+
+	"github.com/tobkle/fp/store"
+)
+
+//go:embed templates/*
+var defaultTemplates embed.FS
+
+// formats of the notification output
+const (
+	FormatEML   = "eml"
+	FormatMerge = "merge"
+)
+
+// Notification is the data the templates of a bucket are executed with, one per customer
+type Notification struct {
+	Bucket        string
+	Rule          string
+	Date          string
+	CustomerKey   string
+	AccountNumber string
+	Name          string
+	GivenName     string
+	FamilyName    string
+	Email         string
+	Address       string
+	Payments      []Payment
+	// FailureCount is the number of failed payment requests of all Payments
+	FailureCount int
+	// Outstanding is the sum of the amounts of Payments in Currency
+	Outstanding string
+	Currency    string
+}
+
+// Payment is a failed payment listed in a notification
+type Payment struct {
+	ID           string
+	Description  string
+	ChargeDate   string
+	Amount       string
+	Currency     string
+	FailureCount int
+	Cause        string
+	Reason       string
+	ReasonCode   string
+}
+
+// Message is a rendered notification
+type Message struct {
+	Notification
+	// Template names the template files, "built-in" or the path of the text template
+	Template  string
+	MessageID string
+	Subject   string
+	Text      string
+	HTML      string
+}
+
+// bucketTemplates are the templates of one bucket, HTML is optional
+type bucketTemplates struct {
+	source string
+	text   *texttemplate.Template
+	html   *htmltemplate.Template
+}
+
+// Notifier renders and writes the notifications
+type Notifier struct {
+	// Format of the files written by Write, FormatEML by default
+	Format string
+	// From is the sender address of the messages
+	From      string
+	templates map[string]bucketTemplates
+}
+
+// New loads the built-in templates and replaces them with the files <bucket>.txt and <bucket>.html of dir.
+// The text template defines the subject with {{define "subject"}}...{{end}}.
+func New(dir string) (*Notifier, error) {
+	n := &Notifier{Format: FormatEML, templates: map[string]bucketTemplates{}}
+	builtin, err := fs.Sub(defaultTemplates, "templates")
+	if err != nil {
+		return nil, err
+	}
+	if err = n.load(builtin, ""); err != nil {
+		return nil, err
+	}
+	if dir != "" {
+		if _, err = os.Stat(dir); err != nil {
+			return nil, err
+		}
+		if err = n.load(os.DirFS(dir), dir); err != nil {
+			return nil, err
+		}
+	}
+	return n, nil
+}
+
+// load parses the *.txt and *.html files of fsys in dir, "" for the built-in ones.
+// A bucket's html template is dropped if only its text is replaced.
+func (n *Notifier) load(fsys fs.FS, dir string) error {
+	texts, err := fs.Glob(fsys, "*.txt")
+	if err != nil {
+		return err
+	}
+	for _, name := range texts {
+		bucket := strings.TrimSuffix(name, ".txt")
+		content, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return err
+		}
+		t, err := texttemplate.New(name).Parse(string(content))
+		if err != nil {
+			return err
+		}
+		if t.Lookup("subject") == nil {
+			return fmt.Errorf("template %s: no subject, add {{define \"subject\"}}...{{end}}", name)
+		}
+		source := "built-in"
+		if dir != "" {
+			source = filepath.Join(dir, name)
+		}
+		n.templates[bucket] = bucketTemplates{source: source, text: t}
+	}
+
+	htmls, err := fs.Glob(fsys, "*.html")
+	if err != nil {
+		return err
+	}
+	for _, name := range htmls {
+		bucket := strings.TrimSuffix(name, ".html")
+		bt, ok := n.templates[bucket]
+		if !ok {
+			return fmt.Errorf("template %s: missing %s.txt for the subject and text part", name, bucket)
+		}
+		content, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return err
+		}
+		if bt.html, err = htmltemplate.New(name).Parse(string(content)); err != nil {
+			return err
+		}
+		n.templates[bucket] = bt
+	}
+	return nil
+}
+
+// ParseFormat checks a notification format parameter
+func ParseFormat(value string) (string, error) {
+	switch value {
+	case "", FormatEML:
+		return FormatEML, nil
+	case FormatMerge:
+		return value, nil
+	}
+	return "", fmt.Errorf("invalid notification format %q, use eml or merge", value)
+}
+
+// HasTemplate reports if notifications can be rendered for bucket
+func (n *Notifier) HasTemplate(bucket string) bool {
+	_, ok := n.templates[bucket]
+	return ok
+}
+
+// Render executes the templates of the notification's bucket
+func (n *Notifier) Render(note Notification) (Message, error) {
+	bt, ok := n.templates[note.Bucket]
+	if !ok {
+		return Message{}, fmt.Errorf("no template for bucket %s", note.Bucket)
+	}
+	msg := Message{Notification: note, Template: bt.source}
+	var buf bytes.Buffer
+	if err := bt.text.ExecuteTemplate(&buf, "subject", note); err != nil {
+		return msg, err
+	}
+	msg.Subject = strings.TrimSpace(buf.String())
+	buf.Reset()
+	if err := bt.text.Execute(&buf, note); err != nil {
+		return msg, err
+	}
+	msg.Text = buf.String()
+	if bt.html != nil {
+		buf.Reset()
+		if err := bt.html.Execute(&buf, note); err != nil {
+			return msg, err
+		}
+		msg.HTML = buf.String()
+	}
+	return msg, nil
+}
+
+// FromPayments builds a notification per customer from the exported payments of a bucket.
+// The payments are grouped by Elevate account number, or by customers_id without account.
+func FromPayments(bucket string, date string, rows []store.ExportRow) []Notification {
+	byKey := map[string]*Notification{}
+	var keys []string
+	for _, row := range rows {
+		e := row.Event
+		key := row.Account.AccountNumber
+		if key == "" {
+			key = e.CustomerID
+		}
+		note, ok := byKey[key]
+		if !ok {
+			note = &Notification{Bucket: bucket, Date: date, CustomerKey: key, AccountNumber: row.Account.AccountNumber,
+				GivenName: e.CustomerGivenName, FamilyName: e.CustomerFamilyName, Email: row.CRM.Email,
+				Address: row.CRM.PremiseAddress, Currency: e.Currency}
+			note.Name = name(row.CRM.Name, row.Account.CustomerName, e.CustomerGivenName, e.CustomerFamilyName)
+			byKey[key] = note
+			keys = append(keys, key)
+		}
+		note.Payments = append(note.Payments, payment(e, row.Count))
+		note.FailureCount += row.Count
+	}
+
+	sort.Strings(keys)
+	notes := make([]Notification, 0, len(keys))
+	for _, key := range keys {
+		note := byKey[key]
+		var outstanding int64
+		for _, row := range rows {
+			if (row.Account.AccountNumber == key || row.Account.AccountNumber == "" && row.Event.CustomerID == key) &&
+				row.Event.Currency == note.Currency {
+				outstanding += row.Event.AmountMinor
+			}
+		}
+		note.Outstanding = store.FormatAmount(outstanding, note.Currency)
+		notes = append(notes, *note)
+	}
+	return notes
+}
+
+// FromCustomers builds the notifications of the exported customers of a bucket, payments are the summaries
+// of their failing payments by payments_id
+func FromCustomers(bucket string, date string, rows []store.CustomerExportRow, payments map[string]store.PaymentSummary) []Notification {
+	notes := make([]Notification, 0, len(rows))
+	for _, row := range rows {
+		a := row.Action
+		note := Notification{Bucket: bucket, Rule: a.Rule, Date: date, CustomerKey: a.CustomerKey,
+			AccountNumber: a.AccountNumber, GivenName: a.CustomerGivenName, FamilyName: a.CustomerFamilyName,
+			Email: row.CRM.Email, Address: row.CRM.PremiseAddress, FailureCount: a.Count,
+			Outstanding: store.FormatAmount(a.OutstandingMinor, a.Currency), Currency: a.Currency}
+		note.Name = name(row.CRM.Name, row.Account.CustomerName, a.CustomerGivenName, a.CustomerFamilyName)
+		for _, id := range a.PaymentIDs {
+			if p, ok := payments[id]; ok {
+				note.Payments = append(note.Payments, payment(p.Event, p.FailureCount))
+			}
+		}
+		notes = append(notes, note)
+	}
+	return notes
+}
+
+// payment lists a failed payment event, the reason is the description of the provider or else its cause
+func payment(e store.FailedPaymentEvent, failures int) Payment {
+	p := Payment{ID: e.PaymentID, Description: e.PaymentDescription, ChargeDate: e.PaymentChargeDate,
+		Amount: store.FormatAmount(e.AmountMinor, e.Currency), Currency: e.Currency, FailureCount: failures,
+		Cause: e.DetailsCause, Reason: e.DetailsDescription, ReasonCode: e.DetailsReasonCode}
+	if p.Reason == "" {
+		p.Reason = strings.ReplaceAll(e.DetailsCause, "_", " ")
+	}
+	return p
+}
+
+// name returns the CRM name, the Elevate name or the name at the payment provider, whichever is known first
+func name(crmName string, elevateName string, givenName string, familyName string) string {
+	switch {
+	case crmName != "":
+		return crmName
+	case elevateName != "":
+		return elevateName
+	}
+	return strings.TrimSpace(givenName + " " + familyName)
+}
+
+// fileSafe replaces characters not allowed in file names
+func fileSafe(value string) string {
+	return strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`/\:*?"<>| `, r) {
+			return '_'
+		}
+		return r
+	}, value)
+}
+
+// outputName is the file the notifications of a bucket are written to in dir, or the directory of its eml files
+func outputName(dir string, format string, bucket string, date string) string {
+	if format == FormatMerge {
+		return filepath.Join(dir, "notifications-"+bucket+"-"+date+".csv")
+	}
+	return filepath.Join(dir, "notifications-"+bucket+"-"+date)
+}
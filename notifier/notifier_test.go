@@ -0,0 +1,200 @@
+package notifier
+
+import (
+	"encoding/csv"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/tobkle/fp/store"
+)
+
+// exportRow is a failed payment of the Elevate account, "" for a customer without account
+func exportRow(paymentID string, account string, customerID string, amount int64, count int) store.ExportRow {
+	return store.ExportRow{
+		Event: store.FailedPaymentEvent{PaymentID: paymentID, CustomerID: customerID, AmountMinor: amount,
+			Currency: "GBP", PaymentDescription: "Rent " + paymentID, DetailsCause: "insufficient_funds",
+			CustomerGivenName: "Anne", CustomerFamilyName: "O'Neil"},
+		Count:   count,
+		Account: store.ElevateAccount{AccountNumber: account},
+		CRM:     store.CRMAccount{Email: "anne@example.com"},
+	}
+}
+
+func TestFromPayments(t *testing.T) {
+	notes := FromPayments("warn", "2022-05-28", []store.ExportRow{
+		exportRow("PM1", "A1", "CU1", 1250, 3),
+		exportRow("PM2", "", "CU2", 500, 1),
+		exportRow("PM3", "A1", "CU3", 750, 2),
+	})
+	if len(notes) != 2 {
+		t.Fatalf("FromPayments() = %d notifications, want 2", len(notes))
+	}
+	tests := []struct {
+		key          string
+		payments     int
+		failureCount int
+		outstanding  string
+	}{
+		{"A1", 2, 5, "20.00"},
+		{"CU2", 1, 1, "5.00"},
+	}
+	for i, test := range tests {
+		note := notes[i]
+		if note.CustomerKey != test.key || len(note.Payments) != test.payments || note.FailureCount != test.failureCount ||
+			note.Outstanding != test.outstanding {
+			t.Errorf("notification %d = %s with %d payments, %d failures, %s outstanding, want %s with %d, %d, %s", i,
+				note.CustomerKey, len(note.Payments), note.FailureCount, note.Outstanding, test.key, test.payments,
+				test.failureCount, test.outstanding)
+		}
+		if note.Name != "Anne O'Neil" || note.Payments[0].Reason != "insufficient funds" {
+			t.Errorf("notification %d: name %q, reason %q", i, note.Name, note.Payments[0].Reason)
+		}
+	}
+}
+
+func TestName(t *testing.T) {
+	tests := []struct{ crm, elevate, given, family, want string }{
+		{"Anne O'Neil Ltd", "A O'Neil", "Anne", "O'Neil", "Anne O'Neil Ltd"},
+		{"", "A O'Neil", "Anne", "O'Neil", "A O'Neil"},
+		{"", "", "Anne", "O'Neil", "Anne O'Neil"},
+		{"", "", "", "O'Neil", "O'Neil"},
+	}
+	for _, test := range tests {
+		if got := name(test.crm, test.elevate, test.given, test.family); got != test.want {
+			t.Errorf("name(%q, %q, %q, %q) = %q, want %q", test.crm, test.elevate, test.given, test.family, got, test.want)
+		}
+	}
+}
+
+func TestRender(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "warn.txt"), []byte(`{{define "subject"}} Hello {{.Name}} {{end}}{{.Outstanding}} {{.Currency}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	custom, err := New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	builtin, err := New("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	note := FromPayments("warn", "2022-05-28", []store.ExportRow{exportRow("PM1", "A1", "CU1", 1250, 3)})[0]
+	note.Payments[0].Description = "<Rent & Co>"
+	tests := []struct {
+		name     string
+		notifier *Notifier
+		template string
+		subject  string
+		text     []string
+		html     []string
+	}{
+		{"built-in", builtin, "built-in", "Your payment <Rent & Co> could not be collected",
+			[]string{"Dear Anne O'Neil,", "- <Rent & Co>, charged on : 12.50 GBP", "3 failed payment requests"},
+			[]string{"<td>&lt;Rent &amp; Co&gt;</td>", "Dear Anne O&#39;Neil,"}},
+		{"custom text drops the built-in html", custom, filepath.Join(dir, "warn.txt"), "Hello Anne O'Neil",
+			[]string{"12.50 GBP"}, nil},
+	}
+	for _, test := range tests {
+		msg, err := test.notifier.Render(note)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if msg.Template != test.template || msg.Subject != test.subject {
+			t.Errorf("%s: template %q, subject %q, want %q, %q", test.name, msg.Template, msg.Subject, test.template, test.subject)
+		}
+		for _, want := range test.text {
+			if !strings.Contains(msg.Text, want) {
+				t.Errorf("%s: text %q doesn't contain %q", test.name, msg.Text, want)
+			}
+		}
+		if test.html == nil && msg.HTML != "" {
+			t.Errorf("%s: html %q, want none", test.name, msg.HTML)
+		}
+		for _, want := range test.html {
+			if !strings.Contains(msg.HTML, want) {
+				t.Errorf("%s: html %q doesn't contain %q", test.name, msg.HTML, want)
+			}
+		}
+	}
+	note.Bucket = "escalate"
+	if _, err = builtin.Render(note); err == nil {
+		t.Errorf("Render() of a bucket without template succeeded")
+	}
+}
+
+func TestNewRejectsTemplates(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+	}{
+		{"no subject", map[string]string{"warn.txt": "Dear {{.Name}}"}},
+		{"html without text", map[string]string{"escalate.html": "<p>{{.Name}}</p>"}},
+		{"syntax", map[string]string{"warn.txt": `{{define "subject"}}x{{end}}{{.Name`}},
+	}
+	for _, test := range tests {
+		dir := t.TempDir()
+		for name, content := range test.files {
+			if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := New(dir); err == nil {
+			t.Errorf("%s: New() succeeded", test.name)
+		}
+	}
+}
+
+func TestWrite(t *testing.T) {
+	noEmail := exportRow("PM2", "A2", "CU2", 500, 1)
+	noEmail.CRM.Email = ""
+	notes := FromPayments("warn", "2022-05-28", []store.ExportRow{
+		exportRow("PM1", "A1/B", "CU1", 1250, 3), noEmail,
+	})
+	for _, format := range []string{FormatEML, FormatMerge} {
+		n, err := New("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		n.Format, n.From = format, "Dunning <dunning@example.com>"
+		dir := t.TempDir()
+		result, err := n.Write(dir, "warn", "2022-05-28", notes)
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		if result.Written != 1 {
+			t.Errorf("%s: wrote %d notifications, want 1 without the customer without email", format, result.Written)
+		}
+		if format == FormatEML {
+			f, err := os.Open(filepath.Join(dir, "notifications-warn-2022-05-28", "A1_B.eml"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			msg, err := mail.ReadMessage(f)
+			f.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if msg.Header.Get("X-Unsent") != "1" || msg.Header.Get("To") != `"Anne O'Neil" <anne@example.com>` ||
+				!strings.HasPrefix(msg.Header.Get("Content-Type"), "multipart/alternative; boundary=") {
+				t.Errorf("eml header %v", msg.Header)
+			}
+			continue
+		}
+		f, err := os.Open(filepath.Join(dir, "notifications-warn-2022-05-28.csv"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		records, err := csv.NewReader(f).ReadAll()
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(records) != 2 || strings.Join(records[1][:8], "|") != "anne@example.com|Anne O'Neil|A1/B|A1/B|1|3|12.50|GBP" {
+			t.Errorf("merge file %v", records)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+/********************************************************************************************************************
+ * name: send
+ * description: record the notifications in the outbox of the database and send them via SMTP
+ ********************************************************************************************************************/
+package notifier
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"github.com/tobkle/fp/store"
+)
+
+// Sender delivers a MIME message
+type Sender interface {
+	Send(from string, to []string, message []byte) error
+}
+
+// SMTP sends through a mail server, with STARTTLS if the server offers it
+type SMTP struct {
+	// Addr is host:port of the server, e.g. localhost:1025 for a local test server
+	Addr     string
+	Username string
+	Password string
+}
+
+// Send delivers message, it authenticates if a Username is set
+func (s *SMTP) Send(from string, to []string, message []byte) error {
+	var auth smtp.Auth
+	if s.Username != "" {
+		host, _, err := net.SplitHostPort(s.Addr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", s.Username, s.Password, host)
+	}
+	return smtp.SendMail(s.Addr, auth, from, to, message)
+}
+
+// Dispatcher queues the notifications in the notifications table and sends them
+type Dispatcher struct {
+	Store    store.Store
+	Notifier *Notifier
+	// Sender delivers the messages, Send fails without
+	Sender Sender
+	// Throttle is the minimum time between two messages
+	Throttle time.Duration
+	lastSend time.Time
+}
+
+// Unsent leaves out the notifications whose payments were all notified in the bucket before
+func (d *Dispatcher) Unsent(bucket string, notes []Notification) ([]Notification, error) {
+	notified, err := d.Store.NotifiedPayments(bucket)
+	if err != nil {
+		return nil, err
+	}
+	var unsent []Notification
+	for _, note := range notes {
+		for _, p := range note.Payments {
+			if !notified[p.ID] {
+				unsent = append(unsent, note)
+				break
+			}
+		}
+	}
+	return unsent, nil
+}
+
+// Queue renders the notifications and stores them with status outbox, customers without email are skipped.
+// It returns the queued rows, one per payment of a message.
+func (d *Dispatcher) Queue(notes []Notification) ([]store.Notification, error) {
+	var queued []store.Notification
+	now := time.Now().UTC().Format(store.ISOTimestamp)
+	for _, note := range notes {
+		if note.Email == "" {
+			continue
+		}
+		msg, err := d.Notifier.Render(note)
+		if err != nil {
+			return nil, fmt.Errorf("customer %s: %w", note.CustomerKey, err)
+		}
+		if msg.MessageID, err = messageID(d.Notifier.From); err != nil {
+			return nil, err
+		}
+		content, err := d.Notifier.Mail(msg)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range note.Payments {
+			queued = append(queued, store.Notification{
+				MessageID: msg.MessageID, PaymentID: p.ID, CustomerKey: note.CustomerKey, Bucket: note.Bucket,
+				Template: msg.Template, Email: note.Email, Subject: msg.Subject, Message: string(content),
+				Status: store.NotificationOutbox, CreatedAt: now,
+			})
+		}
+	}
+	return queued, d.Store.AddNotifications(queued)
+}
+
+// Send delivers the messages of the rows, each message once, and stores whether it was sent or failed.
+// It returns the number of sent and failed messages.
+func (d *Dispatcher) Send(rows []store.Notification) (int, int, error) {
+	if d.Sender == nil {
+		return 0, 0, fmt.Errorf("no SMTP server to send to")
+	}
+	sent, failed := 0, 0
+	done := map[string]bool{}
+	for _, row := range rows {
+		if done[row.MessageID] {
+			continue
+		}
+		done[row.MessageID] = true
+
+		if wait := d.Throttle - time.Since(d.lastSend); !d.lastSend.IsZero() && wait > 0 {
+			time.Sleep(wait)
+		}
+		d.lastSend = time.Now()
+		status, errorText, sentAt := store.NotificationSent, "", time.Now().UTC().Format(store.ISOTimestamp)
+		if err := d.deliver(row); err != nil {
+			status, errorText, sentAt = store.NotificationFailed, err.Error(), ""
+			failed++
+		} else {
+			sent++
+		}
+		if err := d.Store.SetNotificationStatus(row.MessageID, status, sentAt, errorText); err != nil {
+			return sent, failed, err
+		}
+	}
+	return sent, failed, nil
+}
+
+// deliver sends the message of row from the address of its From header
+func (d *Dispatcher) deliver(row store.Notification) error {
+	msg, err := mail.ReadMessage(strings.NewReader(row.Message))
+	if err != nil {
+		return err
+	}
+	from, err := mail.ParseAddress(msg.Header.Get("From"))
+	if err != nil {
+		return fmt.Errorf("sender address: %w", err)
+	}
+	return d.Sender.Send(from.Address, []string{row.Email}, []byte(row.Message))
+}
+
+// messageID returns a new unique Message-ID in the domain of the from address
+func messageID(from string) (string, error) {
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	domain := "fp.localhost"
+	if address, err := mail.ParseAddress(from); err == nil {
+		if at := strings.LastIndex(address.Address, "@"); at >= 0 {
+			domain = address.Address[at+1:]
+		}
+	}
+	return "<" + hex.EncodeToString(random) + "@" + domain + ">", nil
+}
@@ -0,0 +1,168 @@
+package notifier
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tobkle/fp/store"
+)
+
+// fakeSender records the messages and fails for the addresses in fail
+type fakeSender struct {
+	fail  map[string]bool
+	to    []string
+	times []time.Time
+}
+
+func (f *fakeSender) Send(from string, to []string, message []byte) error {
+	f.to = append(f.to, strings.Join(to, ","))
+	f.times = append(f.times, time.Now())
+	if f.fail[to[0]] {
+		return fmt.Errorf("mailbox %s unavailable", to[0])
+	}
+	return nil
+}
+
+// testDispatcher returns a dispatcher on a new database
+func testDispatcher(t *testing.T, sender Sender) *Dispatcher {
+	t.Helper()
+	s, err := store.Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	if _, err = s.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	n, err := New("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.From = "Dunning <dunning@example.com>"
+	return &Dispatcher{Store: s, Notifier: n, Sender: sender}
+}
+
+// customerRow is a failed payment of a customer with its own email address
+func customerRow(paymentID string, account string, email string) store.ExportRow {
+	row := exportRow(paymentID, account, "CU-"+account, 1000, 2)
+	row.CRM.Email = email
+	return row
+}
+
+func TestUnsent(t *testing.T) {
+	d := testDispatcher(t, nil)
+	notes := FromPayments("warn", "2022-05-28", []store.ExportRow{
+		customerRow("PM1", "A1", "a1@example.com"), customerRow("PM2", "A2", "a2@example.com"),
+	})
+	queued, err := d.Queue(notes[:1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		bucket string
+		notes  []Notification
+		want   []string
+	}{
+		{"notified before", "warn", notes, []string{"A2"}},
+		{"other bucket", "suspend-small", notes, []string{"A1", "A2"}},
+		{"new payment of a notified customer", "warn", FromPayments("warn", "2022-05-29", []store.ExportRow{
+			customerRow("PM1", "A1", "a1@example.com"), customerRow("PM3", "A1", "a1@example.com"),
+		}), []string{"A1"}},
+	}
+	for _, test := range tests {
+		unsent, err := d.Unsent(test.bucket, test.notes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var keys []string
+		for _, note := range unsent {
+			keys = append(keys, note.CustomerKey)
+		}
+		if strings.Join(keys, ",") != strings.Join(test.want, ",") {
+			t.Errorf("%s: Unsent() = %v, want %v", test.name, keys, test.want)
+		}
+	}
+
+	if err = d.Store.SetNotificationStatus(queued[0].MessageID, store.NotificationDiscarded, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	if unsent, err := d.Unsent("warn", notes); err != nil || len(unsent) != 2 {
+		t.Errorf("Unsent() after discarding = %d notifications, %v, want 2", len(unsent), err)
+	}
+}
+
+func TestQueue(t *testing.T) {
+	d := testDispatcher(t, nil)
+	queued, err := d.Queue(FromPayments("warn", "2022-05-28", []store.ExportRow{
+		customerRow("PM1", "A1", "a1@example.com"), customerRow("PM2", "A1", "a1@example.com"),
+		customerRow("PM3", "A2", ""),
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(queued) != 2 || queued[0].MessageID != queued[1].MessageID || queued[0].PaymentID != "PM1" ||
+		queued[1].PaymentID != "PM2" {
+		t.Fatalf("Queue() = %+v, want one message of A1 for PM1 and PM2", queued)
+	}
+	if !strings.HasSuffix(queued[0].MessageID, "@example.com>") ||
+		!strings.Contains(queued[0].Message, "Message-ID: "+queued[0].MessageID) {
+		t.Errorf("message id %s, message %s", queued[0].MessageID, queued[0].Message)
+	}
+	outbox, err := d.Store.Notifications(store.NotificationOutbox)
+	if err != nil || len(outbox) != 2 {
+		t.Errorf("outbox = %d rows, %v, want 2", len(outbox), err)
+	}
+}
+
+func TestSend(t *testing.T) {
+	sender := &fakeSender{fail: map[string]bool{"a2@example.com": true}}
+	d := testDispatcher(t, sender)
+	d.Throttle = 20 * time.Millisecond
+	queued, err := d.Queue(FromPayments("warn", "2022-05-28", []store.ExportRow{
+		customerRow("PM1", "A1", "a1@example.com"), customerRow("PM2", "A1", "a1@example.com"),
+		customerRow("PM3", "A2", "a2@example.com"), customerRow("PM4", "A3", "a3@example.com"),
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent, failed, err := d.Send(queued)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent != 2 || failed != 1 || strings.Join(sender.to, " ") != "a1@example.com a2@example.com a3@example.com" {
+		t.Errorf("Send() = %d sent, %d failed to %v, want 2, 1, each message once", sent, failed, sender.to)
+	}
+	for i := 1; i < len(sender.times); i++ {
+		if gap := sender.times[i].Sub(sender.times[i-1]); gap < d.Throttle {
+			t.Errorf("message %d sent %v after the one before, want at least %v", i, gap, d.Throttle)
+		}
+	}
+
+	statuses := map[string]string{}
+	rows, err := d.Store.Notifications()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, row := range rows {
+		statuses[row.PaymentID] = row.Status
+		if row.Status == store.NotificationFailed && !strings.Contains(row.Error, "unavailable") {
+			t.Errorf("payment %s failed with error %q", row.PaymentID, row.Error)
+		}
+		if row.Status == store.NotificationSent && row.SentAt == "" {
+			t.Errorf("payment %s sent without time", row.PaymentID)
+		}
+	}
+	want := map[string]string{"PM1": store.NotificationSent, "PM2": store.NotificationSent,
+		"PM3": store.NotificationFailed, "PM4": store.NotificationSent}
+	if fmt.Sprint(statuses) != fmt.Sprint(want) {
+		t.Errorf("statuses = %v, want %v", statuses, want)
+	}
+
+	if _, _, err = (&Dispatcher{Store: d.Store, Notifier: d.Notifier}).Send(queued); err == nil {
+		t.Errorf("Send() without SMTP server succeeded")
+	}
+}
@@ -0,0 +1,179 @@
+/********************************************************************************************************************
+ * name: write
+ * description: write rendered notifications as .eml files or as mail-merge csv
+ ********************************************************************************************************************/
+package notifier
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// MergeHeader is the first line of the mail-merge csv
+var MergeHeader = []string{
+	"email", "name", "customer_key", "account_number", "failed_payments", "payment_requests_counted",
+	"outstanding_amount", "currency", "subject", "text", "html",
+}
+
+// Result tells where and how many notifications of a bucket were written
+type Result struct {
+	Output  string
+	Written int
+}
+
+// Write renders the notifications of a bucket into dir, as one .eml file per customer in the directory
+// notifications-<bucket>-<date> or as mail-merge file notifications-<bucket>-<date>.csv.
+// Customers without email address are skipped.
+func (n *Notifier) Write(dir string, bucket string, date string, notes []Notification) (Result, error) {
+	result := Result{Output: outputName(dir, n.Format, bucket, date)}
+	var messages []Message
+	for _, note := range notes {
+		if note.Email == "" {
+			continue
+		}
+		msg, err := n.Render(note)
+		if err != nil {
+			return result, fmt.Errorf("customer %s: %w", note.CustomerKey, err)
+		}
+		messages = append(messages, msg)
+	}
+
+	var err error
+	if n.Format == FormatMerge {
+		err = writeMerge(result.Output, messages)
+	} else {
+		err = n.writeEML(result.Output, messages)
+	}
+	if err != nil {
+		return result, err
+	}
+	result.Written = len(messages)
+	return result, nil
+}
+
+// writeEML writes a <customer key>.eml file per message into dir, the files open as draft in Outlook
+func (n *Notifier) writeEML(dir string, messages []Message) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for _, msg := range messages {
+		content, err := n.EML(msg)
+		if err != nil {
+			return err
+		}
+		if err = os.WriteFile(filepath.Join(dir, fileSafe(msg.CustomerKey)+".eml"), content, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// EML returns msg as draft to open in a mail program, with a text and, if the bucket has an html template, an html part
+func (n *Notifier) EML(msg Message) ([]byte, error) {
+	return n.mime(msg, true)
+}
+
+// Mail returns msg as MIME message to send
+func (n *Notifier) Mail(msg Message) ([]byte, error) {
+	return n.mime(msg, false)
+}
+
+// mime formats msg, a draft is marked as unsent
+func (n *Notifier) mime(msg Message, draft bool) ([]byte, error) {
+	var buf bytes.Buffer
+	header := func(key, value string) {
+		fmt.Fprintf(&buf, "%s: %s\r\n", key, value)
+	}
+	if n.From != "" {
+		header("From", n.From)
+	}
+	header("To", (&mail.Address{Name: msg.Name, Address: msg.Email}).String())
+	header("Subject", mime.QEncoding.Encode("utf-8", msg.Subject))
+	header("Date", time.Now().Format(time.RFC1123Z))
+	if msg.MessageID != "" {
+		header("Message-ID", msg.MessageID)
+	}
+	header("MIME-Version", "1.0")
+	if draft {
+		header("X-Unsent", "1")
+	}
+
+	if msg.HTML == "" {
+		header("Content-Type", "text/plain; charset=utf-8")
+		header("Content-Transfer-Encoding", "quoted-printable")
+		buf.WriteString("\r\n")
+		return buf.Bytes(), writeQuotedPrintable(&buf, msg.Text)
+	}
+
+	var body bytes.Buffer
+	parts := multipart.NewWriter(&body)
+	header("Content-Type", "multipart/alternative; boundary="+parts.Boundary())
+	buf.WriteString("\r\n")
+	for _, part := range []struct{ contentType, content string }{
+		{"text/plain; charset=utf-8", msg.Text},
+		{"text/html; charset=utf-8", msg.HTML},
+	} {
+		w, err := parts.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err = writeQuotedPrintable(w, part.content); err != nil {
+			return nil, err
+		}
+	}
+	if err := parts.Close(); err != nil {
+		return nil, err
+	}
+	buf.Write(body.Bytes())
+	return buf.Bytes(), nil
+}
+
+// writeQuotedPrintable encodes content to w
+func writeQuotedPrintable(w io.Writer, content string) error {
+	qp := quotedprintable.NewWriter(w)
+	if _, err := qp.Write([]byte(content)); err != nil {
+		return err
+	}
+	return qp.Close()
+}
+
+// writeMerge creates or overwrites fileName with a line per message for the mail merge of a word processor
+func writeMerge(fileName string, messages []Message) error {
+	f, err := os.OpenFile(fileName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := csv.NewWriter(f)
+	if err = w.Write(MergeHeader); err != nil {
+		return err
+	}
+	for _, msg := range messages {
+		err = w.Write([]string{
+			msg.Email, msg.Name, msg.CustomerKey, msg.AccountNumber, fmt.Sprint(len(msg.Payments)),
+			fmt.Sprint(msg.FailureCount), msg.Outstanding, msg.Currency, msg.Subject, msg.Text, msg.HTML,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	w.Flush()
+	if err = w.Error(); err != nil {
+		return err
+	}
+	return f.Close()
+}
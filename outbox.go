@@ -0,0 +1,156 @@
+/********************************************************************************************************************
+ * name: outbox
+ * description: fp outbox, review, send or discard the queued notifications
+ ********************************************************************************************************************/
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/tobkle/fp/notifier"
+	"github.com/tobkle/fp/store"
+)
+
+// cmdOutbox implements `fp outbox list|show|send|discard [-id message-id]`
+func cmdOutbox(args []string) {
+	var o outboxOptions
+	s := loadSettings(args)
+	flags := newOutboxFlags(&o, s)
+	s.apply(flags)
+	command := ""
+	if positional := parseArgs(flags, args); len(positional) > 0 {
+		command = positional[0]
+	}
+	if command == "send" && o.smtpServer.Addr == "" {
+		log.Fatal("fp outbox send needs the server with -smtp host:port")
+	}
+	o.smtpServer.Password = os.Getenv("FP_SMTP_PASSWORD")
+
+	db, err := store.Open(o.dbName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	dispatcher := &notifier.Dispatcher{Store: db, Sender: &o.smtpServer, Throttle: o.throttle}
+	if err = runOutbox(db, command, o.messageID, dispatcher); err != nil {
+		log.Fatalf("Outbox failed: %s", err)
+	}
+}
+
+// outboxOptions are the parameters of fp outbox
+type outboxOptions struct {
+	dbName     string
+	messageID  string
+	smtpServer notifier.SMTP
+	throttle   time.Duration
+}
+
+// newOutboxFlags returns the parameters of fp outbox with the defaults in the data directory
+func newOutboxFlags(o *outboxOptions, s *settings) *flag.FlagSet {
+	flags := flag.NewFlagSet("outbox", flag.ExitOnError)
+	flags.StringVar(&o.dbName, "db", defaultDatabase(s.dir), "Sqlite database with the outbox")
+	flags.StringVar(&o.messageID, "id", "", "only this message, the MESSAGE-ID of fp outbox list")
+	flags.StringVar(&o.smtpServer.Addr, "smtp", "", "SMTP server host:port to send the notifications with")
+	flags.StringVar(&o.smtpServer.Username, "smtp-user", "", "SMTP user name, the password is read from the environment variable FP_SMTP_PASSWORD")
+	flags.DurationVar(&o.throttle, "throttle", time.Second, "minimum time between two sent notifications")
+	s.register(flags)
+	return flags
+}
+
+// runOutbox lists, shows, sends or discards the notifications with status outbox or failed,
+// messageID selects a single message
+func runOutbox(db store.Store, command string, messageID string, dispatcher *notifier.Dispatcher) error {
+	if _, err := db.Migrate(); err != nil {
+		return err
+	}
+	pending, err := db.Notifications(store.NotificationOutbox, store.NotificationFailed)
+	if err != nil {
+		return err
+	}
+	if messageID != "" {
+		var selected []store.Notification
+		for _, n := range pending {
+			if n.MessageID == messageID {
+				selected = append(selected, n)
+			}
+		}
+		if len(selected) == 0 {
+			return fmt.Errorf("no queued or failed notification with message id %s", messageID)
+		}
+		pending = selected
+	}
+
+	switch command {
+	case "", "list":
+		fmt.Printf("%-8s %-13s %-12s %-30s %-20s %s\n", "STATUS", "BUCKET", "CUSTOMER", "EMAIL", "PAYMENTS", "MESSAGE-ID")
+		for _, msg := range messages(pending) {
+			fmt.Printf("%-8s %-13s %-12s %-30s %-20s %s\n", msg[0].Status, msg[0].Bucket, msg[0].CustomerKey,
+				msg[0].Email, strings.Join(paymentIDs(msg), " "), msg[0].MessageID)
+			fmt.Printf("         %s\n", msg[0].Subject)
+			if msg[0].Error != "" {
+				fmt.Printf("         %s\n", msg[0].Error)
+			}
+		}
+		fmt.Println(countMessages(pending), "notifications in the outbox")
+	case "show":
+		for _, msg := range messages(pending) {
+			fmt.Println(strings.ReplaceAll(msg[0].Message, "\r\n", "\n"))
+		}
+	case "send":
+		sent, failed, err := dispatcher.Send(pending)
+		if err != nil {
+			return err
+		}
+		fmt.Println("SUCCESS: Sent", sent, "notifications")
+		if failed > 0 {
+			fmt.Println("ERROR:  ", failed, "notifications could not be sent, see fp outbox")
+		}
+	case "discard":
+		if messageID == "" {
+			return fmt.Errorf("discard needs the message with -id")
+		}
+		if err = db.SetNotificationStatus(messageID, store.NotificationDiscarded, "", ""); err != nil {
+			return err
+		}
+		fmt.Println("SUCCESS: Discarded", messageID)
+	default:
+		return fmt.Errorf("unknown command %q, use list, show, send or discard", command)
+	}
+	return nil
+}
+
+// messages groups the rows of notifications by message, in the order of the rows
+func messages(rows []store.Notification) [][]store.Notification {
+	var result [][]store.Notification
+	index := map[string]int{}
+	for _, row := range rows {
+		i, ok := index[row.MessageID]
+		if !ok {
+			i = len(result)
+			index[row.MessageID] = i
+			result = append(result, nil)
+		}
+		result[i] = append(result[i], row)
+	}
+	return result
+}
+
+// paymentIDs lists the payments of a message
+func paymentIDs(rows []store.Notification) []string {
+	ids := make([]string, 0, len(rows))
+	for _, row := range rows {
+		ids = append(ids, row.PaymentID)
+	}
+	return ids
+}
+
+// countMessages counts the messages of rows of notifications
+func countMessages(rows []store.Notification) int {
+	return len(messages(rows))
+}
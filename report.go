@@ -0,0 +1,189 @@
+/********************************************************************************************************************
+ * name: report
+ * description: fp report, the payments by state and the actions, state changes and notifications of a day,
+ *              and the data-quality of the accounts joined to the payments
+ ********************************************************************************************************************/
+package main
+
+import (
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/tobkle/fp/rules"
+	"github.com/tobkle/fp/store"
+)
+
+// cmdReport implements `fp report [summary|data-quality] [-date YYYY-MM-DD]`
+func cmdReport(args []string) {
+	var o reportOptions
+	s := loadSettings(args)
+	flags := newReportFlags(&o, s)
+	report := "summary"
+	s.apply(flags)
+	if positional := parseArgs(flags, args); len(positional) > 0 {
+		report = positional[0]
+	}
+	if _, err := parseDate(o.date); err != nil {
+		log.Fatal(err)
+	}
+	if o.csvNameTo == "" {
+		o.csvNameTo = datedName(s.dir, "data-quality-", o.date)
+	}
+	expandDate(o.date, &o.csvNameTo)
+
+	db, err := store.Open(o.dbName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, err = db.Migrate(); err != nil {
+		log.Fatalf("Database migration failed: %s", err)
+	}
+	switch report {
+	case "summary":
+		err = reportSummary(db, o.date)
+	case "data-quality":
+		err = reportDataQuality(db, o.csvNameTo)
+	default:
+		err = fmt.Errorf("unknown report %q, use summary or data-quality", report)
+	}
+	if err != nil {
+		log.Fatalf("Report failed: %s", err)
+	}
+}
+
+// reportOptions are the parameters of fp report
+type reportOptions struct {
+	dbName    string
+	date      string
+	csvNameTo string
+}
+
+// newReportFlags returns the parameters of fp report with the defaults in the data directory
+func newReportFlags(o *reportOptions, s *settings) *flag.FlagSet {
+	flags := flag.NewFlagSet("report", flag.ExitOnError)
+	flags.StringVar(&o.dbName, "db", defaultDatabase(s.dir), "Sqlite database to report on")
+	flags.StringVar(&o.date, "date", time.Now().Format("2006-01-02"), "date YYYY-MM-DD of the actions, state changes and notifications")
+	flags.StringVar(&o.csvNameTo, "to", "", "fp report data-quality: CSV file to write the issues to (default data-quality-<date>.csv)")
+	s.register(flags)
+	return flags
+}
+
+// reportSummary prints the payments by state and the actions, state changes and notifications of date
+func reportSummary(db store.Store, date string) error {
+	states, err := db.PaymentStates("")
+	if err != nil {
+		return err
+	}
+	inState, changed := map[string]int{}, map[string]int{}
+	for _, st := range states {
+		inState[st.State]++
+		if st.Timestamp == date && st.PreviousState != "" {
+			changed[st.State]++
+		}
+	}
+	// the payments and customers put into each bucket on date as recorded in the dunning history
+	payments, customers := map[string]int{}, map[string]int{}
+	for _, bucket := range rules.Buckets {
+		if bucket == rules.BucketIgnore {
+			continue
+		}
+		paymentRows, err := db.ActionExports(string(bucket), date)
+		if err != nil {
+			return err
+		}
+		customerRows, err := db.CustomerActionExports(string(bucket), date)
+		if err != nil {
+			return err
+		}
+		payments[string(bucket)], customers[string(bucket)] = len(paymentRows), len(customerRows)
+	}
+	notifications, err := db.Notifications()
+	if err != nil {
+		return err
+	}
+	messages := map[string]map[string]bool{}
+	for _, n := range notifications {
+		// queued or sent on date
+		if !strings.HasPrefix(n.CreatedAt, date) && !strings.HasPrefix(n.SentAt, date) {
+			continue
+		}
+		if messages[n.Status] == nil {
+			messages[n.Status] = map[string]bool{}
+		}
+		messages[n.Status][n.MessageID] = true
+	}
+
+	fmt.Println("***********************************************************")
+	fmt.Println("REPORT OF", date)
+	fmt.Println("***********************************************************")
+	fmt.Printf("%-13s %8s %12s\n", "STATE", "PAYMENTS", "CHANGED")
+	for _, state := range []string{store.StateActive, store.StateWarned, store.StateSuspended, store.StateRecovered, store.StateWrittenOff} {
+		fmt.Printf("%-13s %8d %12d\n", state, inState[state], changed[state])
+	}
+	fmt.Println(" ")
+	fmt.Printf("%-13s %8s %12s\n", "BUCKET", "PAYMENTS", "CUSTOMERS")
+	for _, bucket := range rules.Buckets {
+		if bucket == rules.BucketIgnore {
+			continue
+		}
+		fmt.Printf("%-13s %8d %12d\n", bucket, payments[string(bucket)], customers[string(bucket)])
+	}
+	fmt.Println(" ")
+	fmt.Printf("%-13s %8s\n", "NOTIFICATIONS", "MESSAGES")
+	for _, status := range []string{store.NotificationOutbox, store.NotificationSent, store.NotificationFailed, store.NotificationDiscarded} {
+		fmt.Printf("%-13s %8d\n", status, len(messages[status]))
+	}
+	return nil
+}
+
+// reportDataQuality prints the number of issues per data-quality check and writes the issues to fileName
+func reportDataQuality(db store.Store, fileName string) error {
+	issues, err := db.QualityIssues()
+	if err != nil {
+		return err
+	}
+	count, exported := map[string]int{}, map[string]int{}
+	for _, issue := range issues {
+		count[issue.Check]++
+		if issue.Buckets != "" {
+			exported[issue.Check]++
+		}
+	}
+
+	fmt.Println("***********************************************************")
+	fmt.Println("DATA QUALITY")
+	fmt.Println("***********************************************************")
+	fmt.Printf("%-20s %8s %12s\n", "CHECK", "ISSUES", "IN BUCKETS")
+	for _, check := range store.QualityChecks {
+		fmt.Printf("%-20s %8d %12d\n", check, count[check], exported[check])
+	}
+	fmt.Println(" ")
+
+	f, err := os.OpenFile(fileName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := csv.NewWriter(f)
+	w.Write([]string{"check", "payments_id", "customers_id", "mandate_reference", "account_number", "buckets", "detail"})
+	for _, issue := range issues {
+		w.Write([]string{issue.Check, issue.PaymentID, issue.CustomerID, issue.MandateReference, issue.AccountNumber,
+			issue.Buckets, issue.Detail})
+	}
+	w.Flush()
+	if err = w.Error(); err != nil {
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	fmt.Println("SUCCESS: Wrote", len(issues), "issues to", fileName)
+	return nil
+}
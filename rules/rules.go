@@ -0,0 +1,438 @@
+/********************************************************************************************************************
+ * name: rules
+ * description: decide which payments get a warning, get suspended or need any other action
+ ********************************************************************************************************************/
+package rules
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tobkle/fp/store"
+	"gopkg.in/yaml.v3"
+)
+
+// Bucket is the action a rule assigns to a payment, every bucket has its own output file
+type Bucket string
+
+// the known action buckets
+const (
+	BucketIgnore       Bucket = "ignore"
+	BucketWarn         Bucket = "warn"
+	BucketFinalWarning Bucket = "final-warning"
+	BucketSuspendSmall Bucket = "suspend-small"
+	BucketSuspendLarge Bucket = "suspend-large"
+	BucketEscalate     Bucket = "escalate"
+)
+
+// Buckets lists the buckets in the order they are exported
+var Buckets = []Bucket{BucketWarn, BucketFinalWarning, BucketSuspendSmall, BucketSuspendLarge, BucketEscalate, BucketIgnore}
+
+// StateBuckets are the buckets a payment counts as warned or suspended in for its lifecycle state
+var StateBuckets = store.StateBuckets{
+	Warn:    []string{string(BucketWarn), string(BucketFinalWarning)},
+	Suspend: []string{string(BucketSuspendSmall), string(BucketSuspendLarge), string(BucketEscalate)},
+}
+
+// TableBuckets are the buckets whose payments are also recorded in paymentsWarnings and paymentsSuspended
+var TableBuckets = store.StateBuckets{
+	Warn:    []string{string(BucketWarn)},
+	Suspend: []string{string(BucketSuspendSmall), string(BucketSuspendLarge)},
+}
+
+// levels the rules can be evaluated on
+const (
+	LevelPayment  = "payment"
+	LevelCustomer = "customer"
+)
+
+// DefaultOutputs are the file names of the buckets, {date} is replaced by the date of the run
+var DefaultOutputs = map[Bucket]string{
+	BucketWarn:         "customers-to-warn-{date}.csv",
+	BucketFinalWarning: "customers-final-warning-{date}.csv",
+	BucketSuspendSmall: "customers-to-suspend-small-{date}.csv",
+	BucketSuspendLarge: "customers-to-suspend-large-{date}.csv",
+	BucketEscalate:     "customers-to-escalate-{date}.csv",
+}
+
+// Match are the conditions of a rule, empty conditions match every payment.
+// Amounts are in major units of the payment currency, MinAmount is inclusive and MaxAmount exclusive.
+type Match struct {
+	MinFailures *int     `json:"min_failures,omitempty" yaml:"min_failures,omitempty"`
+	MaxFailures *int     `json:"max_failures,omitempty" yaml:"max_failures,omitempty"`
+	MinAmount   *float64 `json:"min_amount,omitempty" yaml:"min_amount,omitempty"`
+	MaxAmount   *float64 `json:"max_amount,omitempty" yaml:"max_amount,omitempty"`
+	Currencies  []string `json:"currencies,omitempty" yaml:"currencies,omitempty"`
+	Causes      []string `json:"causes,omitempty" yaml:"causes,omitempty"`
+	ReasonCodes []string `json:"reason_codes,omitempty" yaml:"reason_codes,omitempty"`
+	Schemes     []string `json:"schemes,omitempty" yaml:"schemes,omitempty"`
+	CRMStages   []string `json:"crm_stages,omitempty" yaml:"crm_stages,omitempty"`
+	// Statuses matches payments_status, on customer level the worst status of the customer's payments
+	Statuses []string `json:"statuses,omitempty" yaml:"statuses,omitempty"`
+	// failures and failing payments of the customer across all payments, within the count window
+	MinCustomerFailures *int `json:"min_customer_failures,omitempty" yaml:"min_customer_failures,omitempty"`
+	MaxCustomerFailures *int `json:"max_customer_failures,omitempty" yaml:"max_customer_failures,omitempty"`
+	MinCustomerPayments *int `json:"min_customer_payments,omitempty" yaml:"min_customer_payments,omitempty"`
+	// Within only matches payments whose last failure is at most this long ago, e.g. "30d", "8w" or "72h"
+	Within string `json:"within,omitempty" yaml:"within,omitempty"`
+}
+
+// Rule assigns a bucket to the payments it matches, rules with a lower priority number are evaluated first
+type Rule struct {
+	Name     string `json:"name" yaml:"name"`
+	Priority int    `json:"priority" yaml:"priority"`
+	Match    Match  `json:"match" yaml:"match"`
+	Bucket   Bucket `json:"bucket" yaml:"bucket"`
+}
+
+// Ruleset is the declarative dunning policy, Outputs overrides the DefaultOutputs per bucket.
+// CountWindow limits all failure counts to the failures of e.g. the last "60d", by the date in CountBy,
+// created_at (default) or payments_charge_date. Without a window all failures ever imported are counted.
+// Level "customer" evaluates the rules once per customer instead of once per payment.
+type Ruleset struct {
+	Level       string            `json:"level,omitempty" yaml:"level,omitempty"`
+	CountWindow string            `json:"count_window,omitempty" yaml:"count_window,omitempty"`
+	CountBy     string            `json:"count_by,omitempty" yaml:"count_by,omitempty"`
+	Outputs     map[Bucket]string `json:"outputs,omitempty" yaml:"outputs,omitempty"`
+	Rules       []Rule            `json:"rules" yaml:"rules"`
+}
+
+// Decision is the bucket the first matching rule assigned to a payment
+type Decision struct {
+	Rule    string
+	Bucket  Bucket
+	Summary store.PaymentSummary
+}
+
+// CustomerDecision is the bucket the first matching rule assigned to a customer
+type CustomerDecision struct {
+	Rule     string
+	Bucket   Bucket
+	Customer store.CustomerSummary
+}
+
+// Thresholds are the limits of the -count-warn, -count-suspend and -amount parameters
+type Thresholds struct {
+	// WarnCount warns payments with exactly this number of failed requests
+	WarnCount int
+	// SuspendCount suspends payments with this number of failed requests or more
+	SuspendCount int
+	// AmountSwitch splits suspensions into small and large amounts, in major units of the payment currency
+	AmountSwitch float64
+}
+
+// Ruleset returns the rules equivalent to the thresholds
+func (t Thresholds) Ruleset() *Ruleset {
+	warnCount, suspendCount, amountSwitch := t.WarnCount, t.SuspendCount, t.AmountSwitch
+	return &Ruleset{Rules: []Rule{
+		{Name: "count-suspend-small", Priority: 10, Bucket: BucketSuspendSmall, Match: Match{MinFailures: &suspendCount, MaxAmount: &amountSwitch}},
+		{Name: "count-suspend-large", Priority: 20, Bucket: BucketSuspendLarge, Match: Match{MinFailures: &suspendCount}},
+		{Name: "count-warn", Priority: 30, Bucket: BucketWarn, Match: Match{MinFailures: &warnCount, MaxFailures: &warnCount}},
+	}}
+}
+
+// Load reads a ruleset from a .json, .yaml or .yml file
+func Load(fileName string) (*Ruleset, error) {
+	content, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	var ruleset Ruleset
+	if strings.EqualFold(filepath.Ext(fileName), ".json") {
+		err = json.Unmarshal(content, &ruleset)
+	} else {
+		err = yaml.Unmarshal(content, &ruleset)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", fileName, err)
+	}
+	if err = ruleset.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", fileName, err)
+	}
+	return &ruleset, nil
+}
+
+// Validate checks buckets and time windows and sorts the rules by priority
+func (rs *Ruleset) Validate() error {
+	if len(rs.Rules) == 0 {
+		return fmt.Errorf("ruleset has no rules")
+	}
+	if _, err := ParseWindow(rs.CountWindow); err != nil {
+		return fmt.Errorf("count_window: %w", err)
+	}
+	switch rs.Level {
+	case "":
+		rs.Level = LevelPayment
+	case LevelPayment, LevelCustomer:
+	default:
+		return fmt.Errorf("level: unknown level %q, use %s or %s", rs.Level, LevelPayment, LevelCustomer)
+	}
+	switch rs.CountBy {
+	case "", store.CountByCreatedAt, store.CountByChargeDate:
+	case "charge_date":
+		rs.CountBy = store.CountByChargeDate
+	default:
+		return fmt.Errorf("count_by: unknown date %q, use %s or %s", rs.CountBy, store.CountByCreatedAt, store.CountByChargeDate)
+	}
+	for i, rule := range rs.Rules {
+		if rule.Name == "" {
+			rs.Rules[i].Name = fmt.Sprintf("rule-%d", i+1)
+		}
+		if !knownBucket(rule.Bucket) {
+			return fmt.Errorf("rule %s: unknown bucket %q", rs.Rules[i].Name, rule.Bucket)
+		}
+		if _, err := ParseWindow(rule.Match.Within); err != nil {
+			return fmt.Errorf("rule %s: %w", rs.Rules[i].Name, err)
+		}
+	}
+	for bucket := range rs.Outputs {
+		if !knownBucket(bucket) {
+			return fmt.Errorf("outputs: unknown bucket %q", bucket)
+		}
+	}
+	sort.SliceStable(rs.Rules, func(i, j int) bool { return rs.Rules[i].Priority < rs.Rules[j].Priority })
+	return nil
+}
+
+func knownBucket(bucket Bucket) bool {
+	for _, b := range Buckets {
+		if b == bucket {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseWindow reads durations like "60d", "8w" or Go durations like "72h", empty means no window
+func ParseWindow(window string) (time.Duration, error) {
+	window = strings.TrimSpace(window)
+	if window == "" {
+		return 0, nil
+	}
+	unit := window[len(window)-1]
+	if unit == 'd' || unit == 'w' {
+		n, err := strconv.Atoi(window[:len(window)-1])
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid time window %q", window)
+		}
+		days := n
+		if unit == 'w' {
+			days = n * 7
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(window)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid time window %q", window)
+	}
+	return d, nil
+}
+
+// Query selects the payments to evaluate at time now, counting failures within the count window up to now
+func (rs *Ruleset) Query(now time.Time) store.SummaryQuery {
+	query := store.SummaryQuery{MinFailures: rs.MinFailures(), CountBy: rs.CountBy}
+	if rs.CountBy == store.CountByChargeDate {
+		query.Until = now.Format(store.ISODate)
+	} else {
+		query.Until = now.UTC().Format(store.ISOTimestamp)
+	}
+	if window, _ := ParseWindow(rs.CountWindow); window > 0 {
+		since := now.Add(-window).UTC()
+		if rs.CountBy == store.CountByChargeDate {
+			query.Since = since.Format(store.ISODate)
+		} else {
+			query.Since = since.Format(store.ISOTimestamp)
+		}
+	}
+	return query
+}
+
+// MinFailures is the lowest failure count any rule can react on
+func (rs *Ruleset) MinFailures() int {
+	min := -1
+	for _, rule := range rs.Rules {
+		if rule.Bucket == BucketIgnore {
+			continue
+		}
+		n := 1
+		if rule.Match.MinFailures != nil {
+			n = *rule.Match.MinFailures
+		}
+		if min < 0 || n < min {
+			min = n
+		}
+	}
+	if min < 1 {
+		return 1
+	}
+	return min
+}
+
+// UsedBuckets are the buckets any rule can assign, without ignore
+func (rs *Ruleset) UsedBuckets() []Bucket {
+	var used []Bucket
+	for _, bucket := range Buckets {
+		if bucket == BucketIgnore {
+			continue
+		}
+		for _, rule := range rs.Rules {
+			if rule.Bucket == bucket {
+				used = append(used, bucket)
+				break
+			}
+		}
+	}
+	return used
+}
+
+// Output is the file name of a bucket for a date
+func (rs *Ruleset) Output(bucket Bucket, date string) string {
+	name, ok := rs.Outputs[bucket]
+	if !ok {
+		name = DefaultOutputs[bucket]
+	}
+	return strings.ReplaceAll(name, "{date}", date)
+}
+
+// Evaluate assigns every payment the bucket of the first matching rule, payments matching no rule are left out.
+// now is the time of the evaluation, used for the time windows.
+func (rs *Ruleset) Evaluate(summaries []store.PaymentSummary, now time.Time) []Decision {
+	var decisions []Decision
+	for _, summary := range summaries {
+		for _, rule := range rs.Rules {
+			if rule.Match.matches(summary, now) {
+				decisions = append(decisions, Decision{Rule: rule.Name, Bucket: rule.Bucket, Summary: summary})
+				break
+			}
+		}
+	}
+	return decisions
+}
+
+// EvaluateCustomers assigns every customer the bucket of the first matching rule.
+// The conditions see a customer as one payment: failures and amount are the totals of all its failing payments,
+// status is the worst status, causes, reason codes and schemes are those of its payment with the most failures.
+func (rs *Ruleset) EvaluateCustomers(customers []store.CustomerSummary, now time.Time) []CustomerDecision {
+	var decisions []CustomerDecision
+	for _, customer := range customers {
+		summary := asPayment(customer)
+		for _, rule := range rs.Rules {
+			if rule.Match.matches(summary, now) {
+				decisions = append(decisions, CustomerDecision{Rule: rule.Name, Bucket: rule.Bucket, Customer: customer})
+				break
+			}
+		}
+	}
+	return decisions
+}
+
+// asPayment turns the totals of a customer into a payment summary the conditions can match
+func asPayment(c store.CustomerSummary) store.PaymentSummary {
+	summary := c.Worst
+	summary.FailureCount = c.FailureCount
+	summary.LastFailureAt = c.LastFailureAt
+	summary.CRMStageName = c.CRMStageName
+	summary.CustomerFailureCount = c.FailureCount
+	summary.CustomerPaymentCount = c.PaymentCount
+	summary.Event.AmountMinor = c.OutstandingMinor
+	summary.Event.Currency = c.Currency
+	summary.Event.PaymentStatus = c.WorstStatus
+	return summary
+}
+
+// matches tells if a payment meets all conditions
+func (m Match) matches(summary store.PaymentSummary, now time.Time) bool {
+	e := summary.Event
+	if m.MinFailures != nil && summary.FailureCount < *m.MinFailures {
+		return false
+	}
+	if m.MaxFailures != nil && summary.FailureCount > *m.MaxFailures {
+		return false
+	}
+	if m.MinCustomerFailures != nil && summary.CustomerFailureCount < *m.MinCustomerFailures {
+		return false
+	}
+	if m.MaxCustomerFailures != nil && summary.CustomerFailureCount > *m.MaxCustomerFailures {
+		return false
+	}
+	if m.MinCustomerPayments != nil && summary.CustomerPaymentCount < *m.MinCustomerPayments {
+		return false
+	}
+	if m.MinAmount != nil && e.AmountMinor < store.ToMinorUnits(*m.MinAmount, e.Currency) {
+		return false
+	}
+	if m.MaxAmount != nil && e.AmountMinor >= store.ToMinorUnits(*m.MaxAmount, e.Currency) {
+		return false
+	}
+	if !oneOf(m.Currencies, e.Currency) || !oneOf(m.Causes, e.DetailsCause) || !oneOf(m.ReasonCodes, e.DetailsReasonCode) ||
+		!oneOf(m.Schemes, e.DetailsScheme) || !oneOf(m.CRMStages, summary.CRMStageName) || !oneOf(m.Statuses, e.PaymentStatus) {
+		return false
+	}
+	if window, _ := ParseWindow(m.Within); window > 0 {
+		last, err := store.ParseTimestamp(summary.LastFailureAt)
+		if err != nil || now.Sub(last) > window {
+			return false
+		}
+	}
+	return true
+}
+
+// oneOf tells if value is in the list, an empty list allows every value
+func oneOf(list []string, value string) bool {
+	if len(list) == 0 {
+		return true
+	}
+	for _, v := range list {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// Action converts a decision into a record of the paymentsActions table
+func (d Decision) Action(timestamp string) store.PaymentAction {
+	e := d.Summary.Event
+	return store.PaymentAction{
+		PaymentID:          e.PaymentID,
+		Bucket:             string(d.Bucket),
+		Rule:               d.Rule,
+		Timestamp:          timestamp,
+		Count:              d.Summary.FailureCount,
+		CustomerID:         e.CustomerID,
+		CustomerGivenName:  e.CustomerGivenName,
+		CustomerFamilyName: e.CustomerFamilyName,
+		CustomerLeadID:     e.CustomerLeadID,
+	}
+}
+
+// Action converts a customer decision into a record of the customersActions table
+func (d CustomerDecision) Action(timestamp string) store.CustomerAction {
+	c := d.Customer
+	e := c.Worst.Event
+	return store.CustomerAction{
+		CustomerKey:        c.Key,
+		Bucket:             string(d.Bucket),
+		Rule:               d.Rule,
+		Timestamp:          timestamp,
+		Count:              c.FailureCount,
+		PaymentCount:       c.PaymentCount,
+		OutstandingMinor:   c.OutstandingMinor,
+		Currency:           c.Currency,
+		WorstStatus:        c.WorstStatus,
+		LastFailureAt:      c.LastFailureAt,
+		CustomerIDs:        c.CustomerIDs,
+		PaymentIDs:         c.PaymentIDs,
+		Mandates:           c.Mandates,
+		AccountNumber:      c.AccountNumber,
+		CustomerGivenName:  e.CustomerGivenName,
+		CustomerFamilyName: e.CustomerFamilyName,
+		CustomerLeadID:     e.CustomerLeadID,
+	}
+}
@@ -0,0 +1,129 @@
+package rules
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tobkle/fp/store"
+)
+
+// payment is a summary of a payment with count failures of amount in GBP
+func payment(id string, count int, amount int64) store.PaymentSummary {
+	return store.PaymentSummary{
+		Event:         store.FailedPaymentEvent{PaymentID: id, AmountMinor: amount, Currency: "GBP", DetailsCause: "insufficient_funds"},
+		FailureCount:  count,
+		LastFailureAt: "2020-01-10T10:00:00.000Z",
+	}
+}
+
+// buckets returns the bucket of every decided payment
+func buckets(decisions []Decision) map[string]Bucket {
+	decided := map[string]Bucket{}
+	for _, d := range decisions {
+		decided[d.Summary.Event.PaymentID] = d.Bucket
+	}
+	return decided
+}
+
+func intp(n int) *int { return &n }
+
+func floatp(f float64) *float64 { return &f }
+
+func TestEvaluate(t *testing.T) {
+	rs := &Ruleset{Rules: []Rule{
+		{Name: "recent", Bucket: BucketFinalWarning, Priority: 5, Match: Match{MinFailures: intp(2), Within: "7d"}},
+		{Name: "funds", Bucket: BucketWarn, Priority: 10, Match: Match{Causes: []string{"INSUFFICIENT_FUNDS"}, MaxFailures: intp(1)}},
+		{Name: "other-cause", Bucket: BucketEscalate, Priority: 20, Match: Match{Causes: []string{"bank_account_closed"}}},
+	}}
+	if err := rs.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2020, 1, 12, 0, 0, 0, 0, time.UTC)
+	old := payment("PMOLD", 2, 1000)
+	old.LastFailureAt = "2019-12-01T10:00:00.000Z"
+	decisions := rs.Evaluate([]store.PaymentSummary{payment("PM1", 1, 1000), payment("PM2", 2, 1000), old}, now)
+
+	got := buckets(decisions)
+	want := map[string]Bucket{"PM1": BucketWarn, "PM2": BucketFinalWarning}
+	if len(got) != len(want) {
+		t.Fatalf("Evaluate() = %v, want %v", got, want)
+	}
+	for id, bucket := range want {
+		if got[id] != bucket {
+			t.Errorf("bucket of %s = %q, want %q", id, got[id], bucket)
+		}
+	}
+	if decisions[0].Rule != "funds" {
+		t.Errorf("rule of PM1 = %q, want funds", decisions[0].Rule)
+	}
+}
+
+func TestEvaluatePriority(t *testing.T) {
+	// listed in the wrong order, Validate sorts them by priority
+	rs := &Ruleset{Rules: []Rule{
+		{Name: "warn-all", Bucket: BucketWarn, Priority: 20},
+		{Name: "ignore-small", Bucket: BucketIgnore, Priority: 10, Match: Match{MaxAmount: floatp(5)}},
+		{Name: "escalate-large", Bucket: BucketEscalate, Priority: 10, Match: Match{MinAmount: floatp(100)}},
+	}}
+	if err := rs.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	got := buckets(rs.Evaluate([]store.PaymentSummary{
+		payment("PMSMALL", 3, 499), payment("PMMID", 3, 500), payment("PMLARGE", 3, 10000),
+	}, time.Now()))
+	want := map[string]Bucket{"PMSMALL": BucketIgnore, "PMMID": BucketWarn, "PMLARGE": BucketEscalate}
+	for id, bucket := range want {
+		if got[id] != bucket {
+			t.Errorf("bucket of %s = %q, want %q", id, got[id], bucket)
+		}
+	}
+}
+
+// TestThresholdsRuleset covers the -count-warn, -count-suspend and -amount parameters of the former versions:
+// a warning at exactly count-warn failures, a suspension from count-suspend failures on, split by the amount
+func TestThresholdsRuleset(t *testing.T) {
+	rs := Thresholds{WarnCount: 3, SuspendCount: 4, AmountSwitch: 20}.Ruleset()
+	if err := rs.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if rs.MinFailures() != 3 {
+		t.Errorf("MinFailures() = %d, want 3", rs.MinFailures())
+	}
+	tests := []struct {
+		count  int
+		amount int64
+		want   Bucket
+	}{
+		{2, 1000, ""},
+		{3, 1000, BucketWarn},
+		{3, 5000, BucketWarn},
+		{4, 1999, BucketSuspendSmall},
+		{4, 2000, BucketSuspendLarge},
+		{10, 1000, BucketSuspendSmall},
+		{10, 5000, BucketSuspendLarge},
+	}
+	for _, test := range tests {
+		got := buckets(rs.Evaluate([]store.PaymentSummary{payment("PM", test.count, test.amount)}, time.Now()))["PM"]
+		if got != test.want {
+			t.Errorf("%d failures of %d pence: bucket %q, want %q", test.count, test.amount, got, test.want)
+		}
+	}
+
+	// a warn count above the suspend count only suspends
+	rs = Thresholds{WarnCount: 5, SuspendCount: 4, AmountSwitch: 20}.Ruleset()
+	if got := buckets(rs.Evaluate([]store.PaymentSummary{payment("PM", 5, 1000)}, time.Now()))["PM"]; got != BucketSuspendSmall {
+		t.Errorf("5 failures with warn count 5 and suspend count 4: bucket %q, want %q", got, BucketSuspendSmall)
+	}
+}
+
+func TestQuery(t *testing.T) {
+	now := time.Date(2020, 3, 31, 23, 59, 59, 0, time.UTC)
+	query := (&Ruleset{CountWindow: "30d", Rules: Thresholds{WarnCount: 3, SuspendCount: 4}.Ruleset().Rules}).Query(now)
+	if query.MinFailures != 3 || query.Since != "2020-03-01T23:59:59.000Z" || query.Until != "2020-03-31T23:59:59.000Z" {
+		t.Errorf("Query() = %+v, want 3 failures from 2020-03-01T23:59:59.000Z until 2020-03-31T23:59:59.000Z", query)
+	}
+	query = (&Ruleset{CountBy: store.CountByChargeDate, Rules: Thresholds{WarnCount: 3, SuspendCount: 4}.Ruleset().Rules}).Query(now)
+	if query.Since != "" || query.Until != "2020-03-31" {
+		t.Errorf("Query() by charge date = %+v, want all charge dates until 2020-03-31", query)
+	}
+}
@@ -0,0 +1,93 @@
+/********************************************************************************************************************
+ * name: serve
+ * description: fp serve, the local web dashboard and the REST/JSON API of the failed-payments database
+ ********************************************************************************************************************/
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/tobkle/fp/api"
+	"github.com/tobkle/fp/dashboard"
+	"github.com/tobkle/fp/importer"
+	"github.com/tobkle/fp/store"
+)
+
+// cmdServe implements `fp serve [-addr 127.0.0.1:8080] [-api-token token]`
+func cmdServe(args []string) {
+	var o serveOptions
+	s := loadSettings(args)
+	flags := newServeFlags(&o, s)
+	s.apply(flags)
+	parseArgs(flags, args)
+
+	db, err := store.Open(o.dbName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+	if _, err = db.Migrate(); err != nil {
+		log.Fatalf("Database migration failed: %s", err)
+	}
+
+	board, err := dashboard.New(db)
+	if err != nil {
+		log.Fatal(err)
+	}
+	board.Days = o.days
+	mux := http.NewServeMux()
+	// with the API the dashboard shares its tokens, without only this computer can reach it by default
+	var pages http.Handler = board
+
+	fmt.Println("***********************************************************")
+	fmt.Println("DASHBOARD")
+	fmt.Println("***********************************************************")
+	fmt.Println("Received      Database Name      :", o.dbName)
+	if service := api.New(db, strings.Split(o.tokens, ",")); len(service.Tokens) > 0 {
+		columnMappings, err := o.imf.columns()
+		if err != nil {
+			log.Fatalf("Loading column mapping failed: %s", err)
+		}
+		service.Importer = func(db store.Store) *importer.Importer {
+			return o.imf.importer(db, columnMappings)
+		}
+		mux.Handle(api.Prefix, service)
+		pages = service.Protect(board)
+		fmt.Printf("SUCCESS: Serving the API on http://%s%s, described by %sopenapi.json\n", o.addr, api.Prefix, api.Prefix)
+		fmt.Println("SUCCESS: The dashboard asks for one of the API tokens as password")
+	} else {
+		fmt.Println("Skipping the API, as there is no -api-token or FP_API_TOKEN....")
+	}
+	mux.Handle("/", pages)
+	fmt.Printf("SUCCESS: Serving the dashboard on http://%s/, stop it with Ctrl-C\n", o.addr)
+	if err = http.ListenAndServe(o.addr, mux); err != nil {
+		log.Fatalf("fp serve failed: %s", err)
+	}
+}
+
+// serveOptions are the parameters of fp serve
+type serveOptions struct {
+	dbName string
+	addr   string
+	days   int
+	tokens string
+	imf    importFlags
+}
+
+// newServeFlags returns the parameters of fp serve with the defaults in the data directory
+func newServeFlags(o *serveOptions, s *settings) *flag.FlagSet {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	flags.StringVar(&o.dbName, "db", defaultDatabase(s.dir), "Sqlite database to show")
+	flags.StringVar(&o.addr, "addr", "127.0.0.1:8080", "address the dashboard listens on, only this computer by default")
+	flags.IntVar(&o.days, "days", 90, "days shown in the trend charts")
+	flags.StringVar(&o.tokens, "api-token", "", "bearer tokens of the API at "+api.Prefix+", comma separated, the API is off without (optional)")
+	flags.StringVar(&o.imf.columnsFrom, "columns", "", "JSON file mapping csv header names to database fields per source, for the API imports (optional)")
+	flags.IntVar(&o.imf.maxRejected, "max-rejected", 10, "rejected rows allowed before an API import is rolled back, -1 for no limit")
+	flags.BoolVar(&o.imf.reimport, "reimport", false, "import files sent to the API even if a file with the same content was imported before")
+	s.register(flags)
+	return flags
+}
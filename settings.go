@@ -0,0 +1,234 @@
+/********************************************************************************************************************
+ * name: settings
+ * description: parameters of the config file, its profiles and the environment, fp config show
+ ********************************************************************************************************************/
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/tobkle/fp/config"
+)
+
+// pathParams are the parameters naming a file or directory, relative names of the config file and the
+// environment are in the data directory
+var pathParams = map[string]bool{
+	"db": true, "from": true, "accounts": true, "crm": true, "warn": true, "toSmall": true, "toLarge": true,
+	"toReinstate": true, "rejected": true, "columns": true, "rules": true, "xlsx": true, "notify": true, "templates": true,
+	"to": true,
+}
+
+// knownParams returns the parameters of all commands, the config file may set any of them
+func knownParams() map[string]bool {
+	timestamp := time.Now().Format("2006-01-02")
+	s := &settings{}
+	known := map[string]bool{}
+	for _, flags := range []*flag.FlagSet{
+		newRunFlags(&runOptions{}, s, timestamp),
+		newImportFlags(&importOptions{}, s, timestamp),
+		newEvaluateFlags(&evaluateOptions{}, s, timestamp),
+		newExportFlags(&exportOptions{}, s),
+		newReportFlags(&reportOptions{}, s),
+		newDBFlags(&dbOptions{}, s),
+		newOutboxFlags(&outboxOptions{}, s),
+		newHistoryFlags(&historyOptions{}, s),
+		newMatchFlags(&matchOptions{}, s),
+		newServeFlags(&serveOptions{}, s),
+	} {
+		flags.VisitAll(func(f *flag.Flag) { known[f.Name] = true })
+	}
+	// read by loadSettings before the config file is, the data directory is data_dir of the file
+	delete(known, "config")
+	delete(known, "profile")
+	delete(known, "data-dir")
+	return known
+}
+
+// datePlaceholder in a file name of the config file or the environment is replaced by the date of the files
+const datePlaceholder = "{date}"
+
+// settings are the config file, the profile and the data directory of a command with the parameters they set
+type settings struct {
+	// file is the config file, empty for none
+	file    string
+	profile string
+	// dir is the data directory, the directory of the default files and the relative names of the config file
+	dir    string
+	params map[string]string
+	// sources tells where a parameter is set: config, profile <name> or env FP_<NAME>
+	sources map[string]string
+}
+
+// loadSettings reads the config file of -config or FP_CONFIG, else fp.yaml of the working directory or next
+// to the executable, and resolves the profile of -profile or FP_PROFILE and the data directory of -data-dir,
+// FP_DATA_DIR or the config file. Without a data directory the files are next to the executable.
+func loadSettings(args []string) *settings {
+	s := &settings{params: map[string]string{}, sources: map[string]string{}}
+	fileName, explicit := lookupSetting(args, "config")
+	if !explicit {
+		fileName = findConfig()
+	}
+	var resolved *config.Settings
+	if fileName != "" {
+		f, err := config.Load(fileName)
+		if err == nil {
+			err = f.Check(knownParams())
+		}
+		if err != nil {
+			log.Fatalf("Loading config file failed: %s", err)
+		}
+		profile, _ := lookupSetting(args, "profile")
+		if resolved, err = f.Resolve(profile); err != nil {
+			log.Fatal(err)
+		}
+		s.file, s.profile, s.dir = fileName, resolved.Profile, resolved.DataDir
+		s.params, s.sources = resolved.Parameters, resolved.Sources
+	} else if profile, _ := lookupSetting(args, "profile"); profile != "" {
+		log.Fatalf("-profile %s needs a config file, none found", profile)
+	}
+	if dir, ok := lookupSetting(args, "data-dir"); ok {
+		s.dir = dir
+	}
+	if s.dir == "" {
+		s.dir = getCurrentPath()
+	}
+	if dir, err := filepath.Abs(s.dir); err == nil {
+		s.dir = dir
+	}
+	return s
+}
+
+// lookupSetting returns the value of -name on the command line, else of the environment variable FP_NAME
+func lookupSetting(args []string, name string) (string, bool) {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			break
+		}
+		if !strings.HasPrefix(arg, "-") {
+			continue
+		}
+		arg = strings.TrimPrefix(strings.TrimPrefix(arg, "-"), "-")
+		if arg == name && i+1 < len(args) {
+			return args[i+1], true
+		}
+		if strings.HasPrefix(arg, name+"=") {
+			return strings.TrimPrefix(arg, name+"="), true
+		}
+	}
+	return os.LookupEnv(envName(name))
+}
+
+// findConfig returns config.FileName of the working directory or next to the executable, empty if there is none
+func findConfig() string {
+	candidates := []string{config.FileName}
+	if ex, err := os.Executable(); err == nil {
+		candidates = append(candidates, filepath.Join(filepath.Dir(ex), config.FileName))
+	}
+	for _, name := range candidates {
+		if _, err := os.Stat(name); err == nil {
+			return name
+		}
+	}
+	return ""
+}
+
+// envName is the environment variable of a parameter, e.g. FP_COUNT_WARN of -count-warn
+func envName(param string) string {
+	return "FP_" + strings.ToUpper(strings.ReplaceAll(param, "-", "_"))
+}
+
+// register adds -config, -profile and -data-dir to flags, their values are read by loadSettings
+func (s *settings) register(flags *flag.FlagSet) {
+	flags.String("config", s.file, "YAML config file with the parameters and profiles (default fp.yaml of the working directory or next to the executable)")
+	flags.String("profile", s.profile, "profile of the config file to use (default profile of the config file)")
+	flags.String("data-dir", s.dir, "directory of the default files and of relative file names in the config file (default next to the executable)")
+}
+
+// apply sets the parameters of flags from the config file, its profile and the environment, in this order,
+// the command line parsed afterwards replaces them
+func (s *settings) apply(flags *flag.FlagSet) {
+	set := func(name string, value string, source string) {
+		if pathParams[name] && value != "" && !filepath.IsAbs(value) {
+			value = filepath.Join(s.dir, value)
+		}
+		if err := flags.Set(name, value); err != nil {
+			log.Fatalf("invalid %s of %s: %s", name, source, err)
+		}
+		s.sources[name] = source
+	}
+	flags.VisitAll(func(f *flag.Flag) {
+		switch f.Name {
+		case "config", "profile", "data-dir":
+			return
+		}
+		if value, ok := s.params[f.Name]; ok {
+			set(f.Name, value, s.sources[f.Name])
+		}
+		if value, ok := os.LookupEnv(envName(f.Name)); ok {
+			set(f.Name, value, "env "+envName(f.Name))
+		}
+	})
+}
+
+// expandDate replaces the date placeholder of file names with date, e.g. payments-{date}.csv
+func expandDate(date string, names ...*string) {
+	for _, name := range names {
+		*name = strings.ReplaceAll(*name, datePlaceholder, date)
+	}
+}
+
+// cmdConfig implements `fp config show`, the parameters of fp run with their value and where they are set
+func cmdConfig(args []string) {
+	s := loadSettings(args)
+	var o runOptions
+	flags := newRunFlags(&o, s, time.Now().Format("2006-01-02"))
+	s.apply(flags)
+	positional := parseArgs(flags, args)
+	if len(positional) > 0 && positional[0] != "show" {
+		log.Fatalf("unknown fp config command %q, use show", positional[0])
+	}
+
+	file := s.file
+	if file == "" {
+		file = "none"
+	}
+	fmt.Println("Config File                      :", file)
+	fmt.Println("Profile                          :", s.profile)
+	fmt.Println("Data Directory                   :", s.dir)
+	fmt.Println("***********************************************************")
+	flags.VisitAll(func(f *flag.Flag) {
+		switch f.Name {
+		case "config", "profile", "data-dir":
+			return
+		}
+		source := s.sources[f.Name]
+		switch {
+		case lookupArg(args, f.Name):
+			source = "command line"
+		case source == "":
+			source = "default"
+		}
+		fmt.Printf("%-16s %-48s %s\n", f.Name, f.Value.String(), source)
+	})
+}
+
+// lookupArg tells if -name is given on the command line
+func lookupArg(args []string, name string) bool {
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "-") {
+			continue
+		}
+		arg = strings.TrimPrefix(strings.TrimPrefix(arg, "-"), "-")
+		if arg == name || strings.HasPrefix(arg, name+"=") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,271 @@
+/********************************************************************************************************************
+ * name: accounts
+ * description: Elevate and CRM account snapshots, the current values with their versions and disappeared accounts
+ ********************************************************************************************************************/
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// sources of the account snapshots, the same as Import.Source
+const (
+	SnapshotAccounts = "accounts"
+	SnapshotCRM      = "crm"
+)
+
+// status of an account in a snapshot
+const (
+	AccountNew        = "new"
+	AccountChanged    = "changed"
+	AccountUnchanged  = "unchanged"
+	AccountReappeared = "reappeared"
+)
+
+// Snapshot is an import of an accounts file, taken as the complete list of accounts on Date
+type Snapshot struct {
+	Source   string
+	ImportID int64
+	// Date is the day the snapshot was taken, the valid_from and valid_to of the versions it changes
+	Date string
+	// Missing are the optional columns the file doesn't have, the stored values are kept
+	Missing []string
+}
+
+// AccountChange is the outcome of storing an account of a snapshot
+type AccountChange struct {
+	Status string
+	// Fields are the columns with a new value if the status is AccountChanged
+	Fields []string
+}
+
+// AccountVersion is one row of elevateAccountsHistory or crmAccountsHistory
+type AccountVersion struct {
+	Source string
+	Key    string
+	// Values are the columns of the account by name
+	Values    map[string]string
+	ValidFrom string
+	// ValidTo is empty for the current version
+	ValidTo  string
+	ImportID int64
+	Change   string
+}
+
+// accountTable describes the current-state table of a source and its history table
+type accountTable struct {
+	table   string
+	history string
+	key     string
+	// columns are compared between the snapshots, without the key
+	columns []string
+}
+
+var accountTables = map[string]accountTable{
+	SnapshotAccounts: {
+		table: "elevateAccounts", history: "elevateAccountsHistory", key: "elevate_mandate_reference",
+		columns: []string{"elevate_account_number", "elevate_customer_name"},
+	},
+	SnapshotCRM: {
+		table: "crmAccounts", history: "crmAccountsHistory", key: "crm_account_number",
+		columns: []string{"crm_id", "crm_name", "crm_email", "crm_premise_address", "crm_stage_name", "crm_zen_user_id"},
+	},
+}
+
+// UpsertElevateAccount stores an account of a snapshot: new accounts are inserted, changed values replace the
+// stored ones and start a new version
+func (s *SQLiteStore) UpsertElevateAccount(account ElevateAccount, snapshot Snapshot) (AccountChange, error) {
+	return s.upsertAccount(accountTables[SnapshotAccounts], account.MandateReference,
+		[]string{account.AccountNumber, account.CustomerName}, snapshot)
+}
+
+// UpsertCRMAccount stores an account of a CRM snapshot like UpsertElevateAccount
+func (s *SQLiteStore) UpsertCRMAccount(account CRMAccount, snapshot Snapshot) (AccountChange, error) {
+	return s.upsertAccount(accountTables[SnapshotCRM], account.AccountNumber,
+		[]string{account.ID, account.Name, account.Email, account.PremiseAddress, account.StageName, account.ZenUserID}, snapshot)
+}
+
+// upsertAccount stores the values of t.columns of an account
+func (s *SQLiteStore) upsertAccount(t accountTable, key string, values []string, snapshot Snapshot) (AccountChange, error) {
+	current := make([]string, len(t.columns))
+	targets := make([]interface{}, 0, len(t.columns)+2)
+	for i := range current {
+		targets = append(targets, text{&current[i]})
+	}
+	var disappearedAt string
+	var lastImportID int64
+	targets = append(targets, text{&disappearedAt}, number{&lastImportID})
+	err := s.conn().QueryRow(`
+		SELECT `+columnList("", t.columns)+`, disappeared_at, last_import_id
+		FROM `+t.table+`
+		WHERE `+t.key+` = ?`, key).Scan(targets...)
+	if err == sql.ErrNoRows {
+		_, err = s.conn().Exec(`
+			INSERT INTO `+t.table+`(`+t.key+`, `+columnList("", t.columns)+`, import_id, valid_from, last_import_id)
+			values(`+placeholders(len(t.columns)+4)+`)`,
+			append(append([]interface{}{key}, stringArgs(values)...), importID(snapshot.ImportID), snapshot.Date,
+				importID(snapshot.ImportID))...)
+		if isUniqueViolation(err) {
+			return AccountChange{}, ErrExists
+		}
+		if err != nil {
+			return AccountChange{}, err
+		}
+		return AccountChange{Status: AccountNew}, s.addAccountVersion(t, key, values, snapshot, AccountNew)
+	}
+	if err != nil {
+		return AccountChange{}, err
+	}
+	// the first row of an account wins if a file has it twice
+	if snapshot.ImportID != 0 && lastImportID == snapshot.ImportID {
+		return AccountChange{}, ErrExists
+	}
+
+	change := AccountChange{Status: AccountUnchanged}
+	for i, column := range t.columns {
+		if contains(snapshot.Missing, column) {
+			values[i] = current[i]
+		}
+		if values[i] != current[i] {
+			change.Status, change.Fields = AccountChanged, append(change.Fields, column)
+		}
+	}
+	if change.Status == AccountUnchanged && disappearedAt != "" {
+		change.Status = AccountReappeared
+	}
+	if change.Status == AccountUnchanged {
+		_, err = s.conn().Exec("UPDATE "+t.table+" SET last_import_id = ? WHERE "+t.key+" = ?", importID(snapshot.ImportID), key)
+		return change, err
+	}
+
+	assignments := make([]string, 0, len(t.columns))
+	for _, column := range t.columns {
+		assignments = append(assignments, column+" = ?")
+	}
+	_, err = s.conn().Exec(`
+		UPDATE `+t.table+`
+		SET `+strings.Join(assignments, ", ")+`, valid_from = ?, last_import_id = ?, disappeared_at = NULL
+		WHERE `+t.key+` = ?`,
+		append(stringArgs(values), snapshot.Date, importID(snapshot.ImportID), key)...)
+	if err != nil {
+		return change, err
+	}
+	if err = s.closeAccountVersion(t, key, snapshot.Date); err != nil {
+		return change, err
+	}
+	description := change.Status
+	if change.Status == AccountChanged {
+		description += ": " + strings.Join(change.Fields, ", ")
+	}
+	return change, s.addAccountVersion(t, key, values, snapshot, description)
+}
+
+// MarkDisappeared flags the accounts of the source of snapshot that it doesn't have and closes their current
+// version, it returns their keys
+func (s *SQLiteStore) MarkDisappeared(snapshot Snapshot) ([]string, error) {
+	t, ok := accountTables[snapshot.Source]
+	if !ok {
+		return nil, fmt.Errorf("unknown account snapshot source %q", snapshot.Source)
+	}
+	rows, err := s.conn().Query(`
+		SELECT `+t.key+`
+		FROM `+t.table+`
+		WHERE disappeared_at IS NULL
+		AND (last_import_id IS NULL OR last_import_id <> ?)
+		ORDER BY `+t.key, snapshot.ImportID)
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err = rows.Scan(text{&key}); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, key := range keys {
+		if _, err = s.conn().Exec("UPDATE "+t.table+" SET disappeared_at = ? WHERE "+t.key+" = ?", snapshot.Date, key); err != nil {
+			return nil, err
+		}
+		if err = s.closeAccountVersion(t, key, snapshot.Date); err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+// AccountHistory returns the versions of an Elevate account by mandate reference or account number and of a
+// CRM account by account number, in the order of their dates
+func (s *SQLiteStore) AccountHistory(key string) ([]AccountVersion, error) {
+	var versions []AccountVersion
+	for _, source := range []string{SnapshotAccounts, SnapshotCRM} {
+		t := accountTables[source]
+		condition, args := t.key+" = ?", []interface{}{key}
+		if source == SnapshotAccounts {
+			condition, args = condition+" OR elevate_account_number = ?", append(args, key)
+		}
+		rows, err := s.conn().Query(`
+			SELECT `+t.key+`, `+columnList("", t.columns)+`, valid_from, valid_to, import_id, change
+			FROM `+t.history+`
+			WHERE `+condition+`
+			ORDER BY history_id`, args...)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			v := AccountVersion{Source: source, Values: map[string]string{}}
+			values := make([]string, len(t.columns))
+			targets := []interface{}{text{&v.Key}}
+			for i := range values {
+				targets = append(targets, text{&values[i]})
+			}
+			targets = append(targets, text{&v.ValidFrom}, text{&v.ValidTo}, number{&v.ImportID}, text{&v.Change})
+			if err = rows.Scan(targets...); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			for i, column := range t.columns {
+				v.Values[column] = values[i]
+			}
+			versions = append(versions, v)
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return versions, nil
+}
+
+// addAccountVersion inserts the current version of an account
+func (s *SQLiteStore) addAccountVersion(t accountTable, key string, values []string, snapshot Snapshot, change string) error {
+	_, err := s.conn().Exec(`
+		INSERT INTO `+t.history+`(`+t.key+`, `+columnList("", t.columns)+`, valid_from, import_id, change)
+		values(`+placeholders(len(t.columns)+4)+`)`,
+		append(append([]interface{}{key}, stringArgs(values)...), snapshot.Date, importID(snapshot.ImportID), change)...)
+	return err
+}
+
+// closeAccountVersion ends the current version of an account on date
+func (s *SQLiteStore) closeAccountVersion(t accountTable, key string, date string) error {
+	_, err := s.conn().Exec("UPDATE "+t.history+" SET valid_to = ? WHERE "+t.key+" = ? AND valid_to IS NULL", date, key)
+	return err
+}
+
+// stringArgs converts values to query arguments
+func stringArgs(values []string) []interface{} {
+	args := make([]interface{}, len(values))
+	for i, value := range values {
+		args[i] = value
+	}
+	return args
+}
@@ -0,0 +1,292 @@
+/********************************************************************************************************************
+ * name: customers
+ * description: customer level view on the failed payments and the customersActions table
+ ********************************************************************************************************************/
+package store
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// StatusSeverity lists payments_status values from worst to best, unknown values rank after the listed ones
+var StatusSeverity = []string{
+	"charged_back", "failed", "customer_approval_denied", "cancelled", "pending_customer_approval",
+	"pending_submission", "submitted", "confirmed", "paid_out",
+}
+
+// statusRank returns the position of status in StatusSeverity, lower is worse
+func statusRank(status string) int {
+	for i, s := range StatusSeverity {
+		if s == status {
+			return i
+		}
+	}
+	return len(StatusSeverity)
+}
+
+// CustomerKey identifies the customer of a payment, its Elevate account number or else its customers_id
+func CustomerKey(payment PaymentSummary) string {
+	if payment.AccountNumber != "" {
+		return payment.AccountNumber
+	}
+	return payment.Event.CustomerID
+}
+
+// GroupByCustomer aggregates payment summaries per customer, ordered by customer key
+func GroupByCustomer(payments []PaymentSummary) []CustomerSummary {
+	byKey := map[string]*CustomerSummary{}
+	var keys []string
+	for _, p := range payments {
+		key := CustomerKey(p)
+		c, ok := byKey[key]
+		if !ok {
+			c = &CustomerSummary{Key: key, AccountNumber: p.AccountNumber, Worst: p}
+			byKey[key] = c
+			keys = append(keys, key)
+		}
+		c.CustomerIDs = appendUnique(c.CustomerIDs, p.Event.CustomerID)
+		c.PaymentIDs = appendUnique(c.PaymentIDs, p.Event.PaymentID)
+		c.Mandates = appendUnique(c.Mandates, p.Event.MandateID)
+		c.FailureCount += p.FailureCount
+		c.PaymentCount++
+		if p.FailureCount > c.Worst.FailureCount {
+			c.Worst = p
+		}
+		if c.WorstStatus == "" || statusRank(p.Event.PaymentStatus) < statusRank(c.WorstStatus) {
+			c.WorstStatus = p.Event.PaymentStatus
+		}
+		if p.LastFailureAt > c.LastFailureAt {
+			c.LastFailureAt = p.LastFailureAt
+		}
+		if c.CRMStageName == "" {
+			c.CRMStageName = p.CRMStageName
+		}
+	}
+
+	customers := make([]CustomerSummary, 0, len(keys))
+	sort.Strings(keys)
+	for _, key := range keys {
+		c := byKey[key]
+		c.Currency = c.Worst.Event.Currency
+		for _, p := range payments {
+			if CustomerKey(p) == key && p.Event.Currency == c.Currency {
+				c.OutstandingMinor += p.Event.AmountMinor
+			}
+		}
+		customers = append(customers, *c)
+	}
+	return customers
+}
+
+// appendUnique appends value unless it is empty or already in values
+func appendUnique(values []string, value string) []string {
+	if value == "" {
+		return values
+	}
+	for _, v := range values {
+		if v == value {
+			return values
+		}
+	}
+	return append(values, value)
+}
+
+// CustomerSummaries returns every customer with at least query.MinFailures failed events within the window
+func (s *SQLiteStore) CustomerSummaries(query SummaryQuery) ([]CustomerSummary, error) {
+	minFailures := query.MinFailures
+	query.MinFailures = 1
+	payments, err := s.PaymentSummaries(query)
+	if err != nil {
+		return nil, err
+	}
+	var customers []CustomerSummary
+	for _, c := range GroupByCustomer(payments) {
+		if c.FailureCount >= minFailures {
+			customers = append(customers, c)
+		}
+	}
+	return customers, nil
+}
+
+// addCustomerActions derives customersActions, a customer already in a bucket is only updated if its count increased
+func (s *SQLiteStore) addCustomerActions(actions []CustomerAction) ([]CustomerAction, error) {
+	var changed []CustomerAction
+	err := s.inTx(func(tx *sql.Tx) error {
+		stmt, err := tx.Prepare(`
+			INSERT INTO customersActions(
+				customer_key              ,
+				bucket                    ,
+				rule                      ,
+				timestamp                 ,
+				payment_requests_count    ,
+				failed_payments_count     ,
+				outstanding_amount_minor  ,
+				payments_currency         ,
+				worst_payments_status     ,
+				last_failure_at           ,
+				customers_ids             ,
+				payments_ids              ,
+				payments_links_mandates   ,
+				elevate_account_number    ,
+				customers_given_name      ,
+				customers_family_name     ,
+				customers_metadata_leadID
+			) values(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT(customer_key, bucket)
+			DO UPDATE SET
+				rule                              = excluded.rule,
+				timestamp                         = excluded.timestamp,
+				payment_requests_count            = excluded.payment_requests_count,
+				failed_payments_count             = excluded.failed_payments_count,
+				outstanding_amount_minor          = excluded.outstanding_amount_minor,
+				payments_currency                 = excluded.payments_currency,
+				worst_payments_status             = excluded.worst_payments_status,
+				last_failure_at                   = excluded.last_failure_at,
+				customers_ids                     = excluded.customers_ids,
+				payments_ids                      = excluded.payments_ids,
+				payments_links_mandates           = excluded.payments_links_mandates
+			WHERE excluded.payment_requests_count > customersActions.payment_requests_count`)
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+
+		for _, a := range actions {
+			result, err := stmt.Exec(a.CustomerKey, a.Bucket, a.Rule, a.Timestamp, a.Count, a.PaymentCount,
+				a.OutstandingMinor, a.Currency, a.WorstStatus, a.LastFailureAt, strings.Join(a.CustomerIDs, ","),
+				strings.Join(a.PaymentIDs, ","), strings.Join(a.Mandates, ","), a.AccountNumber, a.CustomerGivenName,
+				a.CustomerFamilyName, a.CustomerLeadID)
+			if err != nil {
+				return fmt.Errorf("insert into customersActions failed for customer %s: %w", a.CustomerKey, err)
+			}
+			if n, _ := result.RowsAffected(); n > 0 {
+				changed = append(changed, a)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return changed, nil
+}
+
+// CustomerActions returns all rows of customersActions, ordered by customer and bucket
+func (s *SQLiteStore) CustomerActions() ([]CustomerAction, error) {
+	rows, err := s.conn().Query(`
+		SELECT ` + columnList("", customerActionColumns) + `
+		FROM customersActions
+		ORDER BY customer_key, bucket`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var actions []CustomerAction
+	for rows.Next() {
+		var row customerActionRow
+		if err = rows.Scan(row.targets()...); err != nil {
+			return nil, err
+		}
+		actions = append(actions, row.action())
+	}
+	return actions, rows.Err()
+}
+
+// CustomerActionExports returns the customers put into a bucket on date according to the dunning history, as
+// recorded then, enriched with their Elevate and CRM accounts. Of several entries of a customer on date the one
+// with the highest count is taken.
+func (s *SQLiteStore) CustomerActionExports(bucket string, date string) ([]CustomerExportRow, error) {
+	rows, err := s.conn().Query(`
+		SELECT
+			dunning_actions.details,
+			MIN(elevateAccounts.elevate_mandate_reference),
+			MIN(elevateAccounts.elevate_customer_name),
+			crmAccounts.crm_account_number,
+			crmAccounts.crm_id,
+			crmAccounts.crm_name,
+			crmAccounts.crm_email,
+			crmAccounts.crm_premise_address,
+			crmAccounts.crm_stage_name,
+			crmAccounts.crm_zen_user_id
+		FROM dunning_actions
+		LEFT JOIN elevateAccounts
+		ON elevateAccounts.elevate_account_number = json_extract(dunning_actions.details, '$.AccountNumber')
+		LEFT JOIN crmAccounts
+		ON crmAccounts.crm_account_number = json_extract(dunning_actions.details, '$.AccountNumber')
+		WHERE dunning_actions.action_id = (SELECT highest.action_id FROM dunning_actions AS highest
+			WHERE highest.level = dunning_actions.level AND highest.customer_key = dunning_actions.customer_key
+			AND highest.date = dunning_actions.date AND highest.action = dunning_actions.action
+			ORDER BY highest.payment_requests_count DESC, highest.action_id DESC LIMIT 1)
+		AND dunning_actions.level = ? AND dunning_actions.date = ? AND dunning_actions.action = ?
+		GROUP BY dunning_actions.customer_key
+		ORDER BY dunning_actions.customer_key`, HistoryCustomer, date, bucket)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []CustomerExportRow
+	for rows.Next() {
+		var row CustomerExportRow
+		var details string
+		err = rows.Scan(text{&details}, text{&row.Account.MandateReference}, text{&row.Account.CustomerName},
+			text{&row.CRM.AccountNumber}, text{&row.CRM.ID}, text{&row.CRM.Name}, text{&row.CRM.Email},
+			text{&row.CRM.PremiseAddress}, text{&row.CRM.StageName}, text{&row.CRM.ZenUserID})
+		if err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal([]byte(details), &row.Action); err != nil {
+			return nil, fmt.Errorf("dunning history of customer on %s: %w", date, err)
+		}
+		row.Account.AccountNumber = row.Action.AccountNumber
+		result = append(result, row)
+	}
+	return result, rows.Err()
+}
+
+// customerActionColumns are the columns of customersActions in the order of customerActionRow.targets
+var customerActionColumns = []string{
+	"customer_key", "bucket", "rule", "timestamp", "payment_requests_count", "failed_payments_count",
+	"outstanding_amount_minor", "payments_currency", "worst_payments_status", "last_failure_at", "customers_ids",
+	"payments_ids", "payments_links_mandates", "elevate_account_number", "customers_given_name",
+	"customers_family_name", "customers_metadata_leadID",
+}
+
+// customerActionRow scans a row of customersActions
+type customerActionRow struct {
+	CustomerAction
+	count, payments, outstanding      int64
+	customerIDs, paymentIDs, mandates string
+}
+
+// targets returns the scan destinations in the order of customerActionColumns
+func (r *customerActionRow) targets() []interface{} {
+	a := &r.CustomerAction
+	return []interface{}{
+		text{&a.CustomerKey}, text{&a.Bucket}, text{&a.Rule}, text{&a.Timestamp}, number{&r.count},
+		number{&r.payments}, number{&r.outstanding}, text{&a.Currency}, text{&a.WorstStatus}, text{&a.LastFailureAt},
+		text{&r.customerIDs}, text{&r.paymentIDs}, text{&r.mandates}, text{&a.AccountNumber},
+		text{&a.CustomerGivenName}, text{&a.CustomerFamilyName}, text{&a.CustomerLeadID},
+	}
+}
+
+// action returns the scanned record
+func (r *customerActionRow) action() CustomerAction {
+	a := r.CustomerAction
+	a.Count, a.PaymentCount, a.OutstandingMinor = int(r.count), int(r.payments), r.outstanding
+	a.CustomerIDs, a.PaymentIDs, a.Mandates = splitList(r.customerIDs), splitList(r.paymentIDs), splitList(r.mandates)
+	return a
+}
+
+// splitList reverses strings.Join(values, ",")
+func splitList(value string) []string {
+	if value == "" {
+		return nil
+	}
+	return strings.Split(value, ",")
+}
@@ -0,0 +1,219 @@
+/********************************************************************************************************************
+ * name: dashboard
+ * description: read-only queries of the web dashboard, customer search, payment timelines and daily trends
+ ********************************************************************************************************************/
+package store
+
+import (
+	"sort"
+	"strings"
+)
+
+// CustomerHit is a customer found by SearchCustomers with its Elevate and CRM account
+type CustomerHit struct {
+	CustomerID    string
+	GivenName     string
+	FamilyName    string
+	LeadID        string
+	Mandates      string
+	AccountNumber string
+	CRMName       string
+	PaymentCount  int
+	FailureCount  int
+	LastFailureAt string
+}
+
+// TrendDay are the failed payment requests, recovered payments and dunning actions of one day
+type TrendDay struct {
+	Date     string
+	Failures int
+	// Payments are the different payments with failed requests on the day
+	Payments  int
+	Recovered int
+	// Actions counts the payments put into each bucket on the day
+	Actions map[string]int
+}
+
+// SearchCustomers returns up to limit customers whose customers_id, lead id, name, mandate, Elevate account
+// number or CRM name contains term, case insensitive
+func (s *SQLiteStore) SearchCustomers(term string, limit int) ([]CustomerHit, error) {
+	pattern := "%" + strings.ToLower(strings.TrimSpace(term)) + "%"
+	rows, err := s.conn().Query(`
+		SELECT failedPaymentRequests.customers_id,
+			MAX(failedPaymentRequests.customers_given_name),
+			MAX(failedPaymentRequests.customers_family_name),
+			MAX(failedPaymentRequests.customers_metadata_leadID),
+			group_concat(DISTINCT failedPaymentRequests.payments_links_mandate),
+			group_concat(DISTINCT elevateAccounts.elevate_account_number),
+			group_concat(DISTINCT crmAccounts.crm_name),
+			COUNT(DISTINCT failedPaymentRequests.payments_id),
+			SUM(CASE WHEN failedPaymentRequests.action = 'failed' THEN 1 ELSE 0 END),
+			MAX(CASE WHEN failedPaymentRequests.action = 'failed' THEN failedPaymentRequests.created_at END)
+		FROM failedPaymentRequests
+		LEFT JOIN elevateAccounts
+		ON elevateAccounts.elevate_mandate_reference = `+accountMandate+`
+		LEFT JOIN crmAccounts
+		ON elevateAccounts.elevate_account_number = crmAccounts.crm_account_number
+		GROUP BY failedPaymentRequests.customers_id
+		HAVING lower(failedPaymentRequests.customers_id) LIKE ?
+		OR lower(ifnull(MAX(failedPaymentRequests.customers_given_name), '') || ' ' ||
+			ifnull(MAX(failedPaymentRequests.customers_family_name), '')) LIKE ?
+		OR lower(ifnull(MAX(failedPaymentRequests.customers_family_name), '') || ' ' ||
+			ifnull(MAX(failedPaymentRequests.customers_given_name), '')) LIKE ?
+		OR lower(ifnull(group_concat(DISTINCT failedPaymentRequests.customers_metadata_leadID), '')) LIKE ?
+		OR lower(ifnull(group_concat(DISTINCT failedPaymentRequests.payments_links_mandate), '')) LIKE ?
+		OR lower(ifnull(group_concat(DISTINCT elevateAccounts.elevate_account_number), '')) LIKE ?
+		OR lower(ifnull(group_concat(DISTINCT crmAccounts.crm_name), '')) LIKE ?
+		ORDER BY MAX(failedPaymentRequests.customers_family_name), MAX(failedPaymentRequests.customers_given_name),
+			failedPaymentRequests.customers_id
+		LIMIT ?`, pattern, pattern, pattern, pattern, pattern, pattern, pattern, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var hits []CustomerHit
+	for rows.Next() {
+		var h CustomerHit
+		err = rows.Scan(text{&h.CustomerID}, text{&h.GivenName}, text{&h.FamilyName}, text{&h.LeadID}, text{&h.Mandates},
+			text{&h.AccountNumber}, text{&h.CRMName}, integer{&h.PaymentCount}, integer{&h.FailureCount},
+			text{&h.LastFailureAt})
+		if err != nil {
+			return nil, err
+		}
+		hits = append(hits, h)
+	}
+	return hits, rows.Err()
+}
+
+// CustomerPayments returns the payments of a customers_id with their latest event, failed requests and accounts,
+// the most recent failure first
+func (s *SQLiteStore) CustomerPayments(customerID string) ([]PaymentSummary, error) {
+	rows, err := s.conn().Query(`
+		SELECT `+columnList("failedPaymentRequests", eventColumns)+`,
+			(SELECT COUNT(*) FROM failedPaymentRequests AS failed
+				WHERE failed.payments_id = failedPaymentRequests.payments_id AND failed.action = 'failed'),
+			(SELECT MAX(failed.created_at) FROM failedPaymentRequests AS failed
+				WHERE failed.payments_id = failedPaymentRequests.payments_id AND failed.action = 'failed') AS last_failure_at,
+			elevateAccounts.elevate_account_number,
+			crmAccounts.crm_stage_name
+		FROM failedPaymentRequests
+		LEFT JOIN elevateAccounts
+		ON elevateAccounts.elevate_mandate_reference = `+accountMandate+`
+		LEFT JOIN crmAccounts
+		ON elevateAccounts.elevate_account_number = crmAccounts.crm_account_number
+		WHERE failedPaymentRequests.customers_id = ?
+		AND failedPaymentRequests.id = (SELECT latest.id FROM failedPaymentRequests AS latest
+			WHERE latest.payments_id = failedPaymentRequests.payments_id
+			ORDER BY latest.created_at DESC, latest.id DESC LIMIT 1)
+		ORDER BY last_failure_at DESC, failedPaymentRequests.payments_id`, customerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var payments []PaymentSummary
+	for rows.Next() {
+		var p PaymentSummary
+		targets := append(p.Event.targets(), integer{&p.FailureCount}, text{&p.LastFailureAt}, text{&p.AccountNumber},
+			text{&p.CRMStageName})
+		if err = rows.Scan(targets...); err != nil {
+			return nil, err
+		}
+		payments = append(payments, p)
+	}
+	return payments, rows.Err()
+}
+
+// PaymentEvents returns all events of a payment in the order they were created, its failure timeline
+func (s *SQLiteStore) PaymentEvents(paymentID string) ([]FailedPaymentEvent, error) {
+	rows, err := s.conn().Query(`
+		SELECT `+columnList("", eventColumns)+`
+		FROM failedPaymentRequests
+		WHERE payments_id = ?
+		ORDER BY created_at, id`, paymentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []FailedPaymentEvent
+	for rows.Next() {
+		var e FailedPaymentEvent
+		if err = rows.Scan(e.targets()...); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// Trend returns the failed requests, recovered payments and payment level dunning actions per day from since on,
+// days without any of them are left out
+func (s *SQLiteStore) Trend(since string) ([]TrendDay, error) {
+	days := map[string]*TrendDay{}
+	var order []string
+	day := func(date string) *TrendDay {
+		if days[date] == nil {
+			days[date] = &TrendDay{Date: date, Actions: map[string]int{}}
+			order = append(order, date)
+		}
+		return days[date]
+	}
+
+	rows, err := s.conn().Query(`
+		SELECT substr(created_at, 1, 10),
+			SUM(CASE WHEN action = 'failed' THEN 1 ELSE 0 END),
+			COUNT(DISTINCT CASE WHEN action = 'failed' THEN payments_id END),
+			COUNT(DISTINCT CASE WHEN action IN ('confirmed', 'paid_out') THEN payments_id END)
+		FROM failedPaymentRequests
+		WHERE substr(created_at, 1, 10) >= ?
+		GROUP BY substr(created_at, 1, 10)`, since)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var date string
+		var failures, payments, recovered int
+		if err = rows.Scan(text{&date}, integer{&failures}, integer{&payments}, integer{&recovered}); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		d := day(date)
+		d.Failures, d.Payments, d.Recovered = failures, payments, recovered
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = s.conn().Query(`
+		SELECT date, action, COUNT(DISTINCT payments_id)
+		FROM dunning_actions
+		WHERE level = ? AND date >= ?
+		GROUP BY date, action`, HistoryPayment, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var date, action string
+		var count int
+		if err = rows.Scan(text{&date}, text{&action}, integer{&count}); err != nil {
+			return nil, err
+		}
+		day(date).Actions[action] += count
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	trend := make([]TrendDay, 0, len(order))
+	for _, date := range order {
+		trend = append(trend, *days[date])
+	}
+	sort.Slice(trend, func(i, j int) bool {
+		return trend[i].Date < trend[j].Date
+	})
+	return trend, nil
+}
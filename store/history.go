@@ -0,0 +1,284 @@
+/********************************************************************************************************************
+ * name: history
+ * description: dunning_actions, the append-only history the current-state action tables are derived from
+ ********************************************************************************************************************/
+package store
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// levels of the dunning history
+const (
+	HistoryPayment  = "payment"
+	HistoryCustomer = "customer"
+)
+
+// actions of the history which aren't buckets: rows of paymentsWarnings and paymentsSuspended of databases older
+// than the history
+const (
+	HistoryWarning    = "warning"
+	HistorySuspension = "suspension"
+)
+
+// historyColumns are the columns of dunning_actions in the order of DunningAction.targets
+var historyColumns = []string{
+	"action_id", "level", "payments_id", "customer_key", "customers_id", "action", "rule", "reason",
+	"payment_requests_count", "date", "timestamp", "operator", "details",
+}
+
+// RecordActions appends the actions that are new for their payment and bucket or have a higher count to the
+// dunning history and derives the current-state tables from them
+func (s *SQLiteStore) RecordActions(actions []PaymentAction, buckets StateBuckets, operator string) ([]PaymentAction, error) {
+	var recorded []PaymentAction
+	err := s.inTx(func(tx *sql.Tx) error {
+		var entries []DunningAction
+		for _, a := range actions {
+			var current int64
+			err := tx.QueryRow(`
+				SELECT payment_requests_count FROM paymentsActions
+				WHERE payments_id = ? AND bucket = ?`, a.PaymentID, a.Bucket).Scan(number{&current})
+			if err != nil && err != sql.ErrNoRows {
+				return err
+			}
+			if err == nil && int64(a.Count) <= current {
+				continue
+			}
+			entry, err := historyEntry(HistoryPayment, a.PaymentID, a.CustomerID, a.CustomerID, a.Bucket, a.Rule, a.Count, a.Timestamp, operator, a)
+			if err != nil {
+				return err
+			}
+			entries = append(entries, entry)
+			recorded = append(recorded, a)
+		}
+		if err := appendHistory(tx, entries); err != nil {
+			return err
+		}
+		return (&SQLiteStore{db: s.db, tx: tx}).project(entries, buckets)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return recorded, nil
+}
+
+// RecordCustomerActions appends the customer actions that are new for their customer and bucket or have a higher
+// count to the dunning history and derives customersActions from them
+func (s *SQLiteStore) RecordCustomerActions(actions []CustomerAction, operator string) ([]CustomerAction, error) {
+	var recorded []CustomerAction
+	err := s.inTx(func(tx *sql.Tx) error {
+		var entries []DunningAction
+		for _, a := range actions {
+			var current int64
+			err := tx.QueryRow(`
+				SELECT payment_requests_count FROM customersActions
+				WHERE customer_key = ? AND bucket = ?`, a.CustomerKey, a.Bucket).Scan(number{&current})
+			if err != nil && err != sql.ErrNoRows {
+				return err
+			}
+			if err == nil && int64(a.Count) <= current {
+				continue
+			}
+			entry, err := historyEntry(HistoryCustomer, strings.Join(a.PaymentIDs, ","), a.CustomerKey,
+				strings.Join(a.CustomerIDs, ","), a.Bucket, a.Rule, a.Count, a.Timestamp, operator, a)
+			if err != nil {
+				return err
+			}
+			entries = append(entries, entry)
+			recorded = append(recorded, a)
+		}
+		if err := appendHistory(tx, entries); err != nil {
+			return err
+		}
+		return (&SQLiteStore{db: s.db, tx: tx}).project(entries, StateBuckets{})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return recorded, nil
+}
+
+// AppendHistory adds changes of the payment state, a payment recovered or written off is removed from the
+// current-state tables
+func (s *SQLiteStore) AppendHistory(entries []DunningAction) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		if err := appendHistory(tx, entries); err != nil {
+			return err
+		}
+		return (&SQLiteStore{db: s.db, tx: tx}).project(entries, StateBuckets{})
+	})
+}
+
+// History returns the entries of a payments_id, customers_id, customer key or Elevate account number,
+// in the order they were recorded
+func (s *SQLiteStore) History(key string) ([]DunningAction, error) {
+	rows, err := s.conn().Query(`
+		SELECT `+columnList("", historyColumns)+`
+		FROM dunning_actions
+		WHERE customer_key = ?
+		OR instr(',' || payments_id || ',', ',' || ? || ',') > 0
+		OR instr(',' || customers_id || ',', ',' || ? || ',') > 0
+		OR payments_id IN (SELECT payments_id FROM failedPaymentRequests WHERE customers_id = ?)
+		OR payments_id IN (
+			SELECT failedPaymentRequests.payments_id
+			FROM failedPaymentRequests
+			INNER JOIN elevateAccounts
+			ON elevateAccounts.elevate_mandate_reference = `+accountMandate+`
+			WHERE elevateAccounts.elevate_account_number = ?)
+		ORDER BY action_id`, key, key, key, key, key)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []DunningAction
+	for rows.Next() {
+		var entry DunningAction
+		if err = rows.Scan(entry.targets()...); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// RebuildCurrentState empties paymentsActions, paymentsWarnings, paymentsSuspended and customersActions and
+// derives them again from the complete dunning history
+func (s *SQLiteStore) RebuildCurrentState(buckets StateBuckets) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		for _, table := range []string{"paymentsActions", "paymentsWarnings", "paymentsSuspended", "customersActions"} {
+			if _, err := tx.Exec("DELETE FROM " + table); err != nil {
+				return err
+			}
+		}
+		rows, err := tx.Query(`
+			SELECT ` + columnList("", historyColumns) + `
+			FROM dunning_actions
+			ORDER BY action_id`)
+		if err != nil {
+			return err
+		}
+		var entries []DunningAction
+		for rows.Next() {
+			var entry DunningAction
+			if err = rows.Scan(entry.targets()...); err != nil {
+				rows.Close()
+				return err
+			}
+			entries = append(entries, entry)
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return err
+		}
+		return (&SQLiteStore{db: s.db, tx: tx}).project(entries, buckets)
+	})
+}
+
+// project derives the current-state tables from history entries in their order: a bucket of a payment goes to
+// paymentsActions and, if it is one of buckets, to paymentsWarnings or paymentsSuspended, a bucket of a customer to
+// customersActions. A payment recovered or written off is removed from the payment tables, other state changes
+// aren't projected.
+func (s *SQLiteStore) project(entries []DunningAction, buckets StateBuckets) error {
+	for _, entry := range entries {
+		var err error
+		switch {
+		case entry.Level == HistoryCustomer:
+			var a CustomerAction
+			if err = json.Unmarshal([]byte(entry.Details), &a); err == nil {
+				_, err = s.addCustomerActions([]CustomerAction{a})
+			}
+		case entry.Action == HistoryWarning:
+			var w Warning
+			if err = json.Unmarshal([]byte(entry.Details), &w); err == nil {
+				_, err = s.addWarnings([]Warning{w})
+			}
+		case entry.Action == HistorySuspension:
+			var su Suspension
+			if err = json.Unmarshal([]byte(entry.Details), &su); err == nil {
+				_, err = s.addSuspensions([]Suspension{su})
+			}
+		case entry.Action == StateRecovered || entry.Action == StateWrittenOff:
+			err = s.startOver(entry.PaymentID)
+		case entry.Action == StateActive || entry.Action == StateWarned || entry.Action == StateSuspended:
+		default:
+			var a PaymentAction
+			if err = json.Unmarshal([]byte(entry.Details), &a); err != nil {
+				break
+			}
+			if _, err = s.addActions([]PaymentAction{a}); err != nil {
+				break
+			}
+			w := Warning{PaymentID: a.PaymentID, Timestamp: a.Timestamp, Count: a.Count, CustomerID: a.CustomerID,
+				CustomerGivenName: a.CustomerGivenName, CustomerFamilyName: a.CustomerFamilyName, CustomerLeadID: a.CustomerLeadID}
+			switch {
+			case contains(buckets.Warn, a.Bucket):
+				_, err = s.addWarnings([]Warning{w})
+			case contains(buckets.Suspend, a.Bucket):
+				_, err = s.addSuspensions([]Suspension{Suspension(w)})
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("dunning history %d: %w", entry.ID, err)
+		}
+	}
+	return nil
+}
+
+// startOver removes a payment that recovered or was written off from paymentsActions, paymentsWarnings and
+// paymentsSuspended, its next actions are compared with the failures after the recovery only
+func (s *SQLiteStore) startOver(paymentID string) error {
+	for _, table := range []string{"paymentsActions", "paymentsWarnings", "paymentsSuspended"} {
+		if _, err := s.conn().Exec("DELETE FROM "+table+" WHERE payments_id = ?", paymentID); err != nil {
+			return fmt.Errorf("delete from %s failed for payments_id %s: %w", table, paymentID, err)
+		}
+	}
+	return nil
+}
+
+// historyEntry creates an entry with details as json, recorded now
+func historyEntry(level, paymentIDs, customerKey, customerIDs, action, rule string, count int, date string, operator string, details interface{}) (DunningAction, error) {
+	content, err := json.Marshal(details)
+	if err != nil {
+		return DunningAction{}, err
+	}
+	return DunningAction{Level: level, PaymentID: paymentIDs, CustomerKey: customerKey, CustomerID: customerIDs,
+		Action: action, Rule: rule, Count: count, Date: date, Timestamp: time.Now().UTC().Format(ISOTimestamp),
+		Operator: operator, Details: string(content)}, nil
+}
+
+// appendHistory inserts entries into dunning_actions
+func appendHistory(tx *sql.Tx, entries []DunningAction) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	stmt, err := tx.Prepare(`
+		INSERT INTO dunning_actions(` + columnList("", historyColumns[1:]) + `)
+		values(` + placeholders(len(historyColumns)-1) + `)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, e := range entries {
+		_, err = stmt.Exec(e.Level, e.PaymentID, e.CustomerKey, e.CustomerID, e.Action, e.Rule, e.Reason, e.Count,
+			e.Date, e.Timestamp, e.Operator, e.Details)
+		if err != nil {
+			return fmt.Errorf("insert into dunning_actions failed for %s %s: %w", e.Action, e.PaymentID, err)
+		}
+	}
+	return nil
+}
+
+// targets returns the scan destinations in the order of historyColumns
+func (e *DunningAction) targets() []interface{} {
+	return []interface{}{
+		number{&e.ID}, text{&e.Level}, text{&e.PaymentID}, text{&e.CustomerKey}, text{&e.CustomerID},
+		text{&e.Action}, text{&e.Rule}, text{&e.Reason}, integer{&e.Count}, text{&e.Date}, text{&e.Timestamp},
+		text{&e.Operator}, text{&e.Details},
+	}
+}
@@ -0,0 +1,72 @@
+package store
+
+import (
+	"fmt"
+	"testing"
+)
+
+// TestExportsOfPastDay covers exporting a day again after the payment failed once more and its count rose
+func TestExportsOfPastDay(t *testing.T) {
+	s := testStore(t)
+	buckets := StateBuckets{Warn: []string{"warn"}, Suspend: []string{"suspend-small"}}
+	for day := 1; day <= 3; day++ {
+		date := fmt.Sprintf("2020-01-0%d", day)
+		insertEvent(t, s, fmt.Sprintf("EV%d", day), date+"T10:00:00.000Z", "failed")
+		bucket := "warn"
+		if day == 3 {
+			bucket = "suspend-small"
+		}
+		_, err := s.RecordActions([]PaymentAction{{PaymentID: "PM1", Bucket: bucket, Rule: bucket, Timestamp: date,
+			Count: day, CustomerID: "CU1"}}, buckets, "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = s.RecordCustomerActions([]CustomerAction{{CustomerKey: "id:CU1", Bucket: bucket, Rule: bucket,
+			Timestamp: date, Count: day, PaymentCount: 1, PaymentIDs: []string{"PM1"}, CustomerIDs: []string{"CU1"}}}, "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		bucket  string
+		date    string
+		eventID string
+		count   int
+	}{
+		{"warn", "2020-01-01", "EV1", 1},
+		{"warn", "2020-01-02", "EV2", 2},
+		{"warn", "2020-01-03", "", 0},
+		{"suspend-small", "2020-01-02", "", 0},
+		{"suspend-small", "2020-01-03", "EV3", 3},
+	}
+	for _, test := range tests {
+		payments, err := s.ActionExports(test.bucket, test.date)
+		if err != nil {
+			t.Fatal(err)
+		}
+		customers, err := s.CustomerActionExports(test.bucket, test.date)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.eventID == "" {
+			if len(payments) != 0 || len(customers) != 0 {
+				t.Errorf("%s on %s = %+v, %+v, want none", test.bucket, test.date, payments, customers)
+			}
+			continue
+		}
+		if len(payments) != 1 || payments[0].Event.ID != test.eventID || payments[0].Count != test.count {
+			t.Errorf("payments in %s on %s = %+v, want %s with count %d", test.bucket, test.date, payments, test.eventID, test.count)
+		}
+		if len(customers) != 1 || customers[0].Action.CustomerKey != "id:CU1" || customers[0].Action.Count != test.count {
+			t.Errorf("customers in %s on %s = %+v, want id:CU1 with count %d", test.bucket, test.date, customers, test.count)
+		}
+	}
+
+	if got := stateOf(t, s, buckets, "2020-01-02"); got != StateWarned {
+		t.Errorf("state as of 2020-01-02 = %s, want %s, the suspension is recorded later", got, StateWarned)
+	}
+	if got := stateOf(t, s, buckets, "2020-01-03"); got != StateSuspended {
+		t.Errorf("state as of 2020-01-03 = %s, want %s", got, StateSuspended)
+	}
+}
@@ -0,0 +1,100 @@
+/********************************************************************************************************************
+ * name: imports
+ * description: the imports ledger, which file was imported when and with which outcome
+ ********************************************************************************************************************/
+package store
+
+// status of an import in the ledger
+const (
+	ImportRunning    = "running"
+	ImportCommitted  = "committed"
+	ImportRolledBack = "rolled back"
+	ImportDuplicate  = "duplicate"
+)
+
+// importColumns are the columns of imports in the order of Import.targets
+var importColumns = []string{
+	"import_id", "source", "file_name", "sha256", "status", "inserted", "updated", "skipped", "rejected",
+	"started_at", "finished_at", "tool_version",
+}
+
+// StartImport adds a file to the imports ledger and returns its import id
+func (s *SQLiteStore) StartImport(imp Import) (int64, error) {
+	result, err := s.conn().Exec(`
+		INSERT INTO imports(
+			source,
+			file_name,
+			sha256,
+			status,
+			started_at,
+			tool_version
+		) values(?, ?, ?, ?, ?, ?)`,
+		imp.Source, imp.FileName, imp.SHA256, imp.Status, imp.StartedAt, imp.ToolVersion)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// FinishImport stores status, counts and end time of an import
+func (s *SQLiteStore) FinishImport(imp Import) error {
+	_, err := s.conn().Exec(`
+		UPDATE imports SET
+			status      = ?,
+			inserted    = ?,
+			updated     = ?,
+			skipped     = ?,
+			rejected    = ?,
+			finished_at = ?
+		WHERE import_id = ?`,
+		imp.Status, imp.Inserted, imp.Updated, imp.Skipped, imp.Rejected, imp.FinishedAt, imp.ID)
+	return err
+}
+
+// Imports lists the ledger in the order of import, only the imports of files with the content sha256 if not empty
+func (s *SQLiteStore) Imports(sha256 string) ([]Import, error) {
+	condition, args := "1 = 1", []interface{}{}
+	if sha256 != "" {
+		condition, args = "sha256 = ?", append(args, sha256)
+	}
+	rows, err := s.conn().Query(`
+		SELECT `+columnList("", importColumns)+`
+		FROM imports
+		WHERE `+condition+`
+		ORDER BY import_id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var imports []Import
+	for rows.Next() {
+		var imp Import
+		if err = rows.Scan(imp.targets()...); err != nil {
+			return nil, err
+		}
+		imports = append(imports, imp)
+	}
+	return imports, rows.Err()
+}
+
+// targets returns the scan destinations in the order of importColumns
+func (imp *Import) targets() []interface{} {
+	return []interface{}{
+		number{&imp.ID}, text{&imp.Source}, text{&imp.FileName}, text{&imp.SHA256}, text{&imp.Status},
+		integer{&imp.Inserted}, integer{&imp.Updated}, integer{&imp.Skipped}, integer{&imp.Rejected}, text{&imp.StartedAt},
+		text{&imp.FinishedAt}, text{&imp.ToolVersion},
+	}
+}
+
+// EventImport returns the import that introduced an event of failedPaymentRequests, sql.ErrNoRows if unknown
+func (s *SQLiteStore) EventImport(eventID string) (Import, error) {
+	var imp Import
+	err := s.conn().QueryRow(`
+		SELECT `+columnList("imports", importColumns)+`
+		FROM failedPaymentRequests
+		INNER JOIN imports
+		ON imports.import_id = failedPaymentRequests.import_id
+		WHERE failedPaymentRequests.id = ?`, eventID).Scan(imp.targets()...)
+	return imp, err
+}
@@ -0,0 +1,246 @@
+/********************************************************************************************************************
+ * name: matches
+ * description: mandateMatches, the review queue of the accounts matched to mandates without Elevate account
+ ********************************************************************************************************************/
+package store
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// status of a match in the review queue
+const (
+	MatchCandidate = "candidate"
+	MatchConfirmed = "confirmed"
+	MatchRejected  = "rejected"
+)
+
+// accountMandate is the Elevate mandate reference of a row of failedPaymentRequests: its own mandate if that has
+// an Elevate account, else the account of a confirmed match
+const accountMandate = `COALESCE(
+			(SELECT direct.elevate_mandate_reference FROM elevateAccounts AS direct
+				WHERE direct.elevate_mandate_reference = failedPaymentRequests.payments_links_mandate),
+			(SELECT confirmed.elevate_mandate_reference FROM mandateMatches AS confirmed
+				WHERE confirmed.payments_links_mandate = failedPaymentRequests.payments_links_mandate
+				AND confirmed.status = '` + MatchConfirmed + `'))`
+
+// matchColumns are the columns of mandateMatches in the order of MandateMatch.targets
+var matchColumns = []string{
+	"match_id", "payments_links_mandate", "elevate_mandate_reference", "elevate_account_number", "methods",
+	"confidence", "status", "created_at", "reviewed_at", "operator",
+}
+
+// MandateMatch is one row of mandateMatches, an Elevate account which may belong to the payments of a mandate
+type MandateMatch struct {
+	ID int64
+	// Mandate is the payments_links_mandate without Elevate account
+	Mandate string
+	// MandateReference and AccountNumber are the Elevate account of the match
+	MandateReference string
+	AccountNumber    string
+	// Methods are the comma separated attributes that matched, e.g. lead_id,name
+	Methods string
+	// Confidence of the match from 0 to 1
+	Confidence float64
+	Status     string
+	CreatedAt  string
+	ReviewedAt string
+	Operator   string
+}
+
+// UnmatchedMandate are the payments of a mandate without Elevate account and without confirmed match,
+// the attributes to match are the latest non-empty ones of its events
+type UnmatchedMandate struct {
+	Mandate      string
+	CustomerID   string
+	GivenName    string
+	FamilyName   string
+	LeadID       string
+	Identity     string
+	Email        string
+	PaymentCount int
+}
+
+// MatchAccount is an Elevate account with its CRM account, a candidate of the unmatched mandates
+type MatchAccount struct {
+	Account ElevateAccount
+	CRM     CRMAccount
+}
+
+// UnmatchedMandates returns the mandates of failed payments without Elevate account and without confirmed match
+func (s *SQLiteStore) UnmatchedMandates() ([]UnmatchedMandate, error) {
+	rows, err := s.conn().Query(`
+		SELECT failedPaymentRequests.payments_links_mandate,
+			MAX(failedPaymentRequests.customers_id),
+			MAX(failedPaymentRequests.customers_given_name),
+			MAX(failedPaymentRequests.customers_family_name),
+			MAX(failedPaymentRequests.customers_metadata_leadID),
+			MAX(failedPaymentRequests.payments_metadata_identity),
+			MAX(failedPaymentRequests.customers_email),
+			COUNT(DISTINCT failedPaymentRequests.payments_id)
+		FROM failedPaymentRequests
+		WHERE ifnull(failedPaymentRequests.payments_links_mandate, '') <> ''
+		AND ` + accountMandate + ` IS NULL
+		GROUP BY failedPaymentRequests.payments_links_mandate
+		ORDER BY failedPaymentRequests.payments_links_mandate`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var mandates []UnmatchedMandate
+	for rows.Next() {
+		var m UnmatchedMandate
+		err = rows.Scan(text{&m.Mandate}, text{&m.CustomerID}, text{&m.GivenName}, text{&m.FamilyName},
+			text{&m.LeadID}, text{&m.Identity}, text{&m.Email}, integer{&m.PaymentCount})
+		if err != nil {
+			return nil, err
+		}
+		mandates = append(mandates, m)
+	}
+	return mandates, rows.Err()
+}
+
+// MatchAccounts returns the Elevate accounts which didn't disappear with their CRM account
+func (s *SQLiteStore) MatchAccounts() ([]MatchAccount, error) {
+	rows, err := s.conn().Query(`
+		SELECT elevateAccounts.elevate_mandate_reference,
+			elevateAccounts.elevate_account_number,
+			elevateAccounts.elevate_customer_name,
+			crmAccounts.crm_account_number,
+			crmAccounts.crm_id,
+			crmAccounts.crm_name,
+			crmAccounts.crm_email,
+			crmAccounts.crm_premise_address,
+			crmAccounts.crm_stage_name,
+			crmAccounts.crm_zen_user_id
+		FROM elevateAccounts
+		LEFT JOIN crmAccounts
+		ON elevateAccounts.elevate_account_number = crmAccounts.crm_account_number
+		WHERE elevateAccounts.disappeared_at IS NULL
+		ORDER BY elevateAccounts.elevate_mandate_reference`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var accounts []MatchAccount
+	for rows.Next() {
+		var a MatchAccount
+		err = rows.Scan(text{&a.Account.MandateReference}, text{&a.Account.AccountNumber}, text{&a.Account.CustomerName},
+			text{&a.CRM.AccountNumber}, text{&a.CRM.ID}, text{&a.CRM.Name}, text{&a.CRM.Email},
+			text{&a.CRM.PremiseAddress}, text{&a.CRM.StageName}, text{&a.CRM.ZenUserID})
+		if err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, a)
+	}
+	return accounts, rows.Err()
+}
+
+// AddMatchCandidates queues matches not known yet, also not rejected ones, and returns the added ones
+func (s *SQLiteStore) AddMatchCandidates(matches []MandateMatch) ([]MandateMatch, error) {
+	var added []MandateMatch
+	err := s.inTx(func(tx *sql.Tx) error {
+		stmt, err := tx.Prepare(`
+			INSERT OR IGNORE INTO mandateMatches(` + columnList("", matchColumns[1:]) + `)
+			values(` + placeholders(len(matchColumns)-1) + `)`)
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+
+		for _, m := range matches {
+			result, err := stmt.Exec(m.Mandate, m.MandateReference, m.AccountNumber, m.Methods, m.Confidence,
+				MatchCandidate, m.CreatedAt, m.ReviewedAt, m.Operator)
+			if err != nil {
+				return fmt.Errorf("insert into mandateMatches failed for %s: %w", m.Mandate, err)
+			}
+			if n, err := result.RowsAffected(); err != nil || n == 0 {
+				continue
+			}
+			if m.ID, err = result.LastInsertId(); err != nil {
+				return err
+			}
+			m.Status = MatchCandidate
+			added = append(added, m)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return added, nil
+}
+
+// MandateMatches lists the review queue by mandate and confidence, only the matches in status if not empty
+func (s *SQLiteStore) MandateMatches(status string) ([]MandateMatch, error) {
+	condition, args := "1 = 1", []interface{}{}
+	if status != "" {
+		condition, args = "status = ?", append(args, status)
+	}
+	rows, err := s.conn().Query(`
+		SELECT `+columnList("", matchColumns)+`
+		FROM mandateMatches
+		WHERE `+condition+`
+		ORDER BY payments_links_mandate, confidence DESC, match_id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var matches []MandateMatch
+	for rows.Next() {
+		var m MandateMatch
+		if err = rows.Scan(m.targets()...); err != nil {
+			return nil, err
+		}
+		matches = append(matches, m)
+	}
+	return matches, rows.Err()
+}
+
+// ReviewMatch confirms or rejects a match. Confirming rejects the other matches of its mandate, from then on the
+// payments of the mandate are exported with the account of the match.
+func (s *SQLiteStore) ReviewMatch(id int64, status string, operator string, reviewedAt string) (MandateMatch, error) {
+	var m MandateMatch
+	if status != MatchConfirmed && status != MatchRejected {
+		return m, fmt.Errorf("invalid review status %q, use %s or %s", status, MatchConfirmed, MatchRejected)
+	}
+	err := s.inTx(func(tx *sql.Tx) error {
+		err := tx.QueryRow(`
+			SELECT `+columnList("", matchColumns)+`
+			FROM mandateMatches
+			WHERE match_id = ?`, id).Scan(m.targets()...)
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("no match %d", id)
+		}
+		if err != nil {
+			return err
+		}
+		if status == MatchConfirmed {
+			_, err = tx.Exec(`
+				UPDATE mandateMatches
+				SET status = ?, reviewed_at = ?, operator = ?
+				WHERE payments_links_mandate = ? AND match_id <> ? AND status <> ?`,
+				MatchRejected, reviewedAt, operator, m.Mandate, id, MatchRejected)
+			if err != nil {
+				return err
+			}
+		}
+		m.Status, m.ReviewedAt, m.Operator = status, reviewedAt, operator
+		_, err = tx.Exec("UPDATE mandateMatches SET status = ?, reviewed_at = ?, operator = ? WHERE match_id = ?",
+			status, reviewedAt, operator, id)
+		return err
+	})
+	return m, err
+}
+
+// targets returns the scan destinations in the order of matchColumns
+func (m *MandateMatch) targets() []interface{} {
+	return []interface{}{
+		number{&m.ID}, text{&m.Mandate}, text{&m.MandateReference}, text{&m.AccountNumber}, text{&m.Methods},
+		&m.Confidence, text{&m.Status}, text{&m.CreatedAt}, text{&m.ReviewedAt}, text{&m.Operator},
+	}
+}
@@ -0,0 +1,425 @@
+/********************************************************************************************************************
+ * name: migrate
+ * description: versioned schema migrations, applied in order and recorded in the schema_version table
+ ********************************************************************************************************************/
+package store
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// Migration upgrades the schema from version-1 to version
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(tx *sql.Tx) error
+}
+
+// migrations in the order they have to be applied, never change or reorder an already released entry
+var migrations = []Migration{
+	{Version: 1, Name: "baseline tables and indexes", Up: execFile("migrations/0001_baseline.sql")},
+	{Version: 2, Name: "add crmAccounts.crm_zen_user_id", Up: addColumn("crmAccounts", "crm_zen_user_id", "text")},
+	{Version: 3, Name: "typed amounts, counts and timestamps", Up: typedPayments},
+	{Version: 4, Name: "paymentsActions for rule engine buckets", Up: execFile("migrations/0004_payments_actions.sql")},
+	{Version: 5, Name: "indexes for time window counts", Up: execFile("migrations/0005_window_indexes.sql")},
+	{Version: 6, Name: "customersActions for customer level rules", Up: execFile("migrations/0006_customers_actions.sql")},
+	{Version: 7, Name: "imports ledger and import_id of imported rows", Up: importsLedger},
+	{Version: 8, Name: "notifications send log and outbox", Up: execFile("migrations/0008_notifications.sql")},
+	{Version: 9, Name: "paymentsStates for the suspension lifecycle", Up: execFile("migrations/0009_payments_states.sql")},
+	{Version: 10, Name: "dunning_actions history of the escalations", Up: dunningHistory},
+	{Version: 11, Name: "versions and disappeared flags of the account snapshots", Up: accountSnapshots},
+	{Version: 12, Name: "mandateMatches review queue of matched accounts", Up: execFile("migrations/0012_mandate_matches.sql")},
+	{Version: 13, Name: "add failedPaymentRequests.customers_email", Up: addColumn("failedPaymentRequests", "customers_email", "text")},
+}
+
+// MigrationState is one line of `fp migrate status`
+type MigrationState struct {
+	Migration
+	AppliedAt string
+}
+
+// execFile runs the statements of an embedded sql file
+func execFile(fileName string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		content, err := migrationFiles.ReadFile(fileName)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(string(content))
+		return err
+	}
+}
+
+// addColumn adds a column unless it is already there, e.g. added by hand or by the former update-db program
+func addColumn(table string, column string, columnType string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		exists, err := columnExists(tx, table, column)
+		if err != nil || exists {
+			return err
+		}
+		_, err = tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, columnType))
+		return err
+	}
+}
+
+// importsLedger creates the imports table and links the rows of the imported tables to it
+func importsLedger(tx *sql.Tx) error {
+	if err := execFile("migrations/0007_imports.sql")(tx); err != nil {
+		return err
+	}
+	for _, table := range []string{"elevateAccounts", "crmAccounts", "failedPaymentRequests"} {
+		if err := addColumn(table, "import_id", "integer")(tx); err != nil {
+			return err
+		}
+	}
+	_, err := tx.Exec("CREATE INDEX IF NOT EXISTS idx_failed_import_id ON failedPaymentRequests(import_id)")
+	return err
+}
+
+// accountSnapshots creates the history tables of the accounts with a first version of every stored account,
+// dated by the import that brought it, and counts the updated accounts in the imports ledger
+func accountSnapshots(tx *sql.Tx) error {
+	if err := execFile("migrations/0011_account_snapshots.sql")(tx); err != nil {
+		return err
+	}
+	if err := addColumn("imports", "updated", "integer")(tx); err != nil {
+		return err
+	}
+	for _, source := range []string{SnapshotAccounts, SnapshotCRM} {
+		t := accountTables[source]
+		for _, column := range [][2]string{{"valid_from", "text"}, {"last_import_id", "integer"}, {"disappeared_at", "text"}} {
+			if err := addColumn(t.table, column[0], column[1])(tx); err != nil {
+				return err
+			}
+		}
+		_, err := tx.Exec(`
+			UPDATE ` + t.table + `
+			SET last_import_id = import_id,
+			valid_from = (SELECT substr(imports.started_at, 1, 10) FROM imports WHERE imports.import_id = ` + t.table + `.import_id)`)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`
+			INSERT INTO ` + t.history + `(` + t.key + `, ` + columnList("", t.columns) + `, valid_from, import_id, change)
+			SELECT ` + t.key + `, ` + columnList("", t.columns) + `, valid_from, import_id, '` + AccountNew + `'
+			FROM ` + t.table + `
+			ORDER BY ` + t.key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dunningHistory creates dunning_actions and fills it with the rows of the tables recorded before it,
+// ordered by their timestamp
+func dunningHistory(tx *sql.Tx) error {
+	if err := execFile("migrations/0010_dunning_actions.sql")(tx); err != nil {
+		return err
+	}
+	const operator, reason = "migration", "recorded before the dunning history"
+
+	var entries []DunningAction
+	add := func(level, paymentIDs, customerKey, customerIDs, action, rule string, count int, date string, details interface{}) error {
+		entry, err := historyEntry(level, paymentIDs, customerKey, customerIDs, action, rule, count, date, operator, details)
+		if err != nil {
+			return err
+		}
+		entry.Reason, entry.Timestamp = reason, date
+		entries = append(entries, entry)
+		return nil
+	}
+	// rows derived from paymentsActions are already in the history with their bucket
+	for _, table := range []string{"paymentsWarnings", "paymentsSuspended"} {
+		rows, err := tx.Query(`
+			SELECT payments_id, timestamp, payment_requests_count, customers_id, customers_given_name,
+				customers_family_name, customers_metadata_leadID
+			FROM ` + table + `
+			WHERE NOT EXISTS (SELECT 1 FROM paymentsActions
+				WHERE paymentsActions.payments_id = ` + table + `.payments_id
+				AND paymentsActions.timestamp = ` + table + `.timestamp)
+			ORDER BY timestamp, payments_id`)
+		if err != nil {
+			return err
+		}
+		var warnings []Warning
+		for rows.Next() {
+			var w Warning
+			err = rows.Scan(text{&w.PaymentID}, text{&w.Timestamp}, integer{&w.Count}, text{&w.CustomerID},
+				text{&w.CustomerGivenName}, text{&w.CustomerFamilyName}, text{&w.CustomerLeadID})
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			warnings = append(warnings, w)
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return err
+		}
+		for _, w := range warnings {
+			action := HistoryWarning
+			if table == "paymentsSuspended" {
+				action = HistorySuspension
+			}
+			if err = add(HistoryPayment, w.PaymentID, w.CustomerID, w.CustomerID, action, "", w.Count, w.Timestamp, w); err != nil {
+				return err
+			}
+		}
+	}
+
+	bound := &SQLiteStore{tx: tx}
+	actions, err := bound.Actions()
+	if err != nil {
+		return err
+	}
+	for _, a := range actions {
+		if err = add(HistoryPayment, a.PaymentID, a.CustomerID, a.CustomerID, a.Bucket, a.Rule, a.Count, a.Timestamp, a); err != nil {
+			return err
+		}
+	}
+	customerActions, err := bound.CustomerActions()
+	if err != nil {
+		return err
+	}
+	for _, a := range customerActions {
+		err = add(HistoryCustomer, strings.Join(a.PaymentIDs, ","), a.CustomerKey, strings.Join(a.CustomerIDs, ","),
+			a.Bucket, a.Rule, a.Count, a.Timestamp, a)
+		if err != nil {
+			return err
+		}
+	}
+
+	// payments recovered or written off before the history, after the actions of the same day
+	closed, err := paymentStates(tx, "")
+	if err != nil {
+		return err
+	}
+	for _, st := range closed {
+		if st.State != StateRecovered && st.State != StateWrittenOff {
+			continue
+		}
+		entry, err := StateEntry(st, operator)
+		if err != nil {
+			return err
+		}
+		entry.Timestamp = st.Timestamp
+		entries = append(entries, entry)
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Date < entries[j].Date
+	})
+	return appendHistory(tx, entries)
+}
+
+// typedPayments rebuilds failedPaymentRequests with integer minor unit amounts and ISO timestamps, empty amounts
+// become NULL. The migration fails with the ids of the rows whose amount or timestamps can't be converted, a lost
+// amount or a timestamp in another format would silently fall out of the time windows.
+func typedPayments(tx *sql.Tx) error {
+	if err := execFile("migrations/0003_typed_payments.sql")(tx); err != nil {
+		return err
+	}
+
+	rows, err := tx.Query(`
+		SELECT id, created_at, payments_created_at, payments_charge_date, payments_amount, payments_currency
+		FROM failedPaymentRequests`)
+	if err != nil {
+		return err
+	}
+	type converted struct {
+		id, createdAt, paymentsCreatedAt, chargeDate string
+		amount                                       sql.NullInt64
+	}
+	var convertedRows []converted
+	var invalid []string
+	for rows.Next() {
+		var id, createdAt, paymentsCreatedAt, chargeDate, amount, currency sql.NullString
+		if err = rows.Scan(&id, &createdAt, &paymentsCreatedAt, &chargeDate, &amount, &currency); err != nil {
+			rows.Close()
+			return err
+		}
+		row := converted{id: id.String}
+		var failed []string
+		if row.createdAt, err = NormalizeTimestamp(createdAt.String); err != nil {
+			failed = append(failed, fmt.Sprintf("created_at %q", createdAt.String))
+		}
+		if row.paymentsCreatedAt, err = NormalizeTimestamp(paymentsCreatedAt.String); err != nil {
+			failed = append(failed, fmt.Sprintf("payments_created_at %q", paymentsCreatedAt.String))
+		}
+		if row.chargeDate, err = NormalizeDate(chargeDate.String); err != nil {
+			failed = append(failed, fmt.Sprintf("payments_charge_date %q", chargeDate.String))
+		}
+		if strings.TrimSpace(amount.String) != "" {
+			minor, err := ParseAmount(amount.String, currency.String)
+			if err != nil {
+				failed = append(failed, fmt.Sprintf("payments_amount %q", amount.String))
+			}
+			row.amount = sql.NullInt64{Int64: minor, Valid: err == nil}
+		}
+		if len(failed) > 0 {
+			invalid = append(invalid, fmt.Sprintf("%s (%s)", id.String, strings.Join(failed, ", ")))
+		}
+		convertedRows = append(convertedRows, row)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	if len(invalid) > 0 {
+		if len(invalid) > 20 {
+			invalid = append(invalid[:20], fmt.Sprintf("and %d more", len(invalid)-20))
+		}
+		return fmt.Errorf("values of failedPaymentRequests can't be converted, correct them and run fp db migrate again: %s",
+			strings.Join(invalid, "; "))
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO failedPaymentRequests_typed
+		SELECT id, created_at, resource_type, action, details_origin, details_cause, details_description,
+			details_scheme, details_reason_code, links_parent_event, links_payment, payments_id,
+			payments_created_at, payments_charge_date, NULL, payments_description, payments_currency,
+			payments_status, customers_id, customers_given_name, customers_family_name,
+			customers_metadata_leadID, payments_links_mandate, payments_metadata_identity
+		FROM failedPaymentRequests`)
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare(`
+		UPDATE failedPaymentRequests_typed
+		SET created_at = ?, payments_created_at = ?, payments_charge_date = ?, payments_amount_minor = ?
+		WHERE id = ?`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, row := range convertedRows {
+		if _, err = stmt.Exec(row.createdAt, row.paymentsCreatedAt, row.chargeDate, row.amount, row.id); err != nil {
+			return err
+		}
+	}
+
+	return execFile("migrations/0003_typed_payments_swap.sql")(tx)
+}
+
+// columnExists checks the table definition for a column
+func columnExists(tx *sql.Tx, table string, column string) (bool, error) {
+	rows, err := tx.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid int
+		var name, columnType string
+		var notNull, primaryKey int
+		var defaultValue sql.NullString
+		if err = rows.Scan(&cid, &name, &columnType, &notNull, &defaultValue, &primaryKey); err != nil {
+			return false, err
+		}
+		if name == column {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
+
+// ensureSchemaVersionTable creates the bookkeeping table for applied migrations
+func ensureSchemaVersionTable(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_version (
+			version    integer primary key,
+			name       text,
+			applied_at text
+		)`)
+	return err
+}
+
+// LatestSchemaVersion is the version of the schema after all known migrations
+func LatestSchemaVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+// MigrationStatus lists every known migration with the time it was applied, empty if still pending
+func (s *SQLiteStore) MigrationStatus() ([]MigrationState, error) {
+	if err := ensureSchemaVersionTable(s.db); err != nil {
+		return nil, err
+	}
+
+	applied := make(map[int]string)
+	rows, err := s.db.Query("SELECT version, applied_at FROM schema_version")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var version int
+		var appliedAt string
+		if err = rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	states := make([]MigrationState, 0, len(migrations))
+	for _, m := range migrations {
+		states = append(states, MigrationState{Migration: m, AppliedAt: applied[m.Version]})
+	}
+	return states, nil
+}
+
+// Migrate applies all pending migrations, each in its own transaction, and returns the applied ones
+func (s *SQLiteStore) Migrate() ([]Migration, error) {
+	states, err := s.MigrationStatus()
+	if err != nil {
+		return nil, err
+	}
+
+	var done []Migration
+	for _, state := range states {
+		if state.AppliedAt != "" {
+			continue
+		}
+		tx, err := s.db.Begin()
+		if err != nil {
+			return done, err
+		}
+		if err = state.Up(tx); err != nil {
+			tx.Rollback()
+			return done, fmt.Errorf("migration %d (%s) failed: %w", state.Version, state.Name, err)
+		}
+		_, err = tx.Exec("INSERT INTO schema_version(version, name, applied_at) values(?, ?, ?)",
+			state.Version, state.Name, time.Now().UTC().Format(time.RFC3339))
+		if err != nil {
+			tx.Rollback()
+			return done, err
+		}
+		if err = tx.Commit(); err != nil {
+			return done, err
+		}
+		done = append(done, state.Migration)
+	}
+	return done, nil
+}
+
+// SchemaVersion is the highest applied migration, 0 for a new database
+func (s *SQLiteStore) SchemaVersion() (int, error) {
+	if err := ensureSchemaVersionTable(s.db); err != nil {
+		return 0, err
+	}
+	var version sql.NullInt64
+	err := s.db.QueryRow("SELECT MAX(version) FROM schema_version").Scan(&version)
+	return int(version.Int64), err
+}
@@ -0,0 +1,186 @@
+package store
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// legacyStore opens a database with the text columns of fp up to version 8, before any schema_version
+func legacyStore(t *testing.T) *SQLiteStore {
+	t.Helper()
+	s, err := Open(filepath.Join(t.TempDir(), "legacy.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	content, err := migrationFiles.ReadFile("migrations/0001_baseline.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.DB().Exec(string(content)); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// insertLegacyFailures adds count failed events of a payment with the text amount as the former import stored them
+func insertLegacyFailures(t *testing.T, s *SQLiteStore, paymentID string, amount string, count int) {
+	t.Helper()
+	for i := 1; i <= count; i++ {
+		_, err := s.DB().Exec(`
+			INSERT INTO failedPaymentRequests(id, created_at, action, payments_id, payments_amount, payments_currency,
+				customers_id)
+			VALUES(?, ?, 'failed', ?, ?, 'GBP', ?)`,
+			fmt.Sprintf("EV%s%02d", paymentID, i), fmt.Sprintf("2020-01-%02dT10:00:00.000Z", i), paymentID, amount,
+			"CU"+paymentID)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// TestMigrateCountsAreNumbers covers payments with 10 failures, compared as text "10" < "4" before migration 3
+func TestMigrateCountsAreNumbers(t *testing.T) {
+	s := legacyStore(t)
+	insertLegacyFailures(t, s, "PM10", "12.50", 10)
+	insertLegacyFailures(t, s, "PM3", "12.50", 3)
+	_, err := s.DB().Exec(`INSERT INTO paymentsSuspended(payments_id, timestamp, payment_requests_count, customers_id)
+		VALUES('PM10', '2020-01-10', '10', 'CUPM10')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+
+	var suspended []string
+	rows, err := s.DB().Query("SELECT payments_id FROM paymentsSuspended WHERE payment_requests_count >= 4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+		var id string
+		if err = rows.Scan(&id); err != nil {
+			t.Fatal(err)
+		}
+		suspended = append(suspended, id)
+	}
+	rows.Close()
+	if len(suspended) != 1 || suspended[0] != "PM10" {
+		t.Errorf("suspensions with at least 4 requests = %v, want [PM10]", suspended)
+	}
+
+	summaries, err := s.PaymentSummaries(SummaryQuery{MinFailures: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(summaries) != 1 || summaries[0].Event.PaymentID != "PM10" || summaries[0].FailureCount != 10 {
+		t.Fatalf("payments with at least 4 failures = %+v, want PM10 with 10", summaries)
+	}
+	if summaries[0].Event.AmountMinor != 1250 {
+		t.Errorf("amount of PM10 = %d, want 1250", summaries[0].Event.AmountMinor)
+	}
+}
+
+func TestMigrateFailsOnInvalidValues(t *testing.T) {
+	s := legacyStore(t)
+	insertLegacyFailures(t, s, "PMOK", "12.50", 1)
+	insertLegacyFailures(t, s, "PMNAN", "NaN", 1)
+	insertLegacyFailures(t, s, "PMROUND", "12.505", 1)
+	insertLegacyFailures(t, s, "PMEMPTY", "", 1)
+	insertLegacyFailures(t, s, "PMDATE", "12.50", 1)
+	if _, err := s.DB().Exec("UPDATE failedPaymentRequests SET created_at = '28.05.2022' WHERE payments_id = 'PMDATE'"); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := s.Migrate()
+	if err == nil {
+		t.Fatal("Migrate() succeeded with amount NaN")
+	}
+	for _, id := range []string{"EVPMNAN01", "EVPMROUND01", `EVPMDATE01 (created_at "28.05.2022")`} {
+		if !strings.Contains(err.Error(), id) {
+			t.Errorf("Migrate() error = %q, want %s", err, id)
+		}
+	}
+	if strings.Contains(err.Error(), "EVPMEMPTY01") || strings.Contains(err.Error(), "EVPMOK01") {
+		t.Errorf("Migrate() error = %q, want the invalid rows only", err)
+	}
+	version, err := s.SchemaVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 2 {
+		t.Errorf("schema version = %d, want 2, migration 3 has to be rolled back", version)
+	}
+	var amount string
+	if err = s.DB().QueryRow("SELECT payments_amount FROM failedPaymentRequests WHERE payments_id = 'PMNAN'").Scan(&amount); err != nil {
+		t.Fatal(err)
+	}
+	if amount != "NaN" {
+		t.Errorf("payments_amount of PMNAN = %q, want NaN kept", amount)
+	}
+}
+
+// TestMigrateKeepsLegacyActions covers the first run after an upgrade, the payments warned and suspended by the
+// former versions must not be actioned again
+func TestMigrateKeepsLegacyActions(t *testing.T) {
+	s := legacyStore(t)
+	insertLegacyFailures(t, s, "PMW", "12.50", 3)
+	insertLegacyFailures(t, s, "PMS", "12.50", 5)
+	insertLegacyFailures(t, s, "PML", "25.00", 4)
+	legacy := []struct{ table, paymentID, timestamp, count string }{
+		{"paymentsWarnings", "PMW", "2020-01-03", "3"},
+		{"paymentsWarnings", "PMS", "2020-01-03", "3"},
+		{"paymentsSuspended", "PMS", "2020-01-05", "5"},
+		{"paymentsSuspended", "PML", "2020-01-04", "4"},
+	}
+	for _, l := range legacy {
+		_, err := s.DB().Exec(`INSERT INTO `+l.table+`(payments_id, timestamp, payment_requests_count, customers_id)
+			VALUES(?, ?, ?, ?)`, l.paymentID, l.timestamp, l.count, "CU"+l.paymentID)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := s.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+
+	actions, err := s.Actions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []PaymentAction{
+		{PaymentID: "PML", Bucket: "suspend-large", Rule: "count-suspend-large", Timestamp: "2020-01-04", Count: 4, CustomerID: "CUPML"},
+		{PaymentID: "PMS", Bucket: "suspend-small", Rule: "count-suspend-small", Timestamp: "2020-01-05", Count: 5, CustomerID: "CUPMS"},
+		{PaymentID: "PMS", Bucket: "warn", Rule: "count-warn", Timestamp: "2020-01-03", Count: 3, CustomerID: "CUPMS"},
+		{PaymentID: "PMW", Bucket: "warn", Rule: "count-warn", Timestamp: "2020-01-03", Count: 3, CustomerID: "CUPMW"},
+	}
+	if fmt.Sprint(actions) != fmt.Sprint(want) {
+		t.Errorf("paymentsActions after migration =\n%v\nwant\n%v", actions, want)
+	}
+
+	history, err := s.History("PMS")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 2 {
+		t.Errorf("history of PMS has %d entries, want the warning and the suspension once: %+v", len(history), history)
+	}
+
+	// the same decisions as before the upgrade, at a later run
+	buckets := StateBuckets{Warn: []string{"warn"}, Suspend: []string{"suspend-small", "suspend-large"}}
+	again := []PaymentAction{
+		{PaymentID: "PMW", Bucket: "warn", Rule: "count-warn", Timestamp: "2020-02-01", Count: 3, CustomerID: "CUPMW"},
+		{PaymentID: "PMS", Bucket: "suspend-small", Rule: "count-suspend-small", Timestamp: "2020-02-01", Count: 5, CustomerID: "CUPMS"},
+		{PaymentID: "PML", Bucket: "suspend-large", Rule: "count-suspend-large", Timestamp: "2020-02-01", Count: 4, CustomerID: "CUPML"},
+	}
+	recorded, err := s.RecordActions(again, buckets, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recorded) != 0 {
+		t.Errorf("RecordActions after the upgrade recorded %+v, want none", recorded)
+	}
+}
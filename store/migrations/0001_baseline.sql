@@ -0,0 +1,68 @@
+-- tables and indexes as created by fp up to version 8
+CREATE TABLE IF NOT EXISTS elevateAccounts (
+	elevate_mandate_reference text primary key,
+	elevate_account_number    text,
+	elevate_customer_name     text
+);
+
+CREATE TABLE IF NOT EXISTS failedPaymentRequests (
+	id                         text primary key,
+	created_at                 text,
+	resource_type              text,
+	action                     text,
+	details_origin             text,
+	details_cause              text,
+	details_description        text,
+	details_scheme             text,
+	details_reason_code        text,
+	links_parent_event         text,
+	links_payment              text,
+	payments_id                text,
+	payments_created_at        text,
+	payments_charge_date       text,
+	payments_amount            text,
+	payments_description       text,
+	payments_currency          text,
+	payments_status            text,
+	customers_id               text,
+	customers_given_name       text,
+	customers_family_name      text,
+	customers_metadata_leadID  text,
+	payments_links_mandate     text,
+	payments_metadata_identity text
+);
+
+CREATE TABLE IF NOT EXISTS crmAccounts (
+	crm_account_number    text primary key,
+	crm_id                text,
+	crm_name              text,
+	crm_email             text,
+	crm_premise_address   text,
+	crm_stage_name        text
+);
+
+CREATE TABLE IF NOT EXISTS paymentsWarnings (
+	payments_id               text primary key,
+	timestamp                 text,
+	payment_requests_count    integer,
+	customers_id              text,
+	customers_given_name      text,
+	customers_family_name     text,
+	customers_metadata_leadID text
+);
+
+CREATE TABLE IF NOT EXISTS paymentsSuspended (
+	payments_id               text primary key,
+	timestamp                 text,
+	payment_requests_count    integer,
+	customers_id              text,
+	customers_given_name      text,
+	customers_family_name     text,
+	customers_metadata_leadID text
+);
+
+CREATE INDEX IF NOT EXISTS idx_payments_id                   ON failedPaymentRequests(payments_id);
+CREATE INDEX IF NOT EXISTS idx_customers_id                  ON failedPaymentRequests(customers_id);
+CREATE INDEX IF NOT EXISTS idx_customers_family_name         ON failedPaymentRequests(customers_family_name);
+CREATE INDEX IF NOT EXISTS idx_payments_warning_timestamp    ON paymentsWarnings(timestamp);
+CREATE INDEX IF NOT EXISTS idx_payments_suspended_timestamp  ON paymentsSuspended(timestamp);
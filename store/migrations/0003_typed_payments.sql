@@ -0,0 +1,31 @@
+-- failedPaymentRequests with amounts in integer minor units of payments_currency,
+-- rows are copied over by the migration converting amounts and timestamps
+CREATE TABLE failedPaymentRequests_typed (
+	id                         text primary key,
+	created_at                 text,
+	resource_type              text,
+	action                     text,
+	details_origin             text,
+	details_cause              text,
+	details_description        text,
+	details_scheme             text,
+	details_reason_code        text,
+	links_parent_event         text,
+	links_payment              text,
+	payments_id                text,
+	payments_created_at        text,
+	payments_charge_date       text,
+	payments_amount_minor      integer,
+	payments_description       text,
+	payments_currency          text,
+	payments_status            text,
+	customers_id               text,
+	customers_given_name       text,
+	customers_family_name      text,
+	customers_metadata_leadID  text,
+	payments_links_mandate     text,
+	payments_metadata_identity text
+);
+
+UPDATE paymentsWarnings  SET payment_requests_count = CAST(payment_requests_count AS integer);
+UPDATE paymentsSuspended SET payment_requests_count = CAST(payment_requests_count AS integer);
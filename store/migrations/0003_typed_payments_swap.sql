@@ -0,0 +1,6 @@
+DROP TABLE failedPaymentRequests;
+ALTER TABLE failedPaymentRequests_typed RENAME TO failedPaymentRequests;
+
+CREATE INDEX IF NOT EXISTS idx_payments_id            ON failedPaymentRequests(payments_id);
+CREATE INDEX IF NOT EXISTS idx_customers_id           ON failedPaymentRequests(customers_id);
+CREATE INDEX IF NOT EXISTS idx_customers_family_name  ON failedPaymentRequests(customers_family_name);
@@ -0,0 +1,39 @@
+-- decisions of the rule engine, one row per payment and action bucket
+CREATE TABLE IF NOT EXISTS paymentsActions (
+	payments_id               text,
+	bucket                    text,
+	rule                      text,
+	timestamp                 text,
+	payment_requests_count    integer,
+	customers_id              text,
+	customers_given_name      text,
+	customers_family_name     text,
+	customers_metadata_leadID text,
+	PRIMARY KEY (payments_id, bucket)
+);
+
+CREATE INDEX IF NOT EXISTS idx_payments_actions_timestamp ON paymentsActions(bucket, timestamp);
+
+-- payments warned and suspended before the rule engine keep their timestamp and count, so they aren't actioned
+-- again. Suspensions are split at 20.00, the default -amount of the former versions, by the latest amount.
+INSERT OR IGNORE INTO paymentsActions(payments_id, bucket, rule, timestamp, payment_requests_count, customers_id,
+	customers_given_name, customers_family_name, customers_metadata_leadID)
+SELECT payments_id, 'warn', 'count-warn', timestamp, payment_requests_count, customers_id,
+	customers_given_name, customers_family_name, customers_metadata_leadID
+FROM paymentsWarnings;
+
+INSERT OR IGNORE INTO paymentsActions(payments_id, bucket, rule, timestamp, payment_requests_count, customers_id,
+	customers_given_name, customers_family_name, customers_metadata_leadID)
+SELECT payments_id, 'suspend-' || size, 'count-suspend-' || size, timestamp, payment_requests_count, customers_id,
+	customers_given_name, customers_family_name, customers_metadata_leadID
+FROM (
+	SELECT paymentsSuspended.*,
+		CASE WHEN ifnull(latest.payments_amount_minor, 0) <
+			CASE WHEN upper(trim(ifnull(latest.payments_currency, ''))) IN ('JPY', 'KRW', 'ISK') THEN 20 ELSE 2000 END
+		THEN 'small' ELSE 'large' END AS size
+	FROM paymentsSuspended
+	LEFT JOIN failedPaymentRequests AS latest
+	ON latest.id = (SELECT id FROM failedPaymentRequests
+		WHERE failedPaymentRequests.payments_id = paymentsSuspended.payments_id
+		ORDER BY created_at DESC, id DESC LIMIT 1)
+);
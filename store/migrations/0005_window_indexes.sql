@@ -0,0 +1,4 @@
+-- indexes for failure counts within a time window and per customer
+CREATE INDEX IF NOT EXISTS idx_failed_created_at      ON failedPaymentRequests(created_at);
+CREATE INDEX IF NOT EXISTS idx_failed_charge_date     ON failedPaymentRequests(payments_charge_date);
+CREATE INDEX IF NOT EXISTS idx_failed_customer_action ON failedPaymentRequests(customers_id, action);
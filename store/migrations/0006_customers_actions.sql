@@ -0,0 +1,24 @@
+-- decisions of the rule engine on customer level, one row per customer and action bucket.
+-- customer_key is the Elevate account number, or customers_id for customers without a matching mandate.
+CREATE TABLE IF NOT EXISTS customersActions (
+	customer_key              text,
+	bucket                    text,
+	rule                      text,
+	timestamp                 text,
+	payment_requests_count    integer,
+	failed_payments_count     integer,
+	outstanding_amount_minor  integer,
+	payments_currency         text,
+	worst_payments_status     text,
+	last_failure_at           text,
+	customers_ids             text,
+	payments_ids              text,
+	payments_links_mandates   text,
+	elevate_account_number    text,
+	customers_given_name      text,
+	customers_family_name     text,
+	customers_metadata_leadID text,
+	PRIMARY KEY (customer_key, bucket)
+);
+
+CREATE INDEX IF NOT EXISTS idx_customers_actions_timestamp ON customersActions(bucket, timestamp);
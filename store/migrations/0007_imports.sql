@@ -0,0 +1,16 @@
+-- ledger of the imported csv files, the imported rows refer to it by import_id
+CREATE TABLE IF NOT EXISTS imports (
+	import_id     integer primary key autoincrement,
+	source        text,
+	file_name     text,
+	sha256        text,
+	status        text,
+	inserted      integer,
+	skipped       integer,
+	rejected      integer,
+	started_at    text,
+	finished_at   text,
+	tool_version  text
+);
+
+CREATE INDEX IF NOT EXISTS idx_imports_sha256 ON imports(sha256);
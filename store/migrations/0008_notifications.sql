@@ -0,0 +1,19 @@
+-- send log and outbox of the customer notifications, one row per payment listed in a message
+CREATE TABLE IF NOT EXISTS notifications (
+	notification_id  integer primary key autoincrement,
+	message_id       text,
+	payments_id      text,
+	customer_key     text,
+	bucket           text,
+	template         text,
+	email            text,
+	subject          text,
+	message          text,
+	status           text,
+	created_at       text,
+	sent_at          text,
+	error            text
+);
+
+CREATE INDEX IF NOT EXISTS idx_notifications_payments_bucket ON notifications(payments_id, bucket);
+CREATE INDEX IF NOT EXISTS idx_notifications_message_id ON notifications(message_id);
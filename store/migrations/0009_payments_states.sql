@@ -0,0 +1,12 @@
+-- lifecycle state of every payment with failed requests, timestamp is the date of the last change
+CREATE TABLE IF NOT EXISTS paymentsStates (
+	payments_id        text primary key,
+	state              text,
+	previous_state     text,
+	timestamp          text,
+	last_event_id      text,
+	last_event_action  text,
+	last_event_at      text
+);
+
+CREATE INDEX IF NOT EXISTS idx_payments_states_timestamp ON paymentsStates(state, timestamp);
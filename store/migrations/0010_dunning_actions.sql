@@ -0,0 +1,21 @@
+-- append-only history of the dunning decisions and state changes, paymentsActions, paymentsWarnings,
+-- paymentsSuspended and customersActions are derived from it. On customer level payments_id and customers_id
+-- are comma separated lists, details holds the derived row as json.
+CREATE TABLE IF NOT EXISTS dunning_actions (
+	action_id                 integer primary key autoincrement,
+	level                     text,
+	payments_id               text,
+	customer_key              text,
+	customers_id              text,
+	action                    text,
+	rule                      text,
+	reason                    text,
+	payment_requests_count    integer,
+	date                      text,
+	timestamp                 text,
+	operator                  text,
+	details                   text
+);
+
+CREATE INDEX IF NOT EXISTS idx_dunning_actions_payments_id ON dunning_actions(payments_id);
+CREATE INDEX IF NOT EXISTS idx_dunning_actions_customer_key ON dunning_actions(customer_key);
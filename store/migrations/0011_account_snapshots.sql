@@ -0,0 +1,31 @@
+-- every version of an account: valid_from is the date of the snapshot that brought the values, valid_to the date
+-- of the snapshot that changed them or no longer had the account, NULL for the current version. change is new,
+-- changed: <columns> or reappeared.
+CREATE TABLE IF NOT EXISTS elevateAccountsHistory (
+	history_id                integer primary key autoincrement,
+	elevate_mandate_reference text,
+	elevate_account_number    text,
+	elevate_customer_name     text,
+	valid_from                text,
+	valid_to                  text,
+	import_id                 integer,
+	change                    text
+);
+
+CREATE TABLE IF NOT EXISTS crmAccountsHistory (
+	history_id            integer primary key autoincrement,
+	crm_account_number    text,
+	crm_id                text,
+	crm_name              text,
+	crm_email             text,
+	crm_premise_address   text,
+	crm_stage_name        text,
+	crm_zen_user_id       text,
+	valid_from            text,
+	valid_to              text,
+	import_id             integer,
+	change                text
+);
+
+CREATE INDEX IF NOT EXISTS idx_elevate_accounts_history_key ON elevateAccountsHistory(elevate_mandate_reference, valid_to);
+CREATE INDEX IF NOT EXISTS idx_crm_accounts_history_key ON crmAccountsHistory(crm_account_number, valid_to);
@@ -0,0 +1,17 @@
+-- review queue of the Elevate accounts matched to mandates of failed payments without Elevate account, by lead id,
+-- identity, email or name. A confirmed match links the payments of the mandate to the account in the exports.
+CREATE TABLE IF NOT EXISTS mandateMatches (
+	match_id                  integer primary key autoincrement,
+	payments_links_mandate    text,
+	elevate_mandate_reference text,
+	elevate_account_number    text,
+	methods                   text,
+	confidence                real,
+	status                    text,
+	created_at                text,
+	reviewed_at               text,
+	operator                  text,
+	UNIQUE(payments_links_mandate, elevate_mandate_reference)
+);
+
+CREATE INDEX IF NOT EXISTS idx_mandate_matches_status ON mandateMatches(payments_links_mandate, status);
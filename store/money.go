@@ -0,0 +1,120 @@
+/********************************************************************************************************************
+ * name: money
+ * description: convert csv amounts to integer minor units and csv dates to ISO timestamps
+ ********************************************************************************************************************/
+package store
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// layouts of the values stored in the database
+const (
+	ISOTimestamp = "2006-01-02T15:04:05.000Z07:00"
+	ISODate      = "2006-01-02"
+)
+
+// layouts accepted when reading timestamps and dates from csv files
+var timestampLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"02/01/2006 15:04:05",
+	"02/01/2006 15:04",
+	ISODate,
+	"02/01/2006",
+}
+
+// currencies without minor units, all others have cents/pence
+var zeroDecimalCurrencies = map[string]bool{
+	"JPY": true,
+	"KRW": true,
+	"ISK": true,
+}
+
+// CurrencyExponent is the number of decimal places of a currency
+func CurrencyExponent(currency string) int {
+	if zeroDecimalCurrencies[strings.ToUpper(strings.TrimSpace(currency))] {
+		return 0
+	}
+	return 2
+}
+
+// decimalAmount is a plain decimal number, without exponent, NaN or Inf: sign, whole units and decimals
+var decimalAmount = regexp.MustCompile(`^([+-]?)([0-9]*)(?:\.([0-9]*))?$`)
+
+// ParseAmount converts a decimal amount like "12.50" to minor units (1250 pence), amounts with more decimals
+// than the currency has are rejected instead of rounded
+func ParseAmount(amount string, currency string) (int64, error) {
+	amount = strings.TrimSpace(amount)
+	if amount == "" {
+		return 0, fmt.Errorf("empty amount")
+	}
+	parts := decimalAmount.FindStringSubmatch(amount)
+	if parts == nil || parts[2]+parts[3] == "" {
+		return 0, fmt.Errorf("invalid amount %q", amount)
+	}
+	exponent := CurrencyExponent(currency)
+	decimals := strings.TrimRight(parts[3], "0")
+	if len(decimals) > exponent {
+		return 0, fmt.Errorf("amount %q has more than %d decimals of %s", amount, exponent, currency)
+	}
+	digits := parts[2] + decimals + strings.Repeat("0", exponent-len(decimals))
+	minor, err := strconv.ParseInt(parts[1]+digits, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid amount %q", amount)
+	}
+	return minor, nil
+}
+
+// ToMinorUnits converts a major unit amount, e.g. the -amount parameter, to minor units of the currency
+func ToMinorUnits(value float64, currency string) int64 {
+	return int64(math.Round(value * math.Pow10(CurrencyExponent(currency))))
+}
+
+// FormatAmount converts minor units back to a decimal amount for exports
+func FormatAmount(minor int64, currency string) string {
+	exponent := CurrencyExponent(currency)
+	return strconv.FormatFloat(float64(minor)/math.Pow10(exponent), 'f', exponent, 64)
+}
+
+// ParseTimestamp reads a timestamp or date in any of the accepted layouts, values without zone are taken as UTC
+func ParseTimestamp(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	for _, layout := range timestampLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid timestamp %q", value)
+}
+
+// NormalizeTimestamp returns the timestamp in ISO format, empty values stay empty
+func NormalizeTimestamp(value string) (string, error) {
+	if strings.TrimSpace(value) == "" {
+		return "", nil
+	}
+	t, err := ParseTimestamp(value)
+	if err != nil {
+		return "", err
+	}
+	return t.Format(ISOTimestamp), nil
+}
+
+// NormalizeDate returns the date in ISO format, empty values stay empty
+func NormalizeDate(value string) (string, error) {
+	if strings.TrimSpace(value) == "" {
+		return "", nil
+	}
+	t, err := ParseTimestamp(value)
+	if err != nil {
+		return "", err
+	}
+	return t.Format(ISODate), nil
+}
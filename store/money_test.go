@@ -0,0 +1,53 @@
+package store
+
+import "testing"
+
+func TestParseAmount(t *testing.T) {
+	tests := []struct {
+		amount   string
+		currency string
+		want     int64
+		wantErr  bool
+	}{
+		{"12.50", "GBP", 1250, false},
+		{"12.5", "GBP", 1250, false},
+		{" 7 ", "GBP", 700, false},
+		{"0.10", "EUR", 10, false},
+		{".5", "GBP", 50, false},
+		{"5.", "GBP", 500, false},
+		{"-3.20", "GBP", -320, false},
+		{"+3.20", "GBP", 320, false},
+		{"1234.567", "GBP", 0, true},
+		{"1234.5600", "GBP", 123456, false},
+		{"1500", "JPY", 1500, false},
+		{"1500.5", "JPY", 0, true},
+		{"1500.0", "JPY", 1500, false},
+		{"0.1", "GBP", 10, false},
+		{"92233720368547758.07", "GBP", 9223372036854775807, false},
+		{"92233720368547758.08", "GBP", 0, true},
+		{"", "GBP", 0, true},
+		{"abc", "GBP", 0, true},
+		{"NaN", "GBP", 0, true},
+		{"nan", "GBP", 0, true},
+		{"Inf", "GBP", 0, true},
+		{"-Infinity", "GBP", 0, true},
+		{"1e3", "GBP", 0, true},
+		{"1.5E-2", "GBP", 0, true},
+		{"0x10", "GBP", 0, true},
+		{"1_000", "GBP", 0, true},
+		{"12,50", "GBP", 0, true},
+		{".", "GBP", 0, true},
+		{"-", "GBP", 0, true},
+		{"1.2.3", "GBP", 0, true},
+	}
+	for _, test := range tests {
+		got, err := ParseAmount(test.amount, test.currency)
+		if (err != nil) != test.wantErr {
+			t.Errorf("ParseAmount(%q, %q) error = %v, want error %v", test.amount, test.currency, err, test.wantErr)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("ParseAmount(%q, %q) = %d, want %d", test.amount, test.currency, got, test.want)
+		}
+	}
+}
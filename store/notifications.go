@@ -0,0 +1,124 @@
+/********************************************************************************************************************
+ * name: notifications
+ * description: the send log and outbox of the customer notifications
+ ********************************************************************************************************************/
+package store
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// status of a notification
+const (
+	NotificationOutbox    = "outbox"
+	NotificationSent      = "sent"
+	NotificationFailed    = "failed"
+	NotificationDiscarded = "discarded"
+)
+
+// notificationColumns are the columns of notifications in the order of Notification.targets
+var notificationColumns = []string{
+	"notification_id", "message_id", "payments_id", "customer_key", "bucket", "template", "email", "subject",
+	"message", "status", "created_at", "sent_at", "error",
+}
+
+// AddNotifications records notifications, usually with status NotificationOutbox
+func (s *SQLiteStore) AddNotifications(notifications []Notification) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		stmt, err := tx.Prepare(`
+			INSERT INTO notifications(` + columnList("", notificationColumns[1:]) + `)
+			values(` + placeholders(len(notificationColumns)-1) + `)`)
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+
+		for _, n := range notifications {
+			_, err = stmt.Exec(n.MessageID, n.PaymentID, n.CustomerKey, n.Bucket, n.Template, n.Email, n.Subject,
+				n.Message, n.Status, n.CreatedAt, n.SentAt, n.Error)
+			if err != nil {
+				return fmt.Errorf("insert into notifications failed for payments_id %s: %w", n.PaymentID, err)
+			}
+		}
+		return nil
+	})
+}
+
+// NotifiedPayments returns the payments_id of a bucket, which are listed in a notification that was not discarded
+func (s *SQLiteStore) NotifiedPayments(bucket string) (map[string]bool, error) {
+	rows, err := s.conn().Query(`
+		SELECT DISTINCT payments_id
+		FROM notifications
+		WHERE bucket = ? AND status <> ?`, bucket, NotificationDiscarded)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	notified := map[string]bool{}
+	for rows.Next() {
+		var paymentID string
+		if err = rows.Scan(text{&paymentID}); err != nil {
+			return nil, err
+		}
+		notified[paymentID] = true
+	}
+	return notified, rows.Err()
+}
+
+// Notifications lists the notifications in the order they were queued, only those with one of statuses if given
+func (s *SQLiteStore) Notifications(statuses ...string) ([]Notification, error) {
+	condition, args := "1 = 1", []interface{}{}
+	if len(statuses) > 0 {
+		condition = "status IN (" + placeholders(len(statuses)) + ")"
+		for _, status := range statuses {
+			args = append(args, status)
+		}
+	}
+	rows, err := s.conn().Query(`
+		SELECT `+columnList("", notificationColumns)+`
+		FROM notifications
+		WHERE `+condition+`
+		ORDER BY notification_id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var notifications []Notification
+	for rows.Next() {
+		var n Notification
+		if err = rows.Scan(n.targets()...); err != nil {
+			return nil, err
+		}
+		notifications = append(notifications, n)
+	}
+	return notifications, rows.Err()
+}
+
+// SetNotificationStatus changes status, send time and error of all rows of a message
+func (s *SQLiteStore) SetNotificationStatus(messageID string, status string, sentAt string, errorText string) error {
+	result, err := s.conn().Exec(`
+		UPDATE notifications SET
+			status  = ?,
+			sent_at = ?,
+			error   = ?
+		WHERE message_id = ?`, status, sentAt, errorText, messageID)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return fmt.Errorf("no notification with message id %s", messageID)
+	}
+	return nil
+}
+
+// targets returns the scan destinations in the order of notificationColumns
+func (n *Notification) targets() []interface{} {
+	return []interface{}{
+		number{&n.ID}, text{&n.MessageID}, text{&n.PaymentID}, text{&n.CustomerKey}, text{&n.Bucket},
+		text{&n.Template}, text{&n.Email}, text{&n.Subject}, text{&n.Message}, text{&n.Status}, text{&n.CreatedAt},
+		text{&n.SentAt}, text{&n.Error},
+	}
+}
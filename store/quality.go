@@ -0,0 +1,126 @@
+/********************************************************************************************************************
+ * name: quality
+ * description: data-quality checks of the joins from the payments to the Elevate and CRM accounts
+ ********************************************************************************************************************/
+package store
+
+// data-quality checks, in the order of QualityIssues
+const (
+	// CheckUnmatchedMandate is a failed payment whose mandate has no Elevate account and no confirmed match
+	CheckUnmatchedMandate = "unmatched-mandate"
+	// CheckNoCRMAccount is an Elevate account without CRM account
+	CheckNoCRMAccount = "no-crm-account"
+	// CheckMissingEmail and CheckMissingZenUser are CRM accounts without email or zen user id
+	CheckMissingEmail   = "missing-email"
+	CheckMissingZenUser = "missing-zen-user-id"
+	// CheckDuplicateMandate is a mandate of the payments of several customers or mandate references which only
+	// differ in case or spaces
+	CheckDuplicateMandate = "duplicate-mandate"
+)
+
+// QualityChecks lists the checks in the order of QualityIssues
+var QualityChecks = []string{
+	CheckUnmatchedMandate, CheckNoCRMAccount, CheckMissingEmail, CheckMissingZenUser, CheckDuplicateMandate,
+}
+
+// QualityIssue is a payment or account failing a data-quality check. Accounts flagged as disappeared from the
+// latest snapshot aren't checked.
+type QualityIssue struct {
+	Check            string
+	PaymentID        string
+	CustomerID       string
+	MandateReference string
+	AccountNumber    string
+	// Buckets are the buckets the payments of the issue were put into, comma separated, their exports lack the
+	// account columns
+	Buckets string
+	Detail  string
+}
+
+// qualityQueries select the payments_id, customers_id, mandate, account number, buckets and detail of a check
+var qualityQueries = map[string]string{
+	CheckUnmatchedMandate: `
+		SELECT failedPaymentRequests.payments_id, MIN(failedPaymentRequests.customers_id),
+			failedPaymentRequests.payments_links_mandate, '',
+			(SELECT group_concat(bucket, ',') FROM paymentsActions WHERE paymentsActions.payments_id = failedPaymentRequests.payments_id),
+			COUNT(*) || ' failed payment requests'
+		FROM failedPaymentRequests
+		WHERE ` + accountMandate + ` IS NULL
+		GROUP BY failedPaymentRequests.payments_id, failedPaymentRequests.payments_links_mandate
+		ORDER BY failedPaymentRequests.payments_id`,
+	CheckNoCRMAccount: `
+		SELECT '', '', elevateAccounts.elevate_mandate_reference, elevateAccounts.elevate_account_number,
+			` + mandateBuckets + `,
+			elevateAccounts.elevate_customer_name
+		FROM elevateAccounts
+		LEFT JOIN crmAccounts
+		ON elevateAccounts.elevate_account_number = crmAccounts.crm_account_number
+		WHERE crmAccounts.crm_account_number IS NULL
+		AND elevateAccounts.disappeared_at IS NULL
+		ORDER BY elevateAccounts.elevate_account_number, elevateAccounts.elevate_mandate_reference`,
+	CheckMissingEmail: `
+		SELECT '', '', '', crm_account_number, ` + accountBuckets + `, crm_name
+		FROM crmAccounts
+		WHERE trim(ifnull(crm_email, '')) = ''
+		AND disappeared_at IS NULL
+		ORDER BY crm_account_number`,
+	CheckMissingZenUser: `
+		SELECT '', '', '', crm_account_number, ` + accountBuckets + `, crm_name
+		FROM crmAccounts
+		WHERE trim(ifnull(crm_zen_user_id, '')) = ''
+		AND disappeared_at IS NULL
+		ORDER BY crm_account_number`,
+	CheckDuplicateMandate: `
+		SELECT '', group_concat(DISTINCT customers_id), payments_links_mandate, '',
+			(SELECT group_concat(DISTINCT bucket) FROM paymentsActions
+			INNER JOIN failedPaymentRequests AS payments ON payments.payments_id = paymentsActions.payments_id
+			WHERE payments.payments_links_mandate = failedPaymentRequests.payments_links_mandate),
+			'payments of ' || COUNT(DISTINCT customers_id) || ' customers'
+		FROM failedPaymentRequests
+		GROUP BY payments_links_mandate
+		HAVING COUNT(DISTINCT customers_id) > 1
+		UNION ALL
+		SELECT '', '', group_concat(elevate_mandate_reference, ','), group_concat(elevate_account_number, ','), '',
+			'mandate references differing only in case or spaces'
+		FROM elevateAccounts
+		WHERE disappeared_at IS NULL
+		GROUP BY upper(trim(elevate_mandate_reference))
+		HAVING COUNT(*) > 1`,
+}
+
+// mandateBuckets are the buckets of the payments of the mandate of an Elevate account
+const mandateBuckets = `(SELECT group_concat(DISTINCT bucket) FROM paymentsActions
+			INNER JOIN failedPaymentRequests ON failedPaymentRequests.payments_id = paymentsActions.payments_id
+			WHERE ` + accountMandate + ` = elevateAccounts.elevate_mandate_reference)`
+
+// accountBuckets are the buckets of the payments of the mandates of a CRM account
+const accountBuckets = `(SELECT group_concat(DISTINCT bucket) FROM paymentsActions
+			INNER JOIN failedPaymentRequests ON failedPaymentRequests.payments_id = paymentsActions.payments_id
+			INNER JOIN elevateAccounts ON elevateAccounts.elevate_mandate_reference = ` + accountMandate + `
+			WHERE elevateAccounts.elevate_account_number = crmAccounts.crm_account_number)`
+
+// QualityIssues runs the data-quality checks and returns the issues ordered by check
+func (s *SQLiteStore) QualityIssues() ([]QualityIssue, error) {
+	var issues []QualityIssue
+	for _, check := range QualityChecks {
+		rows, err := s.conn().Query(qualityQueries[check])
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			issue := QualityIssue{Check: check}
+			err = rows.Scan(text{&issue.PaymentID}, text{&issue.CustomerID}, text{&issue.MandateReference},
+				text{&issue.AccountNumber}, text{&issue.Buckets}, text{&issue.Detail})
+			if err != nil {
+				rows.Close()
+				return nil, err
+			}
+			issues = append(issues, issue)
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return issues, nil
+}
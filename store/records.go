@@ -0,0 +1,231 @@
+/********************************************************************************************************************
+ * name: records
+ * description: typed records of the failed-payments database tables
+ ********************************************************************************************************************/
+package store
+
+// FailedPaymentEvent is one row of failedPaymentRequests, an event of the payment provider export
+type FailedPaymentEvent struct {
+	ID                 string
+	CreatedAt          string
+	ResourceType       string
+	Action             string
+	DetailsOrigin      string
+	DetailsCause       string
+	DetailsDescription string
+	DetailsScheme      string
+	DetailsReasonCode  string
+	LinksParentEvent   string
+	LinksPayment       string
+	PaymentID          string
+	PaymentCreatedAt   string
+	PaymentChargeDate  string
+	AmountMinor        int64
+	PaymentDescription string
+	Currency           string
+	PaymentStatus      string
+	CustomerID         string
+	CustomerGivenName  string
+	CustomerFamilyName string
+	CustomerLeadID     string
+	MandateID          string
+	PaymentIdentity    string
+	CustomerEmail      string
+	// ImportID refers to the imports row of the file the event was read from, 0 if unknown
+	ImportID int64
+}
+
+// ElevateAccount is one row of elevateAccounts, linking a mandate to an Elevate account
+type ElevateAccount struct {
+	MandateReference string
+	AccountNumber    string
+	CustomerName     string
+	ImportID         int64
+}
+
+// CRMAccount is one row of crmAccounts
+type CRMAccount struct {
+	AccountNumber  string
+	ID             string
+	Name           string
+	Email          string
+	PremiseAddress string
+	StageName      string
+	ZenUserID      string
+	ImportID       int64
+}
+
+// Import is one row of imports, the ledger of the imported csv files
+type Import struct {
+	ID       int64
+	Source   string
+	FileName string
+	SHA256   string
+	Status   string
+	Inserted int
+	// Updated are the accounts of a snapshot with changed values
+	Updated     int
+	Skipped     int
+	Rejected    int
+	StartedAt   string
+	FinishedAt  string
+	ToolVersion string
+}
+
+// Notification is one row of notifications, a message queued or sent to a customer for one of the payments it lists
+type Notification struct {
+	ID          int64
+	MessageID   string
+	PaymentID   string
+	CustomerKey string
+	Bucket      string
+	Template    string
+	Email       string
+	Subject     string
+	// Message is the complete MIME message
+	Message   string
+	Status    string
+	CreatedAt string
+	SentAt    string
+	Error     string
+}
+
+// DunningAction is one row of dunning_actions, the append-only history of what happened to a payment or customer
+type DunningAction struct {
+	ID int64
+	// Level is HistoryPayment or HistoryCustomer
+	Level string
+	// PaymentID and CustomerID list the payments and customers_id of a customer comma separated
+	PaymentID   string
+	CustomerKey string
+	CustomerID  string
+	// Action is the bucket, HistoryWarning, HistorySuspension or the state a payment changed to
+	Action string
+	Rule   string
+	Reason string
+	Count  int
+	// Date is the date of the run, the timestamp of the current-state tables
+	Date      string
+	Timestamp string
+	Operator  string
+	// Details is the json of the record derived into the current-state tables
+	Details string
+}
+
+// Warning is one row of paymentsWarnings
+type Warning struct {
+	PaymentID          string
+	Timestamp          string
+	Count              int
+	CustomerID         string
+	CustomerGivenName  string
+	CustomerFamilyName string
+	CustomerLeadID     string
+}
+
+// Suspension is one row of paymentsSuspended
+type Suspension struct {
+	PaymentID          string
+	Timestamp          string
+	Count              int
+	CustomerID         string
+	CustomerGivenName  string
+	CustomerFamilyName string
+	CustomerLeadID     string
+}
+
+// PaymentAction is one row of paymentsActions, the action bucket a rule assigned to a payment
+type PaymentAction struct {
+	PaymentID          string
+	Bucket             string
+	Rule               string
+	Timestamp          string
+	Count              int
+	CustomerID         string
+	CustomerGivenName  string
+	CustomerFamilyName string
+	CustomerLeadID     string
+}
+
+// PaymentState is one row of paymentsStates, where a payment is in its lifecycle
+type PaymentState struct {
+	PaymentID     string
+	State         string
+	PreviousState string
+	// Timestamp is the date State was entered
+	Timestamp       string
+	LastEventID     string
+	LastEventAction string
+	LastEventAt     string
+	// FailureCount is the number of failed requests up to the latest event since the payment was last paid or
+	// cancelled before, not stored in paymentsStates
+	FailureCount int
+}
+
+// PaymentSummary is a payment with the number of its failed events within the counting window,
+// and the failures of all payments of the same customer within the same window
+type PaymentSummary struct {
+	Event                FailedPaymentEvent
+	FailureCount         int
+	LastFailureAt        string
+	AccountNumber        string
+	CRMStageName         string
+	CustomerFailureCount int
+	CustomerPaymentCount int
+}
+
+// CustomerSummary aggregates the failing payments of one customer. A customer is identified by the Elevate
+// account number the mandates of its payments belong to, or by customers_id if no mandate matches an account.
+type CustomerSummary struct {
+	Key           string
+	AccountNumber string
+	CustomerIDs   []string
+	PaymentIDs    []string
+	Mandates      []string
+	FailureCount  int
+	PaymentCount  int
+	// OutstandingMinor sums the amounts of the failing payments in Currency, the currency of Worst
+	OutstandingMinor int64
+	Currency         string
+	WorstStatus      string
+	LastFailureAt    string
+	CRMStageName     string
+	// Worst is the payment with the most failures, it provides names and failure details
+	Worst PaymentSummary
+}
+
+// CustomerAction is one row of customersActions, the action bucket a rule assigned to a customer
+type CustomerAction struct {
+	CustomerKey        string
+	Bucket             string
+	Rule               string
+	Timestamp          string
+	Count              int
+	PaymentCount       int
+	OutstandingMinor   int64
+	Currency           string
+	WorstStatus        string
+	LastFailureAt      string
+	CustomerIDs        []string
+	PaymentIDs         []string
+	Mandates           []string
+	AccountNumber      string
+	CustomerGivenName  string
+	CustomerFamilyName string
+	CustomerLeadID     string
+}
+
+// CustomerExportRow is a customer in an action bucket enriched with its Elevate and CRM account
+type CustomerExportRow struct {
+	Action  CustomerAction
+	Account ElevateAccount
+	CRM     CRMAccount
+}
+
+// ExportRow is a warned or suspended payment enriched with its Elevate and CRM account
+type ExportRow struct {
+	Event   FailedPaymentEvent
+	Count   int
+	Account ElevateAccount
+	CRM     CRMAccount
+}
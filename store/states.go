@@ -0,0 +1,258 @@
+/********************************************************************************************************************
+ * name: states
+ * description: lifecycle of the payments with failed requests: active, warned, suspended, recovered or written-off
+ ********************************************************************************************************************/
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// states of a payment in paymentsStates
+const (
+	StateActive     = "active"
+	StateWarned     = "warned"
+	StateSuspended  = "suspended"
+	StateRecovered  = "recovered"
+	StateWrittenOff = "written-off"
+)
+
+// PaidActions are the event actions after which a failed payment counts as paid
+var PaidActions = []string{"confirmed", "paid_out"}
+
+// WrittenOffActions are the event actions after which a failed payment won't be collected anymore
+var WrittenOffActions = []string{"cancelled"}
+
+// StateBuckets names the action buckets a payment counts as warned or suspended in
+type StateBuckets struct {
+	Warn    []string
+	Suspend []string
+}
+
+// UpdatePaymentStates derives the state of every payment with failed requests from its latest event up to the end
+// of date and the warnings, suspensions and actions recorded up to date since it was last recovered or written off,
+// and stores the states that changed with date as timestamp.
+// It returns the changed states.
+func (s *SQLiteStore) UpdatePaymentStates(buckets StateBuckets, date string) ([]PaymentState, error) {
+	var changed []PaymentState
+	err := s.inTx(func(tx *sql.Tx) error {
+		states, err := paymentStates(tx, "")
+		if err != nil {
+			return err
+		}
+		current := make(map[string]PaymentState, len(states))
+		for _, st := range states {
+			current[st.PaymentID] = st
+		}
+		warned, suspended, err := dunningSince(tx, buckets, date)
+		if err != nil {
+			return err
+		}
+
+		// the latest event up to the end of date of every payment with at least one failed request until then
+		until, err := endOfDay(date)
+		if err != nil {
+			return err
+		}
+		rows, err := tx.Query(`
+			SELECT payments_id, id, action, created_at
+			FROM failedPaymentRequests
+			WHERE created_at <= ?
+			AND payments_id IN (SELECT payments_id FROM failedPaymentRequests WHERE action = "failed" AND created_at <= ?)
+			ORDER BY payments_id, created_at, id`, until, until)
+		if err != nil {
+			return err
+		}
+		latest := map[string]PaymentState{}
+		var paymentIDs []string
+		for rows.Next() {
+			var st PaymentState
+			if err = rows.Scan(text{&st.PaymentID}, text{&st.LastEventID}, text{&st.LastEventAction}, text{&st.LastEventAt}); err != nil {
+				rows.Close()
+				return err
+			}
+			before, ok := latest[st.PaymentID]
+			if !ok {
+				paymentIDs = append(paymentIDs, st.PaymentID)
+			}
+			// the failures are counted until the payment is paid or cancelled, the next failure starts over
+			switch {
+			case st.LastEventAction == "failed" && (contains(PaidActions, before.LastEventAction) || contains(WrittenOffActions, before.LastEventAction)):
+				st.FailureCount = 1
+			case st.LastEventAction == "failed":
+				st.FailureCount = before.FailureCount + 1
+			default:
+				st.FailureCount = before.FailureCount
+			}
+			latest[st.PaymentID] = st
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return err
+		}
+
+		stmt, err := tx.Prepare(`
+			INSERT INTO paymentsStates(
+				payments_id       ,
+				state             ,
+				previous_state    ,
+				timestamp         ,
+				last_event_id     ,
+				last_event_action ,
+				last_event_at
+			) values(?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT(payments_id)
+			DO UPDATE SET
+				state             = excluded.state,
+				previous_state    = CASE WHEN excluded.state <> paymentsStates.state THEN paymentsStates.state ELSE paymentsStates.previous_state END,
+				timestamp         = CASE WHEN excluded.state <> paymentsStates.state THEN excluded.timestamp ELSE paymentsStates.timestamp END,
+				last_event_id     = excluded.last_event_id,
+				last_event_action = excluded.last_event_action,
+				last_event_at     = excluded.last_event_at`)
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+
+		for _, id := range paymentIDs {
+			st := latest[id]
+			switch {
+			case contains(PaidActions, st.LastEventAction):
+				st.State = StateRecovered
+			case contains(WrittenOffActions, st.LastEventAction):
+				st.State = StateWrittenOff
+			case suspended[id]:
+				st.State = StateSuspended
+			case warned[id]:
+				st.State = StateWarned
+			default:
+				st.State = StateActive
+			}
+			old, known := current[id]
+			if known && old.State == st.State && old.LastEventID == st.LastEventID {
+				continue
+			}
+			if _, err = stmt.Exec(st.PaymentID, st.State, "", date, st.LastEventID, st.LastEventAction, st.LastEventAt); err != nil {
+				return fmt.Errorf("insert into paymentsStates failed for payments_id %s: %w", id, err)
+			}
+			if !known || old.State != st.State {
+				st.PreviousState, st.Timestamp = old.State, date
+				changed = append(changed, st)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return changed, nil
+}
+
+// endOfDay returns the last moment of an ISO date in local time as ISO timestamp in UTC, like the -as-of day
+func endOfDay(date string) (string, error) {
+	day, err := time.ParseInLocation(ISODate, date, time.Local)
+	if err != nil {
+		return "", fmt.Errorf("invalid date %q, use YYYY-MM-DD", date)
+	}
+	return day.AddDate(0, 0, 1).Add(-time.Nanosecond).UTC().Format(ISOTimestamp), nil
+}
+
+// PaymentStates returns the states of all payments, ordered by payments_id, only those in state if not empty
+func (s *SQLiteStore) PaymentStates(state string) ([]PaymentState, error) {
+	return paymentStates(s.conn(), state)
+}
+
+// ReinstateExports returns the payments that were suspended and got paid on date according to the dunning history,
+// enriched with their accounts
+func (s *SQLiteStore) ReinstateExports(date string) ([]ExportRow, error) {
+	return s.historyExports(date, "dunning_actions.action = ? AND json_extract(dunning_actions.details, '$.PreviousState') = ?",
+		StateRecovered, StateSuspended)
+}
+
+// StateEntry is the history entry of a payment that changed to st.State on st.Timestamp, with the state it was in
+// before and the failures it had in its details
+func StateEntry(st PaymentState, operator string) (DunningAction, error) {
+	entry, err := historyEntry(HistoryPayment, st.PaymentID, "", "", st.State, "", st.FailureCount, st.Timestamp, operator, st)
+	if err != nil {
+		return entry, err
+	}
+	entry.Reason = st.LastEventAction + " " + st.LastEventID
+	return entry, nil
+}
+
+// paymentStates reads paymentsStates ordered by payments_id, only the rows in state if not empty
+func paymentStates(q queryer, state string) ([]PaymentState, error) {
+	condition, args := "1 = 1", []interface{}{}
+	if state != "" {
+		condition, args = "state = ?", append(args, state)
+	}
+	rows, err := q.Query(`
+		SELECT payments_id, state, previous_state, timestamp, last_event_id, last_event_action, last_event_at
+		FROM paymentsStates
+		WHERE `+condition+`
+		ORDER BY payments_id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var states []PaymentState
+	for rows.Next() {
+		var st PaymentState
+		err = rows.Scan(text{&st.PaymentID}, text{&st.State}, text{&st.PreviousState}, text{&st.Timestamp},
+			text{&st.LastEventID}, text{&st.LastEventAction}, text{&st.LastEventAt})
+		if err != nil {
+			return nil, err
+		}
+		states = append(states, st)
+	}
+	return states, rows.Err()
+}
+
+// dunningSince returns the payments warned and suspended according to the dunning history up to date, in the order
+// it was recorded. A payment recovered or written off starts over, its earlier warnings and suspensions don't count
+// anymore.
+func dunningSince(q queryer, buckets StateBuckets, date string) (warned map[string]bool, suspended map[string]bool, err error) {
+	rows, err := q.Query(`
+		SELECT payments_id, action
+		FROM dunning_actions
+		WHERE level IN (?, ?) AND date <= ?
+		ORDER BY action_id`, HistoryPayment, HistoryCustomer, date)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	warned, suspended = map[string]bool{}, map[string]bool{}
+	for rows.Next() {
+		var list, action string
+		if err = rows.Scan(text{&list}, text{&action}); err != nil {
+			return nil, nil, err
+		}
+		for _, id := range strings.Split(list, ",") {
+			switch {
+			case action == StateRecovered || action == StateWrittenOff:
+				delete(warned, id)
+				delete(suspended, id)
+			case action == HistoryWarning || contains(buckets.Warn, action):
+				warned[id] = true
+			case action == HistorySuspension || contains(buckets.Suspend, action):
+				suspended[id] = true
+			}
+		}
+	}
+	return warned, suspended, rows.Err()
+}
+
+// contains reports if value is one of values
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,191 @@
+package store
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+// testStore opens a new database with all migrations applied
+func testStore(t *testing.T) *SQLiteStore {
+	t.Helper()
+	s, err := Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	if _, err = s.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// insertEvent adds an event of payment PM1
+func insertEvent(t *testing.T, s *SQLiteStore, id string, createdAt string, action string) {
+	t.Helper()
+	err := s.InsertFailedPaymentEvent(FailedPaymentEvent{ID: id, CreatedAt: createdAt, Action: action, PaymentID: "PM1",
+		AmountMinor: 1250, Currency: "GBP", CustomerID: "CU1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// stateOf updates the states on date and returns the state of PM1, recording the recoveries like fp evaluate
+func stateOf(t *testing.T, s *SQLiteStore, buckets StateBuckets, date string) string {
+	t.Helper()
+	changed, err := s.UpdatePaymentStates(buckets, date)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, st := range changed {
+		if st.State == StateRecovered || st.State == StateWrittenOff {
+			entry, err := StateEntry(st, "test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = s.AppendHistory([]DunningAction{entry}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	states, err := s.PaymentStates("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, st := range states {
+		if st.PaymentID == "PM1" {
+			return st.State
+		}
+	}
+	t.Fatalf("PaymentStates() = %+v, want PM1", states)
+	return ""
+}
+
+// TestPaymentStatesAfterRecovery covers a reinstated payment failing again, its former suspension doesn't count
+func TestPaymentStatesAfterRecovery(t *testing.T) {
+	s := testStore(t)
+	buckets := StateBuckets{Warn: []string{"warn"}, Suspend: []string{"suspend-small"}}
+	record := func(bucket string, count int, date string) {
+		t.Helper()
+		_, err := s.RecordActions([]PaymentAction{{PaymentID: "PM1", Bucket: bucket, Rule: bucket, Timestamp: date,
+			Count: count, CustomerID: "CU1"}}, buckets, "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	insertEvent(t, s, "EV1", "2020-01-01T10:00:00.000Z", "failed")
+	if got := stateOf(t, s, buckets, "2020-01-01"); got != StateActive {
+		t.Errorf("state after the first failure = %s, want %s", got, StateActive)
+	}
+	insertEvent(t, s, "EV2", "2020-01-02T10:00:00.000Z", "failed")
+	record("suspend-small", 2, "2020-01-02")
+	if got := stateOf(t, s, buckets, "2020-01-02"); got != StateSuspended {
+		t.Errorf("state after the suspension = %s, want %s", got, StateSuspended)
+	}
+	insertEvent(t, s, "EV3", "2020-01-03T10:00:00.000Z", "confirmed")
+	if got := stateOf(t, s, buckets, "2020-01-03"); got != StateRecovered {
+		t.Errorf("state after the payment = %s, want %s", got, StateRecovered)
+	}
+	insertEvent(t, s, "EV4", "2020-01-04T10:00:00.000Z", "failed")
+	if got := stateOf(t, s, buckets, "2020-01-04"); got != StateActive {
+		t.Errorf("state after failing again without a matching rule = %s, want %s", got, StateActive)
+	}
+	record("warn", 3, "2020-01-04")
+	if got := stateOf(t, s, buckets, "2020-01-04"); got != StateWarned {
+		t.Errorf("state after a new warning = %s, want %s", got, StateWarned)
+	}
+	record("suspend-small", 3, "2020-01-05")
+	if got := stateOf(t, s, buckets, "2020-01-05"); got != StateSuspended {
+		t.Errorf("state after a new suspension = %s, want %s", got, StateSuspended)
+	}
+}
+
+// TestCountsAfterRecovery covers a suspended payment paid and failing once more: it starts over with one failure,
+// a paid payment of the customer doesn't count, and the reinstatement stays in the exports of its day
+func TestCountsAfterRecovery(t *testing.T) {
+	s := testStore(t)
+	buckets := StateBuckets{Warn: []string{"warn"}, Suspend: []string{"suspend-small"}}
+	for i := 1; i <= 5; i++ {
+		insertEvent(t, s, fmt.Sprintf("EV%d", i), fmt.Sprintf("2020-01-0%dT10:00:00.000Z", i), "failed")
+	}
+	for _, e := range []struct{ id, createdAt, action string }{
+		{"EV21", "2020-01-01T11:00:00.000Z", "failed"}, {"EV22", "2020-01-02T11:00:00.000Z", "paid_out"},
+	} {
+		err := s.InsertFailedPaymentEvent(FailedPaymentEvent{ID: e.id, CreatedAt: e.createdAt, Action: e.action,
+			PaymentID: "PM2", AmountMinor: 500, Currency: "GBP", CustomerID: "CU1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	suspend := []PaymentAction{{PaymentID: "PM1", Bucket: "suspend-small", Rule: "count-suspend", Timestamp: "2020-01-05",
+		Count: 5, CustomerID: "CU1"}}
+	if _, err := s.RecordActions(suspend, buckets, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.UpdatePaymentStates(buckets, "2020-01-05"); err != nil {
+		t.Fatal(err)
+	}
+	insertEvent(t, s, "EV6", "2020-01-06T10:00:00.000Z", "confirmed")
+	if got := stateOf(t, s, buckets, "2020-01-06"); got != StateRecovered {
+		t.Fatalf("state after the payment = %s, want %s", got, StateRecovered)
+	}
+	insertEvent(t, s, "EV7", "2020-01-07T10:00:00.000Z", "failed")
+	if got := stateOf(t, s, buckets, "2020-01-07"); got != StateActive {
+		t.Fatalf("state after failing again = %s, want %s", got, StateActive)
+	}
+
+	summaries, err := s.PaymentSummaries(SummaryQuery{MinFailures: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(summaries) != 1 || summaries[0].FailureCount != 1 || summaries[0].CustomerFailureCount != 1 ||
+		summaries[0].CustomerPaymentCount != 1 {
+		t.Fatalf("payments after the recovery = %+v, want PM1 with 1 failure of the payment and the customer", summaries)
+	}
+	again := []PaymentAction{{PaymentID: "PM1", Bucket: "suspend-small", Rule: "count-suspend", Timestamp: "2020-01-07",
+		Count: 1, CustomerID: "CU1"}}
+	if recorded, err := s.RecordActions(again, buckets, "test"); err != nil || len(recorded) != 1 {
+		t.Errorf("RecordActions() after the recovery = %+v, %v, want the new suspension with count 1", recorded, err)
+	}
+	if got := stateOf(t, s, buckets, "2020-01-07"); got != StateSuspended {
+		t.Errorf("state after the new suspension = %s, want %s", got, StateSuspended)
+	}
+
+	reinstated, err := s.ReinstateExports("2020-01-06")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reinstated) != 1 || reinstated[0].Event.ID != "EV5" || reinstated[0].Count != 5 {
+		t.Errorf("reinstated on 2020-01-06 = %+v, want PM1 with its 5 failures up to EV5", reinstated)
+	}
+}
+
+// TestAsOfCutOff covers an evaluation -as-of a past day, events imported for later days don't count
+func TestAsOfCutOff(t *testing.T) {
+	s := testStore(t)
+	insertEvent(t, s, "EV1", "2020-01-01T10:00:00.000Z", "failed")
+	insertEvent(t, s, "EV2", "2020-01-02T10:00:00.000Z", "failed")
+	insertEvent(t, s, "EV3", "2020-01-05T10:00:00.000Z", "failed")
+	insertEvent(t, s, "EV4", "2020-01-06T10:00:00.000Z", "confirmed")
+
+	until, err := endOfDay("2020-01-02")
+	if err != nil {
+		t.Fatal(err)
+	}
+	summaries, err := s.PaymentSummaries(SummaryQuery{MinFailures: 1, Since: "2020-01-01", Until: until})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(summaries) != 1 || summaries[0].FailureCount != 2 || summaries[0].CustomerFailureCount != 2 {
+		t.Fatalf("payments as of 2020-01-02 = %+v, want PM1 with 2 failures of the payment and the customer", summaries)
+	}
+
+	buckets := StateBuckets{Warn: []string{"warn"}, Suspend: []string{"suspend-small"}}
+	if got := stateOf(t, s, buckets, "2020-01-02"); got != StateActive {
+		t.Errorf("state as of 2020-01-02 = %s, want %s, the payment is confirmed later", got, StateActive)
+	}
+	if got := stateOf(t, s, buckets, "2020-01-06"); got != StateRecovered {
+		t.Errorf("state as of 2020-01-06 = %s, want %s", got, StateRecovered)
+	}
+}
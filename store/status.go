@@ -0,0 +1,89 @@
+/********************************************************************************************************************
+ * name: status
+ * description: the current state of the payments of a customer, looked up by customers_id, Elevate account number
+ *              or zen user id
+ ********************************************************************************************************************/
+package store
+
+import "fmt"
+
+// keys PaymentStatuses looks the payments of a customer up by
+const (
+	KeyCustomerID    = "customers_id"
+	KeyAccountNumber = "account_number"
+	KeyZenUserID     = "zen_user_id"
+)
+
+// statusKeys are the columns of the keys
+var statusKeys = map[string]string{
+	KeyCustomerID:    "failedPaymentRequests.customers_id",
+	KeyAccountNumber: "elevateAccounts.elevate_account_number",
+	KeyZenUserID:     "crmAccounts.crm_zen_user_id",
+}
+
+// PaymentStatus is the lifecycle state of a payment with failed requests and the bucket it was put into last
+type PaymentStatus struct {
+	PaymentID     string
+	CustomerID    string
+	Mandate       string
+	AccountNumber string
+	ZenUserID     string
+	FailureCount  int
+	// State is empty for payments imported but not evaluated yet, StateSince the date it was entered
+	State         string
+	PreviousState string
+	StateSince    string
+	// Bucket and BucketDate are the latest row of paymentsActions of the payment, empty if it has none
+	Bucket     string
+	BucketDate string
+}
+
+// PaymentStatuses returns the payments of the customers_id, Elevate account number or zen user id value, key is
+// one of KeyCustomerID, KeyAccountNumber or KeyZenUserID
+func (s *SQLiteStore) PaymentStatuses(key string, value string) ([]PaymentStatus, error) {
+	column, ok := statusKeys[key]
+	if !ok {
+		return nil, fmt.Errorf("cannot look up payments by %q, use %s, %s or %s", key, KeyCustomerID, KeyAccountNumber,
+			KeyZenUserID)
+	}
+	rows, err := s.conn().Query(`
+		SELECT failedPaymentRequests.payments_id,
+			MAX(failedPaymentRequests.customers_id),
+			MAX(failedPaymentRequests.payments_links_mandate),
+			MAX(elevateAccounts.elevate_account_number),
+			MAX(crmAccounts.crm_zen_user_id),
+			SUM(CASE WHEN failedPaymentRequests.action = 'failed' THEN 1 ELSE 0 END),
+			paymentsStates.state,
+			paymentsStates.previous_state,
+			paymentsStates.timestamp,
+			(SELECT bucket FROM paymentsActions WHERE paymentsActions.payments_id = failedPaymentRequests.payments_id
+				ORDER BY timestamp DESC, bucket LIMIT 1),
+			(SELECT MAX(timestamp) FROM paymentsActions WHERE paymentsActions.payments_id = failedPaymentRequests.payments_id)
+		FROM failedPaymentRequests
+		LEFT JOIN elevateAccounts
+		ON elevateAccounts.elevate_mandate_reference = `+accountMandate+`
+		LEFT JOIN crmAccounts
+		ON elevateAccounts.elevate_account_number = crmAccounts.crm_account_number
+		LEFT JOIN paymentsStates
+		ON paymentsStates.payments_id = failedPaymentRequests.payments_id
+		WHERE `+column+` = ?
+		GROUP BY failedPaymentRequests.payments_id
+		ORDER BY failedPaymentRequests.payments_id`, value)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var statuses []PaymentStatus
+	for rows.Next() {
+		var p PaymentStatus
+		err = rows.Scan(text{&p.PaymentID}, text{&p.CustomerID}, text{&p.Mandate}, text{&p.AccountNumber},
+			text{&p.ZenUserID}, integer{&p.FailureCount}, text{&p.State}, text{&p.PreviousState}, text{&p.StateSince},
+			text{&p.Bucket}, text{&p.BucketDate})
+		if err != nil {
+			return nil, err
+		}
+		statuses = append(statuses, p)
+	}
+	return statuses, rows.Err()
+}
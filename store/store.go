@@ -0,0 +1,659 @@
+/********************************************************************************************************************
+ * name: store
+ * description: Store interface over the failed-payments tables and its sqlite3 implementation
+ ********************************************************************************************************************/
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// ErrExists is returned when a record with the same primary key is already stored
+var ErrExists = errors.New("record already exists")
+
+// date columns of failedPaymentRequests failures can be counted by
+const (
+	CountByCreatedAt  = "created_at"
+	CountByChargeDate = "payments_charge_date"
+)
+
+// SummaryQuery selects the payments for the rules
+type SummaryQuery struct {
+	// MinFailures leaves out payments with fewer failed events within the window
+	MinFailures int
+	// Since only counts failed events on or after this ISO date or timestamp, empty counts all
+	Since string
+	// Until only counts failed events on or before this ISO date or timestamp, e.g. the end of the -as-of day,
+	// empty counts all
+	Until string
+	// CountBy is the date column compared with Since and Until, CountByCreatedAt by default
+	CountBy string
+}
+
+// Store reads and writes the failed-payments tables
+type Store interface {
+	// Migrate brings the schema up to date, see MigrationStatus for what is pending
+	Migrate() ([]Migration, error)
+	MigrationStatus() ([]MigrationState, error)
+	SchemaVersion() (int, error)
+
+	// InsertFailedPaymentEvent returns ErrExists for events already imported
+	InsertFailedPaymentEvent(event FailedPaymentEvent) error
+
+	// Upsert...Account store an account of a snapshot, changed values start a new version of the account,
+	// ErrExists is returned for an account the snapshot already had. MarkDisappeared flags the accounts
+	// missing in a snapshot and returns their keys.
+	UpsertElevateAccount(account ElevateAccount, snapshot Snapshot) (AccountChange, error)
+	UpsertCRMAccount(account CRMAccount, snapshot Snapshot) (AccountChange, error)
+	MarkDisappeared(snapshot Snapshot) ([]string, error)
+	// AccountHistory returns the versions of the Elevate and CRM accounts of a key
+	AccountHistory(key string) ([]AccountVersion, error)
+	// QualityIssues returns the payments and accounts failing the data-quality checks
+	QualityIssues() ([]QualityIssue, error)
+
+	// UnmatchedMandates returns the mandates of failed payments without Elevate account and confirmed match,
+	// MatchAccounts the accounts to match them with
+	UnmatchedMandates() ([]UnmatchedMandate, error)
+	MatchAccounts() ([]MatchAccount, error)
+	// AddMatchCandidates queues the matches not known yet and returns them, MandateMatches lists the queue,
+	// only the matches in a status if given
+	AddMatchCandidates(matches []MandateMatch) ([]MandateMatch, error)
+	MandateMatches(status string) ([]MandateMatch, error)
+	// ReviewMatch confirms or rejects a match, the confirmed account is used for the payments of the mandate
+	ReviewMatch(id int64, status string, operator string, reviewedAt string) (MandateMatch, error)
+
+	// StartImport adds a file to the imports ledger and returns its import id, FinishImport stores its outcome
+	StartImport(imp Import) (int64, error)
+	FinishImport(imp Import) error
+	// Imports lists the ledger, optionally only the imports of files with the content sha256
+	Imports(sha256 string) ([]Import, error)
+	// EventImport returns the import that introduced a payment event, sql.ErrNoRows if unknown
+	EventImport(eventID string) (Import, error)
+
+	// PaymentSummaries returns every payment with at least query.MinFailures failed events within the window since it
+	// was last paid or cancelled, payments recovered or written off are left out of the payment and customer counts
+	PaymentSummaries(query SummaryQuery) ([]PaymentSummary, error)
+
+	// CustomerSummaries returns every customer with at least query.MinFailures failed events within the window
+	CustomerSummaries(query SummaryQuery) ([]CustomerSummary, error)
+
+	// RecordActions appends the buckets assigned by the rules to the dunning history, if the payment is new in the
+	// bucket or its count increased, and derives paymentsActions, paymentsWarnings and paymentsSuspended from them.
+	// It returns the recorded actions.
+	RecordActions(actions []PaymentAction, buckets StateBuckets, operator string) ([]PaymentAction, error)
+	// RecordCustomerActions is RecordActions on customer level, deriving customersActions
+	RecordCustomerActions(actions []CustomerAction, operator string) ([]CustomerAction, error)
+	// AppendHistory adds changes of the payment state to the dunning history, a payment recovered or written off
+	// is removed from the current-state tables
+	AppendHistory(entries []DunningAction) error
+	// History returns the dunning history of a payment or customer in the order it was recorded
+	History(key string) ([]DunningAction, error)
+	// RebuildCurrentState recreates paymentsActions, paymentsWarnings, paymentsSuspended and customersActions
+	// from the dunning history
+	RebuildCurrentState(buckets StateBuckets) error
+	// Actions and CustomerActions return all rows of paymentsActions and customersActions
+	Actions() ([]PaymentAction, error)
+	CustomerActions() ([]CustomerAction, error)
+	// ActionExports returns the payments put into a bucket on a date according to the dunning history, with the count
+	// recorded then, enriched with the accounts
+	ActionExports(bucket string, date string) ([]ExportRow, error)
+
+	// CustomerActionExports returns the customers put into a bucket on a date as recorded in the dunning history,
+	// enriched with the accounts
+	CustomerActionExports(bucket string, date string) ([]CustomerExportRow, error)
+
+	// AddNotifications records queued notifications, NotifiedPayments returns the payments_id of a bucket
+	// with a notification that was not discarded
+	AddNotifications(notifications []Notification) error
+	NotifiedPayments(bucket string) (map[string]bool, error)
+	// Notifications lists the notifications, only those with one of statuses if given
+	Notifications(statuses ...string) ([]Notification, error)
+	// SetNotificationStatus changes the status of all rows of a message
+	SetNotificationStatus(messageID string, status string, sentAt string, errorText string) error
+
+	// UpdatePaymentStates derives the lifecycle state of the payments and returns the changed ones,
+	// PaymentStates lists them, only those in a state if given
+	UpdatePaymentStates(buckets StateBuckets, date string) ([]PaymentState, error)
+	PaymentStates(state string) ([]PaymentState, error)
+	// ReinstateExports returns the suspended payments which got paid on a date, enriched with the accounts
+	ReinstateExports(date string) ([]ExportRow, error)
+
+	// SearchCustomers finds customers by id, lead id, name, mandate or account number, CustomerPayments lists
+	// their payments, PaymentEvents the events of a payment and Trend the failures and actions per day since a date
+	SearchCustomers(term string, limit int) ([]CustomerHit, error)
+	CustomerPayments(customerID string) ([]PaymentSummary, error)
+	PaymentEvents(paymentID string) ([]FailedPaymentEvent, error)
+	Trend(since string) ([]TrendDay, error)
+
+	// PaymentStatuses returns the states of the payments of a customers_id, account number or zen user id
+	PaymentStatuses(key string, value string) ([]PaymentStatus, error)
+
+	// Transaction calls fn with a Store whose changes are committed together if fn returns nil
+	Transaction(fn func(Store) error) error
+
+	Close() error
+}
+
+// SQLiteStore is the Store of a sqlite3 database file
+type SQLiteStore struct {
+	db *sql.DB
+	// tx is the running transaction of a Store passed to the function of Transaction
+	tx *sql.Tx
+}
+
+// queryer is implemented by *sql.DB and *sql.Tx
+type queryer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// connectParams make a statement wait up to 10 seconds for the lock of another process, e.g. of an import running
+// while fp serve imports a file, and transactions take the write lock when they begin, a deferred transaction
+// upgrading its read lock would fail with "database is locked" at once
+const connectParams = "_busy_timeout=10000&_txlock=immediate"
+
+// Open creates or opens the sqlite3 database, call Migrate before using it
+func Open(fileName string) (*SQLiteStore, error) {
+	separator := "?"
+	if strings.Contains(fileName, "?") {
+		separator = "&"
+	}
+	db, err := sql.Open("sqlite3", fileName+separator+connectParams)
+	if err != nil {
+		return nil, err
+	}
+	if err = db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("cannot connect to database: %w", err)
+	}
+	return &SQLiteStore{db: db}, nil
+}
+
+// DB gives access to the underlying database for queries not covered by the Store
+func (s *SQLiteStore) DB() *sql.DB {
+	return s.db
+}
+
+// Close closes the database
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
+
+// Transaction calls fn with a Store bound to one transaction, its changes are committed if fn returns nil
+// and rolled back otherwise
+func (s *SQLiteStore) Transaction(fn func(Store) error) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		return fn(&SQLiteStore{db: s.db, tx: tx})
+	})
+}
+
+// inTx runs fn in the running transaction, or in a new one that is committed if fn returns nil
+func (s *SQLiteStore) inTx(fn func(tx *sql.Tx) error) error {
+	if s.tx != nil {
+		return fn(s.tx)
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err = fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// conn returns the running transaction or the database
+func (s *SQLiteStore) conn() queryer {
+	if s.tx != nil {
+		return s.tx
+	}
+	return s.db
+}
+
+// CopyTo writes a consistent copy of the database to fileName, which must not exist yet
+func (s *SQLiteStore) CopyTo(fileName string) error {
+	_, err := s.db.Exec("VACUUM INTO ?", fileName)
+	return err
+}
+
+// isUniqueViolation tells if an insert failed because of an existing primary key
+func isUniqueViolation(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "UNIQUE constraint failed")
+}
+
+// text scans a nullable column into a string, NULL becomes ""
+type text struct{ dest *string }
+
+func (t text) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		*t.dest = ""
+	case []byte:
+		*t.dest = string(v)
+	case string:
+		*t.dest = v
+	default:
+		*t.dest = fmt.Sprint(v)
+	}
+	return nil
+}
+
+// number scans a nullable integer column, NULL becomes 0
+type number struct{ dest *int64 }
+
+func (n number) Scan(value interface{}) error {
+	var v sql.NullInt64
+	if err := v.Scan(value); err != nil {
+		return err
+	}
+	*n.dest = v.Int64
+	return nil
+}
+
+// integer scans a nullable integer column into an int, NULL becomes 0
+type integer struct{ dest *int }
+
+func (i integer) Scan(value interface{}) error {
+	var v int64
+	if err := (number{&v}).Scan(value); err != nil {
+		return err
+	}
+	*i.dest = int(v)
+	return nil
+}
+
+// eventColumns are the columns of failedPaymentRequests in the order of FailedPaymentEvent.targets
+var eventColumns = []string{
+	"id", "created_at", "resource_type", "action", "details_origin", "details_cause", "details_description",
+	"details_scheme", "details_reason_code", "links_parent_event", "links_payment", "payments_id",
+	"payments_created_at", "payments_charge_date", "payments_amount_minor", "payments_description",
+	"payments_currency", "payments_status", "customers_id", "customers_given_name", "customers_family_name",
+	"customers_metadata_leadID", "payments_links_mandate", "payments_metadata_identity", "customers_email",
+	"import_id",
+}
+
+// columnList joins columns for a select or insert, optionally prefixed with their table name
+func columnList(table string, columns []string) string {
+	if table == "" {
+		return strings.Join(columns, ", ")
+	}
+	return table + "." + strings.Join(columns, ", "+table+".")
+}
+
+// placeholders returns "?, ?, ..." for n values
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+// targets returns the scan destinations in the order of eventColumns
+func (e *FailedPaymentEvent) targets() []interface{} {
+	return []interface{}{
+		text{&e.ID}, text{&e.CreatedAt}, text{&e.ResourceType}, text{&e.Action}, text{&e.DetailsOrigin},
+		text{&e.DetailsCause}, text{&e.DetailsDescription}, text{&e.DetailsScheme}, text{&e.DetailsReasonCode},
+		text{&e.LinksParentEvent}, text{&e.LinksPayment}, text{&e.PaymentID}, text{&e.PaymentCreatedAt},
+		text{&e.PaymentChargeDate}, number{&e.AmountMinor}, text{&e.PaymentDescription}, text{&e.Currency},
+		text{&e.PaymentStatus}, text{&e.CustomerID}, text{&e.CustomerGivenName}, text{&e.CustomerFamilyName},
+		text{&e.CustomerLeadID}, text{&e.MandateID}, text{&e.PaymentIdentity}, text{&e.CustomerEmail},
+		number{&e.ImportID},
+	}
+}
+
+// values returns the insert values in the order of eventColumns
+func (e FailedPaymentEvent) values() []interface{} {
+	return []interface{}{
+		e.ID, e.CreatedAt, e.ResourceType, e.Action, e.DetailsOrigin, e.DetailsCause, e.DetailsDescription,
+		e.DetailsScheme, e.DetailsReasonCode, e.LinksParentEvent, e.LinksPayment, e.PaymentID,
+		e.PaymentCreatedAt, e.PaymentChargeDate, e.AmountMinor, e.PaymentDescription, e.Currency,
+		e.PaymentStatus, e.CustomerID, e.CustomerGivenName, e.CustomerFamilyName, e.CustomerLeadID,
+		e.MandateID, e.PaymentIdentity, e.CustomerEmail, importID(e.ImportID),
+	}
+}
+
+// importID stores an unknown import as NULL
+func importID(id int64) interface{} {
+	if id == 0 {
+		return nil
+	}
+	return id
+}
+
+// InsertFailedPaymentEvent stores a new payment event
+func (s *SQLiteStore) InsertFailedPaymentEvent(event FailedPaymentEvent) error {
+	_, err := s.conn().Exec(
+		"INSERT INTO failedPaymentRequests("+columnList("", eventColumns)+") values("+placeholders(len(eventColumns))+")",
+		event.values()...)
+	if isUniqueViolation(err) {
+		return ErrExists
+	}
+	return err
+}
+
+// PaymentSummaries returns every payment with at least query.MinFailures failed events within the window since it
+// was last paid or cancelled, payments recovered or written off are left out of the payment and customer counts
+func (s *SQLiteStore) PaymentSummaries(query SummaryQuery) ([]PaymentSummary, error) {
+	countBy := query.CountBy
+	switch countBy {
+	case "":
+		countBy = CountByCreatedAt
+	case CountByCreatedAt, CountByChargeDate:
+	default:
+		return nil, fmt.Errorf("cannot count failures by %q, use %s or %s", countBy, CountByCreatedAt, CountByChargeDate)
+	}
+	// failures before the latest paid or cancelled event of their payment up to Until don't count, the payment
+	// starts over after it recovered or was written off
+	settledUntil := query.Until
+	if countBy == CountByChargeDate && settledUntil != "" {
+		var err error
+		if settledUntil, err = endOfDay(query.Until); err != nil {
+			return nil, err
+		}
+	}
+	settledActions := append(append([]string{}, PaidActions...), WrittenOffActions...)
+
+	// the conditions of the two customer counts and the payment count, their args are appended in this order
+	var args []interface{}
+	window := func(table string) string {
+		condition := "1 = 1"
+		if query.Since != "" {
+			condition += " AND " + table + "." + countBy + " >= ?"
+			args = append(args, query.Since)
+		}
+		if query.Until != "" {
+			condition += " AND " + table + "." + countBy + " <= ?"
+			args = append(args, query.Until)
+		}
+		condition += " AND " + table + `.created_at > COALESCE((SELECT MAX(settled.created_at)
+			FROM failedPaymentRequests AS settled
+			WHERE settled.payments_id = ` + table + `.payments_id
+			AND settled.action IN (` + placeholders(len(settledActions)) + `)`
+		for _, action := range settledActions {
+			args = append(args, action)
+		}
+		if settledUntil != "" {
+			condition += " AND settled.created_at <= ?"
+			args = append(args, settledUntil)
+		}
+		condition += `), '')
+			AND ` + table + `.payments_id NOT IN (SELECT payments_id FROM paymentsStates WHERE state IN (?, ?))`
+		args = append(args, StateRecovered, StateWrittenOff)
+		return condition
+	}
+	customerFailures := window("customerFailures")
+	customerPayments := window("customerFailures")
+	paymentFailures := window("failedPaymentRequests")
+	args = append(args, query.MinFailures)
+
+	rows, err := s.conn().Query(`
+		SELECT `+columnList("failedPaymentRequests", eventColumns)+`,
+			COUNT(failedPaymentRequests.payments_id),
+			MAX(failedPaymentRequests.created_at),
+			elevateAccounts.elevate_account_number,
+			crmAccounts.crm_stage_name,
+			(SELECT COUNT(*) FROM failedPaymentRequests AS customerFailures
+				WHERE customerFailures.customers_id = failedPaymentRequests.customers_id
+				AND customerFailures.action = "failed" AND `+customerFailures+`),
+			(SELECT COUNT(DISTINCT customerFailures.payments_id) FROM failedPaymentRequests AS customerFailures
+				WHERE customerFailures.customers_id = failedPaymentRequests.customers_id
+				AND customerFailures.action = "failed" AND `+customerPayments+`)
+		FROM failedPaymentRequests
+		LEFT JOIN elevateAccounts
+		ON elevateAccounts.elevate_mandate_reference = `+accountMandate+`
+		LEFT JOIN crmAccounts
+		ON elevateAccounts.elevate_account_number = crmAccounts.crm_account_number
+		WHERE failedPaymentRequests.action = "failed" AND `+paymentFailures+`
+		GROUP BY failedPaymentRequests.payments_id
+		HAVING count(failedPaymentRequests.payments_id) >= ?
+		ORDER BY failedPaymentRequests.payments_id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var summaries []PaymentSummary
+	for rows.Next() {
+		var summary PaymentSummary
+		var count, customerCount, customerPayments int64
+		targets := append(summary.Event.targets(), number{&count}, text{&summary.LastFailureAt}, text{&summary.AccountNumber},
+			text{&summary.CRMStageName},
+			number{&customerCount}, number{&customerPayments})
+		if err = rows.Scan(targets...); err != nil {
+			return nil, err
+		}
+		summary.FailureCount = int(count)
+		summary.CustomerFailureCount = int(customerCount)
+		summary.CustomerPaymentCount = int(customerPayments)
+		summaries = append(summaries, summary)
+	}
+	return summaries, rows.Err()
+}
+
+// addWarnings derives paymentsWarnings, it stores new warnings and returns them, payments already warned are skipped
+func (s *SQLiteStore) addWarnings(warnings []Warning) ([]Warning, error) {
+	var added []Warning
+	err := s.inTx(func(tx *sql.Tx) error {
+		stmt, err := tx.Prepare(`
+			INSERT INTO paymentsWarnings(
+				payments_id               ,
+				timestamp                 ,
+				payment_requests_count    ,
+				customers_id              ,
+				customers_given_name      ,
+				customers_family_name     ,
+				customers_metadata_leadID
+			) values(?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT(payments_id) DO NOTHING`)
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+
+		for _, w := range warnings {
+			result, err := stmt.Exec(w.PaymentID, w.Timestamp, w.Count, w.CustomerID, w.CustomerGivenName,
+				w.CustomerFamilyName, w.CustomerLeadID)
+			if err != nil {
+				return fmt.Errorf("insert into paymentsWarnings failed for payments_id %s: %w", w.PaymentID, err)
+			}
+			if n, _ := result.RowsAffected(); n > 0 {
+				added = append(added, w)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return added, nil
+}
+
+// addSuspensions derives paymentsSuspended, it stores new suspensions, existing ones get the new count and timestamp
+// if the count increased
+func (s *SQLiteStore) addSuspensions(suspensions []Suspension) ([]Suspension, error) {
+	var changed []Suspension
+	err := s.inTx(func(tx *sql.Tx) error {
+		stmt, err := tx.Prepare(`
+			INSERT INTO paymentsSuspended(
+				payments_id               ,
+				timestamp                 ,
+				payment_requests_count    ,
+				customers_id              ,
+				customers_given_name      ,
+				customers_family_name     ,
+				customers_metadata_leadID
+			) values(?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT(payments_id)
+			DO UPDATE SET
+				timestamp                         = excluded.timestamp,
+				payment_requests_count            = excluded.payment_requests_count
+			WHERE excluded.payment_requests_count > paymentsSuspended.payment_requests_count`)
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+
+		for _, su := range suspensions {
+			result, err := stmt.Exec(su.PaymentID, su.Timestamp, su.Count, su.CustomerID, su.CustomerGivenName,
+				su.CustomerFamilyName, su.CustomerLeadID)
+			if err != nil {
+				return fmt.Errorf("insert into paymentsSuspended failed for payments_id %s: %w", su.PaymentID, err)
+			}
+			if n, _ := result.RowsAffected(); n > 0 {
+				changed = append(changed, su)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return changed, nil
+}
+
+// addActions derives paymentsActions, a payment already in a bucket is only updated if its count increased
+func (s *SQLiteStore) addActions(actions []PaymentAction) ([]PaymentAction, error) {
+	var changed []PaymentAction
+	err := s.inTx(func(tx *sql.Tx) error {
+		stmt, err := tx.Prepare(`
+			INSERT INTO paymentsActions(
+				payments_id               ,
+				bucket                    ,
+				rule                      ,
+				timestamp                 ,
+				payment_requests_count    ,
+				customers_id              ,
+				customers_given_name      ,
+				customers_family_name     ,
+				customers_metadata_leadID
+			) values(?, ?, ?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT(payments_id, bucket)
+			DO UPDATE SET
+				rule                              = excluded.rule,
+				timestamp                         = excluded.timestamp,
+				payment_requests_count            = excluded.payment_requests_count
+			WHERE excluded.payment_requests_count > paymentsActions.payment_requests_count`)
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+
+		for _, a := range actions {
+			result, err := stmt.Exec(a.PaymentID, a.Bucket, a.Rule, a.Timestamp, a.Count, a.CustomerID,
+				a.CustomerGivenName, a.CustomerFamilyName, a.CustomerLeadID)
+			if err != nil {
+				return fmt.Errorf("insert into paymentsActions failed for payments_id %s: %w", a.PaymentID, err)
+			}
+			if n, _ := result.RowsAffected(); n > 0 {
+				changed = append(changed, a)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return changed, nil
+}
+
+// Actions returns all rows of paymentsActions, ordered by payment and bucket
+func (s *SQLiteStore) Actions() ([]PaymentAction, error) {
+	rows, err := s.conn().Query(`
+		SELECT
+			payments_id               ,
+			bucket                    ,
+			rule                      ,
+			timestamp                 ,
+			payment_requests_count    ,
+			customers_id              ,
+			customers_given_name      ,
+			customers_family_name     ,
+			customers_metadata_leadID
+		FROM paymentsActions
+		ORDER BY payments_id, bucket`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var actions []PaymentAction
+	for rows.Next() {
+		var a PaymentAction
+		var count int64
+		err = rows.Scan(text{&a.PaymentID}, text{&a.Bucket}, text{&a.Rule}, text{&a.Timestamp}, number{&count},
+			text{&a.CustomerID}, text{&a.CustomerGivenName}, text{&a.CustomerFamilyName}, text{&a.CustomerLeadID})
+		if err != nil {
+			return nil, err
+		}
+		a.Count = int(count)
+		actions = append(actions, a)
+	}
+	return actions, rows.Err()
+}
+
+// ActionExports returns the payments put into a bucket on date according to the dunning history, with the count
+// recorded then and their latest failure up to date, enriched with their Elevate and CRM accounts
+func (s *SQLiteStore) ActionExports(bucket string, date string) ([]ExportRow, error) {
+	return s.historyExports(date, "dunning_actions.action = ?", bucket)
+}
+
+// historyExports joins the payment entries of the dunning history of date with the latest failed event of their
+// payment up to the end of date and its accounts, the count is the one recorded. condition and args narrow down the
+// entries, of several entries of a payment the one with the highest count is taken.
+func (s *SQLiteStore) historyExports(date string, condition string, args ...interface{}) ([]ExportRow, error) {
+	until, err := endOfDay(date)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := s.conn().Query(`
+		SELECT
+			`+columnList("failedPaymentRequests", eventColumns)+`,
+			MAX(dunning_actions.payment_requests_count),
+			elevateAccounts.elevate_mandate_reference,
+			elevateAccounts.elevate_account_number,
+			elevateAccounts.elevate_customer_name,
+			crmAccounts.crm_account_number,
+			crmAccounts.crm_id,
+			crmAccounts.crm_name,
+			crmAccounts.crm_email,
+			crmAccounts.crm_premise_address,
+			crmAccounts.crm_stage_name,
+			crmAccounts.crm_zen_user_id
+		FROM dunning_actions
+		INNER JOIN failedPaymentRequests
+		ON failedPaymentRequests.id = (SELECT latest.id FROM failedPaymentRequests AS latest
+			WHERE latest.payments_id = dunning_actions.payments_id AND latest.action = "failed"
+			AND latest.created_at <= ?
+			ORDER BY latest.created_at DESC, latest.id DESC LIMIT 1)
+		LEFT JOIN elevateAccounts
+		ON elevateAccounts.elevate_mandate_reference = `+accountMandate+`
+		LEFT JOIN crmAccounts
+		ON elevateAccounts.elevate_account_number = crmAccounts.crm_account_number
+		WHERE dunning_actions.level = ? AND dunning_actions.date = ? AND `+condition+`
+		GROUP BY dunning_actions.payments_id
+		ORDER BY dunning_actions.payments_id`, append([]interface{}{until, HistoryPayment, date}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []ExportRow
+	for rows.Next() {
+		var row ExportRow
+		var count int64
+		targets := append(row.Event.targets(), number{&count},
+			text{&row.Account.MandateReference}, text{&row.Account.AccountNumber}, text{&row.Account.CustomerName},
+			text{&row.CRM.AccountNumber}, text{&row.CRM.ID}, text{&row.CRM.Name}, text{&row.CRM.Email},
+			text{&row.CRM.PremiseAddress}, text{&row.CRM.StageName}, text{&row.CRM.ZenUserID})
+		if err = rows.Scan(targets...); err != nil {
+			return nil, err
+		}
+		row.Count = int(count)
+		result = append(result, row)
+	}
+	return result, rows.Err()
+}
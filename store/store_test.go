@@ -0,0 +1,56 @@
+package store
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestConcurrentTransactions covers two processes importing into the same database at once
+func TestConcurrentTransactions(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	var stores []*SQLiteStore
+	for i := 0; i < 2; i++ {
+		s, err := Open(fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		stores = append(stores, s)
+	}
+	if _, err := stores[0].Migrate(); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(stores))
+	for i, s := range stores {
+		wg.Add(1)
+		go func(i int, s *SQLiteStore) {
+			defer wg.Done()
+			errs[i] = s.Transaction(func(tx Store) error {
+				if _, err := tx.PaymentEvents("PM1"); err != nil {
+					return err
+				}
+				time.Sleep(100 * time.Millisecond)
+				return tx.InsertFailedPaymentEvent(FailedPaymentEvent{ID: fmt.Sprintf("EV%d", i), PaymentID: "PM1",
+					CreatedAt: "2020-01-01T10:00:00.000Z", Action: "failed", AmountMinor: 1250, Currency: "GBP"})
+			})
+		}(i, s)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("transaction %d failed: %v", i, err)
+		}
+	}
+	events, err := stores[0].PaymentEvents("PM1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 {
+		t.Errorf("PaymentEvents() = %d events, want 2", len(events))
+	}
+}